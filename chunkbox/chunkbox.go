@@ -0,0 +1,162 @@
+// Package chunkbox encrypts large blobs as a series of secretbox or
+// XChaCha20-Poly1305 chunks, so they can be sealed and opened a piece at a
+// time with progress along the way.
+//
+// A sealed blob starts with a random nonce prefix, followed by the chunks.
+// Nothing in it says which cipher sealed it; the one opening it has to know.
+// Each chunk is ChunkSize bytes of the blob, but for the last which may be
+// shorter, sealed with a nonce made of the prefix and the chunk's number.
+// The last chunk's number has its top bit set, so cutting chunks off the
+// end, reordering or dropping them makes Open fail.
+//
+// Files written with NewWriter are sealed the same way, but can be read back
+// with NewReader from any offset, opening only the chunks needed.
+package chunkbox
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// ChunkSize is the number of bytes of the blob sealed in each chunk.
+const ChunkSize = 64 << 10
+
+// prefixSize is the length of the random part of the nonces.
+const prefixSize = 16
+
+const lastChunk = 1 << 63
+
+// ErrOpen is returned by Open if the blob is not one sealed with the key,
+// or was cut short or tampered with.
+var ErrOpen = errors.New("could not open sealed blob")
+
+// A Cipher is what chunks are sealed with.
+type Cipher int
+
+const (
+	// Secretbox seals chunks with NaCl's secretbox. It is what the web
+	// client uses, and what Seal and Open use.
+	Secretbox Cipher = iota
+
+	// XChaCha20Poly1305 seals chunks with the XChaCha20-Poly1305 AEAD.
+	XChaCha20Poly1305
+)
+
+// overhead is the number of bytes sealing adds to each chunk. Both ciphers
+// add the same.
+const overhead = secretbox.Overhead
+
+func nonce(prefix []byte, i uint64, last bool) *[24]byte {
+	var n [24]byte
+	copy(n[:], prefix)
+	if last {
+		i |= lastChunk
+	}
+	binary.BigEndian.PutUint64(n[prefixSize:], i)
+	return &n
+}
+
+// SealedSize returns the length of a blob of size bytes once sealed with
+// secretbox.
+func SealedSize(size int) int {
+	return Secretbox.SealedSize(size)
+}
+
+// Seal encrypts and authenticates msg with key using secretbox.
+func Seal(key *[32]byte, msg []byte) ([]byte, error) {
+	return Secretbox.Seal(key, msg)
+}
+
+// Open authenticates and decrypts box, which was sealed with key by Seal.
+func Open(key *[32]byte, box []byte) ([]byte, error) {
+	return Secretbox.Open(key, box)
+}
+
+// SealedSize returns the length of a blob of size bytes once sealed with c.
+func (c Cipher) SealedSize(size int) int {
+	chunks := (size + ChunkSize - 1) / ChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return prefixSize + size + chunks*overhead
+}
+
+// Seal encrypts and authenticates msg with key using c.
+func (c Cipher) Seal(key *[32]byte, msg []byte) ([]byte, error) {
+	var aead cipher.AEAD
+	if c == XChaCha20Poly1305 {
+		var err error
+		aead, err = chacha20poly1305.NewX(key[:])
+		if err != nil {
+			return nil, err
+		}
+	}
+	out := make([]byte, prefixSize, c.SealedSize(len(msg)))
+	if _, err := io.ReadFull(rand.Reader, out); err != nil {
+		return nil, err
+	}
+	prefix := out[:prefixSize]
+	for i, done := uint64(0), 0; ; i++ {
+		n := len(msg) - done
+		if n > ChunkSize {
+			n = ChunkSize
+		}
+		last := done+n == len(msg)
+		chunkNonce := nonce(prefix, i, last)
+		if aead != nil {
+			out = aead.Seal(out, chunkNonce[:], msg[done:done+n], nil)
+		} else {
+			out = secretbox.Seal(out, msg[done:done+n], chunkNonce, key)
+		}
+		done += n
+		if last {
+			return out, nil
+		}
+	}
+}
+
+// Open authenticates and decrypts box, which was sealed with key by c.Seal.
+func (c Cipher) Open(key *[32]byte, box []byte) ([]byte, error) {
+	if len(box) < prefixSize+overhead {
+		return nil, ErrOpen
+	}
+	var aead cipher.AEAD
+	if c == XChaCha20Poly1305 {
+		var err error
+		aead, err = chacha20poly1305.NewX(key[:])
+		if err != nil {
+			return nil, err
+		}
+	}
+	prefix, rest := box[:prefixSize], box[prefixSize:]
+	out := make([]byte, 0, len(rest))
+	for i := uint64(0); ; i++ {
+		n := len(rest)
+		if n > ChunkSize+overhead {
+			n = ChunkSize + overhead
+		}
+		last := n == len(rest)
+		chunkNonce := nonce(prefix, i, last)
+		var ok bool
+		if aead != nil {
+			var err error
+			out, err = aead.Open(out, chunkNonce[:], rest[:n], nil)
+			ok = err == nil
+		} else {
+			out, ok = secretbox.Open(out, rest[:n], chunkNonce, key)
+		}
+		if !ok {
+			return nil, ErrOpen
+		}
+		rest = rest[n:]
+		if last {
+			return out, nil
+		}
+	}
+}
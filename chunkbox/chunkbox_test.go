@@ -0,0 +1,94 @@
+package chunkbox
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestSealOpen(t *testing.T) {
+	key := &[32]byte{1, 2, 3}
+	for _, size := range []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3*ChunkSize + 100} {
+		msg := make([]byte, size)
+		rand.Read(msg)
+
+		box, err := Seal(key, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(box) != SealedSize(size) {
+			t.Errorf("%d: sealed %d bytes want %d", size, len(box), SealedSize(size))
+		}
+
+		got, err := Open(key, box)
+		if err != nil {
+			t.Fatalf("%d: %v", size, err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Errorf("%d: opened blob differs", size)
+		}
+	}
+}
+
+func TestOpenTampered(t *testing.T) {
+	key := &[32]byte{1, 2, 3}
+	msg := make([]byte, 3*ChunkSize)
+	rand.Read(msg)
+	box, err := Seal(key, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk := ChunkSize + 16
+
+	flipped := append([]byte(nil), box...)
+	flipped[len(flipped)/2] ^= 1
+	swapped := append([]byte(nil), box[:prefixSize]...)
+	swapped = append(swapped, box[prefixSize+chunk:prefixSize+2*chunk]...)
+	swapped = append(swapped, box[prefixSize:prefixSize+chunk]...)
+	swapped = append(swapped, box[prefixSize+2*chunk:]...)
+
+	for name, b := range map[string][]byte{
+		"wrong key": nil,
+		"flipped":   flipped,
+		"truncated": box[:prefixSize+2*chunk],
+		"swapped":   swapped,
+		"short":     box[:10],
+	} {
+		k := key
+		if b == nil {
+			b, k = box, &[32]byte{4, 5, 6}
+		}
+		if _, err := Open(k, b); err != ErrOpen {
+			t.Errorf("%s: got %v want %v", name, err, ErrOpen)
+		}
+	}
+}
+
+func TestCipher(t *testing.T) {
+	key := &[32]byte{1, 2, 3}
+	ciphers := []Cipher{Secretbox, XChaCha20Poly1305}
+	for _, size := range []int{0, 1, ChunkSize, 2*ChunkSize + 100} {
+		msg := make([]byte, size)
+		rand.Read(msg)
+		for _, sealer := range ciphers {
+			box, err := sealer.Seal(key, msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(box) != sealer.SealedSize(size) {
+				t.Errorf("%d, %v: sealed %d bytes want %d", size, sealer, len(box), sealer.SealedSize(size))
+			}
+			for _, opener := range ciphers {
+				got, err := opener.Open(key, box)
+				switch {
+				case opener == sealer && err != nil:
+					t.Errorf("%d, %v: %v", size, sealer, err)
+				case opener == sealer && !bytes.Equal(got, msg):
+					t.Errorf("%d, %v: opened blob differs", size, sealer)
+				case opener != sealer && err != ErrOpen:
+					t.Errorf("%d, %v opened by %v: got %v want %v", size, sealer, opener, err, ErrOpen)
+				}
+			}
+		}
+	}
+}
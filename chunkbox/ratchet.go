@@ -0,0 +1,186 @@
+package chunkbox
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Ratcheted streams are sent as frames, each one write's data sealed with
+// secretbox:
+//
+//	epoch  uint32  big endian, the number of times the key has moved on
+//	length uint32  big endian, of the sealed data
+//	sealed [length]byte
+//
+// Frames are sealed with the key for their epoch, and a nonce made of the
+// epoch and the number of the frame within the epoch. The writer moves on
+// to the next key, derived from the last with HKDF, after a number of bytes
+// or a while, and forgets the old one, so compromising a key doesn't expose
+// anything sent before it. The reader follows when it sees a frame from the
+// next epoch. Frames can't be skipped, reordered or replayed.
+const (
+	ratchetHeaderSize = 8
+
+	// MaxFrameSize is the largest frame a RatchetWriter writes, which fits
+	// in a DataChannel message.
+	MaxFrameSize = ChunkSize
+
+	maxFramePayload = MaxFrameSize - ratchetHeaderSize - overhead
+)
+
+// ErrRatchet is returned by RatchetReader if a frame was sealed with a key
+// other than the one expected, or was tampered with.
+var ErrRatchet = errors.New("could not open ratcheted frame")
+
+// ratchet replaces key with the next one.
+func ratchet(key *[32]byte) {
+	var next [32]byte
+	io.ReadFull(hkdf.New(sha256.New, key[:], nil, []byte("webwormhole.io/chunkbox ratchet")), next[:])
+	*key = next
+}
+
+func ratchetNonce(epoch uint32, i uint64) *[24]byte {
+	var n [24]byte
+	binary.BigEndian.PutUint32(n[:], epoch)
+	binary.BigEndian.PutUint64(n[4:], i)
+	return &n
+}
+
+// A RatchetWriter seals what is written to it into a ratcheted stream.
+type RatchetWriter struct {
+	// Bytes and Interval, if not zero, are how many bytes to send with a
+	// key, or for how long to use it, before moving on to the next one.
+	Bytes    int64
+	Interval time.Duration
+
+	w     io.Writer
+	key   [32]byte
+	epoch uint32
+	i     uint64    // Frames sent in this epoch.
+	n     int64     // Bytes sent in this epoch.
+	start time.Time // When this epoch started.
+	buf   []byte
+}
+
+// NewRatchetWriter returns a RatchetWriter writing to w, starting with key.
+func NewRatchetWriter(w io.Writer, key *[32]byte) *RatchetWriter {
+	return &RatchetWriter{
+		w:     w,
+		key:   *key,
+		start: time.Now(),
+		buf:   make([]byte, 0, MaxFrameSize),
+	}
+}
+
+// Write seals p as one frame, or more if it doesn't fit in one. Writing
+// nothing sends an empty frame, which RatchetReader reads as an empty Read.
+func (w *RatchetWriter) Write(p []byte) (int, error) {
+	n := 0
+	for {
+		m := len(p)
+		if m > maxFramePayload {
+			m = maxFramePayload
+		}
+		if err := w.frame(p[:m]); err != nil {
+			return n, err
+		}
+		n += m
+		p = p[m:]
+		if len(p) == 0 {
+			return n, nil
+		}
+	}
+}
+
+func (w *RatchetWriter) frame(p []byte) error {
+	if w.i > 0 && (w.Bytes > 0 && w.n >= w.Bytes || w.Interval > 0 && time.Since(w.start) >= w.Interval) {
+		ratchet(&w.key)
+		w.epoch++
+		w.i, w.n, w.start = 0, 0, time.Now()
+	}
+	w.buf = w.buf[:ratchetHeaderSize]
+	binary.BigEndian.PutUint32(w.buf, w.epoch)
+	binary.BigEndian.PutUint32(w.buf[4:], uint32(len(p)+overhead))
+	w.buf = secretbox.Seal(w.buf, p, ratchetNonce(w.epoch, w.i), &w.key)
+	w.i++
+	w.n += int64(len(p))
+	_, err := w.w.Write(w.buf)
+	return err
+}
+
+// A RatchetReader opens a ratcheted stream written by a RatchetWriter.
+type RatchetReader struct {
+	r      io.Reader
+	key    [32]byte
+	epoch  uint32
+	i      uint64 // Frames read in this epoch.
+	buf    []byte
+	opened []byte
+	unread []byte
+}
+
+// NewRatchetReader returns a RatchetReader reading from r, starting with
+// key.
+func NewRatchetReader(r io.Reader, key *[32]byte) *RatchetReader {
+	return &RatchetReader{
+		r:   r,
+		key: *key,
+		buf: make([]byte, MaxFrameSize),
+	}
+}
+
+// Read returns data from the current frame, reading the next one if it is
+// all read. An empty frame makes Read return 0 and no error.
+func (r *RatchetReader) Read(p []byte) (int, error) {
+	if len(r.unread) == 0 {
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.unread)
+	r.unread = r.unread[n:]
+	return n, nil
+}
+
+// next reads and opens the next frame into unread.
+func (r *RatchetReader) next() error {
+	header := r.buf[:ratchetHeaderSize]
+	if _, err := io.ReadFull(r.r, header); err != nil {
+		return err
+	}
+	epoch := binary.BigEndian.Uint32(header)
+	length := binary.BigEndian.Uint32(header[4:])
+	if length < overhead || length > MaxFrameSize-ratchetHeaderSize {
+		return ErrRatchet
+	}
+	switch epoch {
+	case r.epoch:
+	case r.epoch + 1:
+		ratchet(&r.key)
+		r.epoch++
+		r.i = 0
+	default:
+		return ErrRatchet
+	}
+	sealed := r.buf[ratchetHeaderSize : ratchetHeaderSize+length]
+	if _, err := io.ReadFull(r.r, sealed); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	var ok bool
+	r.opened, ok = secretbox.Open(r.opened[:0], sealed, ratchetNonce(r.epoch, r.i), &r.key)
+	if !ok {
+		return ErrRatchet
+	}
+	r.i++
+	r.unread = r.opened
+	return nil
+}
@@ -0,0 +1,110 @@
+package chunkbox
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestRatchet(t *testing.T) {
+	key := &[32]byte{1, 2, 3}
+	var stream bytes.Buffer
+	w := NewRatchetWriter(&stream, key)
+	w.Bytes = 1000
+
+	// A long stream in writes of all sizes, some larger than a frame.
+	var sent []byte
+	for i := 0; i < 500; i++ {
+		p := make([]byte, rand.Intn(3000))
+		if i%50 == 0 {
+			p = make([]byte, MaxFrameSize+rand.Intn(MaxFrameSize))
+		}
+		rand.Read(p)
+		if _, err := w.Write(p); err != nil {
+			t.Fatal(err)
+		}
+		sent = append(sent, p...)
+	}
+	if w.epoch < 100 {
+		t.Errorf("only ratcheted %d times", w.epoch)
+	}
+	if w.key == *key {
+		t.Error("writer still has the first key")
+	}
+
+	r := NewRatchetReader(&stream, key)
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, sent) {
+		t.Errorf("read %d bytes that differ from the %d sent", len(got), len(sent))
+	}
+	if r.epoch != w.epoch || r.key != w.key {
+		t.Errorf("reader at epoch %d, writer at %d", r.epoch, w.epoch)
+	}
+}
+
+func TestRatchetInterval(t *testing.T) {
+	key := &[32]byte{1, 2, 3}
+	var stream bytes.Buffer
+	w := NewRatchetWriter(&stream, key)
+	w.Interval = time.Millisecond
+	r := NewRatchetReader(&stream, key)
+	p := make([]byte, 10)
+	for i := 0; i < 3; i++ {
+		if _, err := w.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		// Empty frames mark something, e.g. the end of input, and are
+		// read as empty reads.
+		if _, err := w.Write(nil); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := r.Read(p); err != nil || string(p[:n]) != "hello" {
+			t.Fatalf("got %q, %v want hello", p[:n], err)
+		}
+		if n, err := r.Read(p); err != nil || n != 0 {
+			t.Fatalf("got %q, %v reading an empty frame", p[:n], err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	if w.epoch != 2 || r.epoch != 2 {
+		t.Errorf("got epochs %d and %d want 2", w.epoch, r.epoch)
+	}
+}
+
+func TestRatchetTampered(t *testing.T) {
+	key := &[32]byte{1, 2, 3}
+	var stream bytes.Buffer
+	w := NewRatchetWriter(&stream, key)
+	w.Bytes = 1
+	var frames [][]byte
+	for _, msg := range []string{"one", "two", "three"} {
+		before := stream.Len()
+		w.Write([]byte(msg))
+		frames = append(frames, append([]byte(nil), stream.Bytes()[before:]...))
+	}
+	join := func(fs ...[]byte) []byte { return bytes.Join(fs, nil) }
+	flipped := join(frames...)
+	flipped[len(frames[0])+ratchetHeaderSize+3] ^= 1
+
+	for name, tt := range map[string]struct {
+		stream []byte
+		key    *[32]byte
+	}{
+		"wrong key": {join(frames...), &[32]byte{4, 5, 6}},
+		"flipped":   {flipped, key},
+		"replayed":  {join(frames[0], frames[0]), key},
+		"reordered": {join(frames[0], frames[2], frames[1]), key},
+		"skipped":   {join(frames[0], frames[2]), key},
+		"truncated": {join(frames[0], frames[1][:10]), key},
+	} {
+		_, err := io.ReadAll(NewRatchetReader(bytes.NewReader(tt.stream), tt.key))
+		if err != ErrRatchet && err != io.ErrUnexpectedEOF {
+			t.Errorf("%s: got %v want %v", name, err, ErrRatchet)
+		}
+	}
+}
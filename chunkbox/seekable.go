@@ -0,0 +1,278 @@
+package chunkbox
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Seekable files are sealed so any part of them can be opened without the
+// rest, e.g. to keep received files encrypted at rest. They start with a
+// header:
+//
+//	magic      [4]byte  "WWCB"
+//	version    byte     1
+//	kdf        byte     1, HKDF-SHA256
+//	chunk size uint32   big endian
+//	salt       [32]byte
+//
+// The chunks follow, each chunk size bytes of the file, but for the last
+// which may be shorter, sealed with XChaCha20-Poly1305. The key is derived
+// from the one given and the salt with the kdf, so every file has its own
+// and nonces can simply count chunks. As with blobs, the last chunk's
+// nonce has its top bit set. The header is authenticated with every chunk.
+// Since the last chunk's nonce also holds how many chunks come before it,
+// opening it authenticates the file's length, which is why NewReader does
+// so before anything else is read.
+const (
+	seekableVersion = 1
+	kdfHKDFSHA256   = 1
+	saltSize        = 32
+	headerSize      = 4 + 1 + 1 + 4 + saltSize
+)
+
+var seekableMagic = []byte("WWCB")
+
+// ErrHeader is returned by NewReader if what it is given is not a seekable
+// file, or one of a version it doesn't understand.
+var ErrHeader = errors.New("not a seekable sealed file")
+
+// seekableAEAD derives a file's key from key and the file's header.
+func seekableAEAD(key *[32]byte, header []byte) (cipher.AEAD, error) {
+	salt := header[headerSize-saltSize:]
+	fileKey := make([]byte, chacha20poly1305.KeySize)
+	kdf := hkdf.New(sha256.New, key[:], salt, []byte("webwormhole.io/chunkbox seekable"))
+	if _, err := io.ReadFull(kdf, fileKey); err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.NewX(fileKey)
+}
+
+// A Writer seals what is written to it into a seekable file.
+type Writer struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte
+	buf    []byte // Plaintext of the chunk being filled.
+	sealed []byte // Scratch space for sealing.
+	i      uint64 // Number of the chunk being filled.
+	err    error
+}
+
+// NewWriter writes the header of a seekable file sealed with key to w, and
+// returns a Writer to write the file's contents with. It must be closed to
+// seal the last chunk.
+func NewWriter(w io.Writer, key *[32]byte) (*Writer, error) {
+	header := make([]byte, headerSize)
+	copy(header, seekableMagic)
+	header[4] = seekableVersion
+	header[5] = kdfHKDFSHA256
+	binary.BigEndian.PutUint32(header[6:], ChunkSize)
+	if _, err := io.ReadFull(rand.Reader, header[headerSize-saltSize:]); err != nil {
+		return nil, err
+	}
+	aead, err := seekableAEAD(key, header)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &Writer{
+		w:      w,
+		aead:   aead,
+		header: header,
+		buf:    make([]byte, 0, ChunkSize),
+		sealed: make([]byte, 0, ChunkSize+overhead),
+	}, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	n := 0
+	for w.err == nil && len(p) > 0 {
+		// Only seal a full chunk once more comes, since the last one is
+		// sealed differently.
+		if len(w.buf) == ChunkSize {
+			w.seal(false)
+			continue
+		}
+		m := copy(w.buf[len(w.buf):ChunkSize], p)
+		w.buf = w.buf[:len(w.buf)+m]
+		n += m
+		p = p[m:]
+	}
+	return n, w.err
+}
+
+// seal seals and writes out the chunk being filled.
+func (w *Writer) seal(last bool) {
+	n := nonce(nil, w.i, last)
+	w.sealed = w.aead.Seal(w.sealed[:0], n[:], w.buf, w.header)
+	_, w.err = w.w.Write(w.sealed)
+	w.buf = w.buf[:0]
+	w.i++
+}
+
+// Close seals the last chunk. It does not close the underlying writer.
+func (w *Writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	w.seal(true)
+	if w.err == nil {
+		w.err = errors.New("chunkbox: write to closed Writer")
+		return nil
+	}
+	return w.err
+}
+
+// A Reader opens a seekable file, reading and opening only the chunks
+// needed for what is read.
+type Reader struct {
+	r      io.ReaderAt
+	aead   cipher.AEAD
+	header []byte
+	chunk  int   // Plaintext bytes in each chunk.
+	chunks int64 // Number of chunks.
+	size   int64 // Plaintext size.
+	off    int64 // Offset for Read and Seek.
+
+	cached int64  // Number of the chunk in buf, or -1.
+	buf    []byte // Plaintext of chunk cached.
+	sealed []byte // Scratch space for reading chunks.
+}
+
+// NewReader returns a Reader for the seekable file of size bytes in r,
+// sealed with key. It opens the last chunk right away, and returns ErrOpen
+// if the file was cut short or extended, or the key is wrong.
+func NewReader(r io.ReaderAt, size int64, key *[32]byte) (*Reader, error) {
+	header := make([]byte, headerSize)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		if err == io.EOF {
+			return nil, ErrHeader
+		}
+		return nil, err
+	}
+	chunk := int(binary.BigEndian.Uint32(header[6:]))
+	if !bytes.Equal(header[:4], seekableMagic) || header[4] != seekableVersion || header[5] != kdfHKDFSHA256 || chunk <= 0 || chunk > 16<<20 {
+		return nil, ErrHeader
+	}
+	aead, err := seekableAEAD(key, header)
+	if err != nil {
+		return nil, err
+	}
+	body := size - headerSize
+	sealedChunk := int64(chunk + overhead)
+	chunks := (body + sealedChunk - 1) / sealedChunk
+	if chunks == 0 || body-(chunks-1)*sealedChunk < overhead {
+		return nil, ErrOpen
+	}
+	rd := &Reader{
+		r:      r,
+		aead:   aead,
+		header: header,
+		chunk:  chunk,
+		chunks: chunks,
+		size:   body - chunks*overhead,
+		cached: -1,
+		sealed: make([]byte, sealedChunk),
+	}
+	if err := rd.open(chunks - 1); err != nil {
+		return nil, err
+	}
+	return rd, nil
+}
+
+// Size returns the size of the file once opened.
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+// open reads and opens chunk i into r.buf.
+func (r *Reader) open(i int64) error {
+	if r.cached == i {
+		return nil
+	}
+	off := headerSize + i*int64(r.chunk+overhead)
+	sealed := r.sealed
+	if i == r.chunks-1 {
+		sealed = sealed[:r.size-i*int64(r.chunk)+overhead]
+	}
+	if _, err := r.r.ReadAt(sealed, off); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	n := nonce(nil, uint64(i), i == r.chunks-1)
+	var err error
+	r.cached = -1
+	r.buf, err = r.aead.Open(r.buf[:0], n[:], sealed, r.header)
+	if err != nil {
+		return ErrOpen
+	}
+	r.cached = i
+	return nil
+}
+
+// ReadAt reads len(p) bytes of the file from off, opening only the chunks
+// they are in. If any of them was tampered with, it returns ErrOpen.
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("chunkbox: negative offset")
+	}
+	n := 0
+	for len(p) > 0 {
+		if off >= r.size {
+			return n, io.EOF
+		}
+		i := off / int64(r.chunk)
+		if err := r.open(i); err != nil {
+			return n, err
+		}
+		m := copy(p, r.buf[off-i*int64(r.chunk):])
+		n += m
+		off += int64(m)
+		p = p[m:]
+	}
+	return n, nil
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	if len(p) > 0 && r.off >= r.size {
+		return 0, io.EOF
+	}
+	if rest := r.size - r.off; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+	n, err := r.ReadAt(p, r.off)
+	r.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.size
+	case io.SeekStart:
+	default:
+		return 0, errors.New("chunkbox: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("chunkbox: negative position")
+	}
+	r.off = offset
+	return offset, nil
+}
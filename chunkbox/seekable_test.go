@@ -0,0 +1,182 @@
+package chunkbox
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func sealFile(t *testing.T, key *[32]byte, msg []byte) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	w, err := NewWriter(&b, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Write in odd sizes so chunks are filled across writes.
+	for p := msg; len(p) > 0; {
+		n := rand.Intn(3*ChunkSize/2) + 1
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestSeekable(t *testing.T) {
+	key := &[32]byte{1, 2, 3}
+	for _, size := range []int{0, 1, ChunkSize, ChunkSize + 1, 3*ChunkSize + 100} {
+		msg := make([]byte, size)
+		rand.Read(msg)
+		sealed := sealFile(t, key, msg)
+
+		r, err := NewReader(bytes.NewReader(sealed), int64(len(sealed)), key)
+		if err != nil {
+			t.Fatalf("%d: %v", size, err)
+		}
+		if r.Size() != int64(size) {
+			t.Errorf("%d: got size %d", size, r.Size())
+		}
+		got, err := io.ReadAll(r)
+		if err != nil || !bytes.Equal(got, msg) {
+			t.Errorf("%d: read %d bytes, %v", size, len(got), err)
+		}
+
+		for _, off := range []int{0, 1, ChunkSize - 10, ChunkSize, 2*ChunkSize + 5, size - 1} {
+			if off < 0 || off >= size {
+				continue
+			}
+			for _, n := range []int{1, 20, ChunkSize + 7} {
+				want := msg[off:]
+				if len(want) > n {
+					want = want[:n]
+				}
+				p := make([]byte, n)
+				m, err := r.ReadAt(p, int64(off))
+				if m != len(want) || !bytes.Equal(p[:m], want) {
+					t.Errorf("%d: ReadAt %d bytes at %d got %d bytes, %v", size, n, off, m, err)
+				}
+				if m < n && err != io.EOF {
+					t.Errorf("%d: short ReadAt %d bytes at %d got %v want EOF", size, n, off, err)
+				}
+			}
+			if _, err := r.Seek(int64(off), io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, msg[off:]) {
+				t.Errorf("%d: reading from %d got %d bytes, %v", size, off, len(got), err)
+			}
+		}
+	}
+}
+
+func TestSeekableTampered(t *testing.T) {
+	key := &[32]byte{1, 2, 3}
+	msg := make([]byte, 3*ChunkSize)
+	rand.Read(msg)
+	sealed := sealFile(t, key, msg)
+	chunk := ChunkSize + overhead
+
+	// Flipping a bit in the second chunk only breaks reading it.
+	flipped := append([]byte(nil), sealed...)
+	flipped[headerSize+chunk+100] ^= 1
+	r, err := NewReader(bytes.NewReader(flipped), int64(len(flipped)), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 10)
+	for _, tt := range []struct {
+		off int64
+		err error
+	}{
+		{0, nil},
+		{ChunkSize + 5, ErrOpen},
+		{2*ChunkSize + 5, nil},
+		{ChunkSize - 5, ErrOpen},
+	} {
+		if _, err := r.ReadAt(p, tt.off); err != tt.err {
+			t.Errorf("reading at %d got %v want %v", tt.off, err, tt.err)
+		}
+	}
+
+	swapped := append([]byte(nil), sealed[:headerSize]...)
+	swapped = append(swapped, sealed[headerSize+chunk:headerSize+2*chunk]...)
+	swapped = append(swapped, sealed[headerSize:headerSize+chunk]...)
+	swapped = append(swapped, sealed[headerSize+2*chunk:]...)
+	resalted := append([]byte(nil), sealed...)
+	resalted[headerSize-1] ^= 1
+
+	for name, b := range map[string][]byte{
+		"wrong key": nil,
+		"truncated": sealed[:headerSize+2*chunk],
+		"swapped":   swapped,
+		"header":    resalted,
+	} {
+		k := key
+		if b == nil {
+			b, k = sealed, &[32]byte{4, 5, 6}
+		}
+		// Some are caught opening the last chunk, others only once
+		// the chunk that was changed is read.
+		r, err := NewReader(bytes.NewReader(b), int64(len(b)), k)
+		if err == nil {
+			_, err = io.ReadAll(r)
+		}
+		if err != ErrOpen {
+			t.Errorf("%s: got %v want %v", name, err, ErrOpen)
+		}
+	}
+
+	for name, b := range map[string][]byte{
+		"short":   sealed[:10],
+		"blob":    mustSeal(t, key, msg),
+		"version": append(append([]byte("WWCB"), 2), sealed[5:]...),
+	} {
+		if _, err := NewReader(bytes.NewReader(b), int64(len(b)), key); err != ErrHeader {
+			t.Errorf("%s: got %v want %v", name, err, ErrHeader)
+		}
+	}
+}
+
+func TestSeekableTruncated(t *testing.T) {
+	key := &[32]byte{1, 2, 3}
+	msg := make([]byte, 2*ChunkSize+100)
+	rand.Read(msg)
+	sealed := sealFile(t, key, msg)
+	chunk := ChunkSize + overhead
+
+	// Cutting a file short never leaves a valid file, not even an empty
+	// one, and neither does cutting it at a chunk boundary.
+	for _, n := range []int{
+		headerSize,
+		headerSize + overhead,
+		headerSize + chunk,
+		headerSize + 2*chunk,
+		len(sealed) - 1,
+	} {
+		if _, err := NewReader(bytes.NewReader(sealed[:n]), int64(n), key); err != ErrOpen {
+			t.Errorf("cut to %d of %d bytes: got %v want %v", n, len(sealed), err, ErrOpen)
+		}
+	}
+	extended := append(append([]byte(nil), sealed...), sealed[headerSize:headerSize+chunk]...)
+	if _, err := NewReader(bytes.NewReader(extended), int64(len(extended)), key); err != ErrOpen {
+		t.Errorf("extended: got %v want %v", err, ErrOpen)
+	}
+}
+
+func mustSeal(t *testing.T, key *[32]byte, msg []byte) []byte {
+	t.Helper()
+	box, err := Seal(key, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return box
+}
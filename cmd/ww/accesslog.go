@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// accessLog writes a line for every request to the server, in Common Log
+// Format or as JSON. WebSocket sessions are logged once they end, with
+// their duration and the bytes sent to the client over them. Paths of
+// WebSocket requests are logged without the slot, and nothing relayed is
+// ever logged.
+type accessLog struct {
+	json bool
+
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// newAccessLog returns an accessLog writing to out in format, "clf" or
+// "json".
+func newAccessLog(out io.Writer, format string) (*accessLog, error) {
+	switch format {
+	case "clf":
+		return &accessLog{out: out}, nil
+	case "json":
+		return &accessLog{out: out, json: true}, nil
+	}
+	return nil, fmt.Errorf("unknown access log format %q", format)
+}
+
+// accessEntry is one request's line in the access log.
+type accessEntry struct {
+	Time     time.Time `json:"time"`
+	Remote   string    `json:"remote"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	Proto    string    `json:"proto"`
+	Status   int       `json:"status"`
+	Bytes    int64     `json:"bytes"`
+	Duration float64   `json:"duration"` // In seconds.
+}
+
+// format returns e as a line in Common Log Format, with the duration in
+// microseconds added at the end like Apache's %D.
+func (e *accessEntry) format() string {
+	bytes := "-"
+	if e.Bytes > 0 {
+		bytes = fmt.Sprint(e.Bytes)
+	}
+	return fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %s %d\n",
+		e.Remote, e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method, e.Path, e.Proto, e.Status, bytes, int64(e.Duration*1e6))
+}
+
+func (l *accessLog) write(e *accessEntry) {
+	line := e.format()
+	if l.json {
+		buf, err := json.Marshal(e)
+		if err != nil {
+			return
+		}
+		line = string(buf) + "\n"
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	io.WriteString(l.out, line)
+}
+
+// handler logs every request next serves.
+func (l *accessLog) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rw := &loggedResponse{ResponseWriter: w}
+		next.ServeHTTP(rw, r)
+
+		path := r.URL.Path
+		if strings.ToLower(r.Header.Get("Upgrade")) == "websocket" && path != "/" {
+			path = "/{slot}"
+		}
+		remote, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			remote = r.RemoteAddr
+		}
+		status := rw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		l.write(&accessEntry{
+			Time:     start,
+			Remote:   remote,
+			Method:   r.Method,
+			Path:     path,
+			Proto:    r.Proto,
+			Status:   status,
+			Bytes:    rw.bytes.Load(),
+			Duration: time.Since(start).Seconds(),
+		})
+	})
+}
+
+// loggedResponse records the status and size of a response, including what
+// is written to the connection after it's hijacked for a WebSocket.
+type loggedResponse struct {
+	http.ResponseWriter
+	status int
+	bytes  atomic.Int64
+}
+
+func (w *loggedResponse) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *loggedResponse) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes.Add(int64(n))
+	return n, err
+}
+
+func (w *loggedResponse) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *loggedResponse) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("http.ResponseWriter does not implement http.Hijacker")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := brw.Writer.Flush(); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	// Servers write through brw rather than conn, so it needs to write
+	// to the counted conn too.
+	counted := &countedConn{Conn: conn, n: &w.bytes}
+	brw.Writer = bufio.NewWriterSize(counted, brw.Writer.Size())
+	return counted, brw, nil
+}
+
+// countedConn adds what is written to it to n.
+type countedConn struct {
+	net.Conn
+	n *atomic.Int64
+}
+
+func (c *countedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+	"webwormhole.io/wormhole"
+)
+
+// lines returns what l has written so far, once it has written n lines.
+func lines(t *testing.T, l *accessLog, out *bytes.Buffer, n int) []string {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		l.mu.Lock()
+		s := out.String()
+		l.mu.Unlock()
+		if strings.Count(s, "\n") >= n {
+			return strings.SplitAfter(s, "\n")[:n]
+		}
+	}
+	t.Fatalf("access log has fewer than %d lines", n)
+	return nil
+}
+
+func TestAccessLog(t *testing.T) {
+	out := &bytes.Buffer{}
+	l, err := newAccessLog(out, "clf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(l.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.ToLower(r.Header.Get("Upgrade")) == "websocket" {
+			relay(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("hello"))
+	})))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/index.html?q=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	clf := regexp.MustCompile(`^127\.0\.0\.1 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /index\.html HTTP/1\.1" 418 5 \d+\n$`)
+	if line := lines(t, l, out, 1)[0]; !clf.MatchString(line) {
+		t.Errorf("got %q, not in common log format", line)
+	}
+
+	// The slot is left out of WebSocket sessions' paths.
+	ws, _, err := websocket.Dial(context.Background(), "ws"+srv.URL[len("http"):]+"/1234", &websocket.DialOptions{
+		Subprotocols: []string{wormhole.Protocol},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.Read(context.Background())
+	ws.Close(websocket.StatusNormalClosure, "")
+	line := lines(t, l, out, 2)[1]
+	if !regexp.MustCompile(`"GET /{slot} HTTP/1\.1" 101 \d+ \d+\n$`).MatchString(line) {
+		t.Errorf("got %q for a WebSocket session", line)
+	}
+	if strings.Contains(line, "1234") {
+		t.Errorf("slot logged in %q", line)
+	}
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	out := &bytes.Buffer{}
+	l, err := newAccessLog(out, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := l.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	r := httptest.NewRequest("POST", "/x", nil)
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	var e accessEntry
+	if err := json.Unmarshal([]byte(lines(t, l, out, 1)[0]), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Remote != "192.0.2.1" || e.Method != "POST" || e.Path != "/x" || e.Status != 200 || e.Bytes != 5 {
+		t.Errorf("got %+v", e)
+	}
+
+	if _, err := newAccessLog(out, "xml"); err == nil {
+		t.Errorf("got no error for unknown format")
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// bundleSize is the largest file sendFiles bundles with others. Smaller
+// files take a header and a message of data each, so sending thousands of
+// them one by one is mostly overhead.
+const bundleSize = msgChunkSize
+
+// bundleGroups splits filenames, in order, into groups to send as one
+// source each: files on their own, and runs of more than threshold files
+// smaller than bundleSize to bundle together with bundleSource. A zero
+// threshold bundles nothing.
+func bundleGroups(filenames []string, threshold int) [][]string {
+	var groups [][]string
+	var run []string
+	flush := func() {
+		if threshold > 0 && len(run) > threshold {
+			groups = append(groups, run)
+		} else {
+			for _, filename := range run {
+				groups = append(groups, []string{filename})
+			}
+		}
+		run = nil
+	}
+	for _, filename := range filenames {
+		info, err := os.Stat(filename)
+		if threshold > 0 && err == nil && info.Mode().IsRegular() && info.Size() < bundleSize {
+			run = append(run, filename)
+			continue
+		}
+		flush()
+		groups = append(groups, []string{filename})
+	}
+	flush()
+	return groups
+}
+
+// bundleSource returns a source for a tar archive of the named files,
+// marked as a bundle so receivers save the files in it like they were sent
+// one by one. See header.Bundle.
+func bundleSource(filenames []string) source {
+	return func() (header, io.ReadCloser, error) {
+		infos := make([]os.FileInfo, len(filenames))
+		for i, filename := range filenames {
+			info, err := os.Stat(filename)
+			if err != nil {
+				return header{}, nil, fmt.Errorf("could not stat file %s: %v", filename, err)
+			}
+			infos[i] = info
+		}
+		// Tar archives of the same headers are the same size whatever the
+		// data, so write one of zeros to size it before sending.
+		var size countWriter
+		err := writeBundle(&size, filenames, infos, func(string) (io.ReadCloser, error) {
+			return io.NopCloser(zeroReader{}), nil
+		})
+		if err != nil {
+			return header{}, nil, err
+		}
+		// Buffer the archive so it is sent in full messages rather than
+		// one for each header and file.
+		r, w := io.Pipe()
+		go func() {
+			bw := bufio.NewWriterSize(w, maxChunkSize)
+			err := writeBundle(bw, filenames, infos, func(filename string) (io.ReadCloser, error) {
+				return os.Open(filename)
+			})
+			if err == nil {
+				err = bw.Flush()
+			}
+			w.CloseWithError(err)
+		}()
+		return header{
+			Name:   fmt.Sprintf("%d-files.tar", len(filenames)),
+			Size:   int(size),
+			Type:   typeTar,
+			Bundle: true,
+		}, r, nil
+	}
+}
+
+// writeBundle writes a tar archive of the named files, described by infos,
+// to w, with their data read from what open opens.
+func writeBundle(w io.Writer, filenames []string, infos []os.FileInfo, open func(filename string) (io.ReadCloser, error)) error {
+	tw := tar.NewWriter(w)
+	for i, filename := range filenames {
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     filepath.Base(filepath.Clean(filename)),
+			Size:     infos[i].Size(),
+			Mode:     int64(infos[i].Mode().Perm()),
+			ModTime:  infos[i].ModTime().Truncate(time.Second),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		r, err := open(filename)
+		if err != nil {
+			return fmt.Errorf("could not open file %s: %v", filename, err)
+		}
+		_, err = io.CopyN(tw, r, hdr.Size)
+		r.Close()
+		if err == io.EOF {
+			return fmt.Errorf("file %s shrank while sending it", filename)
+		}
+		if err != nil {
+			return fmt.Errorf("could not read file %s: %v", filename, err)
+		}
+	}
+	return tw.Close()
+}
+
+// countWriter counts the bytes written to it.
+type countWriter int64
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	*c += countWriter(len(p))
+	return len(p), nil
+}
+
+// zeroReader reads as an endless run of zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// bundleDestination saves the files in bundles to destination one by one,
+// as if they had been sent on their own, counting them against limit's
+// maximum number of files. Everything else is saved as it is.
+type bundleDestination struct {
+	destination
+	limit *limits
+}
+
+func (d *bundleDestination) create(h header) (io.WriterAt, func() error, func(), error) {
+	if !h.Bundle {
+		return d.destination.create(h)
+	}
+	var undos []func()
+	w, closef := piped(func(r io.Reader) error {
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if hdr.Typeflag != tar.TypeReg || hdr.Name == "" {
+				continue
+			}
+			fh := header{Name: hdr.Name, Size: int(hdr.Size), Type: fileType(hdr.Name)}
+			if err := d.limit.file(); err != nil {
+				return err
+			}
+			fw, closeFile, undo, err := d.destination.create(fh)
+			if err != nil {
+				return fmt.Errorf("could not create %s: %v", hdr.Name, err)
+			}
+			undos = append(undos, undo)
+			_, err = io.Copy(&atWriter{w: fw}, tr)
+			if e := closeFile(); err == nil {
+				err = e
+			}
+			if err != nil {
+				return fmt.Errorf("could not save %s: %v", hdr.Name, err)
+			}
+		}
+	})
+	undo := func() {
+		for _, undo := range undos {
+			undo()
+		}
+	}
+	return w, closef, undo, nil
+}
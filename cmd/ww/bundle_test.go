@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeSmallFiles writes n small files with different contents to dir,
+// and returns their paths.
+func writeSmallFiles(tb testing.TB, dir string, n int) []string {
+	tb.Helper()
+	names := make([]string, n)
+	for i := range names {
+		names[i] = filepath.Join(dir, fmt.Sprintf("f%05d.txt", i))
+		if err := os.WriteFile(names[i], []byte(fmt.Sprintf("file %d\n", i)), 0644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return names
+}
+
+// sendBundled sends names over a fresh pipe to a receiver saving to dest
+// with limit. It returns how many messages the sender sent, what the
+// receiver got, and both sides' errors.
+func sendBundled(names []string, bundle int, dest destination, limit *limits) (messages int, results []fileResult, sendErr, receiveErr error) {
+	s, receiver := msgPipe()
+	sender := &countingConn{msgConn: s}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- sendFiles(sender, names, io.Discard, sendOptions{ackTimeout: time.Second, bundle: bundle})
+		sender.Close()
+	}()
+	results, receiveErr = receiveFiles(receiver, dest, io.Discard, nil, nil, limit)
+	receiver.Close()
+	return sender.messages, results, <-errc, receiveErr
+}
+
+func TestSendBundle(t *testing.T) {
+	src := t.TempDir()
+	names := writeSmallFiles(t, src, 1000)
+	// A big file in the middle is sent on its own.
+	big := writeTestFile(t, src, "big.bin", bytes.Repeat([]byte("b"), 100<<10))
+	names = append(names[:500], append([]string{big}, names[500:]...)...)
+
+	var messages [2]int
+	for i, bundle := range []int{0, 100} {
+		dst := t.TempDir()
+		var sendErr, receiveErr error
+		messages[i], _, sendErr, receiveErr = sendBundled(names, bundle, &dirDestination{dir: dst}, nil)
+		if sendErr != nil || receiveErr != nil {
+			t.Fatalf("bundle %d: %v, %v", bundle, sendErr, receiveErr)
+		}
+		for _, name := range names {
+			want, _ := os.ReadFile(name)
+			got, err := os.ReadFile(filepath.Join(dst, filepath.Base(name)))
+			if err != nil || !bytes.Equal(got, want) {
+				t.Fatalf("bundle %d: %s: got %q, %v want %q", bundle, filepath.Base(name), got, err, want)
+			}
+		}
+		entries, _ := os.ReadDir(dst)
+		if len(entries) != len(names) {
+			t.Errorf("bundle %d: got %d files want %d", bundle, len(entries), len(names))
+		}
+	}
+	if messages[1] > messages[0]/10 {
+		t.Errorf("sent %d messages bundled, %d not", messages[1], messages[0])
+	}
+}
+
+func TestBundleGroups(t *testing.T) {
+	src := t.TempDir()
+	small := writeSmallFiles(t, src, 5)
+	big := writeTestFile(t, src, "big.bin", make([]byte, bundleSize))
+	missing := filepath.Join(src, "missing")
+	names := []string{small[0], small[1], small[2], big, small[3], missing, small[4]}
+
+	for _, tc := range []struct {
+		threshold int
+		want      [][]string
+	}{
+		{0, [][]string{{small[0]}, {small[1]}, {small[2]}, {big}, {small[3]}, {missing}, {small[4]}}},
+		{2, [][]string{{small[0], small[1], small[2]}, {big}, {small[3]}, {missing}, {small[4]}}},
+		{3, [][]string{{small[0]}, {small[1]}, {small[2]}, {big}, {small[3]}, {missing}, {small[4]}}},
+	} {
+		if got := bundleGroups(names, tc.threshold); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("threshold %d: got %v want %v", tc.threshold, got, tc.want)
+		}
+	}
+}
+
+func TestReceiveBundleLimit(t *testing.T) {
+	// Files in a bundle count against -max-files like any others, and none
+	// of the bundle is kept if it goes over. The sender is told why.
+	dst := t.TempDir()
+	names := writeSmallFiles(t, t.TempDir(), 20)
+	_, results, sendErr, err := sendBundled(names, 1, &dirDestination{dir: dst}, &limits{maxFiles: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || !errors.Is(results[0].err, errTooManyFiles) {
+		t.Errorf("got results %v want one failing with %v", results, errTooManyFiles)
+	}
+	if entries, _ := os.ReadDir(dst); len(entries) != 0 {
+		t.Errorf("kept %d files of a bundle over the limit", len(entries))
+	}
+	if sendErr == nil || !strings.Contains(sendErr.Error(), errTooManyFiles.Error()) {
+		t.Errorf("sender got %v want it to say %v", sendErr, errTooManyFiles)
+	}
+
+	// The bundle itself isn't a file, and only its header is rate
+	// limited, so a bundle of exactly -max-files files sent at a rate of
+	// one header a second gets through.
+	dst = t.TempDir()
+	_, results, sendErr, err = sendBundled(names, 1, &dirDestination{dir: dst}, &limits{maxFiles: 20, rate: 1})
+	if err != nil || sendErr != nil {
+		t.Fatal(err, sendErr)
+	}
+	if len(results) != 1 || results[0].err != nil {
+		t.Errorf("got results %v want one saved", results)
+	}
+	if entries, _ := os.ReadDir(dst); len(entries) != 20 {
+		t.Errorf("saved %d files of the bundle want 20", len(entries))
+	}
+}
+
+func benchmarkSendSmallFiles(b *testing.B, bundle int) {
+	names := writeSmallFiles(b, b.TempDir(), 1000)
+	for i := 0; i < b.N; i++ {
+		_, _, sendErr, receiveErr := sendBundled(names, bundle, &dirDestination{dir: b.TempDir()}, nil)
+		if sendErr != nil || receiveErr != nil {
+			b.Fatal(sendErr, receiveErr)
+		}
+	}
+}
+
+func BenchmarkSendSmallFiles(b *testing.B)        { benchmarkSendSmallFiles(b, 0) }
+func BenchmarkSendSmallFilesBundled(b *testing.B) { benchmarkSendSmallFiles(b, 100) }
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync/atomic"
+)
+
+// chunkHeaderSize is the length of the offset prefixed to every message of
+// a file sent with offset framing.
+const chunkHeaderSize = 8
+
+var errChunkOverflow = errors.New("received more bytes than expected")
+
+// writeChunk sends p as a single message prefixed with its offset in the file.
+func writeChunk(c io.Writer, offset int64, p []byte) error {
+	buf := make([]byte, chunkHeaderSize+len(p))
+	binary.BigEndian.PutUint64(buf, uint64(offset))
+	copy(buf[chunkHeaderSize:], p)
+	_, err := c.Write(buf)
+	return err
+}
+
+// sendChunks copies r into c as offset-framed messages of up to size
+// bytes, offset included. The first message is at offset. It returns the
+// number of bytes read from r.
+func sendChunks(c io.Writer, r io.Reader, offset int64, size *chunkSize) (written int64, err error) {
+	buf := make([]byte, maxChunkSize)
+	for {
+		n, err := r.Read(buf[:size.get()-chunkHeaderSize])
+		if n > 0 {
+			if err := writeChunk(c, offset+written, buf[:n]); err != nil {
+				return written, err
+			}
+			written += int64(n)
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// chunkSize is the size of the messages a sender sends file data in. It is
+// msgChunkSize, which every receiver takes, unless the receiver says it
+// takes bigger messages. It never grows past what the connection can send.
+type chunkSize struct {
+	limit int
+	n     atomic.Int64
+}
+
+// newChunkSize returns the chunkSize for sending over c, whose
+// MaxMessageSize method, if it has one, limits how big messages can be.
+func newChunkSize(c io.Writer) *chunkSize {
+	s := &chunkSize{limit: maxChunkSize}
+	if m, ok := c.(interface{ MaxMessageSize() int }); ok && m.MaxMessageSize() < s.limit {
+		s.limit = m.MaxMessageSize()
+	}
+	s.n.Store(msgChunkSize)
+	return s
+}
+
+// set records that the receiver takes messages of up to n bytes.
+func (s *chunkSize) set(n int) {
+	if s == nil {
+		return
+	}
+	if n > s.limit {
+		n = s.limit
+	}
+	if n < msgChunkSize {
+		n = msgChunkSize
+	}
+	s.n.Store(int64(n))
+}
+
+func (s *chunkSize) get() int {
+	if s == nil {
+		return msgChunkSize
+	}
+	return int(s.n.Load())
+}
+
+// copyChunks copies r to c, a message of at most the current size at a
+// time. It returns the number of bytes copied.
+func copyChunks(c io.Writer, r io.Reader, size *chunkSize) (written int64, err error) {
+	buf := make([]byte, maxChunkSize)
+	for {
+		n, err := r.Read(buf[:size.get()])
+		if n > 0 {
+			if _, err := c.Write(buf[:n]); err != nil {
+				return written, err
+			}
+			written += int64(n)
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// receiveUnsized reads a file of unknown size from c into w, until an empty
+// message marks its end. It returns the number of bytes written.
+func receiveUnsized(w io.WriterAt, c io.Reader) (written int64, err error) {
+	buf := make([]byte, chunkHeaderSize+maxChunkSize)
+	for {
+		n, err := c.Read(buf)
+		if err == io.EOF {
+			return written, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			return written, nil
+		}
+		n, err = w.WriteAt(buf[:n], written)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// receiveAt reads a file of size bytes from c into w. If framed is set every
+// message is expected to carry its offset, and they may arrive in any order.
+// Otherwise messages are written one after the other from the start of w.
+// It returns the number of bytes written.
+func receiveAt(w io.WriterAt, c io.Reader, size int64, framed bool) (written int64, err error) {
+	// Pre-allocate the file if we can. Not a big deal if it fails.
+	if t, ok := w.(interface{ Truncate(int64) error }); ok {
+		t.Truncate(size)
+	}
+
+	buf := make([]byte, chunkHeaderSize+maxChunkSize)
+	for written < size {
+		n, err := c.Read(buf)
+		if err == io.EOF && n == 0 {
+			return written, nil
+		}
+		if err != nil && err != io.EOF {
+			return written, err
+		}
+		p, offset := buf[:n], written
+		if framed {
+			if n < chunkHeaderSize {
+				return written, io.ErrUnexpectedEOF
+			}
+			offset = int64(binary.BigEndian.Uint64(p))
+			p = p[chunkHeaderSize:]
+		}
+		if offset < 0 || offset+int64(len(p)) > size || written+int64(len(p)) > size {
+			return written, errChunkOverflow
+		}
+		n, err = w.WriteAt(p, offset)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
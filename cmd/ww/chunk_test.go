@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// msgReader returns one message per Read, like a detached DataChannel.
+type msgReader [][]byte
+
+func (r *msgReader) Read(p []byte) (int, error) {
+	if len(*r) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, (*r)[0])
+	*r = (*r)[1:]
+	return n, nil
+}
+
+func (r *msgReader) Write(p []byte) (int, error) {
+	*r = append(*r, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func TestReceiveAtOutOfOrder(t *testing.T) {
+	want := make([]byte, 5*msgChunkSize+123)
+	rand.New(rand.NewSource(1)).Read(want)
+
+	msgs := &msgReader{}
+	n, err := sendChunks(msgs, bytes.NewReader(want), 0, newChunkSize(msgs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(want)) {
+		t.Fatalf("sent %d bytes want %d", n, len(want))
+	}
+	rand.New(rand.NewSource(2)).Shuffle(len(*msgs), func(i, j int) {
+		(*msgs)[i], (*msgs)[j] = (*msgs)[j], (*msgs)[i]
+	})
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	written, err := receiveAt(f, msgs, int64(len(want)), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != int64(len(want)) {
+		t.Fatalf("wrote %d bytes want %d", written, len(want))
+	}
+	got, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("reconstructed file does not match")
+	}
+}
+
+func TestReceiveAtOverflow(t *testing.T) {
+	msgs := &msgReader{}
+	writeChunk(msgs, 8, []byte("too far"))
+	f, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = receiveAt(f, msgs, 10, true)
+	if err != errChunkOverflow {
+		t.Errorf("got %v want %v", err, errChunkOverflow)
+	}
+}
+
+// offsetsDestination is a dirDestination that notes whether any file it
+// saved was sent with offsets.
+type offsetsDestination struct {
+	dirDestination
+	offsets bool
+}
+
+func (d *offsetsDestination) create(h header) (io.WriterAt, func() error, func(), error) {
+	d.offsets = d.offsets || h.Offsets
+	return d.dirDestination.create(h)
+}
+
+func TestSendOffsets(t *testing.T) {
+	src := t.TempDir()
+	want := make([]byte, 3*maxChunkSize+123)
+	rand.New(rand.NewSource(1)).Read(want)
+	name := writeTestFile(t, src, "a.bin", want)
+
+	for _, framed := range []bool{false, true} {
+		dest := &offsetsDestination{dirDestination: dirDestination{dir: t.TempDir()}}
+		sender, receiver := msgPipe()
+		errc := make(chan error, 1)
+		go func() {
+			errc <- sendFiles(sender, []string{name}, io.Discard, sendOptions{ackTimeout: time.Second, framed: framed})
+			sender.Close()
+		}()
+		if _, err := receiveFiles(receiver, dest, io.Discard, nil, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		receiver.Close()
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+		if dest.offsets != framed {
+			t.Errorf("framed %v: sent offsets %v", framed, dest.offsets)
+		}
+		got, _ := os.ReadFile(filepath.Join(dest.dir, "a.bin"))
+		if !bytes.Equal(got, want) {
+			t.Errorf("framed %v: received file does not match", framed)
+		}
+	}
+}
+
+// limitedConn is a msgConn that can't send messages bigger than max.
+type limitedConn struct {
+	*msgConn
+	max int
+}
+
+func (c limitedConn) MaxMessageSize() int { return c.max }
+
+func (c limitedConn) Write(p []byte) (int, error) {
+	if len(p) > c.max {
+		return 0, errChunkOverflow
+	}
+	return c.msgConn.Write(p)
+}
+
+// biggestMessage sends a file of size bytes over sender to a receiver that
+// says it takes big messages if tell is set, and returns the size of the
+// biggest message of file data it got.
+func biggestMessage(t *testing.T, sender io.ReadWriteCloser, receiver io.ReadWriteCloser, size int, tell bool) int {
+	t.Helper()
+	src := t.TempDir()
+	name := writeTestFile(t, src, "f", bytes.Repeat([]byte("x"), size))
+	errc := make(chan error, 1)
+	go func() {
+		errc <- sendFiles(sender, []string{name}, io.Discard, sendOptions{ackTimeout: time.Second})
+		sender.Close()
+	}()
+	defer receiver.Close()
+
+	h, err := readHeader(receiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.ChunkSizes {
+		t.Fatal("sender didn't ask for the chunk size")
+	}
+	if tell {
+		if err := writeChunkSize(receiver); err != nil {
+			t.Fatal(err)
+		}
+	}
+	biggest, got := 0, 0
+	buf := make([]byte, maxChunkSize+1)
+	for got < h.Size {
+		n, err := receiver.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > biggest {
+			biggest = n
+		}
+		got += n
+	}
+	if err := writeControl(receiver, controlAck); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	return biggest
+}
+
+func TestChunkSize(t *testing.T) {
+	// Big enough that the sender has long heard from the receiver before
+	// the last messages go out.
+	size := 16 * maxChunkSize
+
+	// Receivers that don't say they take bigger messages, like older
+	// versions and the web client, get the usual ones.
+	sender, receiver := msgPipe()
+	if got := biggestMessage(t, sender, receiver, size, false); got != msgChunkSize {
+		t.Errorf("got %d byte messages want %d", got, msgChunkSize)
+	}
+
+	// The first messages may be sent before the receiver said.
+	sender, receiver = msgPipe()
+	if got := biggestMessage(t, sender, receiver, size, true); got != maxChunkSize {
+		t.Errorf("got %d byte messages want %d", got, maxChunkSize)
+	}
+
+	// Connections that can't send messages as big as the receiver takes
+	// send the biggest they can.
+	sender, receiver = msgPipe()
+	if got := biggestMessage(t, limitedConn{sender, 64 << 10}, receiver, size, true); got != 64<<10 {
+		t.Errorf("got %d byte messages want %d", got, 64<<10)
+	}
+}
+
+func TestChunkSizeBounds(t *testing.T) {
+	s := newChunkSize(limitedConn{max: 64 << 10})
+	for _, tt := range []struct{ set, want int }{
+		{0, msgChunkSize},
+		{-1, msgChunkSize},
+		{1 << 10, msgChunkSize},
+		{48 << 10, 48 << 10},
+		{1 << 30, 64 << 10},
+	} {
+		s.set(tt.set)
+		if got := s.get(); got != tt.want {
+			t.Errorf("set(%d): got %d want %d", tt.set, got, tt.want)
+		}
+	}
+}
+
+func benchmarkChunkSize(b *testing.B, max int) {
+	src := b.TempDir()
+	content := bytes.Repeat([]byte("x"), 16<<20)
+	name := filepath.Join(src, "f")
+	if err := os.WriteFile(name, content, 0644); err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(content)))
+	for i := 0; i < b.N; i++ {
+		sender, receiver := msgPipe()
+		errc := make(chan error, 1)
+		go func() {
+			errc <- sendFiles(limitedConn{sender, max}, []string{name}, io.Discard, sendOptions{ackTimeout: time.Second})
+			sender.Close()
+		}()
+		if _, err := receiveFiles(receiver, &dirDestination{dir: b.TempDir()}, io.Discard, nil, nil, nil); err != nil {
+			b.Fatal(err)
+		}
+		receiver.Close()
+		if err := <-errc; err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkChunkSize32K(b *testing.B)  { benchmarkChunkSize(b, msgChunkSize) }
+func BenchmarkChunkSize64K(b *testing.B)  { benchmarkChunkSize(b, 64<<10) }
+func BenchmarkChunkSize256K(b *testing.B) { benchmarkChunkSize(b, maxChunkSize) }
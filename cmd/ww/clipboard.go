@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// errNoClipboard is returned by copyToClipboard when there is no clipboard
+// to copy to, e.g. over ssh or in a container.
+var errNoClipboard = errors.New("no clipboard found; install pbcopy, wl-copy, xclip or xsel, or run under a desktop session")
+
+// clipboardCommands returns the commands that can copy their stdin to the
+// system clipboard here, in order of preference. On Linux and the BSDs
+// they need a graphical session to copy to.
+func clipboardCommands() [][]string {
+	switch runtime.GOOS {
+	case "darwin":
+		return [][]string{{"pbcopy"}}
+	case "windows":
+		return [][]string{{"clip"}}
+	}
+	var cmds [][]string
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		cmds = append(cmds, []string{"wl-copy"})
+	}
+	if os.Getenv("DISPLAY") != "" {
+		cmds = append(cmds,
+			[]string{"xclip", "-selection", "clipboard"},
+			[]string{"xsel", "--clipboard", "--input"},
+		)
+	}
+	return cmds
+}
+
+// copyToClipboard copies text to the system clipboard with the first of
+// clipboardCommands that is installed.
+func copyToClipboard(text string) error {
+	for _, args := range clipboardCommands() {
+		path, err := exec.LookPath(args[0])
+		if err != nil {
+			continue
+		}
+		// Not capturing output, which xclip and wl-copy would hold open
+		// from the process they leave behind to serve the clipboard.
+		cmd := exec.Command(path, args[1:]...)
+		cmd.Stdin = strings.NewReader(text)
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s: %v", args[0], err)
+		}
+		return nil
+	}
+	return errNoClipboard
+}
+
+// copyCode copies code to the clipboard for -clipboard, saying whether it
+// did. Not having a clipboard is only worth a warning, since the code is
+// printed anyway.
+func copyCode(code string) {
+	if err := copyToClipboard(code); err != nil {
+		fmt.Fprintf(stderr, "could not copy the code to the clipboard: %v\n", err)
+		return
+	}
+	fmt.Fprintf(stderr, "copied the code to the clipboard\n")
+}
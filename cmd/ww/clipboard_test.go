@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestCopyCodeNoClipboard(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	t.Setenv("DISPLAY", ":0")
+	t.Setenv("WAYLAND_DISPLAY", "wayland-0")
+	var buf bytes.Buffer
+	defer func(w io.Writer) { stderr = w }(stderr)
+	stderr = &buf
+	copyCode("7-aloe-aloft")
+	if !strings.HasPrefix(buf.String(), "could not copy the code to the clipboard: ") {
+		t.Errorf("got %q", buf.String())
+	}
+}
+
+func TestCopyToClipboard(t *testing.T) {
+	if runtime.GOOS == "darwin" || runtime.GOOS == "windows" {
+		t.Skip("uses a fake xclip")
+	}
+	dir := t.TempDir()
+	got := filepath.Join(dir, "clipboard")
+	xclip := "#!/bin/sh\ncat > " + got + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "xclip"), []byte(xclip), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("WAYLAND_DISPLAY", "")
+
+	// Headless, there is no clipboard even with xclip installed.
+	t.Setenv("DISPLAY", "")
+	if err := copyToClipboard("7-aloe-aloft"); err != errNoClipboard {
+		t.Errorf("got %v want %v", err, errNoClipboard)
+	}
+
+	t.Setenv("DISPLAY", ":0")
+	if err := copyToClipboard("7-aloe-aloft"); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(got); err != nil || string(b) != "7-aloe-aloft" {
+		t.Errorf("got %q, %v on the clipboard", b, err)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"webwormhole.io/wordlist"
+)
+
+func convert(args ...string) {
+	set := flag.NewFlagSet(args[0], flag.ExitOnError)
+	set.Usage = func() {
+		fmt.Fprintf(set.Output(), "write a code in another encoding, e.g. to read it out as words or type it as numbers\n\n")
+		fmt.Fprintf(set.Output(), "usage: %s %s code encoding\n\n", os.Args[0], args[0])
+		fmt.Fprintf(set.Output(), "encodings: %s\n", strings.Join(encodingNames(), ", "))
+		fmt.Fprintf(set.Output(), "\nflags:\n")
+		set.PrintDefaults()
+	}
+	set.Parse(args[1:])
+
+	if set.NArg() != 2 {
+		set.Usage()
+		os.Exit(2)
+	}
+	code, err := convertCode(set.Arg(0), set.Arg(1))
+	if err != nil {
+		fatalf("%v", err)
+	}
+	fmt.Println(code)
+}
+
+// convertCode returns code, in whichever encoding, in the named one.
+func convertCode(code, encoding string) (string, error) {
+	slot, pass, _ := wordlist.DecodeVerbose(code)
+	if pass == nil {
+		return "", fmt.Errorf("%q is not a valid code", code)
+	}
+	converted, ok := wordlist.EncodeWith(encoding, slot, pass)
+	if !ok {
+		return "", fmt.Errorf("unknown encoding %q, use one of %s", encoding, strings.Join(encodingNames(), ", "))
+	}
+	return converted, nil
+}
+
+// encodingNames returns the names of the encodings codes can be written in.
+func encodingNames() []string {
+	var names []string
+	for _, enc := range wordlist.Encodings() {
+		names = append(names, enc.Name)
+	}
+	return names
+}
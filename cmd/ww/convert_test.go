@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"webwormhole.io/wordlist"
+)
+
+func TestConvertCode(t *testing.T) {
+	pass := []byte{1, 2, 3, 200}
+	for _, from := range wordlist.Encodings() {
+		code, _ := wordlist.EncodeWith(from.Name, 1234, pass)
+		for _, to := range wordlist.Encodings() {
+			converted, err := convertCode(code, to.Name)
+			if err != nil {
+				t.Fatalf("%s to %s: %v", from.Name, to.Name, err)
+			}
+			slot, got, name := wordlist.DecodeVerbose(converted)
+			if slot != 1234 || !bytes.Equal(got, pass) || name != to.Name {
+				t.Errorf("%s to %s: got %q, which is %d %v in %s", from.Name, to.Name, converted, slot, got, name)
+			}
+		}
+	}
+
+	if _, err := convertCode("not a code", "octal"); err == nil {
+		t.Error("converted an invalid code")
+	}
+	if _, err := convertCode(wordlist.Encode(1, pass), "klingon"); err == nil {
+		t.Error("converted to an unknown encoding")
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"webwormhole.io/wormhole"
+)
+
+// errDeadline is returned when a transfer is aborted for taking too long.
+var errDeadline = errors.New("transfer did not finish before the deadline")
+
+// withDeadline gives transfer, which runs over c, until deadline to finish.
+// If it takes longer, c is closed, which makes the transfer fail and clean
+// up after itself like it would if the peer hung up, removing partially
+// received files. It returns errDeadline if the transfer was aborted. A zero
+// deadline means no limit.
+func withDeadline(deadline time.Duration, c io.Closer, transfer func() error) error {
+	if deadline <= 0 {
+		return transfer()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), deadline)
+	defer cancel()
+	aborted := make(chan bool, 1)
+	go func() {
+		<-ctx.Done()
+		if ctx.Err() == context.DeadlineExceeded {
+			c.Close()
+			aborted <- true
+			return
+		}
+		aborted <- false
+	}()
+	err := transfer()
+	cancel()
+	if <-aborted && err != nil {
+		return errDeadline
+	}
+	return err
+}
+
+// errStalled is returned when a transfer is aborted for making no progress.
+var errStalled = errors.New("transfer stalled, nothing was sent or received for too long")
+
+// A watchdog aborts a transfer that goes too long without sending or
+// receiving anything, like when the peer or the network is stuck without
+// hanging up. Unlike withDeadline, it doesn't mind how long the transfer
+// takes as long as it keeps going. Only reads and writes over connections
+// returned by watch count.
+type watchdog struct {
+	timeout time.Duration
+	paused  func() bool  // Whether the transfer is paused, so not stalled.
+	last    atomic.Int64 // When anything was last read or written, in Unix nanoseconds.
+	holds   atomic.Int32 // How many calls to hold are in progress.
+}
+
+// newWatchdog returns a watchdog for transfers that are stalled if they make
+// no progress for timeout while paused, which may be nil, returns false. A
+// zero timeout means transfers never stall.
+func newWatchdog(timeout time.Duration, paused func() bool) *watchdog {
+	d := &watchdog{timeout: timeout, paused: paused}
+	d.kick()
+	return d
+}
+
+func (d *watchdog) kick() {
+	d.last.Store(time.Now().UnixNano())
+}
+
+// stalled reports whether nothing has been read or written for longer than
+// the timeout, not counting time spent paused or holding.
+func (d *watchdog) stalled(now time.Time) bool {
+	if d.holds.Load() > 0 || d.paused != nil && d.paused() {
+		d.kick()
+		return false
+	}
+	return now.UnixNano()-d.last.Load() > int64(d.timeout)
+}
+
+// hold runs f, which is expected to make no progress for a while, like
+// asking the user something, without that counting as a stall.
+func (d *watchdog) hold(f func() error) error {
+	d.holds.Add(1)
+	defer func() {
+		d.kick()
+		d.holds.Add(-1)
+	}()
+	return f()
+}
+
+// run runs transfer, which runs over c, for as long as it keeps making
+// progress. If it stalls, c is closed, which makes the transfer fail and
+// clean up after itself as with withDeadline. It returns errStalled if the
+// transfer was aborted.
+func (d *watchdog) run(c io.Closer, transfer func() error) error {
+	if d.timeout <= 0 {
+		return transfer()
+	}
+	d.kick()
+	done := make(chan struct{})
+	aborted := make(chan bool, 1)
+	go func() {
+		// Check a few times a timeout so stalls are caught not long after.
+		tick := time.NewTicker(d.timeout / 4)
+		defer tick.Stop()
+		for {
+			select {
+			case <-done:
+				aborted <- false
+				return
+			case now := <-tick.C:
+				if d.stalled(now) {
+					c.Close()
+					aborted <- true
+					return
+				}
+			}
+		}
+	}()
+	err := transfer()
+	close(done)
+	if <-aborted && err != nil {
+		return errStalled
+	}
+	return err
+}
+
+// watch returns c such that reading or writing anything over it counts as
+// progress. Wormholes stay Wormholes, keeping the methods transfers look
+// for, like MaxMessageSize.
+func (d *watchdog) watch(c io.ReadWriteCloser) io.ReadWriteCloser {
+	if w, ok := c.(*wormhole.Wormhole); ok {
+		return &watchedWormhole{w, d}
+	}
+	return &watchedConn{c, d}
+}
+
+// opener wraps open so the channels it opens are watched too.
+func (d *watchdog) opener(open opener) opener {
+	if open == nil {
+		return nil
+	}
+	return func(id uint16) (io.ReadWriteCloser, error) {
+		c, err := open(id)
+		if err != nil {
+			return nil, err
+		}
+		return d.watch(c), nil
+	}
+}
+
+type watchedWormhole struct {
+	*wormhole.Wormhole
+	d *watchdog
+}
+
+func (c *watchedWormhole) Read(p []byte) (int, error) {
+	n, err := c.Wormhole.Read(p)
+	if n > 0 {
+		c.d.kick()
+	}
+	return n, err
+}
+
+func (c *watchedWormhole) Write(p []byte) (int, error) {
+	n, err := c.Wormhole.Write(p)
+	if n > 0 {
+		c.d.kick()
+	}
+	return n, err
+}
+
+type watchedConn struct {
+	io.ReadWriteCloser
+	d *watchdog
+}
+
+func (c *watchedConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	if n > 0 {
+		c.d.kick()
+	}
+	return n, err
+}
+
+func (c *watchedConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	if n > 0 {
+		c.d.kick()
+	}
+	return n, err
+}
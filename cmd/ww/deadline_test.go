@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"webwormhole.io/wormhole"
+)
+
+func TestDeadline(t *testing.T) {
+	dst := t.TempDir()
+	sender, receiver := msgPipe()
+	defer sender.Close()
+	go func() {
+		// Send half of a file, then stall.
+		writeHeader(sender, header{Name: "slow", Size: 2 << 10}, false)
+		sender.Write(bytes.Repeat([]byte("a"), 1<<10))
+	}()
+
+	start := time.Now()
+	err := withDeadline(100*time.Millisecond, receiver, func() error {
+		_, err := receiveFiles(receiver, &dirDestination{dir: dst}, io.Discard, nil, nil, nil)
+		return err
+	})
+	if err != errDeadline {
+		t.Errorf("got %v want %v", err, errDeadline)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("aborted after %v", d)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "slow")); !os.IsNotExist(err) {
+		t.Errorf("partial file left behind: %v", err)
+	}
+
+	// Transfers that finish in time aren't affected.
+	src := t.TempDir()
+	a := writeTestFile(t, src, "a.txt", []byte("hello"))
+	sender, receiver = msgPipe()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- withDeadline(5*time.Second, sender, func() error {
+			return sendFiles(sender, []string{a}, io.Discard, sendOptions{ackTimeout: time.Second})
+		})
+		sender.Close()
+	}()
+	err = withDeadline(5*time.Second, receiver, func() error {
+		_, err := receiveFiles(receiver, &dirDestination{dir: dst}, io.Discard, nil, nil, nil)
+		return err
+	})
+	receiver.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dst, "a.txt")); string(got) != "hello" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestStallTimeout(t *testing.T) {
+	dst := t.TempDir()
+	sender, receiver := msgPipe()
+	defer sender.Close()
+	go func() {
+		// Send half of a file, then stall.
+		writeHeader(sender, header{Name: "stuck", Size: 2 << 10}, false)
+		sender.Write(bytes.Repeat([]byte("a"), 1<<10))
+	}()
+
+	dog := newWatchdog(100*time.Millisecond, nil)
+	start := time.Now()
+	err := dog.run(receiver, func() error {
+		_, err := receiveFiles(dog.watch(receiver), &dirDestination{dir: dst}, io.Discard, nil, nil, nil)
+		return err
+	})
+	if err != errStalled {
+		t.Errorf("got %v want %v", err, errStalled)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("aborted after %v", d)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "stuck")); !os.IsNotExist(err) {
+		t.Errorf("partial file left behind: %v", err)
+	}
+}
+
+func TestStallTimeoutSlow(t *testing.T) {
+	// A transfer that takes longer than the timeout but keeps going isn't
+	// stalled.
+	dst := t.TempDir()
+	sender, receiver := msgPipe()
+	go func() {
+		writeHeader(sender, header{Name: "slow", Size: 8, Ack: true}, false)
+		for i := 0; i < 8; i++ {
+			time.Sleep(25 * time.Millisecond)
+			sender.Write([]byte("a"))
+		}
+		// Take the receiver's ack before hanging up.
+		sender.Read(make([]byte, 512))
+		sender.Close()
+	}()
+
+	dog := newWatchdog(100*time.Millisecond, nil)
+	err := dog.run(receiver, func() error {
+		c := dog.watch(receiver)
+		_, err := receiveFiles(c, &dirDestination{dir: dst}, io.Discard, nil, nil, nil)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dst, "slow")); string(got) != "aaaaaaaa" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestStallTimeoutPaused(t *testing.T) {
+	var paused atomic.Bool
+	paused.Store(true)
+	dog := newWatchdog(20*time.Millisecond, paused.Load)
+	_, c := msgPipe()
+	err := dog.run(c, func() error {
+		time.Sleep(100 * time.Millisecond)
+		paused.Store(false)
+		return dog.hold(func() error {
+			time.Sleep(100 * time.Millisecond)
+			return nil
+		})
+	})
+	if err != nil {
+		t.Errorf("stalled while paused or holding: %v", err)
+	}
+}
+
+func TestWatchKeepsMethods(t *testing.T) {
+	c := newWatchdog(time.Second, nil).watch(&wormhole.Wormhole{})
+	if _, ok := c.(interface{ MaxMessageSize() int }); !ok {
+		t.Error("watched wormhole lost MaxMessageSize")
+	}
+}
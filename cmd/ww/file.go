@@ -1,24 +1,1057 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
 	// msgChunkSize is the maximum size of a WebRTC DataChannel message.
 	// 64k is okay for most modern browsers, 32 is conservative.
 	msgChunkSize = 32 << 10
+
+	// maxChunkSize is the largest message of file data we can receive.
+	// Senders only send messages bigger than msgChunkSize to receivers that
+	// say they can take them. See chunkSize.
+	maxChunkSize = 256 << 10
 )
 
 type header struct {
-	Name string `json:"name",omitempty`
-	Size int    `json:"size",omitempty`
-	Type string `json:"type",omitempty`
+	Name string `json:"name"`
+	Size int    `json:"size"`
+	Type string `json:"type"`
+
+	// Ack asks the receiver to acknowledge the file once it has saved it.
+	Ack bool `json:"ack,omitempty"`
+
+	// Offsets indicates every message of the file's data is prefixed with
+	// its offset in the file, counting from Offset if it is resumed. See
+	// sendChunks.
+	Offsets bool `json:"offsets,omitempty"`
+
+	// ChunkSizes means the sender can send data in messages bigger than
+	// msgChunkSize if the receiver answers with a chunksize control saying
+	// how big a message it can take.
+	ChunkSizes bool `json:"chunksizes,omitempty"`
+
+	// SHA256, if set, is the hex SHA-256 of the file's data. The sender
+	// waits for a skip or send control before sending the data, so
+	// receivers that already have the file can skip it. The web client
+	// doesn't understand it.
+	SHA256 string `json:"sha256,omitempty"`
+
+	// Offset, if set, means the data sent starts this far into the file,
+	// because the receiver said it has the rest in a partial control. The
+	// sender sends the header again with it after the control.
+	Offset int64 `json:"offset,omitempty"`
+
+	// Unsized means the sender doesn't know how big the file is, so
+	// instead of stopping after Size bytes its data ends with an empty
+	// message. The web client doesn't understand it.
+	Unsized bool `json:"unsized,omitempty"`
+
+	// Sparse means the file has holes, and only the rest of it, Data bytes
+	// in all, is sent: in order, each message prefixed with its offset as
+	// with Offsets. The receiver makes the holes again. The web client
+	// doesn't understand it. See sparse.
+	Sparse bool  `json:"sparse,omitempty"`
+	Data   int64 `json:"data,omitempty"`
+
+	// Bundle means the file is a tar archive of many small files sent
+	// together, which the receiver saves one by one as if they were sent
+	// on their own. The web client saves the archive. See bundleSource.
+	Bundle bool `json:"bundle,omitempty"`
+
+	// Streams, if set, means this is not a file but an offer to send the
+	// rest of the files over this many channels. See sendParallel.
+	Streams int `json:"streams,omitempty"`
+
+	// Files and Total, if set, mean this is not a file but an offer of this
+	// many files of this many bytes in all, which the receiver accepts or
+	// declines before any are sent. See offerFiles.
+	Files int   `json:"files,omitempty"`
+	Total int64 `json:"total,omitempty"`
+}
+
+// control is a message sent by the receiver back to the sender. Senders
+// that don't understand it (like the web client) will ignore it.
+type control struct {
+	Control string `json:"control"`
+
+	// Reason says why the receiver declined, or could not save a file.
+	Reason string `json:"reason,omitempty"`
+
+	// Size is the largest message the receiver can take, for chunksize
+	// controls.
+	Size int `json:"size,omitempty"`
+
+	// Offset and SHA256 are how much of a file the receiver already has
+	// and its checksum, for partial controls.
+	Offset int64  `json:"offset,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+const (
+	// controlDecline tells the sender the receiver does not want the files,
+	// e.g. because it was only listing them.
+	controlDecline = "decline"
+
+	// controlAck tells the sender a file was received and saved in full.
+	controlAck = "ack"
+
+	// controlFailed tells the sender a file was received but could not be
+	// saved.
+	controlFailed = "failed"
+
+	// controlPause and controlResume ask the sender to stop sending data
+	// for now, and to carry on.
+	controlPause  = "pause"
+	controlResume = "resume"
+
+	// controlStreams tells the sender the receiver has opened the channels
+	// it offered to send files over.
+	controlStreams = "streams"
+
+	// controlAccept tells the sender the receiver wants the files it
+	// offered.
+	controlAccept = "accept"
+
+	// controlChunkSize tells a sender that asked how big a message of file
+	// data the receiver can take.
+	controlChunkSize = "chunksize"
+
+	// controlChecking is sent as soon as a header with a checksum is
+	// read, before looking for the file, so the sender knows an answer is
+	// coming. Receivers that don't know checksums never send it.
+	controlChecking = "checking"
+
+	// controlSkip and controlSend answer a header with a checksum, telling
+	// the sender the receiver already has the file, or that it doesn't.
+	controlSkip = "skip"
+	controlSend = "send"
+
+	// controlPartial answers a header with a checksum, telling the sender
+	// the receiver has the start of the file from an earlier transfer. The
+	// sender sends the header again with the offset to send from.
+	controlPartial = "partial"
+)
+
+var (
+	// errDeclined is returned by sendFiles when the receiver declined the transfer.
+	errDeclined = errors.New("receiver declined the transfer")
+
+	// errNoAck is returned by sendFiles when the receiver did not acknowledge
+	// every file it was sent.
+	errNoAck = errors.New("receiver did not confirm receiving all files")
+
+	// errNoChecksums is returned by sendFiles when the receiver did not
+	// answer a file's checksum, most likely because it is too old for it.
+	errNoChecksums = errors.New("receiver did not answer the file's checksum, it may not support -checksum")
+)
+
+const (
+	// maxHeaderSize is the largest file header we accept.
+	maxHeaderSize = 4 << 10
+
+	// headerTag starts a framed header, followed by the length of the
+	// header as a big-endian uint16 and then the header itself. Plain
+	// headers, which the web client sends, always start with '{'.
+	headerTag       = 0x00
+	headerFrameSize = 3
+)
+
+var errBadHeader = errors.New("malformed file header")
+
+// writeHeader sends h to c, framed if asked to.
+func writeHeader(c io.Writer, h header, framed bool) error {
+	buf, err := json.Marshal(h)
+	if err != nil {
+		return fmt.Errorf("failed to marshal json: %v", err)
+	}
+	if framed {
+		if len(buf) > maxHeaderSize {
+			return fmt.Errorf("file header too long (%d bytes)", len(buf))
+		}
+		frame := []byte{headerTag, 0, 0}
+		binary.BigEndian.PutUint16(frame[1:], uint16(len(buf)))
+		buf = append(frame, buf...)
+	}
+	_, err = c.Write(buf)
+	return err
+}
+
+// readHeader reads a file header from c, framed or not. It must be a whole
+// message of its own, no longer than maxHeaderSize.
+func readHeader(c io.Reader) (h header, err error) {
+	buf := make([]byte, headerFrameSize+maxHeaderSize+1)
+	n, err := c.Read(buf)
+	if err != nil {
+		return h, err
+	}
+	if n == len(buf) {
+		return h, fmt.Errorf("%w: longer than %d bytes", errBadHeader, maxHeaderSize)
+	}
+	p := buf[:n]
+	if n > 0 && p[0] == headerTag {
+		if n < headerFrameSize || int(binary.BigEndian.Uint16(p[1:])) != n-headerFrameSize {
+			return h, fmt.Errorf("%w: bad frame length", errBadHeader)
+		}
+		p = p[headerFrameSize:]
+	}
+	if len(p) > maxHeaderSize {
+		return h, fmt.Errorf("%w: longer than %d bytes", errBadHeader, maxHeaderSize)
+	}
+	err = json.Unmarshal(p, &h)
+	if err != nil {
+		return h, fmt.Errorf("%w: %v", errBadHeader, err)
+	}
+	if h.Size < 0 || h.Streams < 0 || h.Files < 0 || h.Total < 0 || h.Streams == 0 && h.Files == 0 && h.Name == "" {
+		return h, fmt.Errorf("%w: no name or negative size", errBadHeader)
+	}
+	if h.Unsized && h.Offsets {
+		return h, fmt.Errorf("%w: unsized file with offsets", errBadHeader)
+	}
+	if b, err := hex.DecodeString(h.SHA256); h.SHA256 != "" && (err != nil || len(b) != sha256.Size) {
+		return h, fmt.Errorf("%w: bad checksum", errBadHeader)
+	}
+	if h.Offset < 0 || h.Offset > int64(h.Size) || h.Offset > 0 && (h.SHA256 == "" || h.Unsized) {
+		return h, fmt.Errorf("%w: bad offset", errBadHeader)
+	}
+	if h.Data < 0 || h.Data > int64(h.Size) || h.Data > 0 && !h.Sparse || h.Sparse && (h.Unsized || h.Offsets || h.Offset > 0) {
+		return h, fmt.Errorf("%w: bad sparse file", errBadHeader)
+	}
+	return h, nil
+}
+
+// writeControl sends a control message to the sender.
+func writeControl(c io.Writer, kind string) error {
+	buf, err := json.Marshal(control{Control: kind})
+	if err != nil {
+		return err
+	}
+	_, err = c.Write(buf)
+	return err
+}
+
+// writeDecline tells the sender the transfer is declined, and why.
+func writeDecline(c io.Writer, reason string) error {
+	return writeReason(c, controlDecline, reason)
+}
+
+// writeReason sends a control of kind saying why to c.
+func writeReason(c io.Writer, kind, reason string) error {
+	buf, err := json.Marshal(control{Control: kind, Reason: reason})
+	if err != nil {
+		return err
+	}
+	_, err = c.Write(buf)
+	return err
+}
+
+// writeChunkSize tells the sender the receiver takes messages of file data
+// of up to maxChunkSize bytes.
+func writeChunkSize(c io.Writer) error {
+	buf, err := json.Marshal(control{Control: controlChunkSize, Size: maxChunkSize})
+	if err != nil {
+		return err
+	}
+	_, err = c.Write(buf)
+	return err
+}
+
+// readControls reads control messages from c until it fails. It closes
+// declined if the receiver declines the transfer, sends on acks the ack or
+// failure for each file, sends on answers the answer to each file with a
+// checksum, pauses and resumes pause, and sets size, as asked.
+func readControls(c io.Reader, declined chan struct{}, acks chan control, answers chan control, pause *gate, size *chunkSize) {
+	buf := make([]byte, 1<<10)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return
+		}
+		var m control
+		if json.Unmarshal(buf[:n], &m) != nil {
+			continue
+		}
+		switch m.Control {
+		case controlDecline:
+			close(declined)
+			return
+		case controlAck, controlFailed:
+			select {
+			case acks <- m:
+			default:
+			}
+		case controlChecking, controlSkip, controlSend, controlPartial:
+			select {
+			case answers <- m:
+			default:
+			}
+		case controlPause:
+			pause.Pause()
+		case controlResume:
+			pause.Resume()
+		case controlChunkSize:
+			size.set(m.Size)
+		}
+	}
+}
+
+// listFiles prints the name and size of every file sent over c to out, and
+// writes none of them. An offer only says how many files there are and how
+// big they are in all, which is printed instead, and the offer declined.
+// Otherwise the sender only sends the next header once the file before it is
+// sent, so each file's data is read and dropped, unless it has a checksum,
+// which lets the sender skip it. Parallel transfers are declined, since
+// their files come over other channels.
+func listFiles(c io.ReadWriter, out io.Writer) error {
+	for {
+		h, err := readHeader(c)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch {
+		case h.Files > 0:
+			fmt.Fprintf(out, "%d files\t%d\n", h.Files, h.Total)
+			return writeControl(c, controlDecline)
+		case h.Streams > 0:
+			return writeControl(c, controlDecline)
+		case h.Unsized:
+			fmt.Fprintf(out, "%s\t?\n", h.Name)
+		default:
+			fmt.Fprintf(out, "%s\t%d\n", h.Name, h.Size)
+		}
+		if h.SHA256 != "" {
+			if err := writeControl(c, controlSkip); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := receiveFile(c, discard{}, h); err != nil {
+			return err
+		}
+		if h.Ack {
+			// Not an ack, since nothing was saved, but not a decline
+			// either, so the sender goes on to the next file.
+			if err := writeReason(c, controlFailed, "receiver is only listing files"); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// discard is a destination that drops every file.
+type discard struct{}
+
+func (discard) create(h header) (io.WriterAt, func() error, func(), error) {
+	return discard{}, nil, nil, nil
+}
+
+func (discard) WriteAt(p []byte, off int64) (int, error) {
+	return len(p), nil
+}
+
+// fileResult is the outcome of receiving a file.
+type fileResult struct {
+	name string
+	err  error
+}
+
+// saver is an io.WriterAt that remembers the first error writing to w and
+// drops everything after it, so the rest of a file can still be read off
+// the connection and the next one received.
+type saver struct {
+	w   io.WriterAt
+	err error
+}
+
+func (s *saver) WriteAt(p []byte, off int64) (int, error) {
+	if s.err == nil {
+		_, s.err = s.w.WriteAt(p, off)
+	}
+	return len(p), nil
+}
+
+func (s *saver) Truncate(size int64) error {
+	if t, ok := s.w.(interface{ Truncate(int64) error }); ok && s.err == nil {
+		return t.Truncate(size)
+	}
+	return nil
+}
+
+// appender is an io.WriterAt that writes at offsets relative to the end a
+// file had when it was opened.
+type appender struct {
+	f    *os.File
+	base int64
+}
+
+func (a *appender) WriteAt(p []byte, off int64) (int, error) {
+	return a.f.WriteAt(p, a.base+off)
+}
+
+func (a *appender) Truncate(size int64) error {
+	return a.f.Truncate(a.base + size)
+}
+
+// openFile opens path to receive a file into. If appendFile is set, the file
+// is created if needed and written after its existing content. undo reverts
+// what receiving into the file did.
+func openFile(path string, appendFile bool) (w io.WriterAt, f *os.File, undo func(), err error) {
+	if !appendFile {
+		f, err = os.Create(path)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return f, f, func() { os.Remove(path) }, nil
+	}
+
+	_, err = os.Stat(path)
+	existed := err == nil
+	// Not O_APPEND: writes need offsets, since chunks can arrive in any order.
+	f, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, nil, err
+	}
+	base := info.Size()
+	undo = func() {
+		if existed {
+			os.Truncate(path, base)
+		} else {
+			os.Remove(path)
+		}
+	}
+	return &appender{f, base}, f, undo, nil
+}
+
+// A destination is where received files are saved.
+type destination interface {
+	// create opens somewhere to save the file described by h. Calling
+	// close finishes saving it, and undo reverts whatever was saved of it.
+	create(h header) (w io.WriterAt, close func() error, undo func(), err error)
+}
+
+// dirDestination saves files by name into dir, appending to any existing
+// file of the same name if append is set, or replacing it if not. If resume
+// is set, files with checksums are kept as they arrive, see createPart.
+type dirDestination struct {
+	dir    string
+	append bool
+	resume bool
+}
+
+func (d *dirDestination) create(h header) (io.WriterAt, func() error, func(), error) {
+	if d.resume && h.SHA256 != "" {
+		return d.createPart(h)
+	}
+	if h.Offset > 0 {
+		return nil, nil, nil, errors.New("sender resumed a file that was not asked for")
+	}
+	path := d.path(h)
+	w, f, undo, err := openFile(path, d.append)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return w, f.Close, undo, nil
+}
+
+// has reports whether the file described by h is already in dir with the
+// same size and checksum. Files are never skipped when appending.
+func (d *dirDestination) has(h header) bool {
+	if d.append || h.SHA256 == "" {
+		return false
+	}
+	info, err := os.Stat(d.path(h))
+	if err != nil || !info.Mode().IsRegular() || info.Size() != int64(h.Size) {
+		return false
+	}
+	sum, err := fileSHA256(d.path(h))
+	return err == nil && sum == h.SHA256
+}
+
+// path is where the file described by h is saved.
+func (d *dirDestination) path(h header) string {
+	return filepath.Join(d.dir, filepath.Clean("/"+h.Name))
+}
+
+// A haver is a destination that can tell whether it already has a file, so
+// the sender can skip sending it.
+type haver interface {
+	// has reports whether the file described by h, which has a checksum,
+	// is already saved.
+	has(h header) bool
+}
+
+// answerChecksum tells the sender of the file described by h whether to
+// send it, skipping it if dest already has it, or asking for the rest if
+// dest has the start of it. It reports whether the file was skipped, and
+// returns the header of the data that follows if not.
+func answerChecksum(c io.ReadWriter, dest destination, h header) (header, bool, error) {
+	if err := writeControl(c, controlChecking); err != nil {
+		return h, false, fmt.Errorf("could not answer checksum: %v", err)
+	}
+	if d, ok := dest.(haver); ok && d.has(h) {
+		if err := writeControl(c, controlSkip); err != nil {
+			return h, false, fmt.Errorf("could not answer checksum: %v", err)
+		}
+		return h, true, nil
+	}
+	if d, ok := dest.(partialer); ok {
+		if n, sum := d.partial(h); n > 0 {
+			return resumeFile(c, h, n, sum)
+		}
+	}
+	if err := writeControl(c, controlSend); err != nil {
+		return h, false, fmt.Errorf("could not answer checksum: %v", err)
+	}
+	return h, false, nil
+}
+
+// receiveFile saves the file described by h to dest. saveErr is set if the
+// file could not be saved, in which case its data is still read from c.
+// streamErr is set if reading from c failed and no more files can be
+// received. Partially saved files are undone.
+func receiveFile(c io.Reader, dest destination, h header) (saveErr, streamErr error) {
+	s := &saver{}
+	w, closef, undo, err := dest.create(h)
+	if err != nil {
+		s.err = fmt.Errorf("could not create output file: %v", err)
+	} else {
+		s.w = w
+	}
+
+	switch {
+	case h.Unsized:
+		_, streamErr = receiveUnsized(s, c)
+	case h.Sparse:
+		// Leave the holes to dest if it can make them.
+		var sw io.WriterAt = s
+		if _, ok := w.(interface{ Truncate(int64) error }); !ok {
+			sw = struct{ io.WriterAt }{s}
+		}
+		var written int64
+		written, streamErr = receiveSparse(sw, c, int64(h.Size), h.Data)
+		if streamErr == nil && written != h.Data {
+			streamErr = fmt.Errorf("EOF before receiving all bytes: (%d/%d)", written, h.Data)
+		}
+	default:
+		var written int64
+		size := int64(h.Size) - h.Offset
+		written, streamErr = receiveAt(s, c, size, h.Offsets)
+		if streamErr == nil && written != size {
+			streamErr = fmt.Errorf("EOF before receiving all bytes: (%d/%d)", written, size)
+		}
+	}
+	if closef == nil {
+		return s.err, streamErr
+	}
+	err = closef()
+	if s.err == nil && err != nil {
+		s.err = fmt.Errorf("could not save file: %v", err)
+	}
+	if s.err != nil || streamErr != nil {
+		undo()
+	}
+	return s.err, streamErr
+}
+
+// An acceptor decides whether to take an offer of files, returning why not
+// if it doesn't. See offerFiles.
+type acceptor func(files int, total int64) error
+
+// checkSpace returns an error if dir is on a filesystem without room for
+// total more bytes. It assumes there is room if it can't tell.
+func checkSpace(dir string, total int64) error {
+	free, err := freeSpace(dir)
+	if err != nil {
+		return nil
+	}
+	if total > free {
+		return fmt.Errorf("not enough space in %s: need %d bytes, have %d", dir, total, free)
+	}
+	return nil
+}
+
+// acceptFiles answers the offer of files described by h, accepting it
+// unless accept, if set, says otherwise.
+func acceptFiles(c io.Writer, h header, accept acceptor) error {
+	if accept != nil {
+		if err := accept(h.Files, h.Total); err != nil {
+			writeDecline(c, err.Error())
+			return fmt.Errorf("declined %d files (%d bytes): %v", h.Files, h.Total, err)
+		}
+	}
+	return writeControl(c, controlAccept)
+}
+
+// receiveFiles saves every file read from c to dest, printing progress to
+// out. Files that cannot be saved are skipped. If open is set, the sender
+// can send files over more channels opened with it. If the sender offers
+// the files first, accept decides whether to take them. If the sender goes
+// past limit, the transfer is declined and aborted. It returns the outcome
+// for each file, and an error if the transfer itself failed.
+func receiveFiles(c io.ReadWriter, dest destination, out io.Writer, open opener, accept acceptor, limit *limits) (results []fileResult, err error) {
+	// TODO append number to existing filenames?
+
+	toldSize := false
+	for {
+		h, err := readHeader(c)
+		if err == io.EOF {
+			return results, nil
+		}
+		if err != nil {
+			return results, fmt.Errorf("could not read file header: %v", err)
+		}
+		if err := limit.header(h); err != nil {
+			writeDecline(c, err.Error())
+			return results, err
+		}
+		if h.ChunkSizes && !toldSize {
+			if err := writeChunkSize(c); err != nil {
+				return results, fmt.Errorf("could not send chunk size: %v", err)
+			}
+			toldSize = true
+		}
+		if h.Files > 0 {
+			if err := acceptFiles(c, h, accept); err != nil {
+				return results, err
+			}
+			continue
+		}
+		if h.Streams > 0 {
+			mu := &sync.Mutex{}
+			wait, err := receiveStreams(c, open, h.Streams, dest, &lineWriter{mu: mu, w: out}, limit)
+			if err != nil {
+				return results, err
+			}
+			defer func() {
+				r, e := wait()
+				results = append(results, r...)
+				if err == nil {
+					err = e
+				}
+			}()
+			out = &lineWriter{mu: mu, w: out}
+			open = nil
+			continue
+		}
+
+		if h.SHA256 != "" {
+			var skip bool
+			h, skip, err = answerChecksum(c, dest, h)
+			if err != nil {
+				return results, err
+			}
+			if skip {
+				fmt.Fprintf(out, "skipping %v, already have it\n", h.Name)
+				results = append(results, fileResult{h.Name, nil})
+				continue
+			}
+		}
+
+		fmt.Fprintf(out, "receiving %v... ", h.Name)
+		d := dest
+		if h.Bundle {
+			d = &bundleDestination{dest, limit}
+		}
+		saveErr, streamErr := receiveFile(c, d, h)
+		if streamErr != nil {
+			fmt.Fprintf(out, "failed\n")
+			results = append(results, fileResult{h.Name, streamErr})
+			return results, fmt.Errorf("could not receive %s: %v", h.Name, streamErr)
+		}
+		results = append(results, fileResult{h.Name, saveErr})
+		if saveErr != nil {
+			fmt.Fprintf(out, "failed: %v\n", saveErr)
+		} else {
+			fmt.Fprintf(out, "done\n")
+		}
+		if h.Ack {
+			if saveErr != nil {
+				err = writeReason(c, controlFailed, saveErr.Error())
+			} else {
+				err = writeControl(c, controlAck)
+			}
+			if err != nil {
+				return results, fmt.Errorf("could not acknowledge file: %v", err)
+			}
+		}
+	}
+}
+
+// printSummary prints which of results failed to out, if any did or there
+// was more than one file.
+func printSummary(out io.Writer, results []fileResult) (failed int) {
+	for _, r := range results {
+		if r.err != nil {
+			failed++
+		}
+	}
+	if len(results) < 2 && failed == 0 {
+		return 0
+	}
+	fmt.Fprintf(out, "received %d of %d files\n", len(results)-failed, len(results))
+	for _, r := range results {
+		if r.err != nil {
+			fmt.Fprintf(out, "  %s: %v\n", r.name, r.err)
+		}
+	}
+	return failed
+}
+
+// offerFiles tells the receiver how many files and bytes are coming and
+// waits for it to accept them. Receivers that don't understand offers, like
+// the web client, take them for a file with no name and fail.
+func offerFiles(c io.ReadWriter, filenames []string, framed bool) error {
+	var total int64
+	for _, filename := range filenames {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return fmt.Errorf("could not stat file %s: %v", filename, err)
+		}
+		total += info.Size()
+	}
+	err := writeHeader(c, header{Files: len(filenames), Total: total}, framed)
+	if err != nil {
+		return fmt.Errorf("could not offer files: %v", err)
+	}
+	buf := make([]byte, 1<<10)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return fmt.Errorf("receiver did not answer offer: %v", err)
+		}
+		var m control
+		if json.Unmarshal(buf[:n], &m) != nil {
+			continue
+		}
+		switch m.Control {
+		case controlAccept:
+			return nil
+		case controlDecline:
+			if m.Reason != "" {
+				return fmt.Errorf("%w: %s", errDeclined, m.Reason)
+			}
+			return errDeclined
+		}
+	}
+}
+
+// A source opens something to send, returning its header and data.
+type source func() (header, io.ReadCloser, error)
+
+// fileSource returns a source for the named file.
+func fileSource(filename string) source {
+	return func() (header, io.ReadCloser, error) {
+		f, err := os.Open(filename)
+		if err != nil {
+			return header{}, nil, fmt.Errorf("could not open file %s: %v", filename, err)
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return header{}, nil, fmt.Errorf("could not stat file %s: %v", filename, err)
+		}
+		return header{
+			Name: filepath.Base(filepath.Clean(filename)),
+			Size: int(info.Size()),
+			Type: fileType(filename),
+		}, f, nil
+	}
+}
+
+// checksummed returns a source that adds the SHA-256 of what open opens to
+// its header, so the receiver can skip it if it already has it. Sources
+// that can't be read twice are left as they are.
+func checksummed(open source) source {
+	return func() (header, io.ReadCloser, error) {
+		h, r, err := open()
+		if err != nil {
+			return h, r, err
+		}
+		s, ok := r.(io.ReadSeeker)
+		if !ok || h.Unsized {
+			return h, r, nil
+		}
+		sum := sha256.New()
+		_, err = io.Copy(sum, s)
+		if err == nil {
+			_, err = s.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			r.Close()
+			return h, nil, fmt.Errorf("could not checksum %s: %v", h.Name, err)
+		}
+		h.SHA256 = hex.EncodeToString(sum.Sum(nil))
+		return h, r, nil
+	}
+}
+
+// sendOptions are how sendFiles sends files. The zero value sends them the
+// way the web client understands, without waiting for acknowledgements.
+type sendOptions struct {
+	// ackTimeout, if set, asks the receiver to acknowledge every file, and
+	// is how long to wait for it to after sending everything. The web
+	// client doesn't.
+	ackTimeout time.Duration
+
+	// pause, if set, stops sending whenever it is paused, by either side.
+	pause *gate
+
+	// framed sends headers framed and data with its offsets, which the
+	// web client does not understand.
+	framed bool
+
+	// checksum sends each file's checksum first and skips files the
+	// receiver already has. The web client doesn't answer them.
+	checksum bool
+
+	// sparse sends files with holes without them, which the web client
+	// doesn't understand either.
+	sparse bool
+
+	// bundle, if set, sends runs of more than bundle small files together
+	// as one tar archive, unless checksum or sums are set, which need the
+	// files sent one by one.
+	bundle int
+
+	// sums, if set, gets each file's SHA-256 printed to it once it is
+	// sent.
+	sums io.Writer
+}
+
+// defaultAnswerTimeout is how long to wait for answers to checksums and
+// offers of parallel transfers when there is no ackTimeout.
+const defaultAnswerTimeout = 30 * time.Second
+
+// answerTimeout is how long to wait for the receiver to answer a checksum or
+// an offer of a parallel transfer before taking it for one that doesn't
+// understand them. Unlike acks, they can't go unanswered.
+func (opts sendOptions) answerTimeout() time.Duration {
+	if opts.ackTimeout == 0 {
+		return defaultAnswerTimeout
+	}
+	return opts.ackTimeout
+}
+
+// sendFiles sends every named file over c as opts say, printing progress to
+// out.
+func sendFiles(c io.ReadWriter, filenames []string, out io.Writer, opts sendOptions) error {
+	if opts.checksum || opts.sums != nil {
+		opts.bundle = 0
+	}
+	var sources []source
+	for _, group := range bundleGroups(filenames, opts.bundle) {
+		if len(group) > 1 {
+			sources = append(sources, bundleSource(group))
+			continue
+		}
+		s := fileSource(group[0])
+		if opts.sparse {
+			s = sparse(s)
+		}
+		if opts.checksum {
+			s = checksummed(s)
+		}
+		sources = append(sources, s)
+	}
+	return sendSources(c, sources, out, opts)
+}
+
+// sendSources is like sendFiles, sending whatever sources open. Only the
+// ackTimeout, pause, framed and sums options apply.
+func sendSources(c io.ReadWriter, sources []source, out io.Writer, opts sendOptions) error {
+	pause := opts.pause
+	if pause == nil {
+		pause = newGate()
+	}
+	declined := make(chan struct{})
+	acks := make(chan control, len(sources))
+	answers := make(chan control, 2)
+	done := make(chan struct{})
+	size := newChunkSize(c)
+	go func() {
+		readControls(c, declined, acks, answers, pause, size)
+		close(done)
+	}()
+	w := gatedWriter{c, pause}
+
+	// A failed write is most likely the receiver hanging up after
+	// declining, so report that if we know it.
+	fail := func(err error) error {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+		}
+		select {
+		case <-declined:
+			return errDeclined
+		default:
+			return err
+		}
+	}
+
+	skipped := 0
+	for _, open := range sources {
+		h, r, err := open()
+		if err != nil {
+			return err
+		}
+		h.Ack, h.ChunkSizes = opts.ackTimeout > 0, true
+		// Sparse files carry their offsets already, and unsized ones
+		// can't, as their end is an empty message.
+		h.Offsets = opts.framed && !h.Sparse && !h.Unsized
+		err = writeHeader(w, h, opts.framed)
+		if err != nil {
+			r.Close()
+			return fail(fmt.Errorf("could not send file header: %v", err))
+		}
+		if h.SHA256 != "" {
+			// Receivers too old to know checksums wait for the data
+			// instead of answering, so give up if they don't say they
+			// are checking in time. Finding the file can take longer.
+			var answer control
+			timeout := time.After(opts.answerTimeout())
+			for answer.Control == "" || answer.Control == controlChecking {
+				select {
+				case answer = <-answers:
+					if answer.Control == controlChecking {
+						timeout = nil
+					}
+				case <-timeout:
+					r.Close()
+					return errNoChecksums
+				case <-done:
+					r.Close()
+					return fail(errors.New("receiver hung up before answering checksum"))
+				}
+			}
+			switch answer.Control {
+			case controlSkip:
+				r.Close()
+				fmt.Fprintf(out, "skipping %v, receiver already has it\n", h.Name)
+				skipped++
+				continue
+			case controlPartial:
+				// Resumed files are sent with their holes.
+				h.Sparse, h.Data = false, 0
+				h.Offset, err = resumeFrom(r, answer.Offset, answer.SHA256)
+				if err == nil {
+					err = writeHeader(w, h, opts.framed)
+				}
+				if err != nil {
+					r.Close()
+					return fail(fmt.Errorf("could not resume %s: %v", h.Name, err))
+				}
+			}
+		}
+		if h.Offset > 0 {
+			fmt.Fprintf(out, "resuming %v from byte %d... ", h.Name, h.Offset)
+		} else {
+			fmt.Fprintf(out, "sending %v... ", h.Name)
+		}
+		// Hash files as they are sent, unless their checksum was sent
+		// already, which also covers the start of resumed files.
+		var data io.Reader = r
+		sum := sha256.New()
+		if opts.sums != nil && h.SHA256 == "" {
+			data = io.TeeReader(r, sum)
+		}
+		var written int64
+		if f, ok := r.(*sparseFile); ok && h.Sparse {
+			written, err = sendExtents(w, f, f.extents, size)
+			if err == nil && opts.sums != nil && h.SHA256 == "" {
+				// The holes have to be hashed too.
+				_, err = io.Copy(sum, f)
+			}
+		} else if h.Offsets {
+			// Offsets count from the start of the data sent, which is
+			// h.Offset into resumed files.
+			written, err = sendChunks(w, data, 0, size)
+		} else {
+			written, err = copyChunks(w, data, size)
+		}
+		r.Close()
+		if err != nil {
+			return fail(fmt.Errorf("\ncould not send file: %v", err))
+		}
+		if h.Sparse {
+			if written != h.Data {
+				return fmt.Errorf("\nEOF before sending all bytes: (%d/%d)", written, h.Data)
+			}
+		} else if h.Unsized {
+			// An empty message marks the end.
+			if _, err := w.Write(nil); err != nil {
+				return fail(fmt.Errorf("\ncould not send file: %v", err))
+			}
+		} else if written != int64(h.Size)-h.Offset {
+			return fmt.Errorf("\nEOF before sending all bytes: (%d/%d)", written, int64(h.Size)-h.Offset)
+		}
+		fmt.Fprintf(out, "done\n")
+		if opts.sums != nil {
+			if h.SHA256 == "" {
+				h.SHA256 = hex.EncodeToString(sum.Sum(nil))
+			}
+			fmt.Fprintf(opts.sums, "%s  %s\n", h.SHA256, h.Name)
+		}
+	}
+
+	if opts.ackTimeout == 0 {
+		return nil
+	}
+	timeout := time.After(opts.ackTimeout)
+	var reasons []string
+	for range sources[skipped:] {
+		var ack control
+		select {
+		case ack = <-acks:
+		case <-declined:
+			return errDeclined
+		case <-done:
+			// The receiver hung up. Count whatever acks made it before.
+			if len(acks) == 0 {
+				return errNoAck
+			}
+			ack = <-acks
+		case <-timeout:
+			return errNoAck
+		}
+		if ack.Control == controlFailed {
+			reasons = append(reasons, ack.Reason)
+		}
+	}
+	if len(reasons) > 0 {
+		err := fmt.Errorf("receiver could not save %d of %d files", len(reasons), len(sources))
+		// Older receivers don't say why.
+		if reasons[0] != "" {
+			err = fmt.Errorf("%v: %s", err, strings.Join(reasons, "; "))
+		}
+		return err
+	}
+	return nil
 }
 
 func receive(args ...string) {
@@ -26,53 +1059,185 @@ func receive(args ...string) {
 	set.Usage = func() {
 		fmt.Fprintf(set.Output(), "receive files\n\n")
 		fmt.Fprintf(set.Output(), "usage: %s %s [code]\n\n", os.Args[0], args[0])
+		fmt.Fprintf(set.Output(), "send SIGUSR1 to ask the sender to pause or resume the transfer.\n\n")
 		fmt.Fprintf(set.Output(), "flags:\n")
 		set.PrintDefaults()
 	}
 	length := set.Int("length", 2, "length of generated secret, if generating")
 	directory := set.String("dir", ".", "directory to put downloaded files")
+	list := set.Bool("list", false, "list the incoming files without writing anything, or only how many there are and their total size if the sender offers them")
+	appendFiles := set.Bool("append", false, "append to existing files with the same name instead of replacing them")
+	resume := set.Bool("resume", false, "keep files being received as name.part, and carry on from where they left off if the sender sends them again with -checksum")
+	qrFile := set.String("qr", "", "read the code from a screenshot of its QR code (png, jpeg or gif)")
+	confirm := set.Bool("confirm", false, "if the sender offers the files first, ask before accepting them")
+	splitSize := set.String("split", "", "write everything received as one stream split into numbered files of at most this size, e.g. 100MB, named after the first file")
+	extract := set.Bool("x", false, "extract tar archives (application/x-tar) into -dir instead of saving them")
+	printText := set.Bool("print-text", false, "print text files (text/plain) to stdout instead of saving them")
+	gunzip := set.Bool("gunzip", false, "decompress gzip files (application/gzip) before saving them")
+	merge := set.String("merge", "", "write the contents of all files received one after the other to this file, or - for stdout")
+	asTar := set.Bool("as-tar", false, "with -merge, write the files received as a tar archive that keeps their names")
+	maxFiles := set.Int("max-files", 0, "abort if the sender sends more than this many files (default no limit)")
+	maxRate := set.Float64("max-header-rate", 0, "abort if the sender sends more than this many file headers a second (default no limit)")
+	deadline := set.Duration("deadline", 0, "abort the transfer and remove partially received files if it hasn't finished this long after connecting (default no limit)")
+	stallTimeout := set.Duration("stall-timeout", 0, "abort the transfer and remove partially received files if nothing is received for this long, not counting pauses (default no limit)")
+	httpAddr := set.String("http", "", "serve the files at http://ADDR/_/NAME while they are received into -dir, so they can be played before they finish, and keep serving them until interrupted")
 	set.Parse(args[1:])
 
-	if set.NArg() > 1 {
+	if set.NArg() > 1 || set.NArg() == 1 && *qrFile != "" || *httpAddr != "" && (*list || *splitSize != "" || *merge != "" || *appendFiles || *resume) || *splitSize != "" && *appendFiles || *merge != "" && (*splitSize != "" || *appendFiles) || *resume && *appendFiles || *asTar && *merge == "" {
 		set.Usage()
 		os.Exit(2)
 	}
-	c := newConn(set.Arg(0), *length)
-
-	// TODO append number to existing filenames?
-
-	for {
-		// First message is the header. 1k should be enough.
-		buf := make([]byte, 1<<10)
-		n, err := c.Read(buf)
-		if err == io.EOF {
-			break
+	var dest destination = &dirDestination{dir: *directory, append: *appendFiles, resume: *resume}
+	var parts *splitDestination
+	if *splitSize != "" {
+		size, err := parseSize(*splitSize)
+		if err != nil {
+			fatalf("invalid -split: %v", err)
+		}
+		parts = &splitDestination{dir: *directory, size: size}
+		dest = parts
+	}
+	var merged io.WriteCloser
+	switch *merge {
+	case "":
+	case "-":
+		merged = os.Stdout
+	default:
+		f, err := os.Create(*merge)
+		if err != nil {
+			fatalf("could not create output file: %v", err)
+		}
+		merged = f
+	}
+	var tarred *tarDestination
+	switch {
+	case merged != nil && *asTar:
+		tarred = newTarDestination(merged)
+		dest = tarred
+	case merged != nil:
+		dest = &mergeDestination{w: merged}
+	}
+	if *extract || *printText || *gunzip {
+		typed := &typedDestination{destination: dest, gunzip: *gunzip}
+		if *extract {
+			typed.extract = *directory
+		}
+		if *printText {
+			typed.text = os.Stdout
+		}
+		dest = typed
+	}
+	code := receiveCode(set.Arg(0))
+	if *qrFile != "" {
+		var err error
+		code, err = codeFromQR(*qrFile)
+		if err != nil {
+			fatalf("could not read code from %s: %v", *qrFile, err)
 		}
+	}
+	var ln net.Listener
+	if *httpAddr != "" {
+		var err error
+		ln, err = net.Listen("tcp", *httpAddr)
 		if err != nil {
-			fatalf("could not read file header: %v", err)
+			fatalf("could not listen on %s: %v", *httpAddr, err)
+		}
+	}
+	c := newConn(code, *length, 0, 0)
+
+	var paused atomic.Bool
+	onPauseSignal(func() {
+		paused.Store(!paused.Load())
+		kind := controlResume
+		if paused.Load() {
+			kind = controlPause
 		}
-		var h header
-		err = json.Unmarshal(buf[:n], &h)
+		err := writeControl(c, kind)
 		if err != nil {
-			fatalf("could not decode file header: %v", err)
+			fmt.Fprintf(set.Output(), "\ncould not %s: %v\n", kind, err)
+			return
 		}
+		fmt.Fprintf(set.Output(), "\nasked sender to %s\n", kind)
+	})
 
-		f, err := os.Create(filepath.Join(*directory, filepath.Clean("/"+h.Name)))
+	if *list {
+		err := listFiles(c, os.Stdout)
 		if err != nil {
-			fatalf("could not create output file %s: %v", h.Name, err)
+			fatalf("could not list files: %v", err)
 		}
-		fmt.Fprintf(set.Output(), "receiving %v... ", h.Name)
-		written, err := io.CopyBuffer(f, io.LimitReader(c, int64(h.Size)), make([]byte, msgChunkSize))
+		c.Close()
+		return
+	}
+
+	if ln != nil {
+		files := &downloads{}
+		go http.Serve(ln, files)
+		err := serveFiles(newFileReader(c), *directory, files, "http://"+ln.Addr().String(), set.Output())
 		if err != nil {
-			fatalf("\ncould not save file: %v", err)
+			fatalf("%v", err)
 		}
-		if written != int64(h.Size) {
-			fatalf("\nEOF before receiving all bytes: (%d/%d)", written, h.Size)
+		c.Close()
+		fmt.Fprintf(set.Output(), "received everything, serving until interrupted\n")
+		select {}
+	}
+
+	// Split and merged streams can only take one file at a time, so no
+	// parallel transfers.
+	dog := newWatchdog(*stallTimeout, paused.Load)
+	open := dog.opener(channelOpener(c.Wormhole))
+	if parts != nil || merged != nil {
+		open = nil
+	}
+	accept := func(files int, total int64) error {
+		if err := checkSpace(*directory, total); err != nil {
+			return err
+		}
+		if !*confirm {
+			return nil
+		}
+		return dog.hold(func() error {
+			fmt.Fprintf(set.Output(), "accept %d files, %d bytes in all? [y/N] ", files, total)
+			answer, err := readLine(os.Stdin)
+			if err != nil || answer != "y" && answer != "yes" {
+				return errors.New("receiver said no")
+			}
+			return nil
+		})
+	}
+	var limit *limits
+	if *maxFiles > 0 || *maxRate > 0 {
+		limit = &limits{maxFiles: *maxFiles, rate: *maxRate}
+	}
+	var results []fileResult
+	err := withDeadline(*deadline, c, func() error {
+		return dog.run(c, func() (err error) {
+			results, err = receiveFiles(dog.watch(c.Wormhole), dest, set.Output(), open, accept, limit)
+			return err
+		})
+	})
+	if parts != nil {
+		parts.Close()
+	}
+	// Leave the archive unfinished if the transfer was, so it isn't
+	// mistaken for a complete one.
+	if tarred != nil && err == nil {
+		if err := tarred.Close(); err != nil {
+			fatalf("could not write tar archive: %v", err)
+		}
+	}
+	if merged != nil && merged != os.Stdout {
+		if err := merged.Close(); err != nil {
+			fatalf("could not save output file: %v", err)
 		}
-		f.Close()
-		fmt.Fprintf(set.Output(), "done\n")
+	}
+	failed := printSummary(set.Output(), results)
+	if err != nil {
+		fatalf("%v", err)
 	}
 	c.Close()
+	if failed > 0 {
+		os.Exit(1)
+	}
 }
 
 func send(args ...string) {
@@ -80,49 +1245,72 @@ func send(args ...string) {
 	set.Usage = func() {
 		fmt.Fprintf(set.Output(), "send files\n\n")
 		fmt.Fprintf(set.Output(), "usage: %s %s [files]...\n\n", os.Args[0], args[0])
+		fmt.Fprintf(set.Output(), "send SIGUSR1 to pause or resume the transfer.\n\n")
 		fmt.Fprintf(set.Output(), "flags:\n")
 		set.PrintDefaults()
 	}
 	length := set.Int("length", 2, "length of generated secret")
 	code := set.String("code", "", "use a wormhole code instead of generating one")
+	rotate := set.Duration("rotate", 0, "generate a new code after this long if no one has connected")
+	wait := set.Duration("wait", 0, "give up if no one has connected after this long, exiting with status 3 (default wait forever)")
+	ackTimeout := set.Duration("ack-timeout", 0, "ask the receiver to confirm it saved each file, and wait this long for it to after sending them; the receiver cannot be the web client (default don't ask)")
+	framed := set.Bool("framed", false, "send file headers in length-prefixed frames and file data with its offsets; the receiver cannot be the web client")
+	parallel := set.Int("parallel", 1, fmt.Sprintf("send up to this many files at once over separate channels, at most %d; the receiver cannot be the web client", maxStreams))
+	fromURL := set.String("url", "", "send the body of this http or https URL as it downloads instead of files")
+	offer := set.Bool("offer", false, "tell the receiver how many files and bytes are coming and wait for it to accept them; the receiver cannot be the web client")
+	printSums := set.Bool("sha256", false, "print each file's SHA-256 once it is sent, for the receiver to check with ww verify")
+	checksum := set.Bool("checksum", false, "send each file's checksum first so the receiver can skip files it already has; the receiver cannot be the web client")
+	deadline := set.Duration("deadline", 0, "abort the transfer if it hasn't finished this long after connecting (default no limit)")
+	stallTimeout := set.Duration("stall-timeout", 0, "abort the transfer if nothing is sent for this long, not counting pauses or waiting for the receiver to accept an -offer (default no limit)")
+	sparseFiles := set.Bool("sparse", false, "send files with holes, like disk images, without the holes' zeros where the system can find them; the receiver cannot be the web client")
+	bundle := set.Int("bundle", 0, "send runs of more than this many files under 32KB together as one tar archive, which is much faster for many small files; ww receivers save the files as usual, the web client saves the archive (default 0, never)")
+	set.BoolVar(&clipboard, "clipboard", false, "copy the generated code to the system clipboard, if there is one")
 	set.Parse(args[1:])
 
-	if set.NArg() < 1 {
+	if set.NArg() < 1 && *fromURL == "" || *fromURL != "" && (set.NArg() > 0 || *offer) {
 		set.Usage()
 		os.Exit(2)
 	}
-	c := newConn(*code, *length)
+	c := newConn(*code, *length, *rotate, *wait)
+	var sums io.Writer
+	if *printSums {
+		sums = set.Output()
+	}
 
-	for _, filename := range set.Args() {
-		f, err := os.Open(filename)
-		if err != nil {
-			fatalf("could not open file %s: %v", filename, err)
+	pause := newGate()
+	onPauseSignal(func() {
+		if pause.Toggle() {
+			fmt.Fprintf(set.Output(), "\npaused, send SIGUSR1 again to resume\n")
+		} else {
+			fmt.Fprintf(set.Output(), "\nresumed\n")
 		}
-		info, err := f.Stat()
-		if err != nil {
-			fatalf("could not stat file %s: %v", filename, err)
-		}
-		h, err := json.Marshal(header{
-			Name: filepath.Base(filepath.Clean(filename)),
-			Size: int(info.Size()),
+	})
+
+	dog := newWatchdog(*stallTimeout, pause.Paused)
+	wc := dog.watch(c.Wormhole)
+	err := withDeadline(*deadline, c, func() error {
+		return dog.run(c, func() (err error) {
+			if *fromURL != "" {
+				return sendSources(wc, []source{urlSource(http.DefaultClient, *fromURL)}, set.Output(), sendOptions{ackTimeout: *ackTimeout, pause: pause, framed: *framed, sums: sums})
+			}
+			if *offer {
+				err = dog.hold(func() error {
+					return offerFiles(wc, set.Args(), *framed)
+				})
+			}
+			if err == nil {
+				err = sendParallel(wc, dog.opener(channelOpener(c.Wormhole)), *parallel, set.Args(), set.Output(), sendOptions{ackTimeout: *ackTimeout, pause: pause, framed: *framed, checksum: *checksum, sparse: *sparseFiles, bundle: *bundle, sums: sums})
+			}
+			return err
 		})
-		if err != nil {
-			fatalf("failed to marshal json: %v", err)
-		}
-		_, err = c.Write(h)
-		if err != nil {
-			fatalf("could not send file header: %v", err)
-		}
-		fmt.Fprintf(set.Output(), "sending %v... ", filepath.Base(filepath.Clean(filename)))
-		written, err := io.CopyBuffer(c, f, make([]byte, msgChunkSize))
-		if err != nil {
-			fatalf("\ncould not send file: %v", err)
-		}
-		if written != info.Size() {
-			fatalf("\nEOF before sending all bytes: (%d/%d)", written, info.Size())
-		}
-		f.Close()
-		fmt.Fprintf(set.Output(), "done\n")
+	})
+	if errors.Is(err, errDeclined) {
+		fmt.Fprintf(set.Output(), "\n%v\n", err)
+		c.Close()
+		return
+	}
+	if err != nil {
+		fatalf("%v", err)
 	}
 	c.Close()
 }
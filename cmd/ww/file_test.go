@@ -0,0 +1,722 @@
+package main
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"webwormhole.io/wormhole"
+)
+
+// msgConn is one end of an in-memory, message-oriented pipe. Like a detached
+// DataChannel, each Write is delivered whole by a single Read.
+type msgConn struct {
+	in, out chan []byte
+
+	closed, peerClosed chan struct{}
+	once               *sync.Once
+}
+
+func msgPipe() (a, b *msgConn) {
+	ab, ba := make(chan []byte), make(chan []byte)
+	aclosed, bclosed := make(chan struct{}), make(chan struct{})
+	a = &msgConn{in: ba, out: ab, closed: aclosed, peerClosed: bclosed, once: new(sync.Once)}
+	b = &msgConn{in: ab, out: ba, closed: bclosed, peerClosed: aclosed, once: new(sync.Once)}
+	return a, b
+}
+
+func (c *msgConn) Read(p []byte) (int, error) {
+	select {
+	case m, ok := <-c.in:
+		if !ok {
+			return 0, io.EOF
+		}
+		return copy(p, m), nil
+	case <-c.closed:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+func (c *msgConn) Write(p []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, io.ErrClosedPipe
+	case <-c.peerClosed:
+		return 0, io.ErrClosedPipe
+	case c.out <- append([]byte(nil), p...):
+		return len(p), nil
+	}
+}
+
+func (c *msgConn) Close() error {
+	c.once.Do(func() {
+		close(c.out)
+		close(c.closed)
+	})
+	return nil
+}
+
+func writeTestFile(t *testing.T, dir, name string, content []byte) string {
+	t.Helper()
+	p := filepath.Join(dir, name)
+	if err := os.WriteFile(p, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestList(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	names := []string{
+		writeTestFile(t, src, "a.txt", bytes.Repeat([]byte("a"), 100<<10)),
+		writeTestFile(t, src, "b.txt", []byte("hello")),
+		writeTestFile(t, src, "c.txt", nil),
+	}
+	listing := "a.txt\t102400\nb.txt\t5\nc.txt\t0\n"
+
+	// Run from an empty directory to catch any stray writes.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dst); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	tests := []struct {
+		name    string
+		offer   bool
+		opts    sendOptions
+		listing string
+		err     string // What the sender is told, if anything.
+	}{
+		{"plain", false, sendOptions{}, listing, ""},
+		{"framed", false, sendOptions{framed: true}, listing, ""},
+		{"checksum", false, sendOptions{checksum: true}, listing, ""},
+		{"ack", false, sendOptions{ackTimeout: time.Second}, listing, "only listing"},
+		{"offer", true, sendOptions{}, "3 files\t102405\n", errDeclined.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender, receiver := msgPipe()
+			errc := make(chan error, 1)
+			go func() {
+				var err error
+				if tt.offer {
+					err = offerFiles(sender, names, false)
+				}
+				if err == nil {
+					err = sendFiles(sender, names, io.Discard, tt.opts)
+				}
+				errc <- err
+				sender.Close()
+			}()
+
+			out := &bytes.Buffer{}
+			if err := listFiles(receiver, out); err != nil {
+				t.Fatal(err)
+			}
+			receiver.Close()
+
+			if got := out.String(); got != tt.listing {
+				t.Errorf("listing got %q want %q", got, tt.listing)
+			}
+			err := <-errc
+			if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("sender got %v want %q", err, tt.err)
+			}
+			entries, err := os.ReadDir(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 0 {
+				t.Errorf("list wrote %d files, want none", len(entries))
+			}
+		})
+	}
+}
+
+func TestSendReceive(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	files := map[string][]byte{
+		"a.txt": bytes.Repeat([]byte("a"), 100<<10),
+		"b.txt": []byte("hello"),
+		"c.txt": {},
+	}
+	var names []string
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		names = append(names, writeTestFile(t, src, name, files[name]))
+	}
+
+	sender, receiver := msgPipe()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- sendFiles(sender, names, io.Discard, sendOptions{ackTimeout: time.Second})
+		sender.Close()
+	}()
+	if _, err := receiveFiles(receiver, &dirDestination{dir: dst}, io.Discard, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	receiver.Close()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range files {
+		got, err := os.ReadFile(filepath.Join(dst, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: got %d bytes want %d", name, len(got), len(want))
+		}
+	}
+}
+
+func TestNoAck(t *testing.T) {
+	src := t.TempDir()
+	name := writeTestFile(t, src, "a.txt", []byte("hello"))
+
+	// drain reads a header and the file without acknowledging it.
+	drain := func(c io.Reader) {
+		h, err := readHeader(c)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if !h.Ack {
+			t.Error("sender did not ask for an ack")
+		}
+		io.CopyN(io.Discard, c, int64(h.Size))
+	}
+
+	t.Run("hangup", func(t *testing.T) {
+		sender, receiver := msgPipe()
+		errc := make(chan error, 1)
+		go func() {
+			errc <- sendFiles(sender, []string{name}, io.Discard, sendOptions{ackTimeout: time.Minute})
+		}()
+		drain(receiver)
+		receiver.Close()
+		if err := <-errc; err != errNoAck {
+			t.Errorf("got %v want %v", err, errNoAck)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		sender, receiver := msgPipe()
+		defer receiver.Close()
+		errc := make(chan error, 1)
+		go func() {
+			errc <- sendFiles(sender, []string{name}, io.Discard, sendOptions{ackTimeout: 10 * time.Millisecond})
+		}()
+		drain(receiver)
+		if err := <-errc; err != errNoAck {
+			t.Errorf("got %v want %v", err, errNoAck)
+		}
+	})
+
+	// Without an ackTimeout, as for the web client, no ack is asked for
+	// or waited on.
+	t.Run("off", func(t *testing.T) {
+		sender, receiver := msgPipe()
+		defer receiver.Close()
+		errc := make(chan error, 1)
+		go func() {
+			errc <- sendFiles(sender, []string{name}, io.Discard, sendOptions{})
+		}()
+		h, err := readHeader(receiver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Ack {
+			t.Error("sender asked for an ack")
+		}
+		io.CopyN(io.Discard, receiver, int64(h.Size))
+		select {
+		case err := <-errc:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("sender waited for an ack")
+		}
+	})
+}
+
+func TestControlIgnoresHeaders(t *testing.T) {
+	buf, err := json.Marshal(header{Name: "x", Size: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m control
+	if err := json.Unmarshal(buf, &m); err != nil || m.Control != "" {
+		t.Errorf("header decoded as control %q (%v)", m.Control, err)
+	}
+}
+
+func TestReceiveMixed(t *testing.T) {
+	dst := t.TempDir()
+	// A directory in the way makes "blocked" impossible to save.
+	if err := os.Mkdir(filepath.Join(dst, "blocked"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	sender, receiver := msgPipe()
+	controls := make(chan string, 10)
+	go func() {
+		send := func(name string, size int, data []byte) {
+			h, _ := json.Marshal(header{Name: name, Size: size, Ack: true})
+			sender.Write(h)
+			if len(data) > 0 {
+				sender.Write(data)
+			}
+		}
+		send("a.txt", 5, []byte("hello"))
+		send("blocked", 5, []byte("nope!"))
+		send("b.txt", 5, []byte("world"))
+		send("truncated.txt", 10, []byte("short"))
+		sender.Close()
+	}()
+	go func() {
+		buf := make([]byte, 1<<10)
+		for {
+			n, err := sender.Read(buf)
+			if err != nil {
+				close(controls)
+				return
+			}
+			var m control
+			json.Unmarshal(buf[:n], &m)
+			controls <- m.Control
+		}
+	}()
+
+	results, err := receiveFiles(receiver, &dirDestination{dir: dst}, io.Discard, nil, nil, nil)
+	receiver.Close()
+	if err == nil {
+		t.Error("truncated file did not fail the transfer")
+	}
+
+	want := []struct {
+		name string
+		ok   bool
+	}{{"a.txt", true}, {"blocked", false}, {"b.txt", true}, {"truncated.txt", false}}
+	if len(results) != len(want) {
+		t.Fatalf("got %v results want %v", len(results), len(want))
+	}
+	for i, w := range want {
+		if results[i].name != w.name || (results[i].err == nil) != w.ok {
+			t.Errorf("result %v got %v (%v) want %v ok=%v", i, results[i].name, results[i].err, w.name, w.ok)
+		}
+	}
+
+	for name, content := range map[string]string{"a.txt": "hello", "b.txt": "world"} {
+		got, err := os.ReadFile(filepath.Join(dst, name))
+		if err != nil || string(got) != content {
+			t.Errorf("%s: got %q, %v want %q", name, got, err, content)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dst, "truncated.txt")); !os.IsNotExist(err) {
+		t.Errorf("partial file was left behind: %v", err)
+	}
+
+	var got []string
+	for c := range controls {
+		got = append(got, c)
+	}
+	if want := []string{controlAck, controlFailed, controlAck}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sender got controls %v want %v", got, want)
+	}
+
+	out := &bytes.Buffer{}
+	if failed := printSummary(out, results); failed != 2 {
+		t.Errorf("summary counted %v failures want 2", failed)
+	}
+	if !bytes.Contains(out.Bytes(), []byte("received 2 of 4 files")) {
+		t.Errorf("bad summary %q", out)
+	}
+}
+
+func TestSendNotSaved(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	a := writeTestFile(t, src, "a.txt", []byte("hello"))
+	b := writeTestFile(t, src, "b.txt", []byte("world"))
+	if err := os.Mkdir(filepath.Join(dst, "b.txt"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	sender, receiver := msgPipe()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- sendFiles(sender, []string{a, b}, io.Discard, sendOptions{ackTimeout: time.Second})
+		sender.Close()
+	}()
+	results, err := receiveFiles(receiver, &dirDestination{dir: dst}, io.Discard, nil, nil, nil)
+	receiver.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].err != nil || results[1].err == nil {
+		t.Errorf("got results %v", results)
+	}
+	if err := <-errc; err == nil {
+		t.Error("sender did not report the file that was not saved")
+	}
+}
+
+func TestReceiveAppend(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	name := filepath.Join(src, "log.txt")
+
+	for _, content := range []string{"first\n", "second\n"} {
+		writeTestFile(t, src, "log.txt", []byte(content))
+		sender, receiver := msgPipe()
+		errc := make(chan error, 1)
+		go func() {
+			errc <- sendFiles(sender, []string{name}, io.Discard, sendOptions{ackTimeout: time.Second})
+			sender.Close()
+		}()
+		if _, err := receiveFiles(receiver, &dirDestination{dir: dst, append: true}, io.Discard, nil, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		receiver.Close()
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A truncated transfer leaves what was there before alone.
+	sender, receiver := msgPipe()
+	go func() {
+		h, _ := json.Marshal(header{Name: "log.txt", Size: 10, Offsets: true})
+		sender.Write(h)
+		buf := make([]byte, chunkHeaderSize+5)
+		copy(buf[chunkHeaderSize:], "third")
+		sender.Write(buf)
+		sender.Close()
+	}()
+	if _, err := receiveFiles(receiver, &dirDestination{dir: dst, append: true}, io.Discard, nil, nil, nil); err == nil {
+		t.Error("truncated file did not fail the transfer")
+	}
+	receiver.Close()
+
+	got, err := os.ReadFile(filepath.Join(dst, "log.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "first\nsecond\n"; string(got) != want {
+		t.Errorf("got %q want %q", got, want)
+	}
+}
+
+func TestChecksumOldReceiver(t *testing.T) {
+	name := writeTestFile(t, t.TempDir(), "file.txt", []byte("hello"))
+
+	// Receivers from before checksums take the header and wait for the
+	// data without answering.
+	sender, receiver := msgPipe()
+	defer receiver.Close()
+	go func() {
+		if _, err := readHeader(receiver); err != nil {
+			return
+		}
+		io.Copy(io.Discard, receiver)
+	}()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- sendFiles(sender, []string{name}, io.Discard, sendOptions{ackTimeout: 100 * time.Millisecond, checksum: true})
+	}()
+	select {
+	case err := <-errc:
+		if err != errNoChecksums {
+			t.Errorf("got %v want %v", err, errNoChecksums)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("sender waited for the old receiver to answer the checksum")
+	}
+}
+
+func TestChecksumSkip(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	same := writeTestFile(t, src, "same.txt", []byte("hello"))
+	changed := writeTestFile(t, src, "changed.txt", []byte("world"))
+	missing := writeTestFile(t, src, "missing.txt", []byte("new"))
+	writeTestFile(t, dst, "same.txt", []byte("hello"))
+	writeTestFile(t, dst, "changed.txt", []byte("w0rld"))
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(filepath.Join(dst, "same.txt"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	receive := func(dest destination) string {
+		t.Helper()
+		sender, receiver := msgPipe()
+		errc := make(chan error, 1)
+		out := &bytes.Buffer{}
+		go func() {
+			errc <- sendFiles(sender, []string{same, changed, missing}, out, sendOptions{ackTimeout: time.Second, checksum: true})
+			sender.Close()
+		}()
+		results, err := receiveFiles(receiver, dest, io.Discard, nil, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		receiver.Close()
+		if err := <-errc; err != nil {
+			t.Fatalf("sender: %v", err)
+		}
+		if len(results) != 3 {
+			t.Errorf("got %d results want 3", len(results))
+		}
+		return out.String()
+	}
+
+	out := receive(&dirDestination{dir: dst})
+	if !strings.Contains(out, "skipping same.txt") {
+		t.Errorf("sender did not skip the file the receiver had: %q", out)
+	}
+	for _, name := range []string{"changed.txt", "missing.txt"} {
+		if strings.Contains(out, "skipping "+name) {
+			t.Errorf("sender skipped %s: %q", name, out)
+		}
+	}
+	for name, want := range map[string]string{"same.txt": "hello", "changed.txt": "world", "missing.txt": "new"} {
+		got, err := os.ReadFile(filepath.Join(dst, name))
+		if err != nil || string(got) != want {
+			t.Errorf("%s: got %q, %v want %q", name, got, err, want)
+		}
+	}
+	info, err := os.Stat(filepath.Join(dst, "same.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(old) {
+		t.Error("skipped file was written")
+	}
+
+	// Appending never skips, nor do destinations that can't tell.
+	if out := receive(&dirDestination{dir: dst, append: true}); strings.Contains(out, "skipping") {
+		t.Errorf("skipped a file when appending: %q", out)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dst, "same.txt")); string(got) != "hellohello" {
+		t.Errorf("appended file got %q", got)
+	}
+	var merged bytes.Buffer
+	if out := receive(&mergeDestination{w: &merged}); strings.Contains(out, "skipping") {
+		t.Errorf("skipped a file when merging: %q", out)
+	}
+	if got, want := merged.String(), "helloworldnew"; got != want {
+		t.Errorf("merged got %q want %q", got, want)
+	}
+}
+
+func TestReadHeader(t *testing.T) {
+	framed := func(body []byte) []byte {
+		return append([]byte{headerTag, byte(len(body) >> 8), byte(len(body))}, body...)
+	}
+	valid := []byte(`{"name":"a.txt","size":5}`)
+	long := []byte(`{"name":"` + strings.Repeat("a", maxHeaderSize) + `","size":5}`)
+
+	cases := []struct {
+		name string
+		msg  []byte
+		ok   bool
+	}{
+		{"plain", valid, true},
+		{"framed", framed(valid), true},
+		{"oversized plain", long, false},
+		{"oversized framed", framed(long), false},
+		{"short frame", []byte{headerTag, 0}, false},
+		{"frame length mismatch", append(framed(valid), '}'), false},
+		{"not json", framed([]byte("hello")), false},
+		{"data", []byte("hello"), false},
+		{"no name", []byte(`{"size":5}`), false},
+		{"negative size", []byte(`{"name":"a.txt","size":-1}`), false},
+		{"checksum", []byte(`{"name":"a.txt","size":5,"sha256":"2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"}`), true},
+		{"bad checksum", []byte(`{"name":"a.txt","size":5,"sha256":"2cf24dba"}`), false},
+		{"offset without checksum", []byte(`{"name":"a.txt","size":5,"offset":2}`), false},
+		{"offset past end", []byte(`{"name":"a.txt","size":5,"offset":6,"sha256":"2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"}`), false},
+		{"sparse", []byte(`{"name":"a.txt","size":5,"sparse":true,"data":2}`), true},
+		{"sparse data past end", []byte(`{"name":"a.txt","size":5,"sparse":true,"data":6}`), false},
+		{"data without sparse", []byte(`{"name":"a.txt","size":5,"data":2}`), false},
+		{"sparse unsized", []byte(`{"name":"a.txt","size":5,"sparse":true,"unsized":true}`), false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sender, receiver := msgPipe()
+			defer sender.Close()
+			go sender.Write(c.msg)
+			h, err := readHeader(receiver)
+			if c.ok && (err != nil || h.Name != "a.txt" || h.Size != 5) {
+				t.Errorf("got %+v, %v", h, err)
+			}
+			if !c.ok && !errors.Is(err, errBadHeader) {
+				t.Errorf("got %+v, %v want %v", h, err, errBadHeader)
+			}
+		})
+	}
+
+	// The web client's headers still work.
+	var buf bytes.Buffer
+	if err := writeHeader(&buf, header{Name: "a.txt", Size: 5}, false); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Bytes()[0] != '{' {
+		t.Errorf("unframed header starts with %q", buf.Bytes()[0])
+	}
+	if err := writeHeader(&buf, header{Name: string(long)}, true); err == nil {
+		t.Error("wrote oversized framed header")
+	}
+}
+
+func TestOfferFiles(t *testing.T) {
+	src := t.TempDir()
+	names := []string{
+		writeTestFile(t, src, "a.txt", []byte("hello")),
+		writeTestFile(t, src, "b.txt", []byte("world!")),
+	}
+
+	t.Run("accept", func(t *testing.T) {
+		dst := t.TempDir()
+		sender, receiver := msgPipe()
+		errc := make(chan error, 1)
+		go func() {
+			err := offerFiles(sender, names, false)
+			if err == nil {
+				err = sendFiles(sender, names, io.Discard, sendOptions{ackTimeout: time.Second})
+			}
+			sender.Close()
+			errc <- err
+		}()
+		var files int
+		var total int64
+		accept := func(n int, size int64) error {
+			files, total = n, size
+			return checkSpace(dst, size)
+		}
+		results, err := receiveFiles(receiver, &dirDestination{dir: dst}, io.Discard, nil, accept, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+		if files != 2 || total != 11 {
+			t.Errorf("offered %v files, %v bytes want 2, 11", files, total)
+		}
+		if len(results) != 2 {
+			t.Errorf("got %v files want 2", len(results))
+		}
+	})
+
+	t.Run("no space", func(t *testing.T) {
+		if _, err := freeSpace(t.TempDir()); err != nil {
+			t.Skip(err)
+		}
+		dst := t.TempDir()
+		sender, receiver := msgPipe()
+		defer sender.Close()
+		errc := make(chan error, 1)
+		go func() {
+			// More than any disk has.
+			writeHeader(sender, header{Files: 1, Total: 1 << 62}, false)
+			buf := make([]byte, 1<<10)
+			n, err := sender.Read(buf)
+			if err != nil {
+				errc <- err
+				return
+			}
+			var m control
+			json.Unmarshal(buf[:n], &m)
+			if m.Control != controlDecline || !strings.Contains(m.Reason, "not enough space") {
+				err = fmt.Errorf("got reply %+v want a decline for lack of space", m)
+			}
+			errc <- err
+		}()
+		accept := func(n int, size int64) error { return checkSpace(dst, size) }
+		if _, err := receiveFiles(receiver, &dirDestination{dir: dst}, io.Discard, nil, accept, nil); err == nil {
+			t.Error("accepted more than there is space for")
+		}
+		if err := <-errc; err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("declined", func(t *testing.T) {
+		sender, receiver := msgPipe()
+		defer receiver.Close()
+		go receiveFiles(receiver, &dirDestination{dir: t.TempDir()}, io.Discard, nil, func(int, int64) error {
+			return errors.New("receiver said no")
+		}, nil)
+		err := offerFiles(sender, names, false)
+		if !errors.Is(err, errDeclined) || !strings.Contains(err.Error(), "receiver said no") {
+			t.Errorf("got %v want %v with reason", err, errDeclined)
+		}
+	})
+}
+
+// TestSendTunnel sends a file over a tunnelled Wormhole, whose messages
+// are smaller than usual.
+func TestSendTunnel(t *testing.T) {
+	cfg := &wormhole.Config{Tunnel: true}
+	a, b, erra, errb := loopback(t, cfg, cfg)
+	if erra != nil || errb != nil {
+		t.Fatal(erra, errb)
+	}
+	// The receiver writes last, acknowledging the file.
+	defer a.Close()
+	defer b.Close()
+	src, dst := t.TempDir(), t.TempDir()
+	// Big enough for the receiver to ask for messages as big as the tunnel
+	// can take.
+	content := make([]byte, 300<<10)
+	crand.Read(content)
+	name := writeTestFile(t, src, "f", content)
+	go receiveFiles(b, &dirDestination{dir: dst}, io.Discard, nil, nil, nil)
+	// The sender waits for the file to be acknowledged, once saved.
+	if err := sendFiles(a, []string{name}, io.Discard, sendOptions{ackTimeout: 10 * time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(dst, "f"))
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("got %d bytes, %v that differ from the %d sent", len(got), err, len(content))
+	}
+}
+
+// benchmarkSendFiles measures sending a file with sendFiles to receiveFiles
+// over a local connection whose Write buffers up to writeBuffer bytes.
+func benchmarkSendFiles(b *testing.B, writeBuffer int) {
+	name := filepath.Join(b.TempDir(), "file")
+	if err := os.WriteFile(name, bytes.Repeat([]byte("a"), 16<<20), 0644); err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(16 << 20)
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		sender, receiver := benchLoopback(b, &wormhole.Config{WriteBuffer: writeBuffer})
+		dst := b.TempDir()
+		b.StartTimer()
+		// The receiver only stops once the connection closes, which can
+		// take a while to notice, so stop the clock once the sender has
+		// its acknowledgement instead.
+		go receiveFiles(receiver, &dirDestination{dir: dst}, io.Discard, nil, nil, nil)
+		if err := sendFiles(sender, []string{name}, io.Discard, sendOptions{ackTimeout: 30 * time.Second}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSendFiles64K(b *testing.B)  { benchmarkSendFiles(b, 64<<10) }
+func BenchmarkSendFiles512K(b *testing.B) { benchmarkSendFiles(b, 512<<10) }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	errTooManyFiles = errors.New("sender sent too many files")
+	errTooFast      = errors.New("sender sent file headers too fast")
+)
+
+// limits bounds how much work a sender can make the receiver do, for
+// receivers that take files from anyone. It is shared by all the channels of
+// a transfer. A nil *limits allows anything.
+type limits struct {
+	maxFiles int     // files in a transfer, or 0 for any number
+	rate     float64 // headers a second, or 0 for any rate
+
+	mu     sync.Mutex
+	files  int
+	tokens float64
+	last   time.Time
+}
+
+// header counts h against l, and returns an error if the transfer should
+// be aborted. Bundles count as a header but not a file, since the files in
+// them are counted by file as they are saved.
+func (l *limits) header(h header) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate > 0 {
+		// A token bucket holding up to a second's worth of headers.
+		burst := l.rate
+		if burst < 1 {
+			burst = 1
+		}
+		now := time.Now()
+		if l.last.IsZero() {
+			l.tokens = burst
+		} else {
+			l.tokens += now.Sub(l.last).Seconds() * l.rate
+			if l.tokens > burst {
+				l.tokens = burst
+			}
+		}
+		l.last = now
+		if l.tokens < 1 {
+			return fmt.Errorf("%w: more than %g a second", errTooFast, l.rate)
+		}
+		l.tokens--
+	}
+
+	switch {
+	case l.maxFiles > 0 && h.Files > l.maxFiles:
+		return fmt.Errorf("%w: offered %d, at most %d allowed", errTooManyFiles, h.Files, l.maxFiles)
+	case h.Files > 0 || h.Streams > 0 || h.Bundle:
+		return nil
+	}
+	return l.count()
+}
+
+// file counts a file that came without a header of its own, like one in a
+// bundle, against l's maximum number of files. Only headers are rate
+// limited.
+func (l *limits) file() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.count()
+}
+
+// count counts a file. l.mu must be held.
+func (l *limits) count() error {
+	if l.maxFiles == 0 {
+		return nil
+	}
+	l.files++
+	if l.files > l.maxFiles {
+		return fmt.Errorf("%w: at most %d allowed", errTooManyFiles, l.maxFiles)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestLimits(t *testing.T) {
+	src := t.TempDir()
+	var names []string
+	for i := 0; i < 3; i++ {
+		names = append(names, writeTestFile(t, src, fmt.Sprintf("%d.txt", i), []byte("hello")))
+	}
+
+	tests := []struct {
+		name  string
+		limit *limits
+		offer bool
+		want  error
+		saved int
+	}{
+		{"none", nil, false, nil, 3},
+		{"within", &limits{maxFiles: 3, rate: 100}, false, nil, 3},
+		{"files", &limits{maxFiles: 2}, false, errTooManyFiles, 2},
+		{"offer", &limits{maxFiles: 2}, true, errTooManyFiles, 0},
+		{"rate", &limits{rate: 1}, false, errTooFast, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender, receiver := msgPipe()
+			errc := make(chan error, 1)
+			go func() {
+				defer sender.Close()
+				if tt.offer {
+					if err := offerFiles(sender, names, false); err != nil {
+						errc <- err
+						return
+					}
+				}
+				errc <- sendFiles(sender, names, io.Discard, sendOptions{ackTimeout: time.Second})
+			}()
+
+			results, err := receiveFiles(receiver, &dirDestination{dir: t.TempDir()}, io.Discard, nil, nil, tt.limit)
+			receiver.Close()
+			if !errors.Is(err, tt.want) {
+				t.Errorf("receiver got %v want %v", err, tt.want)
+			}
+			if len(results) != tt.saved {
+				t.Errorf("received %d files want %d", len(results), tt.saved)
+			}
+
+			err = <-errc
+			if tt.want == nil && err != nil {
+				t.Errorf("sender got %v", err)
+			}
+			if tt.want != nil && !errors.Is(err, errDeclined) {
+				t.Errorf("sender got %v want %v", err, errDeclined)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/url"
+)
+
+// codeLink returns a URL that opens code in the web client of server, the
+// signalling server the code is for. It also tells ww which servers to try
+// after it, in order, if server can't be reached or doesn't know the slot,
+// which helps where they lead to the same slots, e.g. server's own address
+// on a LAN. The code is the URL's fragment, so it never reaches the server,
+// and the fallbacks are query parameters, which the web client ignores.
+func codeLink(server, code string, fallbacks ...string) (string, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return "", err
+	}
+	if len(fallbacks) > 0 {
+		q := u.Query()
+		q["fallback"] = append(q["fallback"], fallbacks...)
+		u.RawQuery = q.Encode()
+	}
+	u.Fragment = code
+	return u.String(), nil
+}
+
+// parseLink returns the code in a URL made by codeLink, and the signalling
+// servers to use it with, the preferred one first. It returns false if link
+// isn't such a URL, like when it is a plain code.
+func parseLink(link string) (code string, servers []string, ok bool) {
+	u, err := url.Parse(link)
+	if err != nil || u.Fragment == "" || u.Host == "" {
+		return "", nil, false
+	}
+	switch u.Scheme {
+	case "http", "https", "ws", "wss":
+	default:
+		return "", nil, false
+	}
+	code = u.Fragment
+	fallbacks := u.Query()["fallback"]
+	u.RawQuery, u.Fragment, u.RawFragment = "", "", ""
+	return code, append([]string{u.String()}, fallbacks...), true
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"webwormhole.io/wordlist"
+)
+
+func TestLink(t *testing.T) {
+	code := wordlist.Encode(7, []byte{1, 2, 3})
+	for _, tc := range []struct {
+		server    string
+		fallbacks []string
+		want      []string
+	}{
+		{"https://webwormhole.io/", nil, []string{"https://webwormhole.io/"}},
+		{"https://example.com/teamA", []string{"https://b.example.com/teamA", "http://localhost:8000"}, []string{"https://example.com/teamA", "https://b.example.com/teamA", "http://localhost:8000"}},
+		{"http://[::1]:8000/?other=1", []string{"wss://c.example.com"}, []string{"http://[::1]:8000/", "wss://c.example.com"}},
+	} {
+		link, err := codeLink(tc.server, code, tc.fallbacks...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(link, "#"+code) {
+			t.Errorf("link %s doesn't end in the code", link)
+		}
+		gotCode, servers, ok := parseLink(link)
+		if !ok || gotCode != code || !reflect.DeepEqual(servers, tc.want) {
+			t.Errorf("%s: got %q %q %v want %q %q", link, gotCode, servers, ok, code, tc.want)
+		}
+	}
+
+	// Plain codes and things that aren't links to a server aren't links.
+	for _, s := range []string{code, "7-guitarist-revenge", "https://webwormhole.io/", "#" + code, "file:///tmp/x#" + code, "mailto:a@b#c"} {
+		if _, _, ok := parseLink(s); ok {
+			t.Errorf("parsed %q as a link", s)
+		}
+	}
+}
@@ -5,13 +5,21 @@
 package main
 
 import (
+	"context"
 	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"net"
 	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"rsc.io/qr"
 	"webwormhole.io/wordlist"
@@ -19,23 +27,61 @@ import (
 )
 
 var subcmds = map[string]func(args ...string){
-	"send":    send,
-	"receive": receive,
-	"pipe":    pipe,
-	"server":  server,
+	"send":     send,
+	"receive":  receive,
+	"pipe":     pipe,
+	"ping":     ping,
+	"server":   server,
+	"turntest": turntest,
+	"whoami":   whoami,
+	"tui":      tui,
+	"verify":   verify,
+	"manual":   manual,
+	"convert":  convert,
 }
 
 var (
 	verbose bool   = false
 	sigserv string = "https://webwormhole.io"
+	proxy   string = ""
+	keySalt string = ""
+	keyInfo string = ""
+	label   string = ""
+
+	iceInterfaces string = ""
+	iceExclude    string = ""
+	iceServers    string = ""
+
+	debugBundle string = ""
+	codeFile    string = ""
+	udpPorts    string = ""
+	dscp        string = ""
+	route       bool   = false
+	audit       bool   = false
+	sas         bool   = false
+	signalPin   string = ""
+	reregister  bool   = false
+	confirmJoin bool   = false
+	passphrase  string = ""
+	passFile    string = ""
+	clipboard   bool   = false
 )
 
+// reregisterTimeout is how long -reregister keeps trying to reach a
+// signalling server that dropped our slot.
+const reregisterTimeout = time.Minute
+
+// conf holds the wormhole settings derived from the global flags.
+var conf = &wormhole.Config{}
+
 var stderr = flag.CommandLine.Output()
 
 func usage() {
 	fmt.Fprintf(stderr, "webwormhole creates ephemeral pipes between computers.\n\n")
 	fmt.Fprintf(stderr, "usage:\n\n")
-	fmt.Fprintf(stderr, "  %s [flags] <command> [arguments]\n\n", os.Args[0])
+	fmt.Fprintf(stderr, "  %s [flags] <command> [arguments]\n", os.Args[0])
+	fmt.Fprintf(stderr, "  %s [flags] <code>\n", os.Args[0])
+	fmt.Fprintf(stderr, "  %s [flags] <files>...\n\n", os.Args[0])
 	fmt.Fprintf(stderr, "commands:\n")
 	for key := range subcmds {
 		fmt.Fprintf(stderr, "  %s\n", key)
@@ -46,22 +92,155 @@ func usage() {
 
 func main() {
 	flag.BoolVar(&verbose, "verbose", LookupEnvOrBool("WW_VERBOSE", verbose), "verbose logging")
-	flag.StringVar(&sigserv, "signal", LookupEnvOrString("WW_SIGSERV", sigserv), "signalling server to use")
+	flag.StringVar(&sigserv, "signal", LookupEnvOrString("WW_SIGSERV", sigserv), "signalling server to use, with the namespace to keep slots in as its path if it has them, e.g. https://example.com/teamA, or a comma separated list to fall back on in order if one can't be reached")
+	flag.StringVar(&signalPin, "signal-cert-sha256", LookupEnvOrString("WW_SIGNAL_CERT_SHA256", signalPin), "only trust a signalling server whose certificate or public key has this hex SHA-256 fingerprint")
+	flag.StringVar(&proxy, "proxy", LookupEnvOrString("WW_PROXY", proxy), "http or socks5 proxy to use, with optional user:password@ credentials (default from environment)")
+	flag.StringVar(&keySalt, "key-salt", LookupEnvOrString("WW_KEY_SALT", keySalt), "HKDF salt for deriving the signalling key, must match the peer's")
+	flag.StringVar(&keyInfo, "key-info", LookupEnvOrString("WW_KEY_INFO", keyInfo), "HKDF info for deriving the signalling key, must match the peer's")
+	flag.StringVar(&passFile, "passphrase-file", "", "derive new codes' passwords from the passphrase in this file, or - for the first line of stdin, or else in $WW_PASSPHRASE, instead of generating random ones; much weaker unless the passphrase is long and random")
+	flag.StringVar(&label, "label", LookupEnvOrString("WW_LABEL", label), "name agreed with the peer, e.g. alice-to-bob, without which the connection fails; the web client cannot use one")
+	flag.StringVar(&iceInterfaces, "ice-interfaces", LookupEnvOrString("WW_ICE_INTERFACES", iceInterfaces), "comma separated list of network interfaces to gather ICE candidates from (default all)")
+	flag.StringVar(&iceExclude, "ice-exclude", LookupEnvOrString("WW_ICE_EXCLUDE", iceExclude), "comma separated list of CIDRs never to gather ICE candidates from")
+	flag.StringVar(&codeFile, "code-file", "", "read the wormhole code from this file, or - for the first line of stdin, instead of the command line")
+	flag.StringVar(&debugBundle, "debug-bundle", LookupEnvOrString("WW_DEBUG_BUNDLE", debugBundle), "if connecting fails, write diagnostics as json to this file for bug reports")
+	flag.StringVar(&iceServers, "ice", LookupEnvOrString("WW_ICE", iceServers), "comma separated list of STUN or TURN servers to use along with the signalling server's, with turn:user:password@host for TURN credentials")
+	flag.BoolVar(&conf.IgnoreServerICE, "ignore-server-ice", LookupEnvOrBool("WW_IGNORE_SERVER_ICE", false), "don't use the STUN and TURN servers the signalling server offers, only those given with -ice, so it can't relay the connection through a server of its choosing")
+	flag.BoolVar(&conf.StrictRelay, "strict-relay", LookupEnvOrBool("WW_STRICT_RELAY", false), "like -relay-only, but give up rather than ever send the peer a candidate with our own IP addresses")
+	flag.BoolVar(&conf.RelayOnly, "relay-only", LookupEnvOrBool("WW_RELAY_ONLY", false), "only connect through a TURN relay, so the peer never sees our IP addresses")
+	flag.BoolVar(&conf.Tunnel, "tunnel", LookupEnvOrBool("WW_TUNNEL", false), "encrypt everything sent again on top of DTLS, with a key from the code that the signalling server and relays never see; the peer must use it too and cannot be the web client")
+	flag.BoolVar(&conf.Compress, "compress", LookupEnvOrBool("WW_COMPRESS", false), "ask the signalling server to compress messages")
+	flag.StringVar(&conf.Cipher, "cipher", LookupEnvOrString("WW_CIPHER", wormhole.CipherSecretbox), "cipher to seal signalling messages with, secretbox or xchacha20poly1305, must match the peer's; the web client only uses secretbox")
+	flag.StringVar(&udpPorts, "udp-ports", LookupEnvOrString("WW_UDP_PORTS", udpPorts), "range of local UDP ports to use for ICE, e.g. 50000:50100 (default any)")
+	flag.StringVar(&dscp, "dscp", LookupEnvOrString("WW_DSCP", dscp), "mark the connection's UDP packets with this DSCP, 1 to 63 or a class like EF, AF41 or CS1, for networks with QoS policies")
+	flag.BoolVar(&conf.NoTrickle, "no-trickle", LookupEnvOrBool("WW_NO_TRICKLE", false), "wait for all ICE candidates and send them in the offer or answer instead of one by one")
+	flag.IntVar(&conf.MaxCandidates, "max-candidates", 0, "maximum number of local ICE candidates to send to the peer, 0 for no limit")
+	flag.BoolVar(&reregister, "reregister", LookupEnvOrBool("WW_REREGISTER", reregister), "if the signalling server drops the connection while waiting for the peer, e.g. when restarting, get a new code instead of failing")
+	flag.BoolVar(&confirmJoin, "confirm-join", LookupEnvOrBool("WW_CONFIRM_JOIN", confirmJoin), "once the key is agreed, show a few words to compare with the peer's and ask on the terminal whether they match before connecting, to turn away anyone who got to the code before the peer")
+	flag.BoolVar(&audit, "audit-candidates", LookupEnvOrBool("WW_AUDIT_CANDIDATES", audit), "after connecting, print which types of ICE candidates were sent to the peer, e.g. host ones exposing our IP addresses")
+	flag.BoolVar(&route, "route", LookupEnvOrBool("WW_ROUTE", route), "after connecting, print which ICE candidates and relay the connection uses")
+	flag.BoolVar(&sas, "sas", LookupEnvOrBool("WW_SAS", sas), "after connecting, print a few words to read to the peer, who should see the same ones unless someone is in the middle; the web client does not show them")
 	flag.Usage = usage
 	flag.Parse()
-	if flag.NArg() < 1 {
+	if flag.NArg() < 1 && codeFile == "" && os.Getenv("WW_CODE") == "" {
 		usage()
 		os.Exit(2)
 	}
 	if verbose {
 		wormhole.Verbose = true
 	}
+	if len(signalServers()) == 0 {
+		fatalf("no -signal server given")
+	}
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil {
+			fatalf("invalid proxy url: %v", err)
+		}
+		conf.Proxy = u
+	}
+	if signalPin != "" {
+		pin, err := parseFingerprint(signalPin)
+		if err != nil {
+			fatalf("invalid -signal-cert-sha256: %v", err)
+		}
+		conf.SignalCertFingerprint = pin
+	}
+	if keySalt != "" {
+		conf.KeySalt = []byte(keySalt)
+	}
+	if keyInfo != "" {
+		conf.KeyInfo = []byte(keyInfo)
+	}
+	conf.Label = label
+	if conf.Cipher != wormhole.CipherSecretbox && conf.Cipher != wormhole.CipherXChaCha20Poly1305 {
+		fatalf("invalid -cipher: %q", conf.Cipher)
+	}
+	phrase, err := lookupPassphrase(passFile, os.Stdin)
+	if err != nil {
+		fatalf("could not read -passphrase-file: %v", err)
+	}
+	passphrase = phrase
+	if passphrase != "" {
+		fmt.Fprintf(stderr, "warning: new codes are derived from the passphrase, and only as hard to guess as it is\n")
+	}
+	if confirmJoin {
+		// Stdin may be the data to send, so ask on the terminal instead.
+		tty, err := os.Open("/dev/tty")
+		if err != nil {
+			fatalf("-confirm-join needs a terminal to ask on: %v", err)
+		}
+		conf.ConfirmJoin = askJoin(tty)
+	}
+	if debugBundle != "" {
+		conf.Failed = saveDebugBundle
+	}
+	if iceInterfaces != "" {
+		conf.InterfaceFilter = interfaceFilter(iceInterfaces)
+	}
+	if udpPorts != "" {
+		min, max, err := portRange(udpPorts)
+		if err != nil {
+			fatalf("invalid -udp-ports: %v", err)
+		}
+		conf.UDPPortMin, conf.UDPPortMax = min, max
+	}
+	if dscp != "" {
+		v, err := parseDSCP(dscp)
+		if err != nil {
+			fatalf("invalid -dscp: %v", err)
+		}
+		conf.DSCP = v
+	}
+	if iceExclude != "" {
+		f, err := ipFilter(iceExclude)
+		if err != nil {
+			fatalf("invalid -ice-exclude: %v", err)
+		}
+		conf.IPFilter = f
+	}
+	if iceServers != "" {
+		ice, err := wormhole.ParseICEServers(strings.Split(iceServers, ","))
+		if err != nil {
+			fatalf("invalid -ice: %v", err)
+		}
+		conf.ICEServers = ice
+	}
+	args := flag.Args()
 	cmd, ok := subcmds[flag.Arg(0)]
 	if !ok {
-		flag.Usage()
-		os.Exit(2)
+		name, err := guessCommand(args)
+		if err != nil {
+			fmt.Fprintf(stderr, "%v\n\n", err)
+			flag.Usage()
+			os.Exit(2)
+		}
+		cmd, args = subcmds[name], append([]string{name}, args...)
+	}
+	cmd(args...)
+}
+
+// guessCommand works out whether args, which don't start with a subcommand,
+// are a code to receive with or files to send. No args means receive with
+// a code from -code-file or $WW_CODE.
+func guessCommand(args []string) (string, error) {
+	if len(args) == 0 {
+		return "receive", nil
+	}
+	_, pass := wordlist.Decode(args[0])
+	_, err := os.Stat(args[0])
+	isCode, isFile := pass != nil, err == nil
+	switch {
+	case len(args) == 1 && isCode && isFile:
+		return "", fmt.Errorf("%q is both a code and a file, use send or receive", args[0])
+	case len(args) == 1 && isCode:
+		return "receive", nil
+	}
+	for _, arg := range args {
+		if _, err := os.Stat(arg); err != nil {
+			return "", fmt.Errorf("%q is neither a code nor a file to send", arg)
+		}
 	}
-	cmd(flag.Args()...)
+	return "send", nil
 }
 
 func fatalf(format string, v ...interface{}) {
@@ -69,47 +248,49 @@ func fatalf(format string, v ...interface{}) {
 	os.Exit(1)
 }
 
-func newConn(code string, length int) *wormhole.Wormhole {
+// exitTimedOut is the exit status when no one joined the wormhole in time.
+const exitTimedOut = 3
+
+// connection is a connected wormhole and how it came about.
+type connection struct {
+	*wormhole.Wormhole
+
+	// code is the wormhole code, given or generated, and slot the
+	// signalling server slot in it.
+	code string
+	slot int
+
+	// relay is whether the connection goes through a TURN relay.
+	relay bool
+
+	// server is the signalling server used.
+	server string
+}
+
+// newConn joins the wormhole for code, or creates a new one with a password
+// of length bytes if code is empty. If rotate is non-zero, a new code is
+// generated every rotate until someone connects. If wait is non-zero, it
+// gives up after that long without anyone connecting.
+func newConn(code string, length int, rotate, wait time.Duration) *connection {
+	code, err := lookupCode(code, codeFile, os.Stdin)
+	if err != nil {
+		fatalf("could not read code: %v", err)
+	}
+	var c *connection
 	if code != "" {
 		// Join wormhole.
+		var servers []string
+		code, servers = codeServers(code)
 		slot, pass := wordlist.Decode(code)
 		if pass == nil {
 			fatalf("could not decode password")
 		}
-		c, err := wormhole.Join(strconv.Itoa(slot), string(pass), sigserv)
-		if err == wormhole.ErrBadVersion {
-			fatalf(
-				"%s%s%s",
-				"the signalling server is running an incompatable version.\n",
-				"try upgrading the client:\n\n",
-				"    go get webwormhole.io/cmd/ww\n",
-			)
-		}
-		if err != nil {
-			fatalf("could not dial: %v", err)
-		}
-		if c.IsRelay() {
-			fmt.Fprintf(stderr, "connected: relay\n")
-		} else {
-			fmt.Fprintf(stderr, "connected: direct\n")
-		}
-		return c
-	}
-	// New wormhole.
-	pass := make([]byte, length)
-	if _, err := io.ReadFull(crand.Reader, pass); err != nil {
-		fatalf("could not generate password: %v", err)
+		c, err = join(slot, string(pass), servers)
+		c.code, c.slot = code, slot
+	} else {
+		// New wormhole.
+		c, err = create(length, rotate, wait)
 	}
-	slotc := make(chan string)
-	go func() {
-		s := <-slotc
-		slot, err := strconv.Atoi(s)
-		if err != nil {
-			fatalf("got invalid slot from signalling server: %v", s)
-		}
-		printcode(wordlist.Encode(slot, pass))
-	}()
-	c, err := wormhole.New(string(pass), sigserv, slotc)
 	if err == wormhole.ErrBadVersion {
 		fatalf(
 			"%s%s%s",
@@ -118,25 +299,473 @@ func newConn(code string, length int) *wormhole.Wormhole {
 			"    go get webwormhole.io/cmd/ww\n",
 		)
 	}
+	if err == wormhole.ErrNoSuchSlot {
+		fatalf("code not found or already used, check it or ask the sender for a new one")
+	}
+	if err == wormhole.ErrSlotTaken {
+		fatalf("someone else already joined with this code; if it wasn't you, ask the sender for a new one")
+	}
+	if err == wormhole.ErrJoinRejected {
+		fatalf("the connection was turned down after comparing words")
+	}
+	var short *wormhole.PassTooShortError
+	if errors.As(err, &short) {
+		fatalf("the code is too weak for the signalling server, whose secrets must be at least %d long", short.Min)
+	}
+	if err == wormhole.ErrCipherMismatch {
+		fatalf("the sender uses a different -cipher")
+	}
+	if err == wormhole.ErrTunnelMismatch {
+		fatalf("only one side used -tunnel, both must")
+	}
+	if err == wormhole.ErrNoRelay && conf.IgnoreServerICE {
+		fatalf("-relay-only needs a TURN relay given with -ice when using -ignore-server-ice")
+	}
+	if err == wormhole.ErrNoRelay {
+		fatalf("the signalling server did not offer a TURN relay, which -relay-only needs")
+	}
+	if err == wormhole.ErrNoRelayCandidate {
+		fatalf("none of the TURN servers gave us a relay, which -relay-only and -strict-relay need")
+	}
+	if err == wormhole.ErrNeedTURN {
+		fatalf("could not connect directly to the peer, likely because both are behind symmetric NATs, and there was no TURN relay to fall back on; use a signalling server that offers one, see its -turn flag")
+	}
+	var closed *wormhole.CloseError
+	if errors.As(err, &closed) && closed.Reason != "" {
+		fatalf("the signalling server hung up: %s", closed.Reason)
+	}
+	if err == wormhole.ErrTimedOut {
+		fmt.Fprintf(stderr, "timed out waiting for the peer\n")
+		os.Exit(exitTimedOut)
+	}
 	if err != nil {
 		fatalf("could not dial: %v", err)
 	}
-	if c.IsRelay() {
+	c.relay = c.IsRelay()
+	printConnected(c)
+	return c
+}
+
+// signalServers returns the signalling servers to try, in order.
+func signalServers() []string {
+	var servers []string
+	for _, s := range strings.Split(sigserv, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			servers = append(servers, s)
+		}
+	}
+	return servers
+}
+
+// codeServers returns the code in code, which may be a link to it, and the
+// signalling servers to join it on: those in the link if it is one, so the
+// receiver ends up on the sender's server whatever its -signal, or else
+// those given with -signal.
+func codeServers(code string) (string, []string) {
+	if c, servers, ok := parseLink(code); ok {
+		return c, servers
+	}
+	return code, signalServers()
+}
+
+// tryNext reports whether err means a signalling server can't be used at
+// all, before any slot was made or joined on it, so the next one should
+// be tried. Peers may still see different servers as down, so the one
+// joining also tries the next on wormhole.ErrNoSuchSlot, see join. A server
+// failing the certificate pin is not skipped over, since someone might be
+// in the middle.
+func tryNext(err error) bool {
+	var dialErr *wormhole.DialError
+	if errors.As(err, &dialErr) {
+		return !errors.Is(err, wormhole.ErrCertMismatch)
+	}
+	return err == wormhole.ErrBadVersion
+}
+
+// join joins slot on the first of servers that can be reached and has it.
+// The sender may have found a server down that we can reach, and so made
+// its slot on a later one, which is why a server without the slot doesn't
+// stop us trying the rest. Slots no server hands out fail with
+// wormhole.ErrNoSuchSlot without asking one.
+func join(slot int, pass string, servers []string) (*connection, error) {
+	if slot < 0 || slot >= wordlist.MaxSlots {
+		return &connection{}, wormhole.ErrNoSuchSlot
+	}
+	noSlot := false // Whether a server we reached didn't have the slot.
+	for i := 0; ; i++ {
+		c, err := conf.Join(strconv.Itoa(slot), pass, servers[i])
+		if err == wormhole.ErrNoSuchSlot {
+			noSlot = true
+		}
+		if err != nil && (tryNext(err) || err == wormhole.ErrNoSuchSlot) && i+1 < len(servers) {
+			fmt.Fprintf(stderr, "could not use signalling server %s: %v\n", servers[i], err)
+			continue
+		}
+		if err != nil && tryNext(err) && noSlot {
+			// The last server being down says less about the code
+			// than an earlier one not knowing it.
+			err = wormhole.ErrNoSuchSlot
+		}
+		return &connection{Wormhole: c, server: servers[i]}, err
+	}
+}
+
+// askJoin returns a Config.ConfirmJoin for -confirm-join that asks on tty
+// whether the peer sees the same words.
+func askJoin(tty io.Reader) func(sas string) bool {
+	return func(sas string) bool {
+		fmt.Fprintf(stderr, "check your peer sees these words: %s\ndo they match? [y/N] ", sas)
+		answer, err := readLine(tty)
+		return err == nil && (answer == "y" || answer == "yes")
+	}
+}
+
+// lookupPassphrase returns the passphrase to derive new codes' passwords
+// from, read from file like lookupCode does, or else $WW_PASSPHRASE. There
+// is no flag taking it on the command line, where other users could see it
+// in process listings and it would be saved in shell history.
+func lookupPassphrase(file string, stdin io.Reader) (string, error) {
+	if file == "" {
+		return os.Getenv("WW_PASSPHRASE"), nil
+	}
+	return lookupCode("", file, stdin)
+}
+
+// newPass returns a password of length bytes for a new wormhole, derived
+// from the passphrase if there is one.
+func newPass(length int) ([]byte, error) {
+	if passphrase != "" {
+		return wordlist.DerivePass(passphrase, length)
+	}
+	pass := make([]byte, length)
+	_, err := io.ReadFull(random(), pass)
+	return pass, err
+}
+
+// create makes a new wormhole with a password of length bytes and prints
+// its code. If rotate is non-zero, a new code is generated every rotate
+// until someone connects. If wait is non-zero, it returns
+// wormhole.ErrTimedOut if no one has connected after that long. The first
+// signalling server that can be reached is used.
+func create(length int, rotate, wait time.Duration) (*connection, error) {
+	parent := context.Background()
+	if wait > 0 {
+		var cancel context.CancelFunc
+		parent, cancel = context.WithTimeout(parent, wait)
+		defer cancel()
+	}
+	servers := signalServers()
+	next := 0          // The server to try next.
+	var lost time.Time // When the signalling server last dropped our slot.
+	for {
+		server := servers[next]
+		pass, err := newPass(length)
+		if err != nil {
+			fatalf("could not generate password: %v", err)
+		}
+		slotc := make(chan string)
+		stop, printed := make(chan struct{}), make(chan struct{})
+		registered := false
+		var slot int
+		go func() {
+			defer close(printed)
+			select {
+			case s := <-slotc:
+				var err error
+				slot, err = strconv.Atoi(s)
+				if err != nil {
+					fatalf("got invalid slot from signalling server: %v", s)
+				}
+				registered = true
+				printcode(wordlist.Encode(slot, pass), server, servers[next+1:])
+				if clipboard {
+					copyCode(wordlist.Encode(slot, pass))
+				}
+				if len(servers) > 1 {
+					fmt.Fprintf(stderr, "using signalling server %s, receive with the link above or -signal %s\n", server, server)
+				}
+			case <-stop:
+			}
+		}()
+		ctx, cancel := context.WithCancel(parent)
+		if rotate > 0 {
+			time.AfterFunc(rotate, cancel)
+		}
+		c, err := conf.NewContext(ctx, string(pass), server, slotc)
+		cancel()
+		// Don't print a code after giving up on it.
+		close(stop)
+		<-printed
+		if err == nil {
+			return &connection{Wormhole: c, code: wordlist.Encode(slot, pass), slot: slot, server: server}, nil
+		}
+		if !registered && tryNext(err) && next+1 < len(servers) {
+			fmt.Fprintf(stderr, "could not use signalling server %s: %v\n", server, err)
+			next++
+			continue
+		}
+		if err == context.Canceled {
+			fmt.Fprintf(stderr, "no one connected, generating a new code\n")
+			continue
+		}
+		if err == wormhole.ErrJoinRejected {
+			fmt.Fprintf(stderr, "turned them away, generating a new code\n")
+			continue
+		}
+		var short *wormhole.PassTooShortError
+		if !registered && errors.As(err, &short) && length < short.Min {
+			fmt.Fprintf(stderr, "the signalling server requires secrets of at least length %d, generating a longer code\n", short.Min)
+			length = short.Min
+			continue
+		}
+		if reregister && err == wormhole.ErrSlotLost {
+			fmt.Fprintf(stderr, "lost connection to the signalling server, generating a new code\n")
+			lost, next = time.Now(), 0
+			continue
+		}
+		// If we never got a slot, the signalling server is probably still
+		// restarting.
+		if !registered && reregister && !lost.IsZero() && time.Since(lost) < reregisterTimeout {
+			select {
+			case <-time.After(time.Second):
+				next = 0
+				continue
+			case <-parent.Done():
+				err = parent.Err()
+			}
+		}
+		if err == context.DeadlineExceeded {
+			err = wormhole.ErrTimedOut
+		}
+		return &connection{Wormhole: c}, err
+	}
+}
+
+// printConnected tells the user how c is connected: over a relay or
+// directly, with -route which candidates it uses, with -audit-candidates
+// which types of candidates the peer was sent, and with -sas the short
+// authentication string to compare with the peer's.
+func printConnected(c *connection) {
+	r := ""
+	if route {
+		r = c.Route()
+	}
+	switch {
+	case r != "":
+		fmt.Fprintf(stderr, "connected: %s\n", r)
+	case c.relay:
 		fmt.Fprintf(stderr, "connected: relay\n")
-	} else {
+	default:
 		fmt.Fprintf(stderr, "connected: direct\n")
 	}
-	return c
+	if audit {
+		types := wormhole.CandidateTypes(c.Diagnostics().SentCandidates)
+		fmt.Fprintf(stderr, "sent candidates: %s\n", candidateSummary(types))
+	}
+	if sas {
+		s, err := c.ShortAuthString()
+		if err != nil {
+			fatalf("could not derive the short authentication string: %v", err)
+		}
+		fmt.Fprintf(stderr, "verify with the peer that they see: %s\n", s)
+	}
+}
+
+// candidateSummary describes how many candidates of each type there are in
+// types, as counted by wormhole.CandidateTypes. Types that can expose our
+// addresses are always listed, even if none were sent.
+func candidateSummary(types map[string]int) string {
+	var parts []string
+	for _, typ := range []string{"host", "srflx", "prflx", "relay"} {
+		if n, ok := types[typ]; ok || typ != "prflx" {
+			parts = append(parts, fmt.Sprintf("%d %s", n, typ))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// random returns the source of randomness for generated passwords, which is
+// conf.Rand if it is set for tests.
+func random() io.Reader {
+	if conf.Rand != nil {
+		return conf.Rand
+	}
+	return crand.Reader
+}
+
+// receiveCode returns the code receive joins with: arg, or, if neither it
+// nor -code-file is given, $WW_CODE. Other commands don't read $WW_CODE,
+// so that having it set doesn't make them join instead of creating a new
+// wormhole.
+func receiveCode(arg string) string {
+	if arg == "" && codeFile == "" {
+		return os.Getenv("WW_CODE")
+	}
+	return arg
+}
+
+// lookupCode returns the wormhole code to use, keeping it out of process
+// listings if needed. A code given on the command line wins, then one read
+// from file ("-" meaning stdin). An empty code means a new wormhole should
+// be created.
+func lookupCode(arg, file string, stdin io.Reader) (string, error) {
+	if arg != "" {
+		return arg, nil
+	}
+	if file == "-" {
+		return readLine(stdin)
+	}
+	if file != "" {
+		buf, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(buf)), nil
+	}
+	return "", nil
+}
+
+// readLine reads the first line of r, one byte at a time so that anything
+// after it is left for whoever reads r next, e.g. pipe.
+func readLine(r io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := r.Read(b)
+		if n > 0 {
+			if b[0] == '\n' {
+				break
+			}
+			line = append(line, b[0])
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return strings.TrimSpace(string(line)), nil
+}
+
+// saveDebugBundle writes the diagnostics d of a failed connection to the
+// file named by -debug-bundle.
+func saveDebugBundle(d *wormhole.Diagnostics) {
+	err := writeDebugBundle(debugBundle, d)
+	if err != nil {
+		fmt.Fprintf(stderr, "could not write debug bundle: %v\n", err)
+		return
+	}
+	fmt.Fprintf(stderr, "wrote debug bundle to %s\n", debugBundle)
+}
+
+func writeDebugBundle(path string, d *wormhole.Diagnostics) error {
+	buf, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf, 0644)
+}
+
+// portRange parses a range of ports written as min:max.
+func portRange(s string) (min, max uint16, err error) {
+	lo, hi, ok := strings.Cut(s, ":")
+	if !ok {
+		return 0, 0, fmt.Errorf("%q is not of the form min:max", s)
+	}
+	l, err := strconv.ParseUint(lo, 10, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	h, err := strconv.ParseUint(hi, 10, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	if l == 0 || h < l {
+		return 0, 0, fmt.Errorf("%q is not a valid range of ports", s)
+	}
+	return uint16(l), uint16(h), nil
+}
+
+// dscpClasses are the DSCP values of the standard class selector, assured
+// forwarding and expedited forwarding classes.
+var dscpClasses = map[string]int{
+	"CS1": 8, "CS2": 16, "CS3": 24, "CS4": 32, "CS5": 40, "CS6": 48, "CS7": 56,
+	"AF11": 10, "AF12": 12, "AF13": 14,
+	"AF21": 18, "AF22": 20, "AF23": 22,
+	"AF31": 26, "AF32": 28, "AF33": 30,
+	"AF41": 34, "AF42": 36, "AF43": 38,
+	"EF": 46,
+}
+
+// parseDSCP parses a DSCP written as a number or a class name.
+func parseDSCP(s string) (int, error) {
+	if v, ok := dscpClasses[strings.ToUpper(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.ParseUint(s, 0, 8)
+	if err != nil || v < 1 || v > 63 {
+		return 0, fmt.Errorf("%q is not a class name or a number from 1 to 63", s)
+	}
+	return int(v), nil
+}
+
+// parseFingerprint parses a hex SHA-256 fingerprint, optionally with colons
+// between bytes as openssl prints them.
+func parseFingerprint(s string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, ":", ""))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != sha256.Size {
+		return nil, fmt.Errorf("got %d bytes, want %d", len(b), sha256.Size)
+	}
+	return b, nil
+}
+
+// interfaceFilter returns an ICE interface filter that only allows the
+// interfaces in the comma separated list.
+func interfaceFilter(list string) func(string) bool {
+	allowed := make(map[string]bool)
+	for _, name := range strings.Split(list, ",") {
+		allowed[strings.TrimSpace(name)] = true
+	}
+	return func(name string) bool {
+		return allowed[name]
+	}
+}
+
+// ipFilter returns an ICE address filter that rejects addresses in any of
+// the comma separated list of CIDRs.
+func ipFilter(cidrs string) (func(net.IP) bool, error) {
+	var excluded []*net.IPNet
+	for _, s := range strings.Split(cidrs, ",") {
+		_, n, err := net.ParseCIDR(strings.TrimSpace(s))
+		if err != nil {
+			return nil, err
+		}
+		excluded = append(excluded, n)
+	}
+	return func(ip net.IP) bool {
+		for _, n := range excluded {
+			if n.Contains(ip) {
+				return false
+			}
+		}
+		return true
+	}, nil
 }
 
-func printcode(code string) {
+// printcode prints code, and a QR code of the link to open it with
+// server's web client, which ww also takes as a code to join on server, or
+// else on fallbacks.
+func printcode(code, server string, fallbacks []string) {
 	fmt.Fprintf(stderr, "%s\n", code)
-	u, err := url.Parse(sigserv)
+	link, err := codeLink(server, code, fallbacks...)
 	if err != nil {
 		return
 	}
-	u.Fragment = code
-	qrcode, err := qr.Encode(u.String(), qr.L)
+	qrcode, err := qr.Encode(link, qr.L)
 	if err != nil {
 		return
 	}
@@ -172,7 +801,7 @@ func printcode(code string) {
 		fmt.Fprintf(stderr, "█")
 	}
 	fmt.Fprintf(stderr, "████████\n")
-	fmt.Fprintf(stderr, "%s\n", u.String())
+	fmt.Fprintf(stderr, "%s\n", link)
 }
 
 func LookupEnvOrBool(key string, defaultVal bool) bool {
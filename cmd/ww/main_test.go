@@ -0,0 +1,629 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+	"webwormhole.io/wordlist"
+	"webwormhole.io/wormhole"
+)
+
+func TestLookupCode(t *testing.T) {
+	file := writeTestFile(t, t.TempDir(), "code", []byte("file-code\n"))
+
+	cases := []struct {
+		name      string
+		arg, file string
+		stdin     string
+		want      string
+	}{
+		{"arg wins", "arg-code", file, "stdin-code\n", "arg-code"},
+		{"file", "", file, "", "file-code"},
+		{"stdin", "", "-", "stdin-code\n", "stdin-code"},
+		{"none", "", "", "stdin-code\n", ""},
+	}
+	for _, c := range cases {
+		got, err := lookupCode(c.arg, c.file, strings.NewReader(c.stdin))
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%s: got %q want %q", c.name, got, c.want)
+		}
+	}
+
+	if _, err := lookupCode("", filepath.Join(t.TempDir(), "missing"), nil); err == nil {
+		t.Error("missing code file did not fail")
+	}
+}
+
+func TestReceiveCode(t *testing.T) {
+	defer func(f string) { codeFile = f }(codeFile)
+	t.Setenv("WW_CODE", "env-code")
+
+	codeFile = ""
+	if got := receiveCode("arg-code"); got != "arg-code" {
+		t.Errorf("with arg: got %q want %q", got, "arg-code")
+	}
+	if got := receiveCode(""); got != "env-code" {
+		t.Errorf("without arg: got %q want %q", got, "env-code")
+	}
+	codeFile = "-"
+	if got := receiveCode(""); got != "" {
+		t.Errorf("with -code-file: got %q want it read instead", got)
+	}
+
+	// Only receive reads it.
+	codeFile = ""
+	if got, err := lookupCode("", "", nil); got != "" || err != nil {
+		t.Errorf("got %q, %v want a new wormhole", got, err)
+	}
+}
+
+func TestLookupCodeLeavesStdin(t *testing.T) {
+	stdin := strings.NewReader("stdin-code\npiped data")
+	code, err := lookupCode("", "-", stdin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != "stdin-code" {
+		t.Errorf("got code %q want %q", code, "stdin-code")
+	}
+	rest, _ := io.ReadAll(stdin)
+	if string(rest) != "piped data" {
+		t.Errorf("rest of stdin got %q want %q", rest, "piped data")
+	}
+}
+
+func TestGuessCommand(t *testing.T) {
+	dir := t.TempDir()
+	a := writeTestFile(t, dir, "a.txt", []byte("a"))
+	b := writeTestFile(t, dir, "b.txt", []byte("b"))
+
+	// Run from dir so relative names below can be files.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	cases := []struct {
+		args []string
+		want string // empty for an error
+	}{
+		{nil, "receive"},
+		{[]string{"affix-acre"}, "receive"},
+		{[]string{a}, "send"},
+		{[]string{a, b}, "send"},
+		{[]string{"a.txt", "affix-acre"}, ""}, // a code among files
+		{[]string{"nonexistent"}, ""},
+		{[]string{a, "nonexistent"}, ""},
+	}
+	for _, c := range cases {
+		got, err := guessCommand(c.args)
+		if c.want == "" && err == nil {
+			t.Errorf("%q: got %v want an error", c.args, got)
+		}
+		if c.want != "" && (err != nil || got != c.want) {
+			t.Errorf("%q: got %v, %v want %v", c.args, got, err, c.want)
+		}
+	}
+
+	// A file that also decodes as a code is ambiguous.
+	writeTestFile(t, dir, "affix-acre", []byte("c"))
+	if got, err := guessCommand([]string{"affix-acre"}); err == nil {
+		t.Errorf("ambiguous argument got %v want an error", got)
+	}
+}
+
+func TestPortRange(t *testing.T) {
+	min, max, err := portRange("50000:50100")
+	if err != nil || min != 50000 || max != 50100 {
+		t.Errorf("got %v, %v, %v want 50000, 50100", min, max, err)
+	}
+	for _, s := range []string{"", "50000", "50100:50000", "0:10", "1:70000", "a:b", "1-2"} {
+		if _, _, err := portRange(s); err == nil {
+			t.Errorf("%q: got no error", s)
+		}
+	}
+}
+
+func TestParseDSCP(t *testing.T) {
+	for s, want := range map[string]int{"46": 46, "ef": 46, "AF41": 34, "CS1": 8, "0x3f": 63} {
+		got, err := parseDSCP(s)
+		if err != nil || got != want {
+			t.Errorf("%q: got %v, %v want %v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "0", "64", "-1", "AF44", "best"} {
+		if _, err := parseDSCP(s); err == nil {
+			t.Errorf("%q: got no error", s)
+		}
+	}
+}
+
+func TestParseFingerprint(t *testing.T) {
+	want := bytes.Repeat([]byte{0xab}, 32)
+	for _, s := range []string{strings.Repeat("ab", 32), strings.Repeat("AB:", 31) + "AB"} {
+		got, err := parseFingerprint(s)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%q: got %x, %v want %x", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"ab", strings.Repeat("zz", 32), strings.Repeat("ab", 33)} {
+		if _, err := parseFingerprint(s); err == nil {
+			t.Errorf("%q: got no error", s)
+		}
+	}
+}
+
+func TestCreateWait(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(relay))
+	defer srv.Close()
+	defer func(s string, w io.Writer) { sigserv, stderr = s, w }(sigserv, stderr)
+	sigserv, stderr = srv.URL, io.Discard
+
+	defer func(f func(*wormhole.Diagnostics)) { conf.Failed = f }(conf.Failed)
+	var failed *wormhole.Diagnostics
+	conf.Failed = func(d *wormhole.Diagnostics) { failed = d }
+
+	start := time.Now()
+	c, err := create(2, 0, 100*time.Millisecond)
+	if err != wormhole.ErrTimedOut {
+		t.Fatalf("got %v want %v", err, wormhole.ErrTimedOut)
+	}
+	if c.Wormhole != nil {
+		t.Error("got a wormhole from a failed create")
+	}
+	if failed == nil {
+		t.Error("got no diagnostics")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("gave up after %v", d)
+	}
+
+	// Rotating codes doesn't extend the wait.
+	start = time.Now()
+	if _, err := create(2, 30*time.Millisecond, 100*time.Millisecond); err != wormhole.ErrTimedOut {
+		t.Fatalf("got %v want %v", err, wormhole.ErrTimedOut)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("gave up after %v", d)
+	}
+}
+
+func TestMinPassLength(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(relay))
+	defer srv.Close()
+	r, w := io.Pipe()
+	defer r.Close()
+	defer func(s string, w io.Writer, n int) { sigserv, stderr, minPassLength = s, w, n }(sigserv, stderr, minPassLength)
+	sigserv, stderr, minPassLength = srv.URL, w, 4
+
+	codes := make(chan string, 2)
+	go func() {
+		s := bufio.NewScanner(r)
+		for s.Scan() {
+			if _, pass := wordlist.Decode(s.Text()); pass != nil {
+				codes <- s.Text()
+			}
+		}
+	}()
+	type result struct {
+		c   *connection
+		err error
+	}
+	created := make(chan result, 1)
+	go func() {
+		c, err := create(2, 0, 10*time.Second)
+		created <- result{c, err}
+	}()
+
+	// Codes too short for the server are never handed out.
+	slot, pass := wordlist.Decode(<-codes)
+	if len(pass) != 4 {
+		t.Fatalf("generated a %d byte secret, want 4", len(pass))
+	}
+	// Nor accepted.
+	var short *wormhole.PassTooShortError
+	if _, err := conf.Join(strconv.Itoa(slot), string(pass[:2]), srv.URL); !errors.As(err, &short) || short.Min != 4 {
+		t.Fatalf("joining with a short secret got %v want a %T", err, short)
+	}
+	if res := <-created; res.err == nil {
+		res.c.Close()
+		t.Fatal("connected to a peer with a short secret")
+	}
+
+	go func() {
+		c, err := create(4, 0, 10*time.Second)
+		created <- result{c, err}
+	}()
+	slot, pass = wordlist.Decode(<-codes)
+	b, err := conf.Join(strconv.Itoa(slot), string(pass), srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	res := <-created
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	res.c.Close()
+}
+
+func TestCreateReregister(t *testing.T) {
+	// Keep track of connections to be able to drop them even after the
+	// WebSocket handshake hijacks them.
+	var mu sync.Mutex
+	var conns []net.Conn
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(relay))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			conns = append(conns, c)
+			mu.Unlock()
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+	r, w := io.Pipe()
+	defer r.Close()
+	defer func(s string, w io.Writer, b bool) { sigserv, stderr, reregister = s, w, b }(sigserv, stderr, reregister)
+	sigserv, stderr, reregister = srv.URL, w, true
+
+	codes := make(chan string, 2)
+	go func() {
+		s := bufio.NewScanner(r)
+		for s.Scan() {
+			if _, pass := wordlist.Decode(s.Text()); pass != nil {
+				codes <- s.Text()
+			}
+		}
+	}()
+	type result struct {
+		c   *connection
+		err error
+	}
+	created := make(chan result, 1)
+	go func() {
+		c, err := create(2, 0, 10*time.Second)
+		created <- result{c, err}
+	}()
+
+	first := <-codes
+	// Pretend the server restarted by dropping every connection.
+	mu.Lock()
+	for _, c := range conns {
+		c.Close()
+	}
+	mu.Unlock()
+	var second string
+	select {
+	case second = <-codes:
+	case r := <-created:
+		t.Fatalf("create returned %v instead of registering again", r.err)
+	}
+	if second == first {
+		t.Fatalf("got the same code %v again", first)
+	}
+
+	slot, pass := wordlist.Decode(second)
+	b, err := conf.Join(strconv.Itoa(slot), string(pass), srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	res := <-created
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	res.c.Close()
+}
+
+func TestNewConn(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(relay))
+	defer srv.Close()
+	r, w := io.Pipe()
+	defer r.Close()
+	defer func(s string, w io.Writer) { sigserv, stderr = s, w }(sigserv, stderr)
+	sigserv, stderr = srv.URL, w
+
+	codes := make(chan string, 1)
+	go func() {
+		s := bufio.NewScanner(r)
+		for s.Scan() {
+			if _, pass := wordlist.Decode(s.Text()); pass != nil {
+				codes <- s.Text()
+			}
+		}
+	}()
+	created := make(chan *connection, 1)
+	go func() {
+		created <- newConn("", 2, 0, 10*time.Second)
+	}()
+	b := newConn(<-codes, 2, 0, 0)
+	defer b.Close()
+	a := <-created
+	defer a.Close()
+
+	slot, _ := wordlist.Decode(b.code)
+	for _, c := range []*connection{a, b} {
+		if c.Wormhole == nil {
+			t.Fatal("no wormhole")
+		}
+		if c.code != b.code || c.slot != slot {
+			t.Errorf("got code %v, slot %v want %v, %v", c.code, c.slot, b.code, slot)
+		}
+		if c.relay {
+			t.Error("loopback connection went through a relay")
+		}
+	}
+	if _, err := a.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(b, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("got %q, %v", buf, err)
+	}
+}
+
+func TestSignalFallback(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(relay))
+	down.Close()
+	srv := httptest.NewServer(http.HandlerFunc(relay))
+	defer srv.Close()
+	r, w := io.Pipe()
+	defer r.Close()
+	defer func(s string, w io.Writer) { sigserv, stderr = s, w }(sigserv, stderr)
+	sigserv, stderr = down.URL+", "+srv.URL, w
+
+	codes := make(chan string, 1)
+	go func() {
+		s := bufio.NewScanner(r)
+		for s.Scan() {
+			if _, pass := wordlist.Decode(s.Text()); pass != nil {
+				codes <- s.Text()
+			}
+		}
+	}()
+	created := make(chan *connection, 1)
+	go func() {
+		created <- newConn("", 2, 0, 10*time.Second)
+	}()
+	b := newConn(<-codes, 2, 0, 0)
+	defer b.Close()
+	a := <-created
+	defer a.Close()
+
+	for _, c := range []*connection{a, b} {
+		if c.server != srv.URL {
+			t.Errorf("used signalling server %v want %v", c.server, srv.URL)
+		}
+	}
+}
+
+func TestTryNext(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want bool
+	}{
+		{&wormhole.DialError{Server: "a", Err: io.EOF}, true},
+		{&wormhole.DialError{Server: "a", Err: wormhole.ErrCertMismatch}, false},
+		{wormhole.ErrBadVersion, true},
+		{wormhole.ErrNoSuchSlot, false},
+		{wormhole.ErrBadKey, false},
+	} {
+		if got := tryNext(tt.err); got != tt.want {
+			t.Errorf("tryNext(%v) = %v want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestJoinNoSuchSlot(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(relay))
+	down.Close()
+	srv := httptest.NewServer(http.HandlerFunc(relay))
+	defer srv.Close()
+	defer func(s string) { sigserv = s }(sigserv)
+
+	// Slots no server hands out aren't looked up at all.
+	sigserv = down.URL
+	huge, _ := wordlist.Decode(wordlist.Encode(wordlist.MaxSlots, []byte{1, 2}))
+	for _, slot := range []int{-1, wordlist.MaxSlots, huge} {
+		if _, err := join(slot, "pass", signalServers()); err != wormhole.ErrNoSuchSlot {
+			t.Errorf("slot %v: got %v want %v", slot, err, wormhole.ErrNoSuchSlot)
+		}
+	}
+
+	defer func(f func(*wormhole.Diagnostics)) { conf.Failed = f }(conf.Failed)
+	var failed *wormhole.Diagnostics
+	conf.Failed = func(d *wormhole.Diagnostics) { failed = d }
+	sigserv = srv.URL
+	c, err := join(wordlist.MaxSlots-1, "pass", signalServers())
+	if err != wormhole.ErrNoSuchSlot {
+		t.Errorf("free slot: got %v want %v", err, wormhole.ErrNoSuchSlot)
+	}
+	if c.Wormhole != nil {
+		t.Error("got a wormhole from a failed join")
+	}
+	if failed == nil || failed.Error != wormhole.ErrNoSuchSlot.Error() {
+		t.Errorf("got diagnostics %+v want the error recorded", failed)
+	}
+}
+
+func TestJoinOtherServer(t *testing.T) {
+	// A server that doesn't have the slot, like one the sender found
+	// down but we can reach.
+	empty := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{Subprotocols: []string{wormhole.Protocol}})
+		if err != nil {
+			return
+		}
+		conn.Close(wormhole.CloseNoSuchSlot, "")
+	}))
+	defer empty.Close()
+	down := httptest.NewServer(http.HandlerFunc(relay))
+	down.Close()
+	srv := httptest.NewServer(http.HandlerFunc(relay))
+	defer srv.Close()
+	defer func(w io.Writer) { stderr = w }(stderr)
+	stderr = io.Discard
+
+	pass := []byte{1, 2}
+	slotc := make(chan string)
+	errc := make(chan error, 1)
+	go func() {
+		a, err := wormhole.New(string(pass), srv.URL, slotc)
+		if err == nil {
+			a.Close()
+		}
+		errc <- err
+	}()
+	slot, err := strconv.Atoi(<-slotc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := join(slot, string(pass), []string{empty.URL, srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if c.server != srv.URL {
+		t.Errorf("joined on %s want %s", c.server, srv.URL)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	// Not finding the slot anywhere is still reported as such, even if
+	// the last server was down.
+	if _, err := join(slot, string(pass), []string{empty.URL, down.URL}); err != wormhole.ErrNoSuchSlot {
+		t.Errorf("got %v want %v", err, wormhole.ErrNoSuchSlot)
+	}
+}
+
+func TestCodeServers(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(relay))
+	down.Close()
+	srv := httptest.NewServer(http.HandlerFunc(relay))
+	defer srv.Close()
+	defer func(s string, w io.Writer) { sigserv, stderr = s, w }(sigserv, stderr)
+	sigserv, stderr = "https://elsewhere.example.com", io.Discard
+
+	pass := []byte{1, 2}
+	slotc := make(chan string)
+	errc := make(chan error, 1)
+	go func() {
+		a, err := wormhole.New(string(pass), srv.URL, slotc)
+		if err == nil {
+			a.Close()
+		}
+		errc <- err
+	}()
+	slot, err := strconv.Atoi(<-slotc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := wordlist.Encode(slot, pass)
+
+	// Plain codes are joined on -signal.
+	if got, servers := codeServers(code); got != code || !reflect.DeepEqual(servers, []string{sigserv}) {
+		t.Errorf("got %q %q want %q %q", got, servers, code, sigserv)
+	}
+
+	// Links are joined on the servers they name, falling back in order,
+	// whatever -signal says.
+	link, err := codeLink(down.URL, code, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, servers := codeServers(link)
+	if got != code || !reflect.DeepEqual(servers, []string{down.URL, srv.URL}) {
+		t.Fatalf("got %q %q want %q %q", got, servers, code, []string{down.URL, srv.URL})
+	}
+	c, err := join(slot, string(pass), servers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if c.server != srv.URL {
+		t.Errorf("joined on %s want %s", c.server, srv.URL)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewPassPhrase(t *testing.T) {
+	defer func(p string) { passphrase = p }(passphrase)
+	passphrase = "correct horse battery staple"
+	a, err := newPass(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newPass(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(a, b) {
+		t.Errorf("same passphrase gave passwords %v and %v", a, b)
+	}
+	want, _ := wordlist.DerivePass(passphrase, 2)
+	if !bytes.Equal(a, want) {
+		t.Errorf("got password %v want %v", a, want)
+	}
+}
+
+func TestLookupPassphrase(t *testing.T) {
+	t.Setenv("WW_PASSPHRASE", "from env")
+	if got, err := lookupPassphrase("", nil); got != "from env" || err != nil {
+		t.Errorf("got %q, %v want %q", got, err, "from env")
+	}
+	file := filepath.Join(t.TempDir(), "passphrase")
+	if err := os.WriteFile(file, []byte("from file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := lookupPassphrase(file, nil); got != "from file" || err != nil {
+		t.Errorf("got %q, %v want %q", got, err, "from file")
+	}
+	if got, err := lookupPassphrase("-", strings.NewReader("from stdin\nmore")); got != "from stdin" || err != nil {
+		t.Errorf("got %q, %v want %q", got, err, "from stdin")
+	}
+	if _, err := lookupPassphrase(filepath.Join(t.TempDir(), "missing"), nil); err == nil {
+		t.Error("missing passphrase file did not fail")
+	}
+}
+
+func TestCandidateSummary(t *testing.T) {
+	for _, tt := range []struct {
+		types map[string]int
+		want  string
+	}{
+		{map[string]int{}, "0 host, 0 srflx, 0 relay"},
+		{map[string]int{"host": 2, "relay": 1}, "2 host, 0 srflx, 1 relay"},
+		{map[string]int{"srflx": 1, "prflx": 1}, "0 host, 1 srflx, 1 prflx, 0 relay"},
+	} {
+		if got := candidateSummary(tt.types); got != tt.want {
+			t.Errorf("candidateSummary(%v) = %q want %q", tt.types, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	webrtc "github.com/pion/webrtc/v3"
+	"webwormhole.io/wordlist"
+	"webwormhole.io/wormhole"
+)
+
+// lineSignaller passes handshake messages through the user: messages to
+// send are printed to out, one per line, and the peer's are read from in
+// once pasted. Prompts go to prompt.
+type lineSignaller struct {
+	in     *bufio.Scanner
+	out    io.Writer
+	prompt io.Writer
+}
+
+func newLineSignaller(in io.Reader, out, prompt io.Writer) *lineSignaller {
+	s := bufio.NewScanner(in)
+	// Offers and answers with all their candidates are a few kilobytes.
+	s.Buffer(nil, 1<<20)
+	return &lineSignaller{in: s, out: out, prompt: prompt}
+}
+
+func (s *lineSignaller) Send(msg string) error {
+	fmt.Fprintf(s.prompt, "send this line to your peer:\n")
+	_, err := fmt.Fprintf(s.out, "%s\n", msg)
+	return err
+}
+
+func (s *lineSignaller) Receive() (string, error) {
+	fmt.Fprintf(s.prompt, "paste the line your peer sent:\n")
+	for s.in.Scan() {
+		// Skip blank lines left over from pasting.
+		if line := strings.TrimSpace(s.in.Text()); line != "" {
+			return line, nil
+		}
+	}
+	if err := s.in.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New("no message from peer")
+}
+
+// manualICE stands in for the ICE servers a signalling server would offer,
+// so -ice and -ignore-server-ice work the same with ww manual.
+var manualICE = []webrtc.ICEServer{{URLs: []string{"stun:relay.webwormhole.io"}}}
+
+func manual(args ...string) {
+	set := flag.NewFlagSet(args[0], flag.ExitOnError)
+	set.Usage = func() {
+		fmt.Fprintf(set.Output(), "send or receive files without a signalling server, copying and pasting the handshake\n\n")
+		fmt.Fprintf(set.Output(), "usage: %s %s [files]...\n\n", os.Args[0], args[0])
+		fmt.Fprintf(set.Output(), "one side runs without -code and tells the other the code it prints, then each\n")
+		fmt.Fprintf(set.Output(), "pastes the lines the other prints, three in all. files given are sent, and\n")
+		fmt.Fprintf(set.Output(), "without any, files are received.\n\n")
+		fmt.Fprintf(set.Output(), "flags:\n")
+		set.PrintDefaults()
+	}
+	length := set.Int("length", 2, "length of generated secret")
+	code := set.String("code", "", "answer the peer that generated this code")
+	directory := set.String("dir", ".", "directory to put downloaded files")
+	timeout := set.Duration("timeout", 10*time.Minute, "how long to wait for the connection after printing the last line, while the peer pastes it")
+	in := set.String("in", "", "read the peer's lines from this file, e.g. a named pipe, instead of stdin")
+	set.Parse(args[1:])
+
+	conf.ManualTimeout = *timeout
+	var r io.Reader = os.Stdin
+	if *in != "" {
+		f, err := os.Open(*in)
+		if err != nil {
+			fatalf("could not open input: %v", err)
+		}
+		defer f.Close()
+		r = f
+	}
+	s := newLineSignaller(r, os.Stdout, stderr)
+
+	var w *wormhole.Wormhole
+	var err error
+	if *code == "" {
+		var pass []byte
+		pass, err = newPass(*length)
+		if err != nil {
+			fatalf("could not generate password: %v", err)
+		}
+		*code = wordlist.Encode(0, pass)
+		fmt.Fprintf(stderr, "code: %s\n", *code)
+		w, err = conf.StartManual(string(pass), s, manualICE)
+	} else {
+		_, pass := wordlist.Decode(*code)
+		if pass == nil {
+			fatalf("could not decode password")
+		}
+		w, err = conf.AnswerManual(string(pass), s, manualICE)
+	}
+	if err != nil {
+		fatalf("could not connect: %v", err)
+	}
+	c := &connection{Wormhole: w, code: *code, relay: w.IsRelay()}
+	printConnected(c)
+
+	if set.NArg() > 0 {
+		if err := sendFiles(c, set.Args(), set.Output(), sendOptions{ackTimeout: 30 * time.Second}); err != nil {
+			fatalf("%v", err)
+		}
+		c.Close()
+		return
+	}
+	results, err := receiveFiles(c, &dirDestination{dir: *directory}, set.Output(), nil, nil, nil)
+	failed := printSummary(set.Output(), results)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	c.Close()
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestLineSignaller(t *testing.T) {
+	var out, prompt bytes.Buffer
+	// Pasted lines often come with extra blank lines and spaces.
+	s := newLineSignaller(strings.NewReader("\n  first  \n\r\n"+strings.Repeat("x", 100<<10)+"\n"), &out, &prompt)
+
+	if err := s.Send("hello"); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "hello\n" {
+		t.Errorf("sent %q want %q", out.String(), "hello\n")
+	}
+	if strings.Contains(prompt.String(), "hello") {
+		t.Errorf("message printed with prompts: %q", prompt.String())
+	}
+	for _, want := range []string{"first", strings.Repeat("x", 100<<10)} {
+		got, err := s.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("got %.20q want %.20q", got, want)
+		}
+	}
+	if _, err := s.Receive(); err == nil {
+		t.Errorf("got no error at end of input")
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+var errOutOfOrder = errors.New("received data out of order")
+
+// mergeDestination writes the contents of every file received one after the
+// other to w, leaving out their names. w can be a pipe, so files have to
+// arrive in order, one at a time.
+type mergeDestination struct {
+	w io.Writer
+}
+
+func (d *mergeDestination) create(h header) (io.WriterAt, func() error, func(), error) {
+	// Whatever was written of a file that failed can't be taken back, but
+	// that ends the transfer anyway.
+	return &streamWriter{w: d.w}, func() error { return nil }, func() {}, nil
+}
+
+// streamWriter is an io.WriterAt that writes to w, as long as every write
+// starts where the last one ended.
+type streamWriter struct {
+	w   io.Writer
+	off int64
+}
+
+func (s *streamWriter) WriteAt(p []byte, off int64) (int, error) {
+	if off != s.off {
+		return 0, errOutOfOrder
+	}
+	n, err := s.w.Write(p)
+	s.off += int64(n)
+	return n, err
+}
+
+// tarDestination writes every file received one after the other to a tar
+// stream, keeping their names. Like mergeDestination, files have to arrive
+// in order, one at a time. Close writes the end of the archive.
+type tarDestination struct {
+	tw *tar.Writer
+}
+
+func newTarDestination(w io.Writer) *tarDestination {
+	return &tarDestination{tw: tar.NewWriter(w)}
+}
+
+func (d *tarDestination) create(h header) (io.WriterAt, func() error, func(), error) {
+	if h.Offset > 0 {
+		return nil, nil, nil, errors.New("sender resumed a file that was not asked for")
+	}
+	if h.Unsized {
+		return d.createUnsized(h)
+	}
+	if err := d.tw.WriteHeader(tarHeader(h.Name, int64(h.Size))); err != nil {
+		return nil, nil, nil, err
+	}
+	return &streamWriter{w: d.tw}, d.tw.Flush, func() {}, nil
+}
+
+// createUnsized saves a file of unknown size to a temporary file, and only
+// writes it to the archive once it's all there, since a tar header needs
+// the size up front.
+func (d *tarDestination) createUnsized(h header) (io.WriterAt, func() error, func(), error) {
+	f, err := os.CreateTemp("", "ww-tar-")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	remove := func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	closef := func() error {
+		defer remove()
+		size, err := f.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err := d.tw.WriteHeader(tarHeader(h.Name, size)); err != nil {
+			return err
+		}
+		if _, err := io.Copy(d.tw, f); err != nil {
+			return err
+		}
+		return d.tw.Flush()
+	}
+	return f, closef, remove, nil
+}
+
+func (d *tarDestination) Close() error {
+	return d.tw.Close()
+}
+
+// tarHeader describes a received file called name in a tar archive, with
+// any leading / and .. taken out of its name.
+func tarHeader(name string, size int64) *tar.Header {
+	return &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     strings.TrimPrefix(path.Clean("/"+name), "/"),
+		Size:     size,
+		Mode:     0644,
+		ModTime:  time.Now(),
+	}
+}
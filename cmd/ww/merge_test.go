@@ -0,0 +1,117 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReceiveMerge(t *testing.T) {
+	src := t.TempDir()
+	var names []string
+	var want []byte
+	for i, size := range []int{3 * msgChunkSize / 2, 0, 100} {
+		content := make([]byte, size)
+		rand.Read(content)
+		names = append(names, writeTestFile(t, src, string(rune('a'+i)), content))
+		want = append(want, content...)
+	}
+
+	sender, receiver := msgPipe()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- sendFiles(sender, names, io.Discard, sendOptions{ackTimeout: time.Second, framed: true})
+		sender.Close()
+	}()
+	got := &bytes.Buffer{}
+	results, err := receiveFiles(receiver, &mergeDestination{w: got}, io.Discard, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver.Close()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != len(names) {
+		t.Errorf("received %d files want %d", len(results), len(names))
+	}
+	if !bytes.Equal(got.Bytes(), want) {
+		t.Errorf("got %d bytes that differ from the %d sent", got.Len(), len(want))
+	}
+}
+
+func TestReceiveTar(t *testing.T) {
+	src := t.TempDir()
+	want := map[string][]byte{
+		"a":        make([]byte, 3*msgChunkSize/2),
+		"empty":    nil,
+		"b":        []byte("bbb"),
+		"streamed": make([]byte, 2*msgChunkSize+1),
+	}
+	rand.Read(want["a"])
+	rand.Read(want["streamed"])
+	var sources []source
+	for _, name := range []string{"a", "empty", "b"} {
+		sources = append(sources, fileSource(writeTestFile(t, src, name, want[name])))
+	}
+	sources = append(sources, func() (header, io.ReadCloser, error) {
+		return header{Name: "../streamed", Unsized: true}, io.NopCloser(bytes.NewReader(want["streamed"])), nil
+	})
+
+	sender, receiver := msgPipe()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- sendSources(sender, sources, io.Discard, sendOptions{ackTimeout: time.Second})
+		sender.Close()
+	}()
+	got := &bytes.Buffer{}
+	dest := newTarDestination(got)
+	if _, err := receiveFiles(receiver, dest, io.Discard, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	receiver.Close()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if err := dest.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	tr := tar.NewReader(got)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(content, want[hdr.Name]) {
+			t.Errorf("%s: got %d bytes that differ from the %d sent", hdr.Name, len(content), len(want[hdr.Name]))
+		}
+		names = append(names, hdr.Name)
+	}
+	if got, want := strings.Join(names, " "), "a empty b streamed"; got != want {
+		t.Errorf("got files %q want %q", got, want)
+	}
+}
+
+func TestStreamWriterOrder(t *testing.T) {
+	w := &streamWriter{w: io.Discard}
+	if _, err := w.WriteAt([]byte("hello"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WriteAt([]byte("again"), 0); err != errOutOfOrder {
+		t.Errorf("got %v want %v", err, errOutOfOrder)
+	}
+}
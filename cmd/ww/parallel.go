@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"webwormhole.io/wormhole"
+)
+
+// maxStreams caps how many channels a parallel transfer can use.
+const maxStreams = 8
+
+// errNoStreams is returned by sendParallel when the receiver does not
+// support parallel transfers.
+var errNoStreams = errors.New("receiver does not support parallel transfers")
+
+// opener opens another channel to the peer with an ID both sides agree on.
+// See wormhole.Wormhole.Channel.
+type opener func(id uint16) (io.ReadWriteCloser, error)
+
+// channelOpener returns an opener for extra channels over c.
+func channelOpener(c *wormhole.Wormhole) opener {
+	return func(id uint16) (io.ReadWriteCloser, error) {
+		return c.Channel(id)
+	}
+}
+
+// openStreams opens channels 1 to n-1 using open. Channel 0 is the one
+// the transfer started on.
+func openStreams(open opener, n int) ([]io.ReadWriteCloser, error) {
+	var chans []io.ReadWriteCloser
+	for id := 1; id < n; id++ {
+		ch, err := open(uint16(id))
+		if err != nil {
+			closeAll(chans)
+			return nil, fmt.Errorf("could not open channel %d: %v", id, err)
+		}
+		chans = append(chans, ch)
+	}
+	return chans, nil
+}
+
+func closeAll(chans []io.ReadWriteCloser) {
+	for _, ch := range chans {
+		ch.Close()
+	}
+}
+
+// lineWriter writes to w one line at a time, so progress printed for
+// several channels at once doesn't get mixed up.
+type lineWriter struct {
+	mu  *sync.Mutex
+	w   io.Writer
+	buf []byte
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	l.buf = append(l.buf, p...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		l.mu.Lock()
+		_, err := l.w.Write(l.buf[:i+1])
+		l.mu.Unlock()
+		l.buf = l.buf[i+1:]
+		if err != nil {
+			return len(p), err
+		}
+	}
+}
+
+// split divides filenames into n shares of roughly the same total size,
+// keeping their order within each share.
+func split(filenames []string, n int) [][]string {
+	type file struct {
+		i    int
+		size int64
+	}
+	files := make([]file, len(filenames))
+	for i, name := range filenames {
+		files[i].i = i
+		// Files we can't stat are reported by sendFiles.
+		if info, err := os.Stat(name); err == nil {
+			files[i].size = info.Size()
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool { return files[i].size > files[j].size })
+
+	// Biggest first, each to whichever share is smallest so far.
+	shares := make([][]int, n)
+	totals := make([]int64, n)
+	for _, f := range files {
+		min := 0
+		for i := range totals {
+			if totals[i] < totals[min] || totals[i] == totals[min] && len(shares[i]) < len(shares[min]) {
+				min = i
+			}
+		}
+		shares[min] = append(shares[min], f.i)
+		totals[min] += f.size
+	}
+
+	names := make([][]string, n)
+	for i, share := range shares {
+		sort.Ints(share)
+		for _, j := range share {
+			names[i] = append(names[i], filenames[j])
+		}
+	}
+	return names
+}
+
+// sendParallel is like sendFiles, but sends the files over up to streams
+// channels at once: c and others opened with open. The receiver has to
+// agree to it first, which the web client doesn't. If it doesn't answer
+// within opts.answerTimeout(), c is closed, since its answer could still come
+// and be taken for something else.
+func sendParallel(c io.ReadWriteCloser, open opener, streams int, filenames []string, out io.Writer, opts sendOptions) error {
+	if streams > maxStreams {
+		streams = maxStreams
+	}
+	if streams > len(filenames) {
+		streams = len(filenames)
+	}
+	if streams <= 1 {
+		return sendFiles(c, filenames, out, opts)
+	}
+	// Share one gate between the channels, so pausing stops them all.
+	if opts.pause == nil {
+		opts.pause = newGate()
+	}
+
+	if err := writeHeader(c, header{Streams: streams}, false); err != nil {
+		return fmt.Errorf("could not offer parallel transfer: %v", err)
+	}
+	reply := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1<<10)
+		n, err := c.Read(buf)
+		if err != nil {
+			reply <- err
+			return
+		}
+		var m control
+		json.Unmarshal(buf[:n], &m)
+		switch m.Control {
+		case controlStreams:
+			reply <- nil
+		case controlDecline:
+			reply <- errDeclined
+		default:
+			reply <- errNoStreams
+		}
+	}()
+	select {
+	case err := <-reply:
+		if err != nil {
+			return err
+		}
+	case <-time.After(opts.answerTimeout()):
+		// Closing c also ends the read above.
+		c.Close()
+		<-reply
+		return errNoStreams
+	}
+
+	chans, err := openStreams(open, streams)
+	if err != nil {
+		return err
+	}
+	defer closeAll(chans)
+	conns := append([]io.ReadWriter{c}, toReadWriters(chans)...)
+
+	mu := &sync.Mutex{}
+	errs := make([]error, streams)
+	var wg sync.WaitGroup
+	for i, share := range split(filenames, streams) {
+		wg.Add(1)
+		go func(i int, share []string) {
+			defer wg.Done()
+			opts := opts
+			if opts.sums != nil {
+				opts.sums = &lineWriter{mu: mu, w: opts.sums}
+			}
+			errs[i] = sendFiles(conns[i], share, &lineWriter{mu: mu, w: out}, opts)
+		}(i, share)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func toReadWriters(chans []io.ReadWriteCloser) []io.ReadWriter {
+	rws := make([]io.ReadWriter, len(chans))
+	for i, ch := range chans {
+		rws[i] = ch
+	}
+	return rws
+}
+
+// receiveStreams accepts a parallel transfer offered on c over streams
+// channels, and starts receiving files from all but c, which the caller
+// keeps receiving from. limit applies to all the channels together. wait
+// waits for those and returns what they got.
+func receiveStreams(c io.Writer, open opener, streams int, dest destination, out io.Writer, limit *limits) (wait func() ([]fileResult, error), err error) {
+	if open == nil || streams > maxStreams {
+		writeControl(c, controlDecline)
+		return nil, fmt.Errorf("cannot receive over %d channels", streams)
+	}
+	chans, err := openStreams(open, streams)
+	if err != nil {
+		writeControl(c, controlDecline)
+		return nil, err
+	}
+	if err := writeControl(c, controlStreams); err != nil {
+		closeAll(chans)
+		return nil, err
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		results []fileResult
+		errs    []error
+	)
+	for _, ch := range chans {
+		wg.Add(1)
+		go func(ch io.ReadWriteCloser) {
+			defer wg.Done()
+			defer ch.Close()
+			r, err := receiveFiles(ch, dest, out, nil, nil, limit)
+			mu.Lock()
+			results = append(results, r...)
+			errs = append(errs, err)
+			mu.Unlock()
+		}(ch)
+	}
+	return func() ([]fileResult, error) {
+		wg.Wait()
+		for _, err := range errs {
+			if err != nil {
+				return results, err
+			}
+		}
+		return results, nil
+	}, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// msgChannels returns openers for two ends of a set of msgPipes, one per
+// channel ID, like Wormhole.Channel on two connected peers.
+func msgChannels() (a, b opener) {
+	var mu sync.Mutex
+	pipes := map[uint16][2]*msgConn{}
+	end := func(side int) opener {
+		return func(id uint16) (io.ReadWriteCloser, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			p, ok := pipes[id]
+			if !ok {
+				p[0], p[1] = msgPipe()
+				pipes[id] = p
+			}
+			return p[side], nil
+		}
+	}
+	return end(0), end(1)
+}
+
+func TestSplit(t *testing.T) {
+	src := t.TempDir()
+	var names []string
+	for i, size := range []int{10, 50, 20, 30, 0, 0} {
+		names = append(names, writeTestFile(t, src, string(rune('a'+i)), make([]byte, size)))
+	}
+	got := split(names, 3)
+	want := [][]string{
+		{names[1]},
+		{names[3], names[4], names[5]},
+		{names[0], names[2]},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+}
+
+func TestSendParallel(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	files := map[string][]byte{}
+	var names []string
+	for i, size := range []int{300 << 10, 5, 100 << 10, 0, 64 << 10, 1} {
+		name := string(rune('a'+i)) + ".bin"
+		content := make([]byte, size)
+		rand.Read(content)
+		files[name] = content
+		names = append(names, writeTestFile(t, src, name, content))
+	}
+
+	sender, receiver := msgPipe()
+	sopen, ropen := msgChannels()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- sendParallel(sender, sopen, 3, names, io.Discard, sendOptions{ackTimeout: time.Second, framed: true})
+		sender.Close()
+	}()
+	results, err := receiveFiles(receiver, &dirDestination{dir: dst}, io.Discard, ropen, nil, nil)
+	receiver.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != len(files) {
+		t.Errorf("got %v results want %v", len(results), len(files))
+	}
+	for name, want := range files {
+		got, err := os.ReadFile(filepath.Join(dst, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: received bytes differ from sent ones", name)
+		}
+	}
+}
+
+func TestSendParallelRefused(t *testing.T) {
+	src := t.TempDir()
+	names := []string{
+		writeTestFile(t, src, "a.txt", []byte("hello")),
+		writeTestFile(t, src, "b.txt", []byte("world")),
+	}
+
+	sender, receiver := msgPipe()
+	sopen, _ := msgChannels()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- sendParallel(sender, sopen, 2, names, io.Discard, sendOptions{ackTimeout: time.Second})
+		sender.Close()
+	}()
+	if _, err := receiveFiles(receiver, &dirDestination{dir: t.TempDir()}, io.Discard, nil, nil, nil); err == nil {
+		t.Error("receiver without channels accepted a parallel transfer")
+	}
+	receiver.Close()
+	if err := <-errc; err != errDeclined {
+		t.Errorf("got %v want %v", err, errDeclined)
+	}
+}
+
+func TestSendParallelNoReply(t *testing.T) {
+	src := t.TempDir()
+	names := []string{
+		writeTestFile(t, src, "a.txt", []byte("hello")),
+		writeTestFile(t, src, "b.txt", []byte("world")),
+	}
+
+	// A receiver that takes the offer but never answers it.
+	sender, receiver := msgPipe()
+	defer receiver.Close()
+	go io.Copy(io.Discard, receiver)
+	sopen, _ := msgChannels()
+	if err := sendParallel(sender, sopen, 2, names, io.Discard, sendOptions{ackTimeout: 10 * time.Millisecond}); err != errNoStreams {
+		t.Errorf("got %v want %v", err, errNoStreams)
+	}
+	// Nothing is left reading the connection.
+	if _, err := sender.Read(make([]byte, 1)); err != io.ErrClosedPipe {
+		t.Errorf("got %v from the connection want it closed", err)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+// gate holds up a transfer while it is paused.
+type gate struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	paused bool
+}
+
+func newGate() *gate {
+	g := &gate{}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// Pause makes Wait block until Resume is called.
+func (g *gate) Pause() {
+	g.mu.Lock()
+	g.paused = true
+	g.mu.Unlock()
+}
+
+// Resume unblocks everyone waiting on g.
+func (g *gate) Resume() {
+	g.mu.Lock()
+	g.paused = false
+	g.cond.Broadcast()
+	g.mu.Unlock()
+}
+
+// Toggle pauses g if it is running and resumes it otherwise. It returns
+// whether g is now paused.
+func (g *gate) Toggle() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.paused = !g.paused
+	if !g.paused {
+		g.cond.Broadcast()
+	}
+	return g.paused
+}
+
+// Paused reports whether g is paused.
+func (g *gate) Paused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.paused
+}
+
+// Wait blocks while g is paused.
+func (g *gate) Wait() {
+	g.mu.Lock()
+	for g.paused {
+		g.cond.Wait()
+	}
+	g.mu.Unlock()
+}
+
+// gatedWriter waits for g before every Write to w. Since writes are held
+// up whole, the stream stays intact however often it is paused.
+type gatedWriter struct {
+	w io.Writer
+	g *gate
+}
+
+func (gw gatedWriter) Write(p []byte) (int, error) {
+	gw.g.Wait()
+	return gw.w.Write(p)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPauseResume(t *testing.T) {
+	content := make([]byte, 20*msgChunkSize)
+	rand.Read(content)
+	name := writeTestFile(t, t.TempDir(), "a.bin", content)
+
+	sender, receiver := msgPipe()
+	defer receiver.Close()
+	pause := newGate()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- sendFiles(sender, []string{name}, io.Discard, sendOptions{ackTimeout: time.Second, pause: pause})
+	}()
+
+	h, err := readHeader(receiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, msgChunkSize)
+	got := &bytes.Buffer{}
+	read := func() {
+		n, err := receiver.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got.Write(buf[:n])
+	}
+	read()
+	read()
+
+	if err := writeControl(receiver, controlPause); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !paused(pause) {
+		if time.Now().After(deadline) {
+			t.Fatal("sender did not pause")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The sender may have already been writing one message when it paused,
+	// but nothing after that.
+	msgs := make(chan []byte, 10)
+	go func() {
+		for {
+			n, err := receiver.Read(buf)
+			if err != nil {
+				close(msgs)
+				return
+			}
+			msgs <- append([]byte(nil), buf[:n]...)
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if n := len(msgs); n > 1 {
+		t.Fatalf("got %v messages while paused", n)
+	}
+
+	if err := writeControl(receiver, controlResume); err != nil {
+		t.Fatal(err)
+	}
+	for got.Len() < h.Size {
+		m, ok := <-msgs
+		if !ok {
+			t.Fatal("sender hung up early")
+		}
+		got.Write(m)
+	}
+	if !bytes.Equal(got.Bytes(), content) {
+		t.Error("received bytes differ from sent ones")
+	}
+
+	// Let the receiver's ack through so the sender finishes.
+	pause.Resume()
+	if err := writeControl(receiver, controlAck); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// paused reports whether g is paused.
+func paused(g *gate) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.paused
+}
+
+func TestPauseLocal(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	content := make([]byte, 10*msgChunkSize)
+	rand.Read(content)
+	name := writeTestFile(t, src, "a.bin", content)
+
+	sender, receiver := msgPipe()
+	pause := newGate()
+	pause.Pause()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- sendFiles(sender, []string{name}, io.Discard, sendOptions{ackTimeout: time.Second, pause: pause})
+		sender.Close()
+	}()
+	time.AfterFunc(20*time.Millisecond, pause.Resume)
+	if _, err := receiveFiles(receiver, &dirDestination{dir: dst}, io.Discard, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	receiver.Close()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(dst, "a.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, content) {
+		t.Error("received bytes differ from sent ones")
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// errNoPong is returned by pingConn if the peer doesn't answer in time,
+// most likely because it isn't running ping too.
+var errNoPong = errors.New("peer did not answer, is it running ping?")
+
+// pingMsg is a ping or its answer. Sequence numbers start at 1.
+type pingMsg struct {
+	Ping int `json:"ping,omitempty"`
+	Pong int `json:"pong,omitempty"`
+}
+
+// pingConn sends count pings over c and returns how long each took to be
+// answered, while answering the peer's. Then it marks its end with an
+// empty message and waits for the peer's, so neither side hangs up while
+// the other is still pinging. No file data is sent.
+func pingConn(c io.ReadWriter, count int, timeout time.Duration) ([]time.Duration, error) {
+	pongs := make(chan int, count)
+	peerDone := make(chan struct{})
+	failed := make(chan error, 1)
+	go func() {
+		// Keep answering after the peer is done, until c is closed.
+		buf := make([]byte, 1<<10)
+		done := false
+		for {
+			n, err := c.Read(buf)
+			if err != nil {
+				failed <- err
+				return
+			}
+			if n == 0 {
+				if !done {
+					close(peerDone)
+					done = true
+				}
+				continue
+			}
+			var m pingMsg
+			if err := json.Unmarshal(buf[:n], &m); err != nil {
+				failed <- fmt.Errorf("unexpected message from peer: %v", err)
+				return
+			}
+			switch {
+			case m.Ping > 0:
+				if err := writePing(c, pingMsg{Pong: m.Ping}); err != nil {
+					failed <- err
+					return
+				}
+			case m.Pong > 0:
+				pongs <- m.Pong
+			}
+		}
+	}()
+
+	var rtts []time.Duration
+	for seq := 1; seq <= count; seq++ {
+		start := time.Now()
+		if err := writePing(c, pingMsg{Ping: seq}); err != nil {
+			return rtts, err
+		}
+	wait:
+		for {
+			select {
+			case pong := <-pongs:
+				if pong == seq {
+					break wait
+				}
+			case err := <-failed:
+				return rtts, err
+			case <-time.After(timeout):
+				return rtts, errNoPong
+			}
+		}
+		rtts = append(rtts, time.Since(start))
+	}
+
+	if _, err := c.Write(nil); err != nil {
+		return rtts, err
+	}
+	select {
+	case <-peerDone:
+		return rtts, nil
+	case err := <-failed:
+		return rtts, err
+	case <-time.After(timeout):
+		return rtts, errNoPong
+	}
+}
+
+func writePing(c io.Writer, m pingMsg) error {
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = c.Write(buf)
+	return err
+}
+
+func ping(args ...string) {
+	set := flag.NewFlagSet(args[0], flag.ExitOnError)
+	set.Usage = func() {
+		fmt.Fprintf(set.Output(), "check two peers can connect, and measure the round trip time\n\n")
+		fmt.Fprintf(set.Output(), "usage: %s %s [code]\n\n", os.Args[0], args[0])
+		fmt.Fprintf(set.Output(), "the peer has to run ping too.\n\n")
+		fmt.Fprintf(set.Output(), "flags:\n")
+		set.PrintDefaults()
+	}
+	length := set.Int("length", 2, "length of generated secret, if generating")
+	wait := set.Duration("wait", 0, "if generating, give up if no one has connected after this long, exiting with status 3 (default wait forever)")
+	count := set.Int("count", 3, "number of pings to send")
+	timeout := set.Duration("timeout", 5*time.Second, "how long to wait for each answer")
+	set.Parse(args[1:])
+
+	if set.NArg() > 1 || *count < 1 {
+		set.Usage()
+		os.Exit(2)
+	}
+	c := newConn(set.Arg(0), *length, 0, *wait)
+	rtts, err := pingConn(c, *count, *timeout)
+	c.Close()
+	for i, rtt := range rtts {
+		fmt.Fprintf(stderr, "ping %d: %v\n", i+1, rtt.Round(time.Microsecond))
+	}
+	if err != nil {
+		fatalf("%v", err)
+	}
+	var min, max, sum time.Duration
+	for i, rtt := range rtts {
+		if i == 0 || rtt < min {
+			min = rtt
+		}
+		if rtt > max {
+			max = rtt
+		}
+		sum += rtt
+	}
+	avg := sum / time.Duration(len(rtts))
+	fmt.Fprintf(stderr, "round trip min/avg/max: %v/%v/%v\n", min.Round(time.Microsecond), avg.Round(time.Microsecond), max.Round(time.Microsecond))
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"webwormhole.io/wormhole"
+)
+
+func TestPing(t *testing.T) {
+	a, b, erra, errb := loopback(t, &wormhole.Config{}, &wormhole.Config{})
+	if erra != nil || errb != nil {
+		t.Fatalf("could not connect: %v, %v", erra, errb)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		rtts, err := pingConn(b, 2, 5*time.Second)
+		if err == nil && len(rtts) != 2 {
+			t.Errorf("peer got %d round trip times want 2", len(rtts))
+		}
+		errc <- err
+	}()
+	rtts, err := pingConn(a, 3, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rtts) != 3 {
+		t.Errorf("got %d round trip times want 3", len(rtts))
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("peer: %v", err)
+	}
+
+	a.Close()
+	b.Close()
+}
+
+func TestPingNoAnswer(t *testing.T) {
+	sender, receiver := msgPipe()
+	defer receiver.Close()
+	defer sender.Close()
+	go receiver.Read(make([]byte, 1<<10))
+	if _, err := pingConn(sender, 1, 50*time.Millisecond); err != errNoPong {
+		t.Errorf("got %v want %v", err, errNoPong)
+	}
+}
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"os"
+	"time"
+
+	"webwormhole.io/chunkbox"
+	"webwormhole.io/wormhole"
 )
 
 func pipe(args ...string) {
@@ -16,31 +22,157 @@ func pipe(args ...string) {
 		set.PrintDefaults()
 	}
 	length := set.Int("length", 2, "length of generated secret, if generating")
+	wait := set.Duration("wait", 0, "if generating, give up if no one has connected after this long, exiting with status 3 (default wait forever)")
+	ratchetBytes := set.Int64("ratchet-bytes", 0, "also encrypt the pipe with keys that are replaced after this many bytes, so a key leaking doesn't expose what was sent before; both sides ratchet as often as the stricter of them asks (default never)")
+	ratchetInterval := set.Duration("ratchet-interval", 0, "also encrypt the pipe with keys that are replaced this often; both sides ratchet as often as the stricter of them asks (default never)")
+	size := set.Int("buffer", msgChunkSize, fmt.Sprintf("send stdin in messages of up to this many bytes, at most %d", maxPipeBuffer))
 	set.Parse(args[1:])
 
-	if set.NArg() > 1 {
+	if set.NArg() > 1 || *size <= 0 || *size > maxPipeBuffer {
 		set.Usage()
 		os.Exit(2)
 	}
-	c := newConn(set.Arg(0), *length)
+	ours := pipeSettings{Pipe: true, RatchetBytes: *ratchetBytes, RatchetInterval: *ratchetInterval}
+	conf.Metadata, _ = json.Marshal(ours)
+	c := newConn(set.Arg(0), *length, 0, *wait)
+	if m := c.MaxMessageSize(); *size > m {
+		*size = m
+	}
+	settings, err := ours.negotiate(c.Metadata())
+	if err != nil {
+		c.Close()
+		fatalf("%v", err)
+	}
+	var rw io.ReadWriter = c
+	if settings.ratchets() {
+		rw, err = ratcheted(c.Wormhole, settings.RatchetBytes, settings.RatchetInterval)
+		if err != nil {
+			fatalf("could not set up ratchet: %v", err)
+		}
+	}
+	err = pipeConn(rw, os.Stdin, os.Stdout, *size)
+	c.Close()
+	if err != nil {
+		fatalf("%v", err)
+	}
+}
+
+// pipeSettings are what pipe sends the peer with the handshake, as
+// metadata, so the two agree on whether to ratchet.
+type pipeSettings struct {
+	// Pipe is always set, to tell the settings of a peer that doesn't
+	// ratchet from a peer that doesn't send any.
+	Pipe bool `json:"pipe"`
+
+	RatchetBytes    int64         `json:"ratchetBytes,omitempty"`
+	RatchetInterval time.Duration `json:"ratchetInterval,omitempty"`
+}
 
-	done := make(chan struct{})
-	// The recieve end of the pipe.
+// errNoRatchet is returned by negotiate when we ratchet but the peer can't.
+var errNoRatchet = errors.New("the peer can't ratchet, it may be too old or not running ww pipe")
+
+// ratchets reports whether s asks for ratcheting.
+func (s pipeSettings) ratchets() bool {
+	return s.RatchetBytes > 0 || s.RatchetInterval > 0
+}
+
+// negotiate returns the settings both peers use, given the peer's metadata:
+// if either asks for ratcheting both ratchet, as often as the stricter of
+// the two asks.
+func (s pipeSettings) negotiate(metadata []byte) (pipeSettings, error) {
+	var peer pipeSettings
+	if json.Unmarshal(metadata, &peer) != nil || !peer.Pipe {
+		if s.ratchets() {
+			return s, errNoRatchet
+		}
+		return s, nil
+	}
+	if peer.RatchetBytes > 0 && (s.RatchetBytes == 0 || peer.RatchetBytes < s.RatchetBytes) {
+		s.RatchetBytes = peer.RatchetBytes
+	}
+	if peer.RatchetInterval > 0 && (s.RatchetInterval == 0 || peer.RatchetInterval < s.RatchetInterval) {
+		s.RatchetInterval = peer.RatchetInterval
+	}
+	return s, nil
+}
+
+// ratcheted returns c encrypted again with keys that move on after bytes
+// are sent, or after interval, giving forward secrecy within a long session.
+func ratcheted(c *wormhole.Wormhole, bytes int64, interval time.Duration) (io.ReadWriter, error) {
+	send, receive, err := c.ExportKeys("pipe ratchet")
+	if err != nil {
+		return nil, err
+	}
+	w := chunkbox.NewRatchetWriter(c, send)
+	w.Bytes, w.Interval = bytes, interval
+	return struct {
+		io.Reader
+		io.Writer
+	}{chunkbox.NewRatchetReader(c, receive), w}, nil
+}
+
+// maxPipeBuffer is the biggest message pipe sends, the biggest a Wormhole
+// can.
+const maxPipeBuffer = 64 << 10
+
+// pipeConn copies in to c, in messages of at most size bytes, and c to out
+// until both directions are done. A Wormhole can't be half-closed, so the
+// end of in is marked by sending an empty message, after which the peer's
+// data is still read until it marks its end too or closes the connection.
+func pipeConn(c io.ReadWriter, in io.Reader, out io.Writer, size int) error {
+	sent, received := make(chan error, 1), make(chan error, 1)
 	go func() {
-		_, err := io.CopyBuffer(os.Stdout, c, make([]byte, msgChunkSize))
+		// Hide any WriterTo in so writes stay within size.
+		_, err := io.CopyBuffer(c, struct{ io.Reader }{in}, make([]byte, size))
+		if err == nil {
+			_, err = c.Write(nil)
+		}
 		if err != nil {
-			fatalf("could not write to stdout: %v", err)
+			err = fmt.Errorf("could not write to channel: %v", err)
 		}
-		done <- struct{}{}
+		sent <- err
 	}()
-	// The send end of the pipe.
 	go func() {
-		_, err := io.CopyBuffer(c, os.Stdin, make([]byte, msgChunkSize))
-		if err != nil {
-			fatalf("could not write to channel: %v", err)
+		// The peer's messages may be bigger than ours.
+		buf := make([]byte, maxPipeBuffer)
+		for {
+			n, err := c.Read(buf)
+			if err == io.EOF {
+				received <- err
+				return
+			}
+			if err != nil {
+				received <- fmt.Errorf("could not read from channel: %v", err)
+				return
+			}
+			if n == 0 {
+				received <- nil
+				return
+			}
+			if _, err := out.Write(buf[:n]); err != nil {
+				received <- fmt.Errorf("could not write to stdout: %v", err)
+				return
+			}
 		}
-		done <- struct{}{}
 	}()
-	<-done
-	c.Close()
+
+	for sent != nil || received != nil {
+		select {
+		case err := <-sent:
+			if err != nil {
+				return err
+			}
+			sent = nil
+		case err := <-received:
+			if err == io.EOF {
+				// The peer is gone, so there is no point sending any more.
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			received = nil
+		}
+	}
+	return nil
 }
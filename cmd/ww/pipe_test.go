@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"webwormhole.io/wormhole"
+)
+
+func TestPipeConn(t *testing.T) {
+	a, b, erra, errb := loopback(t, &wormhole.Config{}, &wormhole.Config{})
+	if erra != nil || errb != nil {
+		t.Fatal(erra, errb)
+	}
+	defer b.Close()
+	defer a.Close()
+
+	ina, inb := make([]byte, 512<<10), make([]byte, 300<<10)
+	crand.Read(ina)
+	crand.Read(inb)
+	var outa, outb bytes.Buffer
+	errc := make(chan error, 1)
+	go func() {
+		errc <- pipeConn(b, bytes.NewReader(inb), &outb, msgChunkSize)
+	}()
+	if err := pipeConn(a, bytes.NewReader(ina), &outa, msgChunkSize); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(outb.Bytes(), ina) {
+		t.Errorf("b got %v bytes, want all %v sent by a", outb.Len(), len(ina))
+	}
+	if !bytes.Equal(outa.Bytes(), inb) {
+		t.Errorf("a got %v bytes, want all %v sent by b", outa.Len(), len(inb))
+	}
+}
+
+func TestPipeRatchet(t *testing.T) {
+	a, b, erra, errb := loopback(t, &wormhole.Config{}, &wormhole.Config{})
+	if erra != nil || errb != nil {
+		t.Fatal(erra, errb)
+	}
+	defer b.Close()
+	defer a.Close()
+
+	// Different ratchets on each side are fine, since each reader follows
+	// its peer's writer.
+	ra, err := ratcheted(a, 10<<10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rb, err := ratcheted(b, 0, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ina, inb := make([]byte, 512<<10), make([]byte, 300<<10)
+	crand.Read(ina)
+	crand.Read(inb)
+	var outa, outb bytes.Buffer
+	errc := make(chan error, 1)
+	go func() {
+		errc <- pipeConn(rb, bytes.NewReader(inb), &outb, msgChunkSize)
+	}()
+	if err := pipeConn(ra, bytes.NewReader(ina), &outa, msgChunkSize); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(outb.Bytes(), ina) {
+		t.Errorf("b got %v bytes, want all %v sent by a", outb.Len(), len(ina))
+	}
+	if !bytes.Equal(outa.Bytes(), inb) {
+		t.Errorf("a got %v bytes, want all %v sent by b", outa.Len(), len(inb))
+	}
+}
+
+func TestPipeSettings(t *testing.T) {
+	metadata := func(s pipeSettings) []byte {
+		b, err := json.Marshal(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	ratchet := pipeSettings{Pipe: true, RatchetBytes: 10 << 10, RatchetInterval: time.Minute}
+	plain := pipeSettings{Pipe: true}
+
+	// The settings go over with the handshake.
+	a, b, erra, errb := loopback(t, &wormhole.Config{Metadata: metadata(ratchet)}, &wormhole.Config{Metadata: metadata(plain)})
+	if erra != nil || errb != nil {
+		t.Fatal(erra, errb)
+	}
+	defer b.Close()
+	defer a.Close()
+	sa, err := ratchet.negotiate(a.Metadata())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := plain.negotiate(b.Metadata())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sa != ratchet || sb != ratchet {
+		t.Errorf("got %+v and %+v want both %+v", sa, sb, ratchet)
+	}
+
+	for _, tt := range []struct {
+		ours, peer pipeSettings
+		want       pipeSettings
+	}{
+		{plain, plain, plain},
+		{
+			pipeSettings{Pipe: true, RatchetBytes: 100, RatchetInterval: time.Hour},
+			pipeSettings{Pipe: true, RatchetBytes: 200, RatchetInterval: time.Second},
+			pipeSettings{Pipe: true, RatchetBytes: 100, RatchetInterval: time.Second},
+		},
+		{
+			pipeSettings{Pipe: true, RatchetInterval: time.Hour},
+			pipeSettings{Pipe: true, RatchetBytes: 200},
+			pipeSettings{Pipe: true, RatchetBytes: 200, RatchetInterval: time.Hour},
+		},
+	} {
+		if got, err := tt.ours.negotiate(metadata(tt.peer)); err != nil || got != tt.want {
+			t.Errorf("%+v with %+v: got %+v, %v want %+v", tt.ours, tt.peer, got, err, tt.want)
+		}
+	}
+
+	// Peers that send no settings can't ratchet, which only matters if we
+	// want to.
+	for _, peer := range [][]byte{nil, []byte("something else")} {
+		if _, err := ratchet.negotiate(peer); err != errNoRatchet {
+			t.Errorf("ratcheting with %q: got %v want %v", peer, err, errNoRatchet)
+		}
+		if got, err := plain.negotiate(peer); err != nil || got != plain {
+			t.Errorf("not ratcheting with %q: got %+v, %v", peer, got, err)
+		}
+	}
+}
+
+// benchmarkPipe measures piping over a local connection in messages of
+// size bytes.
+func benchmarkPipe(b *testing.B, size int) {
+	a, c := benchLoopback(b, &wormhole.Config{})
+
+	in := make([]byte, 16<<20)
+	b.SetBytes(int64(len(in)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var out bytes.Buffer
+		errs := make(chan error, 1)
+		go func() {
+			errs <- pipeConn(c, bytes.NewReader(nil), &out, size)
+		}()
+		if err := pipeConn(a, bytes.NewReader(in), io.Discard, size); err != nil {
+			b.Fatal(err)
+		}
+		if err := <-errs; err != nil {
+			b.Fatal(err)
+		}
+		if out.Len() != len(in) {
+			b.Fatalf("got %v bytes want %v", out.Len(), len(in))
+		}
+	}
+	b.StopTimer()
+}
+
+func BenchmarkPipe16K(b *testing.B) { benchmarkPipe(b, 16<<10) }
+func BenchmarkPipe32K(b *testing.B) { benchmarkPipe(b, msgChunkSize) }
+func BenchmarkPipe64K(b *testing.B) { benchmarkPipe(b, maxPipeBuffer) }
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"rsc.io/qr/coding"
+	"rsc.io/qr/gf256"
+)
+
+// This is a minimal QR code reader, good enough for screenshots of the codes
+// ww and the web client show: upright, sharp, and not too small. It does not
+// correct errors, it only detects them.
+
+var errNoQR = errors.New("no QR code found")
+
+// codeFromQR reads the wormhole code from a QR code in the image file at
+// path. The QR code is expected to hold a link to the code, as made by
+// codeLink, which is returned whole so the code is joined on the
+// servers it names, but a bare code works too.
+func codeFromQR(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return "", fmt.Errorf("could not read image: %v", err)
+	}
+	text, err := decodeQR(img)
+	if err != nil {
+		return "", err
+	}
+	text = strings.TrimSpace(text)
+	if _, _, ok := parseLink(text); ok {
+		return text, nil
+	}
+	if u, err := url.Parse(text); err == nil && u.Fragment != "" {
+		return u.Fragment, nil
+	}
+	return text, nil
+}
+
+// decodeQR returns the text in the QR code in img.
+func decodeQR(img image.Image) (string, error) {
+	dark := binarize(img)
+	tl, tr, bl, err := findFinders(dark)
+	if err != nil {
+		return "", err
+	}
+
+	// The finders' centres are 3.5 modules in from the corners, so they
+	// are size-7 modules apart.
+	modules := (dist(tl, tr)/tl.ux+dist(tl, bl)/tl.uy)/2 + 7
+	v := int(math.Round((modules - 17) / 4))
+	err = errNoQR
+	// Try the nearest versions too, in case the estimate was a bit off.
+	for _, v := range []int{v, v - 1, v + 1} {
+		if v < int(coding.MinVersion) || v > int(coding.MaxVersion) {
+			continue
+		}
+		var text string
+		text, err = decodeGrid(sample(dark, tl, tr, bl, 17+4*v))
+		if err == nil {
+			return text, nil
+		}
+	}
+	return "", err
+}
+
+// binarize returns which pixels of img are dark, with rows first.
+func binarize(img image.Image) [][]bool {
+	b := img.Bounds()
+	lum := make([][]uint32, b.Dy())
+	min, max := uint32(math.MaxUint32), uint32(0)
+	for y := range lum {
+		lum[y] = make([]uint32, b.Dx())
+		for x := range lum[y] {
+			r, g, bb, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			l := (299*r + 587*g + 114*bb) / 1000
+			lum[y][x] = l
+			if l < min {
+				min = l
+			}
+			if l > max {
+				max = l
+			}
+		}
+	}
+	threshold := min + (max-min)/2
+	dark := make([][]bool, len(lum))
+	for y := range lum {
+		dark[y] = make([]bool, len(lum[y]))
+		for x, l := range lum[y] {
+			dark[y][x] = l < threshold
+		}
+	}
+	return dark
+}
+
+// finder is the centre of a finder pattern, the big squares in three corners
+// of a QR code, and the width and height of a module around it.
+type finder struct {
+	x, y   float64
+	ux, uy float64
+	n      int
+}
+
+func dist(a, b finder) float64 {
+	return math.Hypot(a.x-b.x, a.y-b.y)
+}
+
+// runs returns the lengths of runs of the same value in line, starting with
+// a dark one, and where each run starts.
+func runs(line []bool) (lengths, starts []int) {
+	for i := 0; i < len(line); {
+		j := i
+		for j < len(line) && line[j] == line[i] {
+			j++
+		}
+		if len(lengths) > 0 || line[i] {
+			lengths = append(lengths, j-i)
+			starts = append(starts, i)
+		}
+		i = j
+	}
+	return lengths, starts
+}
+
+// finderRatio reports whether five runs are in the 1:1:3:1:1 ratio of a line
+// through the middle of a finder pattern, and the size of a module if so.
+func finderRatio(r []int) (float64, bool) {
+	total := 0
+	for _, n := range r {
+		total += n
+	}
+	u := float64(total) / 7
+	if u < 1 {
+		return 0, false
+	}
+	for i, n := range r {
+		want := u
+		if i == 2 {
+			want = 3 * u
+		}
+		if math.Abs(float64(n)-want) > want/2 {
+			return 0, false
+		}
+	}
+	return u, true
+}
+
+// crossCheck looks for a finder pattern's 1:1:3:1:1 ratio vertically through
+// (x, y), and returns its centre and module height.
+func crossCheck(dark [][]bool, x, y int) (cy, uy float64, ok bool) {
+	col := make([]bool, len(dark))
+	for i := range dark {
+		col[i] = dark[i][x]
+	}
+	lengths, starts := runs(col)
+	for i := 0; i+5 <= len(lengths); i += 2 {
+		if starts[i+2] > y || y >= starts[i+2]+lengths[i+2] {
+			continue
+		}
+		uy, ok := finderRatio(lengths[i : i+5])
+		if !ok {
+			return 0, 0, false
+		}
+		return float64(starts[i+2]) + float64(lengths[i+2])/2, uy, true
+	}
+	return 0, 0, false
+}
+
+// findFinders returns the centres of the top left, top right and bottom left
+// finder patterns in dark.
+func findFinders(dark [][]bool) (tl, tr, bl finder, err error) {
+	var found []finder
+	for y, row := range dark {
+		lengths, starts := runs(row)
+		// Dark runs are at even indices.
+		for i := 0; i+5 <= len(lengths); i += 2 {
+			ux, ok := finderRatio(lengths[i : i+5])
+			if !ok {
+				continue
+			}
+			cx := float64(starts[i+2]) + float64(lengths[i+2])/2
+			cy, uy, ok := crossCheck(dark, int(cx), y)
+			if !ok {
+				continue
+			}
+			c := finder{cx, cy, ux, uy, 1}
+			merged := false
+			for j := range found {
+				f := &found[j]
+				if math.Abs(f.x-c.x) < 2*f.ux && math.Abs(f.y-c.y) < 2*f.uy {
+					n := float64(f.n)
+					f.x, f.y = (f.x*n+c.x)/(n+1), (f.y*n+c.y)/(n+1)
+					f.ux, f.uy = (f.ux*n+c.ux)/(n+1), (f.uy*n+c.uy)/(n+1)
+					f.n++
+					merged = true
+					break
+				}
+			}
+			if !merged {
+				found = append(found, c)
+			}
+		}
+	}
+	if len(found) < 3 {
+		return tl, tr, bl, errNoQR
+	}
+	sort.SliceStable(found, func(i, j int) bool { return found[i].n > found[j].n })
+	f := found[:3]
+
+	// The top left finder is the one opposite the longest side.
+	switch {
+	case dist(f[0], f[1]) >= dist(f[0], f[2]) && dist(f[0], f[1]) >= dist(f[1], f[2]):
+		tl, tr, bl = f[2], f[0], f[1]
+	case dist(f[0], f[2]) >= dist(f[1], f[2]):
+		tl, tr, bl = f[1], f[0], f[2]
+	default:
+		tl, tr, bl = f[0], f[1], f[2]
+	}
+	// Going clockwise from the top left, top right comes first.
+	if (tr.x-tl.x)*(bl.y-tl.y)-(tr.y-tl.y)*(bl.x-tl.x) < 0 {
+		tr, bl = bl, tr
+	}
+	return tl, tr, bl, nil
+}
+
+// sample reads the modules of a QR code size modules wide from dark, given
+// the centres of its finder patterns.
+func sample(dark [][]bool, tl, tr, bl finder, size int) [][]bool {
+	steps := float64(size - 7)
+	grid := make([][]bool, size)
+	for i := range grid {
+		grid[i] = make([]bool, size)
+		for j := range grid[i] {
+			dj, di := float64(j)-3, float64(i)-3
+			x := tl.x + dj*(tr.x-tl.x)/steps + di*(bl.x-tl.x)/steps
+			y := tl.y + dj*(tr.y-tl.y)/steps + di*(bl.y-tl.y)/steps
+			px, py := int(x), int(y)
+			if py >= 0 && py < len(dark) && px >= 0 && px < len(dark[py]) {
+				grid[i][j] = dark[py][px]
+			}
+		}
+	}
+	return grid
+}
+
+// decodeGrid returns the text in a QR code, given its modules.
+func decodeGrid(grid [][]bool) (string, error) {
+	v := coding.Version((len(grid) - 17) / 4)
+
+	// Rather than decode the format bits, see which level and mask's
+	// would look most like them.
+	var plan *coding.Plan
+	best := math.MaxInt
+	for l := coding.L; l <= coding.H; l++ {
+		for m := coding.Mask(0); m < 8; m++ {
+			p, err := coding.NewPlan(v, l, m)
+			if err != nil {
+				return "", err
+			}
+			wrong := 0
+			for y, row := range p.Pixel {
+				for x, pix := range row {
+					if pix.Role() == coding.Format && (pix&coding.Black != 0) != grid[y][x] {
+						wrong++
+					}
+				}
+			}
+			if wrong < best {
+				plan, best = p, wrong
+			}
+		}
+	}
+	// There are two copies of the 15 format bits. Codes for different
+	// formats differ in at least 7 bits each.
+	if best > 6 {
+		return "", errNoQR
+	}
+
+	buf := make([]byte, plan.DataBytes+plan.CheckBytes)
+	for y, row := range plan.Pixel {
+		for x, pix := range row {
+			switch pix.Role() {
+			case coding.Data, coding.Check:
+				if grid[y][x] != (pix&coding.Black != 0) {
+					o := pix.Offset()
+					buf[o/8] |= 1 << (7 - o&7)
+				}
+			}
+		}
+	}
+
+	// Check every block, as coding.Bits.AddCheckBytes made them.
+	data, check := buf[:plan.DataBytes], buf[plan.DataBytes:]
+	ne := plan.CheckBytes / plan.Blocks
+	db, extra := plan.DataBytes/plan.Blocks, plan.DataBytes%plan.Blocks
+	rs := gf256.NewRSEncoder(coding.Field, ne)
+	chk := make([]byte, ne)
+	for i, dat := 0, data; i < plan.Blocks; i++ {
+		if i == plan.Blocks-extra {
+			db++
+		}
+		rs.ECC(dat[:db], chk)
+		if string(chk) != string(check[i*ne:(i+1)*ne]) {
+			return "", errors.New("QR code is damaged or unreadable")
+		}
+		dat = dat[db:]
+	}
+	return decodeSegments(data, v)
+}
+
+const qrAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ $%*+-./:"
+
+// decodeSegments returns the text encoded in a QR code's data bytes.
+func decodeSegments(data []byte, v coding.Version) (string, error) {
+	class := 0
+	switch {
+	case v >= 27:
+		class = 2
+	case v >= 10:
+		class = 1
+	}
+	off := 0
+	bits := func(n int) (int, bool) {
+		if off+n > len(data)*8 {
+			return 0, false
+		}
+		x := 0
+		for i := 0; i < n; i++ {
+			x = x<<1 | int(data[(off+i)/8]>>(7-(off+i)%8)&1)
+		}
+		off += n
+		return x, true
+	}
+	errShort := errors.New("QR code data is truncated")
+
+	var text []byte
+	for {
+		mode, ok := bits(4)
+		if !ok || mode == 0 {
+			return string(text), nil
+		}
+		switch mode {
+		case 1: // Numeric, three digits to ten bits.
+			n, ok := bits([]int{10, 12, 14}[class])
+			if !ok {
+				return "", errShort
+			}
+			for ; n > 0; n -= 3 {
+				digits, width := 3, 10
+				if n < 3 {
+					digits, width = n, []int{0, 4, 7}[n]
+				}
+				x, ok := bits(width)
+				if !ok {
+					return "", errShort
+				}
+				text = append(text, fmt.Sprintf("%0*d", digits, x)...)
+			}
+		case 2: // Alphanumeric, two characters to eleven bits.
+			n, ok := bits([]int{9, 11, 13}[class])
+			if !ok {
+				return "", errShort
+			}
+			for ; n > 1; n -= 2 {
+				x, ok := bits(11)
+				if !ok || x >= 45*45 {
+					return "", errShort
+				}
+				text = append(text, qrAlphabet[x/45], qrAlphabet[x%45])
+			}
+			if n == 1 {
+				x, ok := bits(6)
+				if !ok || x >= 45 {
+					return "", errShort
+				}
+				text = append(text, qrAlphabet[x])
+			}
+		case 4: // Bytes.
+			n, ok := bits([]int{8, 16, 16}[class])
+			if !ok {
+				return "", errShort
+			}
+			for ; n > 0; n-- {
+				x, ok := bits(8)
+				if !ok {
+					return "", errShort
+				}
+				text = append(text, byte(x))
+			}
+		default:
+			return "", fmt.Errorf("unsupported QR code data mode %d", mode)
+		}
+	}
+}
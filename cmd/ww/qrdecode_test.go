@@ -0,0 +1,137 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"rsc.io/qr"
+	"webwormhole.io/wordlist"
+	"webwormhole.io/wormhole"
+)
+
+// render draws code like a screenshot would: modules w by h pixels, on
+// a white background with a border of the given width.
+func render(code *qr.Code, w, h, border int) image.Image {
+	img := image.NewGray(image.Rect(0, 0, code.Size*w+2*border, code.Size*h+2*border))
+	for y := 0; y < img.Bounds().Dy(); y++ {
+		for x := 0; x < img.Bounds().Dx(); x++ {
+			c := color.Gray{0xee}
+			if code.Black((x-border)/w, (y-border)/h) && x >= border && y >= border {
+				c = color.Gray{0x22}
+			}
+			img.SetGray(x, y, c)
+		}
+	}
+	return img
+}
+
+func writePNG(t *testing.T, img image.Image) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "code.png")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDecodeQR(t *testing.T) {
+	for _, text := range []string{
+		"https://webwormhole.io/#3-ambient-revival",
+		"HELLO WORLD 123",
+		"0123456789012",
+		"https://webwormhole.io/#" + string(make([]byte, 200)),
+	} {
+		code, err := qr.Encode(text, qr.L)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, img := range []image.Image{
+			render(code, 4, 4, 16),
+			// Like ww's output in a terminal: tall modules, no quiet zone.
+			render(code, 5, 9, 0),
+		} {
+			got, err := decodeQR(img)
+			if err != nil {
+				t.Errorf("%q: %v", text, err)
+				continue
+			}
+			if got != text {
+				t.Errorf("got %q want %q", got, text)
+			}
+		}
+	}
+
+	if _, err := decodeQR(image.NewGray(image.Rect(0, 0, 100, 100))); err != errNoQR {
+		t.Errorf("blank image got %v want %v", err, errNoQR)
+	}
+	code, _ := qr.Encode("https://webwormhole.io/#3-ambient-revival", qr.L)
+	img := render(code, 4, 4, 16).(*image.Gray)
+	// Scribble over the data in the bottom right.
+	for y := 60; y < 100; y++ {
+		for x := 70; x < 100; x += 3 {
+			img.SetGray(x, y, color.Gray{0x22})
+		}
+	}
+	if _, err := decodeQR(img); err == nil {
+		t.Error("damaged code decoded")
+	}
+}
+
+func TestCodeFromQR(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(relay))
+	defer srv.Close()
+
+	slotc := make(chan string)
+	errc := make(chan error, 1)
+	pass := []byte{1, 2}
+	var a *wormhole.Wormhole
+	go func() {
+		var err error
+		a, err = wormhole.New(string(pass), srv.URL, slotc)
+		errc <- err
+	}()
+	slot, err := strconv.Atoi(<-slotc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, err := qr.Encode(srv.URL+"/#"+wordlist.Encode(slot, pass), qr.L)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := codeFromQR(writePNG(t, render(code, 3, 3, 12)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, servers := codeServers(got)
+	if want := []string{srv.URL + "/"}; !reflect.DeepEqual(servers, want) {
+		t.Errorf("got servers %q from QR want %q", servers, want)
+	}
+	gotSlot, gotPass := wordlist.Decode(got)
+	b, err := wormhole.Join(strconv.Itoa(gotSlot), string(gotPass), servers[0])
+	if err != nil {
+		t.Fatalf("could not join with code %q from QR: %v", got, err)
+	}
+	b.Close()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+
+	if _, err := codeFromQR(writePNG(t, image.NewGray(image.Rect(0, 0, 10, 10)))); err == nil {
+		t.Error("got a code from an image without a QR code")
+	}
+}
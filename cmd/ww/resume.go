@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// A partialer is a destination that can keep what it got of a file when a
+// transfer fails, so a later transfer of it can carry on from there.
+type partialer interface {
+	// partial returns how much of the file described by h, which has a
+	// checksum, is already saved and the checksum of that much, or 0 if
+	// none is.
+	partial(h header) (n int64, sum string)
+}
+
+// partPath is where the file described by h is kept until it is complete.
+func (d *dirDestination) partPath(h header) string {
+	return d.path(h) + ".part"
+}
+
+// createPart saves the file described by h into its part file, after the
+// h.Offset bytes already there, and renames it to its own name once it is
+// complete. Whatever arrives is kept, even if the transfer fails, so it
+// can be resumed.
+func (d *dirDestination) createPart(h header) (io.WriterAt, func() error, func(), error) {
+	path := d.partPath(h)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	info, err := f.Stat()
+	if err == nil && info.Size() < h.Offset {
+		err = fmt.Errorf("%s is shorter than the %d bytes to resume from", path, h.Offset)
+	}
+	if err == nil {
+		err = f.Truncate(h.Offset)
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, nil, err
+	}
+	closef := func() error {
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		if info.Size() != int64(h.Size) {
+			// Keep it for next time.
+			return nil
+		}
+		return os.Rename(path, d.path(h))
+	}
+	// Hide Truncate, so the file isn't pre-allocated and its size is always
+	// how much of it arrived.
+	return struct{ io.WriterAt }{&appender{f, h.Offset}}, closef, func() {}, nil
+}
+
+func (d *dirDestination) partial(h header) (int64, string) {
+	if !d.resume {
+		return 0, ""
+	}
+	f, err := os.Open(d.partPath(h))
+	if err != nil {
+		return 0, ""
+	}
+	defer f.Close()
+	sum := sha256.New()
+	n, err := io.Copy(sum, f)
+	if err != nil || n >= int64(h.Size) {
+		return 0, ""
+	}
+	return n, hex.EncodeToString(sum.Sum(nil))
+}
+
+// resumeFile tells the sender of the file described by h that the first n
+// bytes of it, with checksum sum, have already been received, and returns
+// the header the sender sends again with the offset it sends from.
+func resumeFile(c io.ReadWriter, h header, n int64, sum string) (header, bool, error) {
+	buf, err := json.Marshal(control{Control: controlPartial, Offset: n, SHA256: sum})
+	if err != nil {
+		return h, false, err
+	}
+	if _, err := c.Write(buf); err != nil {
+		return h, false, fmt.Errorf("could not answer checksum: %v", err)
+	}
+	resumed, err := readHeader(c)
+	if err != nil {
+		return h, false, fmt.Errorf("could not read file header: %v", err)
+	}
+	if resumed.Name != h.Name || resumed.Size != h.Size || resumed.SHA256 != h.SHA256 || resumed.Offset != 0 && resumed.Offset != n {
+		return h, false, fmt.Errorf("%w: resumed %s differently", errBadHeader, h.Name)
+	}
+	return resumed, false, nil
+}
+
+// resumeFrom returns where to send r from to a receiver that has its first
+// n bytes with checksum sum: n if they match what r has, or 0 if they don't
+// or r can't seek. r is left there.
+func resumeFrom(r io.Reader, n int64, sum string) (int64, error) {
+	s, ok := r.(io.ReadSeeker)
+	if !ok {
+		return 0, nil
+	}
+	h := sha256.New()
+	m, err := io.CopyN(h, s, n)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	if m == n && hex.EncodeToString(h.Sum(nil)) == sum {
+		return n, nil
+	}
+	_, err = s.Seek(0, io.SeekStart)
+	return 0, err
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// droppingConn is a msgConn that hangs up instead of sending more than left
+// bytes.
+type droppingConn struct {
+	*msgConn
+	left int
+}
+
+func (c *droppingConn) Write(p []byte) (int, error) {
+	if len(p) > c.left {
+		c.msgConn.Close()
+		return 0, io.ErrClosedPipe
+	}
+	c.left -= len(p)
+	return c.msgConn.Write(p)
+}
+
+// countingConn is a msgConn that counts the bytes and messages it sends.
+type countingConn struct {
+	*msgConn
+	sent     int
+	messages int
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	c.sent += len(p)
+	c.messages++
+	return c.msgConn.Write(p)
+}
+
+// resumeTransfer sends name with checksums from sender to a receiver
+// resuming into dst, and returns the sender's and receiver's errors.
+func resumeTransfer(sender io.ReadWriteCloser, receiver *msgConn, name, dst string) (sendErr, receiveErr error) {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- sendFiles(sender, []string{name}, io.Discard, sendOptions{ackTimeout: time.Second, checksum: true})
+		sender.Close()
+	}()
+	_, receiveErr = receiveFiles(receiver, &dirDestination{dir: dst, resume: true}, io.Discard, nil, nil, nil)
+	receiver.Close()
+	return <-errc, receiveErr
+}
+
+func TestResume(t *testing.T) {
+	src := t.TempDir()
+	content := make([]byte, 600<<10)
+	for i := range content {
+		content[i] = byte(i * 7 / 3)
+	}
+	name := writeTestFile(t, src, "a.bin", content)
+
+	// The first transfer drops part of the way through.
+	dst := t.TempDir()
+	sender, receiver := msgPipe()
+	if _, err := resumeTransfer(&droppingConn{sender, 300 << 10}, receiver, name, dst); err == nil {
+		t.Fatal("dropped transfer did not fail")
+	}
+	part := filepath.Join(dst, "a.bin.part")
+	kept, err := os.ReadFile(part)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kept) == 0 || len(kept) >= len(content) || !bytes.Equal(kept, content[:len(kept)]) {
+		t.Fatalf("kept %d bytes of %d, or the wrong ones", len(kept), len(content))
+	}
+	if _, err := os.Stat(filepath.Join(dst, "a.bin")); err == nil {
+		t.Error("partial file saved under its own name")
+	}
+	corrupt := t.TempDir()
+	writeTestFile(t, corrupt, "a.bin.part", append([]byte{^kept[0]}, kept[1:]...))
+
+	// A new pairing only sends the rest.
+	sender, receiver = msgPipe()
+	counted := &countingConn{msgConn: sender}
+	if sendErr, receiveErr := resumeTransfer(counted, receiver, name, dst); sendErr != nil || receiveErr != nil {
+		t.Fatalf("resumed transfer failed: %v, %v", sendErr, receiveErr)
+	}
+	got, err := os.ReadFile(filepath.Join(dst, "a.bin"))
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("resumed file has %d bytes want %d (%v)", len(got), len(content), err)
+	}
+	if _, err := os.Stat(part); err == nil {
+		t.Error("part file left behind")
+	}
+	if rest := len(content) - len(kept); counted.sent < rest || counted.sent > rest+1<<10 {
+		t.Errorf("sent %d bytes to resume, want about %d", counted.sent, rest)
+	}
+
+	// If what the receiver has doesn't match, the whole file is sent.
+	sender, receiver = msgPipe()
+	counted = &countingConn{msgConn: sender}
+	if sendErr, receiveErr := resumeTransfer(counted, receiver, name, corrupt); sendErr != nil || receiveErr != nil {
+		t.Fatalf("transfer failed: %v, %v", sendErr, receiveErr)
+	}
+	got, err = os.ReadFile(filepath.Join(corrupt, "a.bin"))
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("got %d bytes want %d (%v)", len(got), len(content), err)
+	}
+	if counted.sent < len(content) {
+		t.Errorf("sent %d bytes, want all %d", counted.sent, len(content))
+	}
+}
+
+func TestResumeFrom(t *testing.T) {
+	r := bytes.NewReader([]byte("hello world"))
+	// sha256("hello")
+	hello := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	if off, err := resumeFrom(r, 5, hello); err != nil || off != 5 {
+		t.Errorf("got %d, %v want 5", off, err)
+	}
+	if rest, _ := io.ReadAll(r); string(rest) != " world" {
+		t.Errorf("left reader at %q", rest)
+	}
+	r.Reset([]byte("jello world"))
+	if off, err := resumeFrom(r, 5, hello); err != nil || off != 0 {
+		t.Errorf("got %d, %v want 0", off, err)
+	}
+	if rest, _ := io.ReadAll(r); string(rest) != "jello world" {
+		t.Errorf("left reader at %q", rest)
+	}
+	if off, err := resumeFrom(struct{ io.Reader }{r}, 5, hello); err != nil || off != 0 {
+		t.Errorf("got %d, %v for a reader that can't seek want 0", off, err)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+
+	"webwormhole.io/wormhole"
+)
+
+// downloads serves files as they are received, each at the path the web
+// client's Service Worker would serve it at, wormhole.ServiceWorkerPath(name).
+// Range requests are answered with what has arrived, waiting for the rest,
+// so e.g. a video player can start and seek before the whole file is here.
+type downloads struct {
+	mu    sync.Mutex
+	files map[string]*wormhole.ServiceWorkerDownload
+}
+
+func (d *downloads) add(h header, g *growingFile) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.files == nil {
+		d.files = make(map[string]*wormhole.ServiceWorkerDownload)
+	}
+	// Keyed by the unescaped path, which is what requests are matched by.
+	d.files[wormhole.ServiceWorkerPrefix+h.Name] = &wormhole.ServiceWorkerDownload{
+		Name: h.Name,
+		Type: h.Type,
+		Size: int64(h.Size),
+		Open: g.open,
+	}
+}
+
+func (d *downloads) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	f := d.files[r.URL.Path]
+	d.mu.Unlock()
+	if f == nil {
+		http.NotFound(w, r)
+		return
+	}
+	f.ServeHTTP(w, r)
+}
+
+// A growingFile is a file being received. It can be read from any offset
+// while it is, waiting for data that hasn't arrived yet.
+type growingFile struct {
+	f *os.File
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	size int64 // Bytes written so far.
+	done bool
+	err  error // Why it was cut short, if it was.
+}
+
+func newGrowingFile(f *os.File) *growingFile {
+	g := &growingFile{f: f}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+func (g *growingFile) Write(p []byte) (int, error) {
+	n, err := g.f.Write(p)
+	g.mu.Lock()
+	g.size += int64(n)
+	g.mu.Unlock()
+	g.cond.Broadcast()
+	return n, err
+}
+
+// finish wakes up readers waiting for data that won't come. err is why the
+// file was cut short, or nil if it wasn't.
+func (g *growingFile) finish(err error) {
+	g.mu.Lock()
+	g.done, g.err = true, err
+	g.mu.Unlock()
+	g.cond.Broadcast()
+}
+
+func (g *growingFile) open(offset int64) (io.ReadCloser, error) {
+	return io.NopCloser(&growingReader{g, offset}), nil
+}
+
+type growingReader struct {
+	g   *growingFile
+	off int64
+}
+
+func (r *growingReader) Read(p []byte) (int, error) {
+	g := r.g
+	g.mu.Lock()
+	for g.size <= r.off && !g.done {
+		g.cond.Wait()
+	}
+	size, err := g.size, g.err
+	g.mu.Unlock()
+	if r.off >= size {
+		if err != nil {
+			return 0, err
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > size-r.off {
+		p = p[:size-r.off]
+	}
+	n, err := g.f.ReadAt(p, r.off)
+	r.off += int64(n)
+	return n, err
+}
+
+// serveFiles saves the files read with r into dir, and adds each to d as
+// soon as it starts arriving. base is the URL d is served at, printed to out
+// for each file. Unsized files are saved but not served, since downloads
+// need a size.
+//
+// The files are left open, since d serves them after they are received.
+func serveFiles(r *fileReader, dir string, d *downloads, base string, out io.Writer) error {
+	for {
+		h, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		f, err := os.Create((&dirDestination{dir: dir}).path(h))
+		if err != nil {
+			return fmt.Errorf("could not save %s: %v", h.Name, err)
+		}
+		g := newGrowingFile(f)
+		if !h.Unsized {
+			d.add(h, g)
+			fmt.Fprintf(out, "serving %s at %s%s\n", h.Name, base, wormhole.ServiceWorkerPath(h.Name))
+		}
+		_, err = io.Copy(g, r)
+		g.finish(err)
+		if err != nil {
+			return fmt.Errorf("could not receive %s: %v", h.Name, err)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"webwormhole.io/wormhole"
+)
+
+func TestServeFiles(t *testing.T) {
+	sender, receiver := msgPipe()
+	next := make(chan struct{})
+	go func() {
+		writeHeader(sender, header{Name: "movie", Size: 10, Type: "video/mp4"}, false)
+		sender.Write([]byte("01234"))
+		// Only send the rest once the range is asked for.
+		<-next
+		sender.Write([]byte("56789"))
+		sender.Close()
+	}()
+
+	d := &downloads{}
+	ts := httptest.NewServer(d)
+	defer ts.Close()
+	dir := t.TempDir()
+	pr, pw := io.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- serveFiles(newFileReader(receiver), dir, d, ts.URL, pw)
+		pw.Close()
+	}()
+	lines := bufio.NewScanner(pr)
+	if !lines.Scan() {
+		t.Fatal("nothing served")
+	}
+	url := ts.URL + wormhole.ServiceWorkerPath("movie")
+	if want := "serving movie at " + url; lines.Text() != want {
+		t.Errorf("got %q want %q", lines.Text(), want)
+	}
+	go io.Copy(io.Discard, pr)
+
+	req, _ := http.NewRequest("GET", url, nil)
+	// Half of it has yet to arrive.
+	req.Header.Set("Range", "bytes=3-7")
+	respc := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+		}
+		respc <- resp
+	}()
+	close(next)
+	resp := <-respc
+	if resp == nil {
+		t.FailNow()
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Errorf("got status %d want %d", resp.StatusCode, http.StatusPartialContent)
+	}
+	if got, want := resp.Header.Get("Content-Range"), "bytes 3-7/10"; got != want {
+		t.Errorf("got Content-Range %q want %q", got, want)
+	}
+	if got, want := resp.Header.Get("Content-Type"), "video/mp4"; got != want {
+		t.Errorf("got Content-Type %q want %q", got, want)
+	}
+	if string(body) != "34567" {
+		t.Errorf("got body %q want %q", body, "34567")
+	}
+
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	saved, err := os.ReadFile(filepath.Join(dir, "movie"))
+	if err != nil || string(saved) != "0123456789" {
+		t.Errorf("saved %q, %v", saved, err)
+	}
+
+	resp, err = http.Get(ts.URL + wormhole.ServiceWorkerPath("other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got status %d for a file never sent", resp.StatusCode)
+	}
+}
+
+func TestGrowingFileCutShort(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	g := newGrowingFile(f)
+	g.Write([]byte("abc"))
+	rc, _ := g.open(1)
+	go g.finish(io.ErrUnexpectedEOF)
+	got, err := io.ReadAll(rc)
+	if string(got) != "bc" || err != io.ErrUnexpectedEOF {
+		t.Errorf("got %q, %v want what arrived and io.ErrUnexpectedEOF", got, err)
+	}
+}
@@ -11,13 +11,16 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"html"
 	"log"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/NYTimes/gziphandler"
@@ -26,30 +29,110 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/crypto/acme/autocert"
 	"nhooyr.io/websocket"
+	"webwormhole.io/wordlist"
 	"webwormhole.io/wormhole"
 )
 
 // slotTimeout is the the maximum amount of time a client is allowed to
-// hold a slot.
-const slotTimeout = 12 * time.Hour
+// hold a slot. It is a variable for tests.
+var slotTimeout = 12 * time.Hour
+
+// closeReasons are the reasons given with each status the server closes
+// connections with, so clients can tell users why a rendezvous failed.
+var closeReasons = map[websocket.StatusCode]string{
+	wormhole.CloseNoSuchSlot:        "no such slot",
+	wormhole.CloseSlotTimedOut:      "timed out",
+	wormhole.CloseNoMoreSlots:       "cannot allocate slots",
+	wormhole.CloseWrongProto:        "wrong protocol, please upgrade client",
+	wormhole.ClosePeerHungUp:        "peer hung up",
+	wormhole.CloseBadKey:            "bad key",
+	wormhole.CloseSlotTaken:         "slot already taken",
+	wormhole.CloseJoinRejected:      "join rejected",
+	wormhole.CloseTunnelMismatch:    "tunnel mismatch",
+	websocket.StatusPolicyViolation: "message sent before the peer joined",
+	websocket.StatusInternalError:   "internal error",
+}
+
+// signalConn is a client's connection to the relay: a WebSocket, or a
+// stream of one carrying many with wormhole.MuxProtocol.
+type signalConn interface {
+	Read(ctx context.Context) (websocket.MessageType, []byte, error)
+	Write(ctx context.Context, typ websocket.MessageType, p []byte) error
+	Close(code websocket.StatusCode, reason string) error
+	Ping(ctx context.Context) error
+}
+
+// closeWith closes c with code and its reason from closeReasons.
+func closeWith(c signalConn, code websocket.StatusCode) {
+	c.Close(code, closeReasons[code])
+}
 
+// importMeta is the page go get is sent to, with the module path and its
+// repository's URL to fill in.
 const importMeta = `<!doctype html>
 <meta charset=utf-8>
-<meta name="go-import" content="webwormhole.io git https://github.com/saljam/webwormhole">
-<meta http-equiv="refresh" content="0;URL='https://github.com/saljam/webwormhole'">
+<meta name="go-import" content="%[1]s git %[2]s">
+<meta http-equiv="refresh" content="0;URL='%[2]s'">
 `
 
-const serviceWorkerPage = `You're not supposed to get this file or end up here.
+// goImportHandler answers go get, and browsers following the ww command's
+// import path, with a page pointing at module's repository repo. Other
+// requests go to next. If module is empty, all requests go to next.
+func goImportHandler(module, repo string, next http.Handler) http.Handler {
+	if module == "" {
+		return next
+	}
+	page := fmt.Sprintf(importMeta, html.EscapeString(module), html.EscapeString(repo))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("go-get") == "1" || r.URL.Path == "/cmd/ww" {
+			w.Write([]byte(page))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
 
-This is a dummy URL is used by WebWormhole to help web browsers
-efficiently download files from a WebRTC connection. It should be
-handled entirely by a ServiceWorker running in your browser.
+// corsHandler allows pages from origins to load what next serves, e.g. JS
+// modules, by echoing their Origin back in Access-Control-Allow-Origin.
+// Other origins get no CORS headers. An origin of "*" allows any page.
+func corsHandler(origins []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		for _, o := range origins {
+			if o == "*" {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+				break
+			}
+			if origin != "" && strings.EqualFold(o, origin) {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Add("Vary", "Origin")
+				break
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
 
-If you got this text instead of the file you expected to download,
-it is possible your web browser doesn't fully support ServiceWorkers
-but claims it does. Try a different web browser, and if that doesn't
-work, please file a bug report.
-`
+// hostsOf returns the hosts of origins, e.g. example.com for
+// https://example.com, or nil if one of them is "*" for any origin.
+func hostsOf(origins []string) ([]string, error) {
+	hosts := []string{}
+	for _, o := range origins {
+		o = strings.TrimSpace(o)
+		if o == "*" {
+			return nil, nil
+		}
+		if o == "" {
+			continue
+		}
+		u, err := url.Parse(o)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("%q is not an origin like https://example.com", o)
+		}
+		hosts = append(hosts, u.Host)
+	}
+	return hosts, nil
+}
 
 var (
 	rendezvousCounter = prometheus.NewCounterVec(
@@ -58,7 +141,7 @@ var (
 			Name:      "rendezvous_attempts",
 			Help:      "Number of attempts to rendezvous using the signalling server.",
 		},
-		[]string{"result"},
+		[]string{"result", "client"},
 	)
 	iceCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -66,7 +149,7 @@ var (
 			Name:      "webrtc_attempts",
 			Help:      "Number of reported ICE results sliced by ICE method used.",
 		},
-		[]string{"result", "method"},
+		[]string{"result", "method", "client"},
 	)
 	protocolErrorCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -92,11 +175,28 @@ func init() {
 	prometheus.MustRegister(slotsGuage)
 }
 
-// slots is a map of allocated slot numbers.
+// slots is a map of allocated slot numbers, keyed by slotKey.
 var slots = struct {
-	m map[string]chan *websocket.Conn
+	m map[string]chan signalConn
+	// taken holds each slot a peer has joined until that peer hangs up,
+	// so anyone else joining is told it's taken. Only the first to join a
+	// slot gets the peer that created it.
+	taken map[string]*takenSlot
 	sync.RWMutex
-}{m: make(map[string]chan *websocket.Conn)}
+}{m: make(map[string]chan signalConn), taken: make(map[string]*takenSlot)}
+
+// takenSlot is a slot in slots.taken.
+type takenSlot struct {
+	joiner  signalConn
+	creator signalConn // Nil until the joiner has been paired with it.
+	late    int        // Peers told the slot was taken.
+}
+
+// maxLateJoins, unless 0, is how many peers may be told a slot is taken
+// before the server ends the rendezvous on it. Others racing for a slot
+// means its code got out, so whoever joined may not be who the creator
+// gave it to, and both are better off starting again with a new code.
+var maxLateJoins int
 
 // turnSecret, turnServer, and stunServers are used to generate ICE config
 // and send it to clients as soon as they connect.
@@ -104,34 +204,95 @@ var turnSecret string
 var turnServer string
 var stunServers []webrtc.ICEServer
 
-// freeslot tries to find an available numeric slot, favouring smaller numbers.
-// This assume slots is locked.
-func freeslot() (slot string, ok bool) {
-	// Assuming varint encoding, we first try for one byte. That's 7 bits in varint.
-	for i := 0; i < 64; i++ {
-		s := strconv.Itoa(rand.Intn(1 << 7))
-		if _, ok := slots.m[s]; !ok {
+// originHosts, unless nil, are the hosts of the only origins, besides the
+// server's own, whose pages may open signalling connections, as given to
+// websocket.AcceptOptions.OriginPatterns. Clients other than browsers send
+// no Origin and are always let in. It is set from -cors-origins.
+var originHosts []string
+
+// compress enables permessage-deflate on signalling connections for clients
+// that ask for it.
+var compress bool
+
+// maintenance, when set, makes the server refuse new slots while joins to
+// existing ones, and relays already going, carry on. It is toggled through
+// maintenanceHandler.
+var maintenance atomic.Bool
+
+// maintenanceHandler shows whether the server is in maintenance mode, and
+// turns it on or off when POSTed on=true or on=false.
+func maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		on, err := strconv.ParseBool(r.FormValue("on"))
+		if err != nil {
+			http.Error(w, "on must be true or false", http.StatusBadRequest)
+			return
+		}
+		if maintenance.Swap(on) != on {
+			log.Printf("maintenance mode: %v", on)
+		}
+	}
+	fmt.Fprintf(w, "maintenance: %v\n", maintenance.Load())
+}
+
+// namespaces are the names clients may prefix slots with, e.g. /teamA/12,
+// to keep them apart from everyone else's. Slots without one are always
+// allowed.
+var namespaces = map[string]bool{}
+
+// splitSlotPath splits a WebSocket request path into its namespace, if any,
+// and slot, which is empty for a new one: /12 is slot 12, /teamA/ a new slot
+// in teamA, and /teamA/12 slot 12 in teamA.
+func splitSlotPath(path string) (namespace, slot string) {
+	path = strings.TrimPrefix(path, "/")
+	i := strings.LastIndex(path, "/")
+	if i < 0 {
+		return "", path
+	}
+	return path[:i], path[i+1:]
+}
+
+// slotKey is the key for slot in namespace in slots. It is the path the
+// slot is joined on, less the leading slash.
+func slotKey(namespace, slot string) string {
+	if namespace == "" {
+		return slot
+	}
+	return namespace + "/" + slot
+}
+
+// minPassLength is the shortest password, in bytes, clients are told to use.
+var minPassLength int
+
+// freeslot tries to find an available numeric slot in namespace, favouring
+// smaller numbers. This assume slots is locked.
+func freeslot(namespace string) (slot string, ok bool) {
+	// Assuming varint encoding, we first try for one byte. That's 7 bits in
+	// varint, and a single word in codes, so use any that is free.
+	for _, i := range rand.Perm(wordlist.WordSlots) {
+		s := strconv.Itoa(i)
+		if _, ok := slots.m[slotKey(namespace, s)]; !ok {
 			return s, true
 		}
 	}
 	// Then try for two bytes. 11 bits.
 	for i := 0; i < 1024; i++ {
 		s := strconv.Itoa(rand.Intn(1 << 11))
-		if _, ok := slots.m[s]; !ok {
+		if _, ok := slots.m[slotKey(namespace, s)]; !ok {
 			return s, true
 		}
 	}
 	// Then try for three bytes. 16 bits.
 	for i := 0; i < 2048; i++ {
 		s := strconv.Itoa(rand.Intn(1 << 16))
-		if _, ok := slots.m[s]; !ok {
+		if _, ok := slots.m[slotKey(namespace, s)]; !ok {
 			return s, true
 		}
 	}
 	// Then try for four bytes. 21 bits.
 	for i := 0; i < 2048; i++ {
-		s := strconv.Itoa(rand.Intn(1 << 21))
-		if _, ok := slots.m[s]; !ok {
+		s := strconv.Itoa(rand.Intn(wordlist.MaxSlots))
+		if _, ok := slots.m[slotKey(namespace, s)]; !ok {
 			return s, true
 		}
 	}
@@ -146,70 +307,157 @@ func turnServers() []webrtc.ICEServer {
 	if turnServer == "" {
 		return nil
 	}
-	username := fmt.Sprintf("%d:wormhole", time.Now().Add(slotTimeout).Unix())
-	mac := hmac.New(sha1.New, []byte(turnSecret))
-	mac.Write([]byte(username))
+	username, credential := turnCredentials(turnSecret, time.Now().Add(slotTimeout))
 	return []webrtc.ICEServer{{
 		URLs:       []string{turnServer},
 		Username:   username,
-		Credential: base64.StdEncoding.EncodeToString(mac.Sum(nil)),
+		Credential: credential,
 	}}
 }
 
-// relay sets up a rendezvous on a slot and pipes the two websockets together.
+// turnCredentials returns a TURN username and password derived from secret
+// that are valid until expires.
+func turnCredentials(secret string, expires time.Time) (username, credential string) {
+	username = fmt.Sprintf("%d:wormhole", expires.Unix())
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return username, base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// clientType makes a best guess at what kind of client made r from its
+// User-Agent, for use as a metric label. It is one of "web", "cli", or
+// "unknown" to keep the number of label values small.
+func clientType(r *http.Request) string {
+	ua := r.Header.Get("User-Agent")
+	switch {
+	case strings.HasPrefix(ua, "Mozilla/"):
+		// Every browser claims to be Mozilla.
+		return "web"
+	case strings.HasPrefix(ua, "webwormhole"), strings.HasPrefix(ua, "Go-http-client/"):
+		return "cli"
+	default:
+		return "unknown"
+	}
+}
+
+// relay sets up a rendezvous on a slot and pipes the two websockets
+// together, or does so for each stream of a wormhole.MuxProtocol one.
 func relay(w http.ResponseWriter, r *http.Request) {
-	slotkey := r.URL.Path[1:] // strip leading slash
-	var rconn *websocket.Conn
+	// Safari has broken compression, so it's off unless asked for.
+	// https://github.com/nhooyr/websocket/issues/218
+	compression := websocket.CompressionDisabled
+	if compress {
+		compression = websocket.CompressionNoContextTakeover
+	}
 	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
-		// This sounds nasty but checking origin only matters if requests
-		// change any user state on the server, aka CSRF. We don't have any
-		// user state other than this ephemeral connection. So it's fine.
-		InsecureSkipVerify: true,
+		// There is no user state on the server to forge requests against,
+		// only this ephemeral connection, so any origin is fine unless
+		// the operator limited them.
+		InsecureSkipVerify: originHosts == nil,
+		OriginPatterns:     originHosts,
 
-		// Safari has broken compression.
-		// https://github.com/nhooyr/websocket/issues/218
-		CompressionMode: websocket.CompressionDisabled,
+		CompressionMode: compression,
 
 		// Protocol version negotiation.
-		Subprotocols: []string{wormhole.Protocol},
+		Subprotocols: []string{wormhole.Protocol, wormhole.MuxProtocol},
 	})
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	if conn.Subprotocol() != wormhole.Protocol {
+	switch conn.Subprotocol() {
+	case wormhole.Protocol:
+		relaySlot(r, conn, r.URL.Path)
+	case wormhole.MuxProtocol:
+		relayMux(r, conn)
+	default:
 		// Make sure we negotiated the right protocol, since "blank" is also a
 		// default one.
 		protocolErrorCounter.WithLabelValues("wrongversion").Inc()
-		conn.Close(wormhole.CloseWrongProto, "wrong protocol, please upgrade client")
+		closeWith(conn, wormhole.CloseWrongProto)
+	}
+}
+
+// relayMux relays each stream the client opens over conn, which speaks
+// wormhole.MuxProtocol, like a WebSocket of its own.
+func relayMux(r *http.Request, conn *websocket.Conn) {
+	m := wormhole.NewMux(conn, false)
+	for {
+		s, err := m.Accept(r.Context())
+		if err != nil {
+			return
+		}
+		go func() {
+			relaySlot(r, s, s.Path())
+			// Let the client know the stream is done with even if
+			// relaySlot left it be, e.g. after its peer hung up.
+			s.Close(websocket.StatusNormalClosure, "")
+		}()
+	}
+}
+
+// relaySlot sets up a rendezvous on the slot in path for conn, the
+// client's connection, and pipes it together with its peer's.
+func relaySlot(r *http.Request, conn signalConn, path string) {
+	namespace, slot := splitSlotPath(path)
+	slotkey := slotKey(namespace, slot)
+	client := clientType(r)
+	var rconn signalConn
+
+	if namespace != "" && !namespaces[namespace] {
+		rendezvousCounter.WithLabelValues("nosuchslot", client).Inc()
+		conn.Close(wormhole.CloseNoSuchSlot, "no such namespace")
+		return
+	}
+
+	if slot != "" && upstream != "" && !localSlot(slotkey) {
+		forward(r, conn, slotkey, client)
 		return
 	}
 
 	ctx, cancel := context.WithTimeout(r.Context(), slotTimeout)
 
+	if slot != "" {
+		joined := slotkey
+		defer func() {
+			slots.Lock()
+			if t := slots.taken[joined]; t != nil && t.joiner == conn {
+				delete(slots.taken, joined)
+			}
+			slots.Unlock()
+		}()
+	}
+
 	initmsg := struct {
-		Slot       string             `json:"slot",omitempty`
-		ICEServers []webrtc.ICEServer `json:"iceServers",omitempty`
+		Slot          string             `json:"slot"`
+		ICEServers    []webrtc.ICEServer `json:"iceServers"`
+		MinPassLength int                `json:"minPassLength,omitempty"`
 	}{}
 	initmsg.ICEServers = append(turnServers(), stunServers...)
+	initmsg.MinPassLength = minPassLength
 
 	go func() {
-		if slotkey == "" {
+		if slot == "" {
+			if maintenance.Load() {
+				rendezvousCounter.WithLabelValues("maintenance", client).Inc()
+				conn.Close(wormhole.CloseNoMoreSlots, "maintenance")
+				return
+			}
 			// Book a new slot.
 			slots.Lock()
-			newslot, ok := freeslot()
+			newslot, ok := freeslot(namespace)
 			if !ok {
 				slots.Unlock()
-				rendezvousCounter.WithLabelValues("nomoreslots").Inc()
-				conn.Close(wormhole.CloseNoMoreSlots, "cannot allocate slots")
+				rendezvousCounter.WithLabelValues("nomoreslots", client).Inc()
+				closeWith(conn, wormhole.CloseNoMoreSlots)
 				return
 			}
-			slotkey = newslot
-			sc := make(chan *websocket.Conn)
+			slotkey = slotKey(namespace, newslot)
+			sc := make(chan signalConn)
 			slots.m[slotkey] = sc
 			slotsGuage.Set(float64(len(slots.m)))
 			slots.Unlock()
-			initmsg.Slot = slotkey
+			initmsg.Slot = newslot
 			buf, err := json.Marshal(initmsg)
 			if err != nil {
 				log.Println(err)
@@ -217,6 +465,7 @@ func relay(w http.ResponseWriter, r *http.Request) {
 				delete(slots.m, slotkey)
 				slotsGuage.Set(float64(len(slots.m)))
 				slots.Unlock()
+				closeWith(conn, websocket.StatusInternalError)
 				return
 			}
 			err = conn.Write(ctx, websocket.MessageText, buf)
@@ -226,6 +475,7 @@ func relay(w http.ResponseWriter, r *http.Request) {
 				delete(slots.m, slotkey)
 				slotsGuage.Set(float64(len(slots.m)))
 				slots.Unlock()
+				closeWith(conn, websocket.StatusInternalError)
 				return
 			}
 
@@ -233,12 +483,11 @@ func relay(w http.ResponseWriter, r *http.Request) {
 			for {
 				select {
 				case <-ctx.Done():
-					rendezvousCounter.WithLabelValues("timeout").Inc()
+					rendezvousCounter.WithLabelValues("timeout", client).Inc()
 					slots.Lock()
 					delete(slots.m, slotkey)
 					slotsGuage.Set(float64(len(slots.m)))
 					slots.Unlock()
-					conn.Close(wormhole.CloseSlotTimedOut, "timed out")
 					return
 				case <-time.After(30 * time.Second):
 					// Do a WebSocket Ping every 30 seconds.
@@ -248,7 +497,7 @@ func relay(w http.ResponseWriter, r *http.Request) {
 				}
 			}
 			rconn = <-sc
-			rendezvousCounter.WithLabelValues("success").Inc()
+			rendezvousCounter.WithLabelValues("success", client).Inc()
 			return
 		}
 
@@ -256,61 +505,116 @@ func relay(w http.ResponseWriter, r *http.Request) {
 		slots.Lock()
 		sc, ok := slots.m[slotkey]
 		if !ok {
+			t := slots.taken[slotkey]
+			var ended []signalConn
+			if t != nil {
+				t.late++
+				if maxLateJoins > 0 && t.late >= maxLateJoins {
+					delete(slots.taken, slotkey)
+					ended = []signalConn{t.joiner, t.creator}
+				}
+			}
 			slots.Unlock()
-			rendezvousCounter.WithLabelValues("nosuchslot").Inc()
-			conn.Close(wormhole.CloseNoSuchSlot, "no such slot")
+			// The pair gets the same status, with a reason saying why.
+			// Both are closed at once, so each hears it before its relay
+			// tells it the other hung up.
+			for _, c := range ended {
+				if c != nil {
+					go c.Close(wormhole.CloseSlotTaken, "too many peers tried to join the slot")
+				}
+			}
+			if t != nil {
+				rendezvousCounter.WithLabelValues("taken", client).Inc()
+				closeWith(conn, wormhole.CloseSlotTaken)
+				return
+			}
+			rendezvousCounter.WithLabelValues("nosuchslot", client).Inc()
+			closeWith(conn, wormhole.CloseNoSuchSlot)
 			return
 		}
 		delete(slots.m, slotkey)
+		taken := &takenSlot{joiner: conn}
+		slots.taken[slotkey] = taken
 		slotsGuage.Set(float64(len(slots.m)))
 		slots.Unlock()
-		initmsg.Slot = slotkey
+		initmsg.Slot = slot
 		buf, err := json.Marshal(initmsg)
 		if err != nil {
 			log.Println(err)
+			closeWith(conn, websocket.StatusInternalError)
 			return
 		}
 		err = conn.Write(ctx, websocket.MessageText, buf)
 		if err != nil {
 			log.Println(err)
+			closeWith(conn, websocket.StatusInternalError)
 			return
 		}
 		select {
 		case <-ctx.Done():
-			conn.Close(wormhole.CloseSlotTimedOut, "timed out")
+			rendezvousCounter.WithLabelValues("timeout", client).Inc()
+			return
 		case rconn = <-sc:
 		}
+		slots.Lock()
+		taken.creator = rconn
+		slots.Unlock()
 		sc <- conn
-		rendezvousCounter.WithLabelValues("success").Inc()
+		rendezvousCounter.WithLabelValues("success", client).Inc()
+	}()
+
+	go func() {
+		// Neither waiting for the peer nor signalling with it can take
+		// longer than slotTimeout.
+		<-ctx.Done()
+		if ctx.Err() == context.DeadlineExceeded {
+			closeWith(conn, wormhole.CloseSlotTimedOut)
+		}
 	}()
 
 	defer cancel()
 	for {
-		msgType, p, err := conn.Read(ctx)
+		// Not reading with ctx, which when done would have the websocket
+		// package close conn itself, without saying why.
+		msgType, p, err := conn.Read(r.Context())
 		switch websocket.CloseStatus(err) {
 		case wormhole.CloseBadKey:
-			iceCounter.WithLabelValues("fail", "badkey").Inc()
+			iceCounter.WithLabelValues("fail", "badkey", client).Inc()
+			if rconn != nil {
+				closeWith(rconn, wormhole.CloseBadKey)
+			}
+			return
+		case wormhole.CloseJoinRejected:
+			iceCounter.WithLabelValues("fail", "rejected", client).Inc()
 			if rconn != nil {
-				rconn.Close(wormhole.CloseBadKey, "bad key")
+				closeWith(rconn, wormhole.CloseJoinRejected)
+			}
+			return
+		case wormhole.CloseTunnelMismatch:
+			iceCounter.WithLabelValues("fail", "tunnel", client).Inc()
+			if rconn != nil {
+				closeWith(rconn, wormhole.CloseTunnelMismatch)
 			}
 			return
 		case wormhole.CloseWebRTCFailed:
-			iceCounter.WithLabelValues("fail", "unknown").Inc()
+			iceCounter.WithLabelValues("fail", "unknown", client).Inc()
 			return
 		case wormhole.CloseWebRTCSuccess:
-			iceCounter.WithLabelValues("success", "unknown").Inc()
+			iceCounter.WithLabelValues("success", "unknown", client).Inc()
 			return
 		case wormhole.CloseWebRTCSuccessDirect:
-			iceCounter.WithLabelValues("success", "direct").Inc()
+			iceCounter.WithLabelValues("success", "direct", client).Inc()
 			return
 		case wormhole.CloseWebRTCSuccessRelay:
-			iceCounter.WithLabelValues("success", "relay").Inc()
+			iceCounter.WithLabelValues("success", "relay", client).Inc()
 			return
 		}
 		if err != nil {
-			iceCounter.WithLabelValues("unknown", "unknown").Inc()
-			if rconn != nil {
-				rconn.Close(wormhole.ClosePeerHungUp, "peer hung up")
+			iceCounter.WithLabelValues("unknown", "unknown", client).Inc()
+			if rconn != nil && ctx.Err() == context.DeadlineExceeded {
+				closeWith(rconn, wormhole.CloseSlotTimedOut)
+			} else if rconn != nil {
+				closeWith(rconn, wormhole.ClosePeerHungUp)
 			}
 			return
 		}
@@ -318,10 +622,12 @@ func relay(w http.ResponseWriter, r *http.Request) {
 			// We could synchronise with the rendezvous goroutine above and wait for
 			// B to connect, but receiving anything at this stage is a protocol violation
 			// so we should just bail out.
+			closeWith(conn, websocket.StatusPolicyViolation)
 			return
 		}
 		err = rconn.Write(ctx, msgType, p)
 		if err != nil {
+			closeWith(conn, wormhole.ClosePeerHungUp)
 			return
 		}
 	}
@@ -339,15 +645,28 @@ func server(args ...string) {
 	}
 	httpaddr := set.String("http", ":http", "http listen address")
 	httpsaddr := set.String("https", ":https", "https listen address")
-	debugaddr := set.String("debug", "", "debug and metrics listen address")
+	debugaddr := set.String("debug", "", "debug and metrics listen address; POST /maintenance?on=true there to stop handing out new slots")
 	hosts := set.String("hosts", "", "comma separated list of hosts by which site is accessible")
 	secretpath := set.String("secrets", os.Getenv("HOME")+"/keys", "path to put let's encrypt cache")
-	cert := set.String("cert", "", "https certificate (leave empty to use letsencrypt)")
+	cert := set.String("cert", "", "https certificate (leave empty to use letsencrypt), reloaded on SIGHUP")
 	key := set.String("key", "", "https certificate key")
-	html := set.String("ui", "./web", "path to the web interface files")
+	ui := set.String("ui", "./web", "path to the web interface files")
 	stunservers := set.String("stun", "stun:relay.webwormhole.io", "list of STUN server addresses to tell clients to use")
 	set.StringVar(&turnServer, "turn", "", "TURN server to use for relaying")
 	set.StringVar(&turnSecret, "turn-secret", "", "secret for HMAC-based authentication in TURN server")
+	set.StringVar(&upstream, "upstream", "", "signalling server to forward joins for slots not on this one to, e.g. https://webwormhole.io")
+	namespaceList := set.String("namespaces", "", "comma separated names clients may keep their slots apart in by giving one as the path of their -signal server, e.g. https://example.com/teamA")
+	set.IntVar(&minPassLength, "min-length", 0, "shortest secret, in bytes, clients should generate or accept; only clients that understand it enforce it")
+	set.IntVar(&maxLateJoins, "max-late-joins", 0, "end the rendezvous on a slot, closing both peers, once this many others have tried to join it while it was taken, since its code has likely got out (default no limit)")
+	set.BoolVar(&compress, "compress", false, "allow clients to negotiate permessage-deflate compression (broken on some Safari versions)")
+	statsInterval := set.Duration("stats-interval", 0, "log a summary of the metrics this often (default never)")
+	metricsFile := set.String("metrics-file", "", "file to save counters to and restore them from on startup, so totals survive restarts")
+	metricsInterval := set.Duration("metrics-interval", time.Minute, "how often to save counters to -metrics-file")
+	goModule := set.String("go-import", "webwormhole.io", "module path to tell go get is served from -go-import-repo, or empty to not answer go get")
+	corsOrigins := set.String("cors-origins", "*", "comma separated list of origins whose pages may load the web interface's files and use the signalling server, or * for any")
+	goRepo := set.String("go-import-repo", "https://github.com/saljam/webwormhole", "git repository go get and browsers visiting /cmd/ww are sent to")
+	accessLogFile := set.String("access-log", "", "file to append a line to for every request and WebSocket session, or - for stdout (default none)")
+	accessLogFormat := set.String("access-log-format", "clf", "format of -access-log lines: clf (Common Log Format, with the duration in microseconds at the end) or json")
 	set.Parse(args[1:])
 
 	if (*cert == "") != (*key == "") {
@@ -358,14 +677,34 @@ func server(args ...string) {
 		log.Fatal("cannot use a TURN server without a secret")
 	}
 
-	for _, s := range strings.Split(*stunservers, ",") {
-		if s == "" {
-			continue
+	for _, ns := range strings.Split(*namespaceList, ",") {
+		if ns != "" {
+			namespaces[strings.Trim(ns, "/")] = true
+		}
+	}
+
+	var err error
+	stunServers, err = wormhole.ParseICEServers(strings.Split(*stunservers, ","))
+	if err != nil {
+		log.Fatalf("invalid -stun: %v", err)
+	}
+	if turnServer != "" {
+		turn, err := wormhole.ParseICEServers([]string{turnServer})
+		if err != nil {
+			log.Fatalf("invalid -turn: %v", err)
 		}
-		stunServers = append(stunServers, webrtc.ICEServer{URLs: []string{s}})
+		// Credentials come from -turn-secret, never hand out any given here.
+		turnServer = turn[0].URLs[0]
 	}
 
-	fs := gziphandler.GzipHandler(http.FileServer(http.Dir(*html)))
+	fs := wormhole.ServiceWorkerHandler(gziphandler.GzipHandler(http.FileServer(http.Dir(*ui))))
+	fs = goImportHandler(*goModule, *goRepo, fs)
+	origins := strings.Split(*corsOrigins, ",")
+	fs = corsHandler(origins, fs)
+	originHosts, err = hostsOf(origins)
+	if err != nil {
+		log.Fatalf("invalid -cors-origins: %v", err)
+	}
 	handler := func(w http.ResponseWriter, r *http.Request) {
 		// Handle WebSocket connections.
 		if strings.ToLower(r.Header.Get("Upgrade")) == "websocket" {
@@ -373,9 +712,6 @@ func server(args ...string) {
 			return
 		}
 
-		// Allow 3rd parties to load JS modules, etc.
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-
 		// Disallow 3rd party code to run when we're the origin.
 		// unsafe-eval is required for wasm :(
 		// https://github.com/WebAssembly/content-security-policy/issues/7
@@ -396,23 +732,32 @@ func server(args ...string) {
 			w.Header().Set("Strict-Transport-Security", "max-age=63072000")
 		}
 
-		// Return a redirect to source code repo for the go get URL.
-		if r.URL.Query().Get("go-get") == "1" || r.URL.Path == "/cmd/ww" {
-			w.Write([]byte(importMeta))
-			return
-		}
-
-		// Handle the Service Worker private prefix. A well-behaved Service Worker
-		// must *never* reach us on this path.
-		if strings.HasPrefix(r.URL.Path, "/_/") {
+		// A well-behaved Service Worker must *never* reach us on its private
+		// prefix. fs returns a page saying so.
+		if strings.HasPrefix(r.URL.Path, wormhole.ServiceWorkerPrefix) {
 			protocolErrorCounter.WithLabelValues("serviceworkererr").Inc()
-			http.Error(w, serviceWorkerPage, http.StatusNotFound)
-			return
 		}
 
 		fs.ServeHTTP(w, r)
 	}
 
+	logged := func(h http.Handler) http.Handler { return h }
+	if *accessLogFile != "" {
+		out := os.Stdout
+		if *accessLogFile != "-" {
+			f, err := os.OpenFile(*accessLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+			if err != nil {
+				log.Fatalf("could not open access log: %v", err)
+			}
+			out = f
+		}
+		l, err := newAccessLog(out, *accessLogFormat)
+		if err != nil {
+			log.Fatal(err)
+		}
+		logged = l.handler
+	}
+
 	m := &autocert.Manager{
 		Cache:      autocert.DirCache(*secretpath),
 		Prompt:     autocert.AcceptTOS,
@@ -424,7 +769,7 @@ func server(args ...string) {
 		WriteTimeout: 60 * time.Minute,
 		IdleTimeout:  20 * time.Second,
 		Addr:         *httpsaddr,
-		Handler:      http.HandlerFunc(handler),
+		Handler:      logged(http.HandlerFunc(handler)),
 		TLSConfig: &tls.Config{
 			MinVersion: tls.VersionTLS12,
 			CipherSuites: []uint16{
@@ -442,21 +787,48 @@ func server(args ...string) {
 		WriteTimeout: 60 * time.Minute,
 		IdleTimeout:  20 * time.Second,
 		Addr:         *httpaddr,
-		Handler:      m.HTTPHandler(http.HandlerFunc(handler)),
+		Handler:      logged(m.HTTPHandler(http.HandlerFunc(handler))),
 	}
 
 	if *cert == "" && *key == "" {
 		ssrv.TLSConfig.GetCertificate = m.GetCertificate
+	} else {
+		certs, err := newCertReloader(*cert, *key)
+		if err != nil {
+			log.Fatalf("could not load certificate: %v", err)
+		}
+		ssrv.TLSConfig.GetCertificate = certs.GetCertificate
+		onReloadSignal(func() {
+			err := certs.reload()
+			if err != nil {
+				log.Printf("could not reload certificate: %v", err)
+				return
+			}
+			log.Printf("reloaded certificate")
+		})
+	}
+
+	if *metricsFile != "" {
+		err := loadMetrics(*metricsFile, persistedCounters)
+		if err != nil {
+			log.Fatalf("could not restore metrics: %v", err)
+		}
+		go persistMetrics(*metricsFile, prometheus.DefaultGatherer, persistedCounters, *metricsInterval)
+	}
+
+	if *statsInterval > 0 {
+		go logStats(prometheus.DefaultGatherer, *statsInterval)
 	}
 
 	errc := make(chan error)
 	if *debugaddr != "" {
 		http.Handle("/metrics", promhttp.Handler())
+		http.HandleFunc("/maintenance", maintenanceHandler)
 		go func() { errc <- http.ListenAndServe(*debugaddr, nil) }()
 	}
 	if *httpsaddr != "" {
-		srv.Handler = m.HTTPHandler(nil) // Enable redirect to https handler.
-		go func() { errc <- ssrv.ListenAndServeTLS(*cert, *key) }()
+		srv.Handler = logged(m.HTTPHandler(nil)) // Enable redirect to https handler.
+		go func() { errc <- ssrv.ListenAndServeTLS("", "") }()
 	}
 	if *httpaddr != "" {
 		go func() { errc <- srv.ListenAndServe() }()
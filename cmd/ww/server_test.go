@@ -0,0 +1,951 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+	"webwormhole.io/wordlist"
+	"webwormhole.io/wormhole"
+)
+
+// slotBusy reports whether slot is currently allocated on the server.
+func slotBusy(slot string) bool {
+	slots.RLock()
+	defer slots.RUnlock()
+	_, ok := slots.m[slot]
+	return ok
+}
+
+// waitSlotFree waits for the server to release slot.
+func waitSlotFree(t *testing.T, slot string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for slotBusy(slot) {
+		if time.Now().After(deadline) {
+			t.Fatalf("slot %v was not released", slot)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRotateSlot(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(relay))
+	defer srv.Close()
+
+	// newSlot asks for a slot and returns it along with a function that
+	// gives up waiting for a peer on it.
+	newSlot := func() (string, func() error) {
+		ctx, cancel := context.WithCancel(context.Background())
+		slotc := make(chan string)
+		errc := make(chan error, 1)
+		go func() {
+			_, err := (&wormhole.Config{}).NewContext(ctx, "pass", srv.URL, slotc)
+			errc <- err
+		}()
+		select {
+		case slot := <-slotc:
+			return slot, func() error {
+				cancel()
+				return <-errc
+			}
+		case err := <-errc:
+			t.Fatalf("could not get slot: %v", err)
+		}
+		return "", nil
+	}
+
+	first, rotate := newSlot()
+	if !slotBusy(first) {
+		t.Fatalf("slot %v not allocated", first)
+	}
+	if err := rotate(); err != context.Canceled {
+		t.Fatalf("got %v want %v", err, context.Canceled)
+	}
+	waitSlotFree(t, first)
+
+	second, rotate := newSlot()
+	if !slotBusy(second) {
+		t.Fatalf("slot %v not allocated", second)
+	}
+	rotate()
+	waitSlotFree(t, second)
+}
+
+// loopback connects two wormholes configured with a and b via a local
+// signalling server.
+func loopback(t testing.TB, a, b *wormhole.Config) (ca, cb *wormhole.Wormhole, erra, errb error) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(relay))
+	defer srv.Close()
+
+	slotc := make(chan string)
+	errc := make(chan error, 1)
+	go func() {
+		var err error
+		ca, err = a.New("pass", srv.URL, slotc)
+		errc <- err
+	}()
+	select {
+	case slot := <-slotc:
+		cb, errb = b.Join(slot, "pass", srv.URL)
+	case err := <-errc:
+		t.Fatalf("could not get slot: %v", err)
+	}
+	erra = <-errc
+	return ca, cb, erra, errb
+}
+
+// benchLoopback connects two Wormholes set up with cfg like loopback, for
+// benchmarks. Close can take a while flushing, so they are closed in the
+// background once b is done, rather than between runs.
+func benchLoopback(b *testing.B, cfg *wormhole.Config) (x, y *wormhole.Wormhole) {
+	b.Helper()
+	x, y, errx, erry := loopback(b, cfg, cfg)
+	if errx != nil || erry != nil {
+		b.Fatal(errx, erry)
+	}
+	b.Cleanup(func() {
+		go x.Close()
+		go y.Close()
+	})
+	return x, y
+}
+
+func TestFreeSlotWord(t *testing.T) {
+	slots.Lock()
+	defer slots.Unlock()
+	// Leave only one single word slot free.
+	for i := 0; i < wordlist.WordSlots; i++ {
+		if s := strconv.Itoa(i); i != 42 && slots.m[s] == nil {
+			slots.m[s] = make(chan signalConn)
+			defer delete(slots.m, s)
+		}
+	}
+	slot, ok := freeslot("")
+	if !ok || slot != "42" {
+		t.Fatalf("got slot %v, %v want 42", slot, ok)
+	}
+	n, _ := strconv.Atoi(slot)
+	if word := wordlist.SlotWord(n); word == "" {
+		t.Errorf("slot %v has no word", slot)
+	}
+}
+
+func TestDebugBundle(t *testing.T) {
+	var failed *wormhole.Diagnostics
+	a, _, erra, _ := loopback(t,
+		&wormhole.Config{KeyInfo: []byte("info"), Failed: func(d *wormhole.Diagnostics) { failed = d }},
+		&wormhole.Config{KeyInfo: []byte("other info")},
+	)
+	if erra == nil || a != nil || failed == nil {
+		t.Fatalf("got %v, %v, diagnostics %v want a failed wormhole", a, erra, failed)
+	}
+
+	path := filepath.Join(t.TempDir(), "bundle.json")
+	if err := writeDebugBundle(path, failed); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var d wormhole.Diagnostics
+	if err := json.Unmarshal(buf, &d); err != nil {
+		t.Fatalf("bundle is not valid json: %v", err)
+	}
+	if d.Error != erra.Error() {
+		t.Errorf("bundle has error %q want %q", d.Error, erra)
+	}
+	if len(d.Events) == 0 {
+		t.Error("bundle has no events")
+	}
+	if d.Start.IsZero() {
+		t.Error("bundle has no start time")
+	}
+	if bytes.Contains(buf, []byte("pass")) {
+		t.Error("bundle contains the password")
+	}
+}
+
+func TestCompression(t *testing.T) {
+	defer func(old bool) { compress = old }(compress)
+
+	for _, server := range []bool{false, true} {
+		compress = server
+		srv := httptest.NewServer(http.HandlerFunc(relay))
+		ws, resp, err := websocket.Dial(context.Background(), "ws"+srv.URL[len("http"):], &websocket.DialOptions{
+			Subprotocols:    []string{wormhole.Protocol},
+			CompressionMode: websocket.CompressionNoContextTakeover,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ws.Close(websocket.StatusNormalClosure, "")
+		srv.Close()
+		negotiated := strings.Contains(resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+		if negotiated != server {
+			t.Errorf("server compression %v: negotiated %v", server, negotiated)
+		}
+		if got := resp.Header.Get("Sec-WebSocket-Protocol"); got != wormhole.Protocol {
+			t.Errorf("server compression %v: got subprotocol %q want %q", server, got, wormhole.Protocol)
+		}
+
+		a, b, erra, errb := loopback(t, &wormhole.Config{Compress: true}, &wormhole.Config{})
+		if erra != nil || errb != nil {
+			t.Fatalf("server compression %v: could not connect: %v, %v", server, erra, errb)
+		}
+		a.Close()
+		b.Close()
+	}
+}
+
+// getSlot asks the signalling server srv for a slot with cfg, and gives it
+// up once it has one.
+func getSlot(cfg *wormhole.Config, srv string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	slotc := make(chan string, 1)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := cfg.NewContext(ctx, "pass", srv, slotc)
+		errc <- err
+	}()
+	select {
+	case <-slotc:
+		return nil
+	case err := <-errc:
+		return err
+	}
+}
+
+func TestSignalCertFingerprint(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(relay))
+	defer srv.Close()
+	cert := srv.Certificate()
+	certSum := sha256.Sum256(cert.Raw)
+	keySum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+
+	for _, tt := range []struct {
+		name     string
+		pin      []byte
+		insecure bool
+		ok       bool
+	}{
+		{"cert", certSum[:], false, true},
+		{"public key", keySum[:], false, true},
+		{"self-signed", certSum[:], true, true},
+		{"wrong", make([]byte, sha256.Size), false, false},
+		{"wrong self-signed", make([]byte, sha256.Size), true, false},
+	} {
+		tlsConfig := srv.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+		if tt.insecure {
+			tlsConfig = &tls.Config{InsecureSkipVerify: true}
+		}
+		cfg := &wormhole.Config{TLSConfig: tlsConfig, SignalCertFingerprint: tt.pin}
+		err := getSlot(cfg, srv.URL)
+		if tt.ok && err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+		}
+		if !tt.ok && !errors.Is(err, wormhole.ErrCertMismatch) {
+			t.Errorf("%v: got %v want %v", tt.name, err, wormhole.ErrCertMismatch)
+		}
+	}
+
+	// Resuming a session made without the pin doesn't skip it.
+	tlsConfig := srv.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	resumed := false
+	tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+		resumed = cs.DidResume
+		return nil
+	}
+	if err := getSlot(&wormhole.Config{TLSConfig: tlsConfig}, srv.URL); err != nil {
+		t.Fatal(err)
+	}
+	err := getSlot(&wormhole.Config{TLSConfig: tlsConfig, SignalCertFingerprint: make([]byte, sha256.Size)}, srv.URL)
+	if !resumed {
+		t.Error("no session was resumed")
+	}
+	if !errors.Is(err, wormhole.ErrCertMismatch) {
+		t.Errorf("resumed session: got %v want %v", err, wormhole.ErrCertMismatch)
+	}
+}
+
+func TestClientType(t *testing.T) {
+	for ua, want := range map[string]string{
+		"Mozilla/5.0 (X11; Linux x86_64; rv:109.0) Gecko/20100101 Firefox/115.0": "web",
+		wormhole.UserAgent:   "cli",
+		"Go-http-client/1.1": "cli",
+		"curl/8.0.1":         "unknown",
+		"":                   "unknown",
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("User-Agent", ua)
+		if got := clientType(r); got != want {
+			t.Errorf("%q got %v want %v", ua, got, want)
+		}
+	}
+
+	// Our own client should be counted as such.
+	before := testutil.ToFloat64(rendezvousCounter.WithLabelValues("success", "cli"))
+	a, b, erra, errb := loopback(t, &wormhole.Config{}, &wormhole.Config{})
+	if erra != nil || errb != nil {
+		t.Fatalf("could not connect: %v, %v", erra, errb)
+	}
+	a.Close()
+	b.Close()
+	if after := testutil.ToFloat64(rendezvousCounter.WithLabelValues("success", "cli")); after <= before {
+		t.Errorf("cli rendezvous count went from %v to %v", before, after)
+	}
+}
+
+func TestCompressedSDP(t *testing.T) {
+	for _, cfgs := range [][2]*wormhole.Config{
+		{{CompressSDP: true}, {}},
+		{{}, {CompressSDP: true}},
+		{{CompressSDP: true}, {CompressSDP: true}},
+	} {
+		a, b, erra, errb := loopback(t, cfgs[0], cfgs[1])
+		if erra != nil || errb != nil {
+			t.Fatalf("could not connect with %+v, %+v: %v, %v", *cfgs[0], *cfgs[1], erra, errb)
+		}
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestGoImport(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ui"))
+	})
+	get := func(h http.Handler, target string) string {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		return w.Body.String()
+	}
+
+	h := goImportHandler("example.com/ww", "https://git.example.com/ww", next)
+	for _, target := range []string{"/?go-get=1", "/cmd/ww", "/cmd/ww?go-get=1"} {
+		body := get(h, target)
+		if !strings.Contains(body, `<meta name="go-import" content="example.com/ww git https://git.example.com/ww">`) {
+			t.Errorf("%s: got %q", target, body)
+		}
+		if strings.Contains(body, "saljam") {
+			t.Errorf("%s: still points upstream: %q", target, body)
+		}
+	}
+	if body := get(h, "/"); body != "ui" {
+		t.Errorf("got %q for the UI", body)
+	}
+
+	h = goImportHandler("", "https://git.example.com/ww", next)
+	for _, target := range []string{"/?go-get=1", "/cmd/ww"} {
+		if body := get(h, target); body != "ui" {
+			t.Errorf("%s: got %q with go-import disabled", target, body)
+		}
+	}
+}
+
+func TestUpstream(t *testing.T) {
+	// Both servers would share the same slots, so stand in for the upstream
+	// with one that echoes messages back on any slot.
+	closed := make(chan websocket.StatusCode, 1)
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/404" {
+			conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{Subprotocols: []string{wormhole.Protocol}})
+			if err != nil {
+				return
+			}
+			conn.Close(wormhole.CloseNoSuchSlot, "no such slot")
+			return
+		}
+		if ua := r.Header.Get("User-Agent"); ua != "test-client" {
+			t.Errorf("upstream got User-Agent %q", ua)
+		}
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{Subprotocols: []string{wormhole.Protocol}})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Write(r.Context(), websocket.MessageText, []byte(`{"slot":"`+r.URL.Path[1:]+`"}`))
+		for {
+			typ, p, err := conn.Read(r.Context())
+			if err != nil {
+				closed <- websocket.CloseStatus(err)
+				return
+			}
+			conn.Write(r.Context(), typ, p)
+		}
+	}))
+	defer up.Close()
+	down := httptest.NewServer(http.HandlerFunc(relay))
+	defer down.Close()
+	upstream = up.URL
+	defer func() { upstream = "" }()
+
+	ctx := context.Background()
+	conn, _, err := websocket.Dial(ctx, down.URL+"/1234", &websocket.DialOptions{
+		HTTPHeader:   http.Header{"User-Agent": {"test-client"}},
+		Subprotocols: []string{wormhole.Protocol},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, p, err := conn.Read(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p) != `{"slot":"1234"}` {
+		t.Errorf("got init message %q", p)
+	}
+	conn.Write(ctx, websocket.MessageText, []byte("hello"))
+	_, p, err = conn.Read(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p) != "hello" {
+		t.Errorf("got %q back want %q", p, "hello")
+	}
+	conn.Close(wormhole.CloseWebRTCSuccessDirect, "")
+	select {
+	case code := <-closed:
+		if code != wormhole.CloseWebRTCSuccessDirect {
+			t.Errorf("upstream saw close code %v want %v", code, wormhole.CloseWebRTCSuccessDirect)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream never saw the close")
+	}
+
+	// The upstream's close codes make it back to the client.
+	_, err = (&wormhole.Config{}).Join("404", "pass", down.URL)
+	if err != wormhole.ErrNoSuchSlot {
+		t.Errorf("got %v joining a slot missing upstream, want %v", err, wormhole.ErrNoSuchSlot)
+	}
+
+	// Slots on this server aren't forwarded.
+	upstream = "http://127.0.0.1:1"
+	a, b, erra, errb := loopback(t, &wormhole.Config{}, &wormhole.Config{})
+	if erra != nil || errb != nil {
+		t.Fatalf("could not connect locally: %v, %v", erra, errb)
+	}
+	a.Close()
+	b.Close()
+}
+
+func TestCORS(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	cases := []struct {
+		origins []string
+		origin  string
+		want    string
+	}{
+		{[]string{"*"}, "https://example.com", "*"},
+		{[]string{"*"}, "", "*"},
+		{[]string{"https://example.com", "https://ww.example.com"}, "https://ww.example.com", "https://ww.example.com"},
+		{[]string{"https://example.com"}, "https://EXAMPLE.com", "https://EXAMPLE.com"},
+		{[]string{"https://example.com"}, "https://evil.example", ""},
+		{[]string{"https://example.com"}, "http://example.com", ""},
+		{[]string{"https://example.com"}, "", ""},
+		{[]string{""}, "https://example.com", ""},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		if c.origin != "" {
+			r.Header.Set("Origin", c.origin)
+		}
+		corsHandler(c.origins, next).ServeHTTP(w, r)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != c.want {
+			t.Errorf("%v from %q: got %q want %q", c.origins, c.origin, got, c.want)
+		}
+		if vary := w.Header().Get("Vary"); (c.want != "" && c.want != "*") != (vary == "Origin") {
+			t.Errorf("%v from %q: got Vary %q", c.origins, c.origin, vary)
+		}
+	}
+}
+
+func TestRelayOrigin(t *testing.T) {
+	defer func(h []string) { originHosts = h }(originHosts)
+	var err error
+	originHosts, err = hostsOf([]string{"https://ww.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(relay))
+	defer srv.Close()
+
+	dial := func(origin string) error {
+		h := http.Header{}
+		if origin != "" {
+			h.Set("Origin", origin)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		ws, _, err := websocket.Dial(ctx, srv.URL, &websocket.DialOptions{
+			Subprotocols: []string{wormhole.Protocol},
+			HTTPHeader:   h,
+		})
+		if err == nil {
+			ws.Close(websocket.StatusNormalClosure, "")
+		}
+		return err
+	}
+	for _, origin := range []string{"", "https://ww.example.com", "http://" + strings.TrimPrefix(srv.URL, "http://")} {
+		if err := dial(origin); err != nil {
+			t.Errorf("from %q: %v", origin, err)
+		}
+	}
+	if err := dial("https://evil.example"); err == nil {
+		t.Error("upgraded a connection from another origin")
+	}
+
+	for _, c := range []struct {
+		origins []string
+		want    []string
+	}{
+		{[]string{"*"}, nil},
+		{[]string{"https://example.com", "*"}, nil},
+		{[]string{"https://example.com", " http://localhost:8000"}, []string{"example.com", "localhost:8000"}},
+		{[]string{""}, []string{}},
+	} {
+		got, err := hostsOf(c.origins)
+		if err != nil || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("hostsOf(%q) = %q, %v want %q", c.origins, got, err, c.want)
+		}
+	}
+	if _, err := hostsOf([]string{"example.com"}); err == nil {
+		t.Error("took a host for an origin")
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(relay))
+	defer srv.Close()
+	admin := httptest.NewServer(http.HandlerFunc(maintenanceHandler))
+	defer admin.Close()
+	setMaintenance := func(on bool) {
+		t.Helper()
+		resp, err := http.PostForm(admin.URL, map[string][]string{"on": {strconv.FormatBool(on)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if want := fmt.Sprintf("maintenance: %v\n", on); string(body) != want {
+			t.Fatalf("got %q want %q", body, want)
+		}
+	}
+	defer setMaintenance(false)
+
+	// A wormhole waiting for its peer before maintenance starts.
+	slotc := make(chan string)
+	errc := make(chan error, 1)
+	var a *wormhole.Wormhole
+	go func() {
+		var err error
+		a, err = conf.New("pass", srv.URL, slotc)
+		errc <- err
+	}()
+	var slot string
+	select {
+	case slot = <-slotc:
+	case err := <-errc:
+		t.Fatalf("could not get slot: %v", err)
+	}
+
+	setMaintenance(true)
+	_, err := conf.New("pass", srv.URL, make(chan string, 1))
+	var closeErr websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != wormhole.CloseNoMoreSlots || closeErr.Reason != "maintenance" {
+		t.Errorf("got %v creating a slot in maintenance, want it closed with %v maintenance", err, wormhole.CloseNoMoreSlots)
+	}
+	var wormholeErr *wormhole.CloseError
+	if !errors.As(err, &wormholeErr) || err.Error() != "signalling server closed the connection: maintenance" {
+		t.Errorf("got %v creating a slot in maintenance, want a wormhole.CloseError", err)
+	}
+
+	// Its peer can still join, and the relay still forwards their
+	// signalling.
+	b, err := conf.Join(slot, "pass", srv.URL)
+	if err != nil {
+		t.Fatalf("could not join in maintenance: %v", err)
+	}
+	defer b.Close()
+	if err := <-errc; err != nil {
+		t.Fatalf("could not connect in maintenance: %v", err)
+	}
+	defer a.Close()
+
+	setMaintenance(false)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go conf.NewContext(ctx, "pass", srv.URL, slotc)
+	select {
+	case <-slotc:
+	case <-time.After(5 * time.Second):
+		t.Error("no slot after maintenance")
+	}
+}
+
+func TestConcurrentJoins(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(relay))
+	defer srv.Close()
+	wsURL := "ws" + srv.URL[len("http"):]
+	dial := func(slot string) *websocket.Conn {
+		t.Helper()
+		ws, _, err := websocket.Dial(context.Background(), wsURL+"/"+slot, &websocket.DialOptions{
+			Subprotocols: []string{wormhole.Protocol},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ws
+	}
+
+	creator := dial("")
+	defer creator.Close(websocket.StatusNormalClosure, "")
+	var initmsg struct{ Slot string }
+	if err := wsjson.Read(context.Background(), creator, &initmsg); err != nil {
+		t.Fatal(err)
+	}
+	// Answer the server hanging up on us.
+	go creator.Read(context.Background())
+
+	// Only the first to join is paired. The rest are told the slot is
+	// taken, for as long as it is.
+	const joiners = 8
+	conns := make([]*websocket.Conn, joiners)
+	for i := range conns {
+		conns[i] = dial(initmsg.Slot)
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, joiners)
+	for i, ws := range conns {
+		wg.Add(1)
+		go func(i int, ws *websocket.Conn) {
+			defer wg.Done()
+			_, _, errs[i] = ws.Read(context.Background())
+		}(i, ws)
+	}
+	wg.Wait()
+	var winner *websocket.Conn
+	for i, err := range errs {
+		switch websocket.CloseStatus(err) {
+		case -1:
+			if err != nil {
+				t.Fatal(err)
+			}
+			if winner != nil {
+				t.Fatal("more than one peer joined the slot")
+			}
+			winner = conns[i]
+		case wormhole.CloseSlotTaken:
+		default:
+			t.Errorf("joiner %d: got %v want %v", i, err, wormhole.CloseSlotTaken)
+		}
+	}
+	if winner == nil {
+		t.Fatal("no peer joined the slot")
+	}
+	_, _, err := dial(initmsg.Slot).Read(context.Background())
+	if websocket.CloseStatus(err) != wormhole.CloseSlotTaken {
+		t.Errorf("late joiner got %v want %v", err, wormhole.CloseSlotTaken)
+	}
+
+	// Once the peer that joined hangs up, the slot is gone.
+	winner.Close(websocket.StatusNormalClosure, "")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, _, err := dial(initmsg.Slot).Read(context.Background())
+		if websocket.CloseStatus(err) == wormhole.CloseNoSuchSlot {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %v after the peer hung up, want %v", err, wormhole.CloseNoSuchSlot)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMaxLateJoins(t *testing.T) {
+	defer func(n int) { maxLateJoins = n }(maxLateJoins)
+	maxLateJoins = 2
+	srv := httptest.NewServer(http.HandlerFunc(relay))
+	defer srv.Close()
+	wsURL := "ws" + srv.URL[len("http"):]
+	dial := func(slot string) *websocket.Conn {
+		t.Helper()
+		ws, _, err := websocket.Dial(context.Background(), wsURL+"/"+slot, &websocket.DialOptions{
+			Subprotocols: []string{wormhole.Protocol},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ws
+	}
+	var initmsg struct{ Slot string }
+	creator := dial("")
+	defer creator.Close(websocket.StatusNormalClosure, "")
+	if err := wsjson.Read(context.Background(), creator, &initmsg); err != nil {
+		t.Fatal(err)
+	}
+	joiner := dial(initmsg.Slot)
+	defer joiner.Close(websocket.StatusNormalClosure, "")
+	if err := wsjson.Read(context.Background(), joiner, &initmsg); err != nil {
+		t.Fatal(err)
+	}
+	relayed := func() error {
+		if err := creator.Write(context.Background(), websocket.MessageText, []byte("hi")); err != nil {
+			return err
+		}
+		_, _, err := joiner.Read(context.Background())
+		return err
+	}
+	if err := relayed(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Up to the limit, late joiners are turned away and the pair carries on.
+	_, _, err := dial(initmsg.Slot).Read(context.Background())
+	if websocket.CloseStatus(err) != wormhole.CloseSlotTaken {
+		t.Fatalf("late joiner got %v want %v", err, wormhole.CloseSlotTaken)
+	}
+	if err := relayed(); err != nil {
+		t.Fatalf("pair ended before the limit: %v", err)
+	}
+
+	// At it, the pair is told the slot was taken too, and it's gone.
+	_, _, err = dial(initmsg.Slot).Read(context.Background())
+	if websocket.CloseStatus(err) != wormhole.CloseSlotTaken {
+		t.Fatalf("late joiner got %v want %v", err, wormhole.CloseSlotTaken)
+	}
+	for name, ws := range map[string]*websocket.Conn{"creator": creator, "joiner": joiner} {
+		_, _, err := ws.Read(context.Background())
+		if websocket.CloseStatus(err) != wormhole.CloseSlotTaken {
+			t.Errorf("%s got %v want %v", name, err, wormhole.CloseSlotTaken)
+		}
+	}
+	_, _, err = dial(initmsg.Slot).Read(context.Background())
+	if websocket.CloseStatus(err) != wormhole.CloseNoSuchSlot {
+		t.Errorf("got %v after the rendezvous ended, want %v", err, wormhole.CloseNoSuchSlot)
+	}
+}
+
+func TestConfirmJoin(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(relay))
+	defer srv.Close()
+
+	// Either side can turn the other away, after both are shown the same
+	// words.
+	for _, rejecter := range []string{"creator", "joiner"} {
+		var creatorSAS, joinerSAS string
+		slotc := make(chan string)
+		errc := make(chan error, 1)
+		go func() {
+			_, err := (&wormhole.Config{ConfirmJoin: func(sas string) bool {
+				creatorSAS = sas
+				return rejecter != "creator"
+			}}).New("pass", srv.URL, slotc)
+			errc <- err
+		}()
+		slot := <-slotc
+		_, err := (&wormhole.Config{ConfirmJoin: func(sas string) bool {
+			joinerSAS = sas
+			return rejecter != "joiner"
+		}}).Join(slot, "pass", srv.URL)
+		if err != wormhole.ErrJoinRejected {
+			t.Errorf("%v rejecting: joiner got %v want %v", rejecter, err, wormhole.ErrJoinRejected)
+		}
+		if err := <-errc; err != wormhole.ErrJoinRejected {
+			t.Errorf("%v rejecting: creator got %v want %v", rejecter, err, wormhole.ErrJoinRejected)
+		}
+		if creatorSAS == "" || creatorSAS != joinerSAS {
+			t.Errorf("%v rejecting: creator saw %q and joiner %q", rejecter, creatorSAS, joinerSAS)
+		}
+	}
+}
+
+func TestCloseReasons(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(relay))
+	defer srv.Close()
+	wsURL := "ws" + srv.URL[len("http"):]
+	dial := func(slot, proto string) *websocket.Conn {
+		t.Helper()
+		ws, _, err := websocket.Dial(context.Background(), wsURL+"/"+slot, &websocket.DialOptions{
+			Subprotocols: []string{proto},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ws
+	}
+	create := func() (*websocket.Conn, string) {
+		t.Helper()
+		ws := dial("", wormhole.Protocol)
+		var initmsg struct{ Slot string }
+		if err := wsjson.Read(context.Background(), ws, &initmsg); err != nil {
+			t.Fatal(err)
+		}
+		return ws, initmsg.Slot
+	}
+	// pair returns a creator and the joiner paired with it on slot.
+	pair := func() (a, b *websocket.Conn, slot string) {
+		t.Helper()
+		a, slot = create()
+		b = dial(slot, wormhole.Protocol)
+		var initmsg struct{ Slot string }
+		if err := wsjson.Read(context.Background(), b, &initmsg); err != nil {
+			t.Fatal(err)
+		}
+		// Wait for the server to pair them.
+		if err := b.Write(context.Background(), websocket.MessageText, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := a.Read(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return a, b, slot
+	}
+	check := func(what string, ws *websocket.Conn, code websocket.StatusCode, reason string) {
+		t.Helper()
+		_, _, err := ws.Read(context.Background())
+		var ce websocket.CloseError
+		if !errors.As(err, &ce) || ce.Code != code || ce.Reason != reason {
+			t.Errorf("%s: got %v want %v %q", what, err, code, reason)
+		}
+	}
+
+	check("wrong protocol", dial("", "1"), wormhole.CloseWrongProto, "wrong protocol, please upgrade client")
+	check("no such slot", dial("9999", wormhole.Protocol), wormhole.CloseNoSuchSlot, "no such slot")
+
+	a, b, _ := pair()
+	b.Close(websocket.StatusNormalClosure, "")
+	check("peer hung up", a, wormhole.ClosePeerHungUp, "peer hung up")
+
+	// Statuses a peer closes with are passed on with a reason.
+	for code, reason := range map[websocket.StatusCode]string{
+		wormhole.CloseBadKey:         "bad key",
+		wormhole.CloseJoinRejected:   "join rejected",
+		wormhole.CloseTunnelMismatch: "tunnel mismatch",
+	} {
+		a, b, _ := pair()
+		b.Close(code, "")
+		check(reason, a, code, reason)
+	}
+
+	a, b, slot := pair()
+	defer b.Close(websocket.StatusNormalClosure, "")
+	check("slot taken", dial(slot, wormhole.Protocol), wormhole.CloseSlotTaken, "slot already taken")
+	a.Close(websocket.StatusNormalClosure, "")
+
+	a, _ = create()
+	a.Write(context.Background(), websocket.MessageText, []byte("early"))
+	check("message before peer", a, websocket.StatusPolicyViolation, "message sent before the peer joined")
+
+	maintenance.Store(true)
+	check("maintenance", dial("", wormhole.Protocol), wormhole.CloseNoMoreSlots, "maintenance")
+	maintenance.Store(false)
+
+	defer func(d time.Duration) { slotTimeout = d }(slotTimeout)
+	slotTimeout = time.Second
+	a, _ = create()
+	check("timed out", a, wormhole.CloseSlotTimedOut, "timed out")
+	// Paired peers too, so the signalling for one connection can't go on
+	// forever.
+	a, b, _ = pair()
+	check("timed out creator", a, wormhole.CloseSlotTimedOut, "timed out")
+	check("timed out joiner", b, wormhole.CloseSlotTimedOut, "timed out")
+}
+
+func TestNamespaces(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(relay))
+	defer srv.Close()
+	namespaces = map[string]bool{"teamA": true, "teamB": true}
+	defer func() { namespaces = map[string]bool{} }()
+
+	create := func(namespace, pass string) (string, chan *wormhole.Wormhole, chan error) {
+		t.Helper()
+		slotc := make(chan string, 1)
+		cc, errc := make(chan *wormhole.Wormhole, 1), make(chan error, 1)
+		go func() {
+			c, err := (&wormhole.Config{}).New(pass, srv.URL+"/"+namespace, slotc)
+			cc <- c
+			errc <- err
+		}()
+		select {
+		case slot := <-slotc:
+			return slot, cc, errc
+		case err := <-errc:
+			t.Fatalf("could not get a slot in %s: %v", namespace, err)
+		}
+		return "", nil, nil
+	}
+
+	slot, ca, erra := create("teamA", "passA")
+	if !slotBusy("teamA/"+slot) || slotBusy(slot) {
+		t.Fatalf("slot %s not allocated in teamA alone", slot)
+	}
+	// Not on the same slot anywhere else.
+	for _, sigserv := range []string{srv.URL, srv.URL + "/teamB", srv.URL + "/teamC"} {
+		if _, err := (&wormhole.Config{}).Join(slot, "passA", sigserv); err != wormhole.ErrNoSuchSlot {
+			t.Errorf("joining %s on %s: got %v want %v", slot, sigserv, err, wormhole.ErrNoSuchSlot)
+		}
+	}
+	_, err := (&wormhole.Config{}).New("pass", srv.URL+"/teamC", make(chan string, 1))
+	var closed *wormhole.CloseError
+	if !errors.As(err, &closed) || closed.Code != int(wormhole.CloseNoSuchSlot) || closed.Reason != "no such namespace" {
+		t.Errorf("creating in an unknown namespace: got %v", err)
+	}
+
+	// Leave teamB only the same slot to get.
+	slots.Lock()
+	for i := 0; i < wordlist.WordSlots; i++ {
+		if k := slotKey("teamB", strconv.Itoa(i)); strconv.Itoa(i) != slot && slots.m[k] == nil {
+			slots.m[k] = make(chan signalConn)
+			defer delete(slots.m, k)
+		}
+	}
+	slots.Unlock()
+	same, cb, errb := create("teamB", "passB")
+	if same != slot {
+		t.Fatalf("got slot %s in teamB want %s", same, slot)
+	}
+
+	// Each joiner gets the peer in its own namespace, which would have
+	// failed with ErrBadKey otherwise.
+	for _, peer := range []struct {
+		namespace, pass string
+		cc              chan *wormhole.Wormhole
+		errc            chan error
+	}{{"teamA", "passA", ca, erra}, {"teamB", "passB", cb, errb}} {
+		c, err := (&wormhole.Config{}).Join(slot, peer.pass, srv.URL+"/"+peer.namespace)
+		if err != nil {
+			t.Fatalf("joining %s in %s: %v", slot, peer.namespace, err)
+		}
+		creator := <-peer.cc
+		if err := <-peer.errc; err != nil {
+			t.Fatalf("creator in %s: %v", peer.namespace, err)
+		}
+		creator.Close()
+		c.Close()
+	}
+}
@@ -0,0 +1,10 @@
+//go:build windows || plan9 || js
+// +build windows plan9 js
+
+package main
+
+// onPauseSignal does nothing on systems without SIGUSR1.
+func onPauseSignal(f func()) {}
+
+// onReloadSignal does nothing on systems without SIGHUP.
+func onReloadSignal(f func()) {}
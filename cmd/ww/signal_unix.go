@@ -0,0 +1,31 @@
+//go:build !windows && !plan9 && !js
+// +build !windows,!plan9,!js
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// onSignal calls f every time the process gets sig.
+func onSignal(sig os.Signal, f func()) {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, sig)
+	go func() {
+		for range sigc {
+			f()
+		}
+	}()
+}
+
+// onPauseSignal calls f every time the process gets SIGUSR1.
+func onPauseSignal(f func()) {
+	onSignal(syscall.SIGUSR1, f)
+}
+
+// onReloadSignal calls f every time the process gets SIGHUP.
+func onReloadSignal(f func()) {
+	onSignal(syscall.SIGHUP, f)
+}
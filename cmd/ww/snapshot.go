@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// persistedCounters are the counters saved to -metrics-file, by the name
+// they are gathered as. The busy slots gauge isn't, since the slots
+// themselves don't survive a restart.
+var persistedCounters = map[string]*prometheus.CounterVec{
+	"ww_rendezvous_attempts": rendezvousCounter,
+	"ww_webrtc_attempts":     iceCounter,
+	"ww_protocol_errors":     protocolErrorCounter,
+}
+
+// A counterValue is one counter's value in a metrics snapshot.
+type counterValue struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels"`
+	Value  float64           `json:"value"`
+}
+
+// saveMetrics writes the values of the counters gathered from g to path,
+// replacing it whole so a crash never leaves half a snapshot.
+func saveMetrics(path string, g prometheus.Gatherer, counters map[string]*prometheus.CounterVec) error {
+	mfs, err := g.Gather()
+	if err != nil {
+		return err
+	}
+	values := []counterValue{}
+	for _, mf := range mfs {
+		if counters[mf.GetName()] == nil {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			values = append(values, counterValue{mf.GetName(), labels, m.GetCounter().GetValue()})
+		}
+	}
+	buf, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// loadMetrics adds the values saved in path by saveMetrics back to counters.
+// A missing file is not an error, since there's none before the first save.
+// Values of counters that no longer exist, or whose labels changed, are
+// dropped.
+func loadMetrics(path string, counters map[string]*prometheus.CounterVec) error {
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var values []counterValue
+	if err := json.Unmarshal(buf, &values); err != nil {
+		return err
+	}
+	for _, v := range values {
+		vec := counters[v.Name]
+		if vec == nil || v.Value < 0 {
+			continue
+		}
+		c, err := vec.GetMetricWith(v.Labels)
+		if err != nil {
+			log.Printf("dropping saved metric %s: %v", v.Name, err)
+			continue
+		}
+		c.Add(v.Value)
+	}
+	return nil
+}
+
+// persistMetrics saves the counters gathered from g to path every interval.
+func persistMetrics(path string, g prometheus.Gatherer, counters map[string]*prometheus.CounterVec, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := saveMetrics(path, g, counters); err != nil {
+			log.Printf("could not save metrics: %v", err)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRestoreMetrics(t *testing.T) {
+	newCounters := func() (*prometheus.Registry, map[string]*prometheus.CounterVec) {
+		vec := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_attempts"}, []string{"result"})
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(vec)
+		return reg, map[string]*prometheus.CounterVec{"test_attempts": vec}
+	}
+	path := filepath.Join(t.TempDir(), "metrics.json")
+
+	// Nothing to restore on the first start.
+	reg, counters := newCounters()
+	if err := loadMetrics(path, counters); err != nil {
+		t.Fatal(err)
+	}
+	counters["test_attempts"].WithLabelValues("success").Add(3)
+	counters["test_attempts"].WithLabelValues("timeout").Inc()
+	if err := saveMetrics(path, reg, counters); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restart.
+	_, counters = newCounters()
+	counters["test_attempts"].WithLabelValues("success").Inc()
+	if err := loadMetrics(path, counters); err != nil {
+		t.Fatal(err)
+	}
+	vec := counters["test_attempts"]
+	if got := testutil.ToFloat64(vec.WithLabelValues("success")); got != 4 {
+		t.Errorf("got %v successes want 4", got)
+	}
+	if got := testutil.ToFloat64(vec.WithLabelValues("timeout")); got != 1 {
+		t.Errorf("got %v timeouts want 1", got)
+	}
+
+	if err := os.WriteFile(path, []byte(`[{"name":"test_attempts","labels":{"method":"x"},"value":1},{"name":"gone","value":1}]`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	_, counters = newCounters()
+	if err := loadMetrics(path, counters); err != nil {
+		t.Fatal(err)
+	}
+	if n := testutil.CollectAndCount(counters["test_attempts"]); n != 0 {
+		t.Errorf("restored %v counters with unknown names or labels", n)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package main
+
+import "errors"
+
+// freeSpace is not implemented on this system.
+func freeSpace(dir string) (int64, error) {
+	return 0, errors.New("cannot tell free space on this system")
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+)
+
+// An extent is a region of a file that holds data, rather than a hole.
+type extent struct {
+	off, n int64
+}
+
+// sparseFile is a file with holes, opened by sparse. Only its extents are
+// sent. Reading it reads all of it, holes as zeros.
+type sparseFile struct {
+	*os.File
+	extents []extent
+}
+
+// sparse returns a source that sends regular files with holes, like disk
+// images, as only their extents, if it can find their holes. Others, and
+// files on systems or filesystems that don't say where holes are, are sent
+// as they are.
+func sparse(open source) source {
+	return func() (header, io.ReadCloser, error) {
+		h, r, err := open()
+		if err != nil {
+			return h, r, err
+		}
+		f, ok := r.(*os.File)
+		if !ok || h.Unsized {
+			return h, r, nil
+		}
+		extents, err := dataExtents(f, int64(h.Size))
+		if err != nil {
+			return h, r, nil
+		}
+		var data int64
+		for _, e := range extents {
+			data += e.n
+		}
+		if data == int64(h.Size) {
+			return h, r, nil
+		}
+		h.Sparse, h.Data = true, data
+		return h, &sparseFile{f, extents}, nil
+	}
+}
+
+// sendExtents sends the extents of r as offset-framed messages of at most
+// the current size, in order. It returns the number of bytes sent.
+func sendExtents(c io.Writer, r io.ReaderAt, extents []extent, size *chunkSize) (written int64, err error) {
+	buf := make([]byte, maxChunkSize)
+	for _, e := range extents {
+		for off, end := e.off, e.off+e.n; off < end; {
+			p := buf[:size.get()-chunkHeaderSize]
+			if int64(len(p)) > end-off {
+				p = p[:end-off]
+			}
+			n, err := r.ReadAt(p, off)
+			if n < len(p) {
+				if err == nil || err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return written, err
+			}
+			if err := writeChunk(c, off, p); err != nil {
+				return written, err
+			}
+			off += int64(n)
+			written += int64(n)
+		}
+	}
+	return written, nil
+}
+
+// receiveSparse reads the data bytes of a sparse file of size bytes from c
+// into w, each message prefixed with its offset, in order. If w can be
+// truncated, the holes are left for it to make. Otherwise they are filled
+// with zeros, so w can be written one message after the other. It returns
+// the number of data bytes written.
+func receiveSparse(w io.WriterAt, c io.Reader, size, data int64) (written int64, err error) {
+	t, holes := w.(interface{ Truncate(int64) error })
+	if holes {
+		if err := t.Truncate(size); err != nil {
+			return 0, err
+		}
+	}
+
+	end := int64(0) // Where the last message ended.
+	buf := make([]byte, chunkHeaderSize+maxChunkSize)
+	for written < data {
+		n, err := c.Read(buf)
+		if err == io.EOF && n == 0 {
+			return written, io.ErrUnexpectedEOF
+		}
+		if err != nil && err != io.EOF {
+			return written, err
+		}
+		if n < chunkHeaderSize {
+			return written, io.ErrUnexpectedEOF
+		}
+		offset := int64(binary.BigEndian.Uint64(buf))
+		p := buf[chunkHeaderSize:n]
+		if offset < end {
+			return written, errOutOfOrder
+		}
+		if offset+int64(len(p)) > size || written+int64(len(p)) > data {
+			return written, errChunkOverflow
+		}
+		if !holes {
+			if err := writeZeros(w, end, offset); err != nil {
+				return written, err
+			}
+		}
+		n, err = w.WriteAt(p, offset)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+		end = offset + int64(n)
+	}
+	if !holes {
+		if err := writeZeros(w, end, size); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// zeros is written in place of holes.
+var zeros = make([]byte, msgChunkSize)
+
+// writeZeros fills w from off up to end with zeros.
+func writeZeros(w io.WriterAt, off, end int64) error {
+	for off < end {
+		p := zeros
+		if int64(len(p)) > end-off {
+			p = p[:end-off]
+		}
+		n, err := w.WriteAt(p, off)
+		if err != nil {
+			return err
+		}
+		off += int64(n)
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// dataExtents is not implemented on this system, so files are always sent
+// with their holes.
+func dataExtents(f *os.File, size int64) ([]extent, error) {
+	return nil, errors.New("cannot find holes on this system")
+}
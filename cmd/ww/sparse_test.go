@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSparseFile writes a file of size bytes to dir that is all holes but
+// for data at each of offsets, skipping the test if the filesystem doesn't
+// keep holes. It returns the file's path and content.
+func writeSparseFile(t *testing.T, dir, name string, size int64, data []byte, offsets ...int64) (string, []byte) {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	content := make([]byte, size)
+	for _, off := range offsets {
+		if _, err := f.WriteAt(data, off); err != nil {
+			t.Fatal(err)
+		}
+		copy(content[off:], data)
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	if !isSparse(t, path) {
+		t.Skip("filesystem does not keep holes")
+	}
+	return path, content
+}
+
+// isSparse reports whether the file at path has holes.
+func isSparse(t *testing.T, path string) bool {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	extents, err := dataExtents(f, info.Size())
+	if err != nil {
+		return false
+	}
+	var data int64
+	for _, e := range extents {
+		data += e.n
+	}
+	return data < info.Size()
+}
+
+func TestSendSparse(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	data := bytes.Repeat([]byte("data"), 64<<10)
+	// Holes at the start, between data and at the end.
+	name, content := writeSparseFile(t, src, "disk.img", 16<<20, data, 1<<20, 8<<20)
+	dense := writeTestFile(t, src, "dense", []byte("no holes"))
+
+	sender, receiver := msgPipe()
+	counted := &countingConn{msgConn: sender}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- sendFiles(counted, []string{name, dense}, io.Discard, sendOptions{ackTimeout: time.Second, sparse: true})
+		sender.Close()
+	}()
+	results, err := receiveFiles(receiver, &dirDestination{dir: dst}, io.Discard, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		if r.err != nil {
+			t.Errorf("%s: %v", r.name, r.err)
+		}
+	}
+
+	got, err := os.ReadFile(filepath.Join(dst, "disk.img"))
+	if err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("got %d bytes, %v that differ from the %d sent", len(got), err, len(content))
+	}
+	if !isSparse(t, filepath.Join(dst, "disk.img")) {
+		t.Error("received file has no holes")
+	}
+	if n := counted.sent; n > 4*len(data) {
+		t.Errorf("sent %d bytes for %d of data", n, 2*len(data))
+	}
+	if got, err := os.ReadFile(filepath.Join(dst, "dense")); err != nil || string(got) != "no holes" {
+		t.Errorf("got %q, %v", got, err)
+	}
+}
+
+func TestReceiveSparseFilled(t *testing.T) {
+	src := t.TempDir()
+	data := []byte("data")
+	name, content := writeSparseFile(t, src, "disk.img", 4<<20, data, 2<<20)
+
+	// Destinations that are written in order get the holes as zeros.
+	sender, receiver := msgPipe()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- sendFiles(sender, []string{name}, io.Discard, sendOptions{ackTimeout: time.Second, sparse: true})
+		sender.Close()
+	}()
+	var merged bytes.Buffer
+	if _, err := receiveFiles(receiver, &mergeDestination{w: &merged}, io.Discard, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(merged.Bytes(), content) {
+		t.Errorf("got %d bytes that differ from the %d sent", merged.Len(), len(content))
+	}
+
+	// So do readers of the files as they arrive.
+	sender, receiver = msgPipe()
+	go func() {
+		errc <- sendFiles(sender, []string{name}, io.Discard, sendOptions{ackTimeout: time.Second, sparse: true})
+		sender.Close()
+	}()
+	r := newFileReader(receiver)
+	h, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.Sparse || h.Data >= int64(h.Size) {
+		t.Errorf("got header %+v", h)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("got %d bytes, %v that differ from the %d sent", len(got), err, len(content))
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("got %v after the last file want io.EOF", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReceiveSparseOutOfOrder(t *testing.T) {
+	sender, receiver := msgPipe()
+	defer sender.Close()
+	go func() {
+		writeChunk(sender, 10, []byte("b"))
+		writeChunk(sender, 5, []byte("a"))
+	}()
+	_, err := receiveSparse(struct{ io.WriterAt }{&streamWriter{w: io.Discard}}, receiver, 20, 2)
+	if err != errOutOfOrder {
+		t.Errorf("got %v want %v", err, errOutOfOrder)
+	}
+}
@@ -0,0 +1,46 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// dataExtents returns the extents of f, which is size bytes long, using
+// SEEK_DATA and SEEK_HOLE. Filesystems that don't keep holes report the
+// whole file as data. f is left at its start.
+func dataExtents(f *os.File, size int64) ([]extent, error) {
+	var extents []extent
+	for off := int64(0); off < size; {
+		data, err := f.Seek(off, unix.SEEK_DATA)
+		if errors.Is(err, syscall.ENXIO) {
+			// Only a hole from off to the end.
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		hole, err := f.Seek(data, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, err
+		}
+		if hole > size {
+			hole = size
+		}
+		if hole <= data {
+			break
+		}
+		extents = append(extents, extent{data, hole - data})
+		off = hole
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return extents, nil
+}
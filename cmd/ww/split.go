@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// splitWriter is an io.WriterAt that spreads a stream over numbered files of
+// at most size bytes each: prefix.000, prefix.001, and so on.
+type splitWriter struct {
+	prefix string
+	size   int64
+	parts  []*os.File
+}
+
+func (s *splitWriter) name(i int) string {
+	return fmt.Sprintf("%s.%03d", s.prefix, i)
+}
+
+// part returns the i-th file, creating it and any before it if needed.
+func (s *splitWriter) part(i int) (*os.File, error) {
+	for len(s.parts) <= i {
+		f, err := os.Create(s.name(len(s.parts)))
+		if err != nil {
+			return nil, err
+		}
+		s.parts = append(s.parts, f)
+	}
+	return s.parts[i], nil
+}
+
+func (s *splitWriter) WriteAt(p []byte, off int64) (n int, err error) {
+	for len(p) > 0 {
+		f, err := s.part(int(off / s.size))
+		if err != nil {
+			return n, err
+		}
+		chunk := s.size - off%s.size
+		if chunk > int64(len(p)) {
+			chunk = int64(len(p))
+		}
+		m, err := f.WriteAt(p[:chunk], off%s.size)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p, off = p[chunk:], off+chunk
+	}
+	return n, nil
+}
+
+// Truncate cuts the stream down to size bytes, removing parts that are no
+// longer needed.
+func (s *splitWriter) Truncate(size int64) error {
+	keep := int((size + s.size - 1) / s.size)
+	for len(s.parts) > keep {
+		last := len(s.parts) - 1
+		s.parts[last].Close()
+		if err := os.Remove(s.name(last)); err != nil {
+			return err
+		}
+		s.parts = s.parts[:last]
+	}
+	if keep == 0 {
+		return nil
+	}
+	return s.parts[keep-1].Truncate(size - int64(keep-1)*s.size)
+}
+
+func (s *splitWriter) Close() (err error) {
+	for _, f := range s.parts {
+		if e := f.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// splitDestination saves every file received one after the other into a
+// single stream split over numbered files of at most size bytes, named
+// after the first file, in dir.
+type splitDestination struct {
+	dir  string
+	size int64
+
+	w       *splitWriter
+	written int64
+}
+
+func (d *splitDestination) create(h header) (io.WriterAt, func() error, func(), error) {
+	if d.w == nil {
+		d.w = &splitWriter{
+			prefix: filepath.Join(d.dir, filepath.Clean("/"+h.Name)),
+			size:   d.size,
+		}
+	}
+	base := d.written
+	w := &offsetWriter{w: d.w, base: base}
+	done := func() error {
+		d.written = base + w.end
+		return nil
+	}
+	undo := func() {
+		d.w.Truncate(base)
+		d.written = base
+	}
+	return w, done, undo, nil
+}
+
+// Close closes all the parts written.
+func (d *splitDestination) Close() error {
+	if d.w == nil {
+		return nil
+	}
+	return d.w.Close()
+}
+
+// offsetWriter is an io.WriterAt that writes to w at offsets relative to
+// base. end is where the furthest write so far ended.
+type offsetWriter struct {
+	w    io.WriterAt
+	base int64
+	end  int64
+}
+
+func (o *offsetWriter) WriteAt(p []byte, off int64) (int, error) {
+	n, err := o.w.WriteAt(p, o.base+off)
+	if off+int64(n) > o.end {
+		o.end = off + int64(n)
+	}
+	return n, err
+}
+
+// parseSize parses a size in bytes like 100MB or 1GiB. KB, MB and GB are
+// powers of 1000, and K, M, G, KiB, MiB and GiB powers of 1024, like
+// split(1).
+func parseSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		n      int64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+		{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9},
+		{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30},
+		{"B", 1},
+	}
+	mult := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			s, mult = strings.TrimSuffix(s, u.suffix), u.n
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n <= 0 {
+		return 0, errors.New("size must be positive")
+	}
+	if n > (1<<63-1)/mult {
+		return 0, errors.New("size too large")
+	}
+	return n * mult, nil
+}
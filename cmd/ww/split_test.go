@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	for s, want := range map[string]int64{
+		"100":   100,
+		"100B":  100,
+		"100MB": 100e6,
+		"2KiB":  2048,
+		"1G":    1 << 30,
+	} {
+		got, err := parseSize(s)
+		if err != nil || got != want {
+			t.Errorf("%v: got %v, %v want %v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "MB", "-1MB", "0", "1TB", "9999999999GB"} {
+		if _, err := parseSize(s); err == nil {
+			t.Errorf("%v: parsed invalid size", s)
+		}
+	}
+}
+
+func TestReceiveSplit(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	a, b := make([]byte, 250), make([]byte, 100)
+	rand.Read(a)
+	rand.Read(b)
+	names := []string{
+		writeTestFile(t, src, "backup.tar", a),
+		writeTestFile(t, src, "more", b),
+	}
+
+	sender, receiver := msgPipe()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- sendFiles(sender, names, io.Discard, sendOptions{ackTimeout: time.Second})
+		sender.Close()
+	}()
+	dest := &splitDestination{dir: dst, size: 100}
+	if _, err := receiveFiles(receiver, dest, io.Discard, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	dest.Close()
+	receiver.Close()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	want := append(a, b...)
+	var got []byte
+	for i, size := range []int{100, 100, 100, 50} {
+		part, err := os.ReadFile(filepath.Join(dst, "backup.tar.00"+string(rune('0'+i))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(part) != size {
+			t.Errorf("part %v is %v bytes want %v", i, len(part), size)
+		}
+		got = append(got, part...)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("parts differ from the stream sent")
+	}
+	entries, _ := os.ReadDir(dst)
+	if len(entries) != 4 {
+		t.Errorf("got %v files want 4", len(entries))
+	}
+}
+
+func TestSplitWriter(t *testing.T) {
+	dir := t.TempDir()
+	w := &splitWriter{prefix: filepath.Join(dir, "x"), size: 10}
+	defer w.Close()
+
+	// Out of order writes, like offset framed chunks.
+	for _, c := range []struct {
+		off int64
+		p   string
+	}{{15, "fghijklmnopq"}, {0, "0123456789abcde"}} {
+		if _, err := w.WriteAt([]byte(c.p), c.off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Truncate(12); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"0123456789", "ab"} {
+		got, err := os.ReadFile(w.name(i))
+		if err != nil || string(got) != want {
+			t.Errorf("part %v: got %q, %v want %q", i, got, err, want)
+		}
+	}
+	if _, err := os.Stat(w.name(2)); !os.IsNotExist(err) {
+		t.Errorf("truncated part still there: %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// stats is a summary of the signalling server's metrics, for logging where
+// no one scrapes them.
+type stats struct {
+	busy       float64 // Slots in use.
+	rendezvous float64 // Successful rendezvous.
+	failed     float64 // Failed rendezvous.
+	direct     float64 // Successful direct WebRTC connections.
+	relay      float64 // Successful relayed WebRTC connections.
+}
+
+// gatherStats sums up the metrics in g.
+func gatherStats(g prometheus.Gatherer) (stats, error) {
+	var s stats
+	mfs, err := g.Gather()
+	if err != nil {
+		return s, err
+	}
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			switch mf.GetName() {
+			case "ww_busy_slots":
+				s.busy += m.GetGauge().GetValue()
+			case "ww_rendezvous_attempts":
+				if labelValue(m, "result") == "success" {
+					s.rendezvous += m.GetCounter().GetValue()
+				} else {
+					s.failed += m.GetCounter().GetValue()
+				}
+			case "ww_webrtc_attempts":
+				if labelValue(m, "result") != "success" {
+					continue
+				}
+				switch labelValue(m, "method") {
+				case "direct":
+					s.direct += m.GetCounter().GetValue()
+				case "relay":
+					s.relay += m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return s, nil
+}
+
+func labelValue(m *dto.Metric, name string) string {
+	for _, l := range m.GetLabel() {
+		if l.GetName() == name {
+			return l.GetValue()
+		}
+	}
+	return ""
+}
+
+// since returns the counts in s that happened after prev. Busy slots are
+// left as they are now.
+func (s stats) since(prev stats) stats {
+	return stats{
+		busy:       s.busy,
+		rendezvous: s.rendezvous - prev.rendezvous,
+		failed:     s.failed - prev.failed,
+		direct:     s.direct - prev.direct,
+		relay:      s.relay - prev.relay,
+	}
+}
+
+func (s stats) String() string {
+	return fmt.Sprintf("busy slots %v, rendezvous %v ok %v failed, webrtc %v direct %v relay",
+		s.busy, s.rendezvous, s.failed, s.direct, s.relay)
+}
+
+// logStats logs what happened in the metrics in g every interval.
+func logStats(g prometheus.Gatherer, interval time.Duration) {
+	prev, err := gatherStats(g)
+	if err != nil {
+		log.Printf("could not gather stats: %v", err)
+	}
+	for range time.Tick(interval) {
+		s, err := gatherStats(g)
+		if err != nil {
+			log.Printf("could not gather stats: %v", err)
+			continue
+		}
+		log.Printf("last %v: %v", interval, s.since(prev))
+		prev = s
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestGatherStats(t *testing.T) {
+	before, err := gatherStats(prometheus.DefaultGatherer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slotsGuage.Inc()
+	defer slotsGuage.Dec()
+	rendezvousCounter.WithLabelValues("success", "test").Add(3)
+	rendezvousCounter.WithLabelValues("timeout", "test").Inc()
+	rendezvousCounter.WithLabelValues("nosuchslot", "test").Inc()
+	iceCounter.WithLabelValues("success", "direct", "test").Add(2)
+	iceCounter.WithLabelValues("success", "relay", "test").Inc()
+	iceCounter.WithLabelValues("fail", "unknown", "test").Inc()
+
+	after, err := gatherStats(prometheus.DefaultGatherer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := after.since(before)
+	want := stats{busy: before.busy + 1, rendezvous: 3, failed: 2, direct: 2, relay: 1}
+	if got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+}
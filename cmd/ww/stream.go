@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// A fileReader reads the files sent over a connection one after the other,
+// like tar.Reader does for archives. Next moves on to the next file, and
+// Read returns the current file's data as each message of it arrives, so
+// it can be processed, e.g. played, before the rest has been sent. Read
+// returns io.EOF exactly at the end of each file.
+//
+// Offers of files are accepted, and files with checksums always asked for.
+// Parallel transfers are declined, since their files can't arrive one after
+// the other. Bundles are read as the tar archives they are.
+type fileReader struct {
+	c io.ReadWriter
+
+	h      header
+	read   int64  // Bytes of the current file read so far.
+	data   int64  // Bytes of them that were sent, not holes.
+	buf    []byte // The last message read.
+	hole   int64  // Zeros to return before unread, for sparse files.
+	unread []byte // What's left of buf to return.
+	eof    bool   // Whether the current file has been read in full.
+	err    error  // Sticky error reading the current file.
+
+	toldSize bool // Whether the sender was told how big messages can be.
+}
+
+func newFileReader(c io.ReadWriter) *fileReader {
+	return &fileReader{c: c, buf: make([]byte, chunkHeaderSize+maxChunkSize), eof: true}
+}
+
+// Next skips the rest of the current file, if any, and returns the header
+// of the next one. It returns io.EOF when the sender has no more.
+func (r *fileReader) Next() (header, error) {
+	if !r.eof {
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			return header{}, err
+		}
+	}
+	for {
+		h, err := readHeader(r.c)
+		if err != nil {
+			return h, err
+		}
+		if h.Streams > 0 {
+			writeControl(r.c, controlDecline)
+			return h, fmt.Errorf("cannot read files sent over %d channels as one stream", h.Streams)
+		}
+		if h.Files > 0 {
+			if err := writeControl(r.c, controlAccept); err != nil {
+				return h, err
+			}
+			continue
+		}
+		if h.ChunkSizes && !r.toldSize {
+			if err := writeChunkSize(r.c); err != nil {
+				return h, fmt.Errorf("could not send chunk size: %v", err)
+			}
+			r.toldSize = true
+		}
+		if h.SHA256 != "" {
+			if err := writeControl(r.c, controlSend); err != nil {
+				return h, err
+			}
+		}
+		r.h, r.read, r.data, r.hole, r.unread, r.eof, r.err = h, 0, 0, 0, nil, false, nil
+		if !h.Unsized && h.Size == 0 {
+			if err := r.finish(); err != nil {
+				return h, err
+			}
+		}
+		return h, nil
+	}
+}
+
+// Read reads the current file's data, waiting for the sender if none has
+// arrived yet.
+func (r *fileReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.hole == 0 && len(r.unread) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+		if err := r.readMessage(); err != nil {
+			r.err = err
+			return 0, err
+		}
+		if r.eof && r.hole == 0 && len(r.unread) == 0 {
+			return 0, io.EOF
+		}
+	}
+	if r.hole > 0 {
+		n := len(p)
+		if int64(n) > r.hole {
+			n = int(r.hole)
+		}
+		for i := range p[:n] {
+			p[i] = 0
+		}
+		r.hole -= int64(n)
+		return n, nil
+	}
+	n := copy(p, r.unread)
+	r.unread = r.unread[n:]
+	return n, nil
+}
+
+// readMessage reads the next message of the current file into unread, and
+// for sparse files the hole before it into hole.
+func (r *fileReader) readMessage() error {
+	if r.h.Sparse && r.data == r.h.Data {
+		// Everything left is a hole.
+		r.hole, r.read = int64(r.h.Size)-r.read, int64(r.h.Size)
+		return r.finish()
+	}
+	n, err := r.c.Read(r.buf)
+	if err == io.EOF || err == nil && n == 0 && !r.h.Unsized {
+		return io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		// The end of an unsized file.
+		return r.finish()
+	}
+	p := r.buf[:n]
+	if r.h.Offsets || r.h.Sparse {
+		if n < chunkHeaderSize {
+			return io.ErrUnexpectedEOF
+		}
+		off := int64(binary.BigEndian.Uint64(p))
+		if off < r.read || off != r.read && !r.h.Sparse {
+			return errOutOfOrder
+		}
+		p = p[chunkHeaderSize:]
+		r.hole, r.read = off-r.read, off
+	}
+	if !r.h.Unsized && r.read+int64(len(p)) > int64(r.h.Size) || r.h.Sparse && r.data+int64(len(p)) > r.h.Data {
+		return errChunkOverflow
+	}
+	r.read += int64(len(p))
+	r.data += int64(len(p))
+	r.unread = p
+	if !r.h.Unsized && r.read == int64(r.h.Size) {
+		return r.finish()
+	}
+	return nil
+}
+
+// finish marks the current file as received, acknowledging it if the
+// sender asked to.
+func (r *fileReader) finish() error {
+	r.eof = true
+	if !r.h.Ack {
+		return nil
+	}
+	if err := writeControl(r.c, controlAck); err != nil {
+		return fmt.Errorf("could not acknowledge file: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestFileReaderIncremental(t *testing.T) {
+	sender, receiver := msgPipe()
+	defer sender.Close()
+	next := make(chan struct{})
+	go func() {
+		writeHeader(sender, header{Name: "movie", Size: 6}, false)
+		sender.Write([]byte("abc"))
+		// Only send the rest once the first part was read.
+		<-next
+		sender.Write([]byte("def"))
+	}()
+
+	r := newFileReader(receiver)
+	h, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Name != "movie" {
+		t.Errorf("got file %q", h.Name)
+	}
+	buf := make([]byte, 10)
+	n, err := r.Read(buf)
+	if err != nil || string(buf[:n]) != "abc" {
+		t.Fatalf("got %q, %v want the first part before the rest was sent", buf[:n], err)
+	}
+	close(next)
+	n, err = r.Read(buf)
+	if err != nil || string(buf[:n]) != "def" {
+		t.Fatalf("got %q, %v", buf[:n], err)
+	}
+	if n, err := r.Read(buf); n != 0 || err != io.EOF {
+		t.Errorf("got %d, %v at the end of the file want io.EOF", n, err)
+	}
+}
+
+func TestFileReader(t *testing.T) {
+	src := t.TempDir()
+	a := bytes.Repeat([]byte("a"), 3*msgChunkSize+1)
+	files := []string{
+		writeTestFile(t, src, "a", a),
+		writeTestFile(t, src, "empty", nil),
+		writeTestFile(t, src, "b", []byte("bbb")),
+		writeTestFile(t, src, "skipped", []byte("skip me")),
+		writeTestFile(t, src, "c", []byte("c")),
+	}
+	sender, receiver := msgPipe()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- sendFiles(sender, files, io.Discard, sendOptions{ackTimeout: time.Second})
+		sender.Close()
+	}()
+
+	r := newFileReader(receiver)
+	for _, want := range []struct {
+		name    string
+		content []byte
+	}{{"a", a}, {"empty", nil}, {"b", []byte("bbb")}, {"skipped", nil}, {"c", []byte("c")}} {
+		h, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Name != want.name {
+			t.Fatalf("got file %q want %q", h.Name, want.name)
+		}
+		if want.name == "skipped" {
+			continue
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want.content) {
+			t.Errorf("%s: got %d bytes want %d", want.name, len(got), len(want.content))
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("got %v after the last file want io.EOF", err)
+	}
+	receiver.Close()
+	// Every file was acknowledged.
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
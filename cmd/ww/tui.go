@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxDisplayLines is how many of the last lines printed the display
+	// keeps on screen. The code's QR code scrolls off once files arrive.
+	maxDisplayLines = 40
+
+	// redrawInterval is how often progress alone redraws the display.
+	redrawInterval = 100 * time.Millisecond
+
+	// barWidth is the width of the progress bar, not counting brackets.
+	barWidth = 40
+)
+
+func tui(args ...string) {
+	set := flag.NewFlagSet(args[0], flag.ExitOnError)
+	set.Usage = func() {
+		fmt.Fprintf(set.Output(), "send files, or receive them if none are given, showing the code, its QR code\n")
+		fmt.Fprintf(set.Output(), "and the transfer's progress full-screen. without a terminal, it does what\n")
+		fmt.Fprintf(set.Output(), "send or receive would.\n\n")
+		fmt.Fprintf(set.Output(), "usage: %s %s [files]...\n\n", os.Args[0], args[0])
+		fmt.Fprintf(set.Output(), "flags:\n")
+		set.PrintDefaults()
+	}
+	length := set.Int("length", 2, "length of generated secret, if generating")
+	code := set.String("code", "", "use a wormhole code instead of generating one")
+	directory := set.String("dir", ".", "directory to put received files")
+	set.Parse(args[1:])
+
+	if !isTerminal(os.Stderr) {
+		// Nowhere to draw.
+		args := plainArgs(*code, *length, *directory, set.Args())
+		if args[0] == "send" {
+			send(args...)
+		} else {
+			receive(args...)
+		}
+		return
+	}
+
+	var total int64
+	for _, name := range set.Args() {
+		info, err := os.Stat(name)
+		if err != nil {
+			fatalf("could not stat file %s: %v", name, err)
+		}
+		total += info.Size()
+	}
+	d := &display{w: os.Stderr, total: total}
+	stderr = d
+	c := newConn(*code, *length, 0, 0)
+	pc := &progressConn{connection: c, d: d, sending: set.NArg() > 0}
+
+	var err error
+	if set.NArg() > 0 {
+		err = sendFiles(pc, set.Args(), d, sendOptions{ackTimeout: 30 * time.Second})
+	} else {
+		// Parallel transfers are declined, since only this channel's
+		// progress is shown.
+		var results []fileResult
+		results, err = receiveFiles(pc, &dirDestination{dir: *directory}, d, nil, nil, nil)
+		printSummary(d, results)
+	}
+	c.Close()
+	d.draw()
+	if err != nil {
+		fatalf("%v", err)
+	}
+}
+
+// plainArgs returns the send or receive command line that does what tui
+// would, for when there's no terminal to draw on.
+func plainArgs(code string, length int, directory string, files []string) []string {
+	if len(files) > 0 {
+		args := []string{"send", "-length", strconv.Itoa(length)}
+		if code != "" {
+			args = append(args, "-code", code)
+		}
+		return append(args, files...)
+	}
+	args := []string{"receive", "-length", strconv.Itoa(length), "-dir", directory}
+	if code != "" {
+		args = append(args, code)
+	}
+	return args
+}
+
+// isTerminal reports whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// A display shows the last lines printed to it on a terminal, under a
+// progress bar of the transfer, redrawing the whole screen whenever either
+// changes.
+type display struct {
+	w io.Writer
+
+	mu    sync.Mutex
+	lines []string // The last lines printed, the last one possibly partial.
+	n     int64    // Bytes transferred so far.
+	total int64    // Bytes to transfer in all, or 0 if not known.
+	start time.Time
+	drawn time.Time
+}
+
+func (d *display) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.lines) == 0 {
+		d.lines = []string{""}
+	}
+	for i, s := range strings.Split(string(p), "\n") {
+		if i == 0 {
+			d.lines[len(d.lines)-1] += s
+			continue
+		}
+		d.lines = append(d.lines, s)
+	}
+	if len(d.lines) > maxDisplayLines {
+		d.lines = d.lines[len(d.lines)-maxDisplayLines:]
+	}
+	d.redraw()
+	return len(p), nil
+}
+
+// add counts n more bytes transferred.
+func (d *display) add(n int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.start.IsZero() {
+		d.start = time.Now()
+	}
+	d.n += int64(n)
+	if time.Since(d.drawn) >= redrawInterval {
+		d.redraw()
+	}
+}
+
+// draw redraws the display.
+func (d *display) draw() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.redraw()
+}
+
+// redraw redraws the display. It assumes d is locked.
+func (d *display) redraw() {
+	var b bytes.Buffer
+	// Move to the top left and clear the screen.
+	b.WriteString("\x1b[H\x1b[2J")
+	b.WriteString(strings.Join(d.lines, "\n"))
+	if !d.start.IsZero() {
+		if len(d.lines) > 0 && d.lines[len(d.lines)-1] != "" {
+			b.WriteString("\n")
+		}
+		b.WriteString("\n")
+		b.WriteString(progressBar(d.n, d.total, time.Since(d.start)))
+		b.WriteString("\n")
+	}
+	d.w.Write(b.Bytes())
+	d.drawn = time.Now()
+}
+
+// progressBar describes n of total bytes transferred in elapsed time,
+// with a bar if total is known.
+func progressBar(n, total int64, elapsed time.Duration) string {
+	rate := ""
+	if elapsed > 0 {
+		rate = fmt.Sprintf(", %s/s", formatBytes(int64(float64(n)/elapsed.Seconds())))
+	}
+	if total <= 0 {
+		return formatBytes(n) + rate
+	}
+	if n > total {
+		n = total
+	}
+	filled := int(n * barWidth / total)
+	bar := strings.Repeat("=", filled)
+	if filled < barWidth {
+		bar += ">" + strings.Repeat(" ", barWidth-filled-1)
+	}
+	return fmt.Sprintf("[%s] %3d%% %s of %s%s", bar, n*100/total, formatBytes(n), formatBytes(total), rate)
+}
+
+// formatBytes formats n bytes in kB, MB or GB, powers of 1000, as needed.
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1e9:
+		return fmt.Sprintf("%.1f GB", float64(n)/1e9)
+	case n >= 1e6:
+		return fmt.Sprintf("%.1f MB", float64(n)/1e6)
+	case n >= 1e3:
+		return fmt.Sprintf("%.1f kB", float64(n)/1e3)
+	default:
+		return fmt.Sprintf("%d B", n)
+	}
+}
+
+// progressConn is a connection that counts the bytes sent over it on a
+// display if sending, or the bytes received if not.
+type progressConn struct {
+	*connection
+	d       *display
+	sending bool
+}
+
+func (c *progressConn) Read(p []byte) (int, error) {
+	n, err := c.connection.Read(p)
+	if !c.sending {
+		c.d.add(n)
+	}
+	return n, err
+}
+
+func (c *progressConn) Write(p []byte) (int, error) {
+	n, err := c.connection.Write(p)
+	if c.sending {
+		c.d.add(n)
+	}
+	return n, err
+}
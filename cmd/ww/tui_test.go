@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"webwormhole.io/wordlist"
+)
+
+func TestPlainArgs(t *testing.T) {
+	for _, tt := range []struct {
+		code  string
+		files []string
+		want  []string
+	}{
+		{"", []string{"a", "b"}, []string{"send", "-length", "3", "a", "b"}},
+		{"1-foo-bar", []string{"a"}, []string{"send", "-length", "3", "-code", "1-foo-bar", "a"}},
+		{"", nil, []string{"receive", "-length", "3", "-dir", "out"}},
+		{"1-foo-bar", nil, []string{"receive", "-length", "3", "-dir", "out", "1-foo-bar"}},
+	} {
+		if got := plainArgs(tt.code, 3, "out", tt.files); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("plainArgs(%q, %q) = %q want %q", tt.code, tt.files, got, tt.want)
+		}
+	}
+}
+
+func TestIsTerminal(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	f, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, f := range []*os.File{r, w, f} {
+		if isTerminal(f) {
+			t.Errorf("%s is a terminal", f.Name())
+		}
+	}
+}
+
+func TestTUIFallback(t *testing.T) {
+	if isTerminal(os.Stderr) {
+		t.Skip("stderr is a terminal")
+	}
+	src, dst := t.TempDir(), t.TempDir()
+	name := writeTestFile(t, src, "a.txt", []byte("hello"))
+
+	srv := httptest.NewServer(http.HandlerFunc(relay))
+	defer srv.Close()
+	r, w := io.Pipe()
+	defer r.Close()
+	defer func(s string, w io.Writer) { sigserv, stderr = s, w }(sigserv, stderr)
+	sigserv, stderr = srv.URL, w
+
+	out := &bytes.Buffer{}
+	codes := make(chan string, 1)
+	scanned := make(chan struct{})
+	go func() {
+		defer close(scanned)
+		s := bufio.NewScanner(r)
+		for s.Scan() {
+			out.WriteString(s.Text() + "\n")
+			if _, pass := wordlist.Decode(s.Text()); pass != nil {
+				codes <- s.Text()
+			}
+		}
+	}()
+	sent := make(chan struct{})
+	go func() {
+		tui("tui", name)
+		close(sent)
+	}()
+	c := newConn(<-codes, 2, 0, 0)
+	// The sender hanging up once it's done may fail the next read, and
+	// leave Close waiting to flush until the connection times out.
+	receiveFiles(c, &dirDestination{dir: dst}, io.Discard, nil, nil, nil)
+	go c.Close()
+	select {
+	case <-sent:
+	case <-time.After(10 * time.Second):
+		t.Fatal("sender did not finish")
+	}
+
+	got, err := os.ReadFile(filepath.Join(dst, "a.txt"))
+	if err != nil || string(got) != "hello" {
+		t.Errorf("received %q, %v", got, err)
+	}
+	w.Close()
+	<-scanned
+	if strings.Contains(out.String(), "\x1b[") {
+		t.Errorf("drew on a non-terminal: %q", out.String())
+	}
+}
+
+func TestProgressBar(t *testing.T) {
+	for _, tt := range []struct {
+		n, total int64
+		elapsed  time.Duration
+		want     string
+	}{
+		{0, 1000, 0, "[>" + strings.Repeat(" ", 39) + "]   0% 0 B of 1.0 kB"},
+		{500, 1000, time.Second, "[" + strings.Repeat("=", 20) + ">" + strings.Repeat(" ", 19) + "]  50% 500 B of 1.0 kB, 500 B/s"},
+		{2e6, 2e6, 2 * time.Second, "[" + strings.Repeat("=", 40) + "] 100% 2.0 MB of 2.0 MB, 1.0 MB/s"},
+		{3e9, 0, time.Second, "3.0 GB, 3.0 GB/s"},
+	} {
+		if got := progressBar(tt.n, tt.total, tt.elapsed); got != tt.want {
+			t.Errorf("progressBar(%d, %d, %v) = %q want %q", tt.n, tt.total, tt.elapsed, got, tt.want)
+		}
+	}
+}
+
+func TestDisplay(t *testing.T) {
+	var screen bytes.Buffer
+	d := &display{w: &screen, total: 10}
+	for i := 0; i < maxDisplayLines+5; i++ {
+		io.WriteString(d, "receiving a.txt... ")
+		io.WriteString(d, "done\n")
+	}
+	if len(d.lines) != maxDisplayLines {
+		t.Errorf("kept %d lines want %d", len(d.lines), maxDisplayLines)
+	}
+	d.add(5)
+	d.draw()
+	last := screen.String()[strings.LastIndex(screen.String(), "\x1b[2J"):]
+	if !strings.Contains(last, "receiving a.txt... done\n") || !strings.Contains(last, " 50% 5 B of 10 B") {
+		t.Errorf("got screen %q", last)
+	}
+}
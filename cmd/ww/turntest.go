@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/turn/v2"
+)
+
+func turntest(args ...string) {
+	set := flag.NewFlagSet(args[0], flag.ExitOnError)
+	set.Usage = func() {
+		fmt.Fprintf(set.Output(), "check a TURN server by allocating a relay on it, without a peer\n\n")
+		fmt.Fprintf(set.Output(), "usage: %s %s -turn <url> -turn-secret <secret>\n\n", os.Args[0], args[0])
+		fmt.Fprintf(set.Output(), "flags:\n")
+		set.PrintDefaults()
+	}
+	server := set.String("turn", "", "TURN server to test, e.g. turns:relay.example.com:5349")
+	secret := set.String("turn-secret", "", "secret for HMAC-based authentication in TURN server, as given to the signalling server")
+	timeout := set.Duration("timeout", 10*time.Second, "give up on the allocation after this long")
+	set.Parse(args[1:])
+
+	if *server == "" || set.NArg() > 0 {
+		set.Usage()
+		os.Exit(2)
+	}
+
+	start := time.Now()
+	relayed, err := turnAllocate(*server, *secret, *timeout)
+	if err != nil {
+		fatalf("could not allocate on %v: %v", *server, err)
+	}
+	fmt.Fprintf(stderr, "allocated relay %v in %v\n", relayed, time.Since(start).Round(time.Millisecond))
+}
+
+// turnAllocate makes a TURN allocation on server using the same credentials
+// the signalling server would hand out, and returns the relayed address. The
+// allocation is released before returning.
+func turnAllocate(server, secret string, timeout time.Duration) (net.Addr, error) {
+	u, err := ice.ParseURL(server)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != ice.SchemeTypeTURN && u.Scheme != ice.SchemeTypeTURNS {
+		return nil, fmt.Errorf("%v is not a TURN server", server)
+	}
+	addr := net.JoinHostPort(u.Host, strconv.Itoa(u.Port))
+
+	var conn net.PacketConn
+	switch {
+	case u.Scheme == ice.SchemeTypeTURNS:
+		c, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr, &tls.Config{ServerName: u.Host})
+		if err != nil {
+			return nil, err
+		}
+		conn = turn.NewSTUNConn(c)
+	case u.Proto == ice.ProtoTypeTCP:
+		c, err := net.DialTimeout("tcp", addr, timeout)
+		if err != nil {
+			return nil, err
+		}
+		conn = turn.NewSTUNConn(c)
+	default:
+		conn, err = net.ListenPacket("udp", ":0")
+		if err != nil {
+			return nil, err
+		}
+	}
+	defer conn.Close()
+
+	username, credential := turnCredentials(secret, time.Now().Add(timeout))
+	client, err := turn.NewClient(&turn.ClientConfig{
+		TURNServerAddr: addr,
+		Username:       username,
+		Password:       credential,
+		Conn:           conn,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	if err := client.Listen(); err != nil {
+		return nil, err
+	}
+
+	// Allocate retransmits for a long time if the server doesn't answer.
+	// Closing the client makes it give up.
+	timer := time.AfterFunc(timeout, client.Close)
+	relay, err := client.Allocate()
+	if !timer.Stop() {
+		return nil, errors.New("timed out")
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer relay.Close()
+	return relay.LocalAddr(), nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/turn/v2"
+)
+
+// turnTestServer starts a TURN server on localhost that checks credentials
+// the way coturn's use-auth-secret does, and returns its port.
+func turnTestServer(t *testing.T, secret string) int {
+	t.Helper()
+	udp, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := turn.NewServer(turn.ServerConfig{
+		Realm: "webwormhole.test",
+		AuthHandler: func(username, realm string, _ net.Addr) ([]byte, bool) {
+			expires, _, _ := strings.Cut(username, ":")
+			ts, err := strconv.ParseInt(expires, 10, 64)
+			if err != nil || time.Unix(ts, 0).Before(time.Now()) {
+				return nil, false
+			}
+			u, credential := turnCredentials(secret, time.Unix(ts, 0))
+			if u != username {
+				return nil, false
+			}
+			return turn.GenerateAuthKey(username, realm, credential), true
+		},
+		PacketConnConfigs: []turn.PacketConnConfig{{
+			PacketConn: udp,
+			RelayAddressGenerator: &turn.RelayAddressGeneratorStatic{
+				RelayAddress: net.ParseIP("127.0.0.1"),
+				Address:      "127.0.0.1",
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	return udp.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestTURNAllocate(t *testing.T) {
+	port := turnTestServer(t, "secret")
+	server := "turn:127.0.0.1:" + strconv.Itoa(port)
+
+	relayed, err := turnAllocate(server, "secret", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, ok := relayed.(*net.UDPAddr); !ok || !a.IP.Equal(net.ParseIP("127.0.0.1")) || a.Port == port {
+		t.Errorf("got relayed address %v", relayed)
+	}
+
+	if _, err := turnAllocate(server, "wrong", 5*time.Second); err == nil {
+		t.Error("allocated with the wrong secret")
+	}
+	if _, err := turnAllocate("stun:127.0.0.1:"+strconv.Itoa(port), "secret", time.Second); err == nil {
+		t.Error("allocated on a STUN URL")
+	}
+}
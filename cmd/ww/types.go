@@ -0,0 +1,190 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Types of files receive can do more with than save, if asked to.
+const (
+	typeTar  = "application/x-tar"
+	typeText = "text/plain"
+	typeGzip = "application/gzip"
+)
+
+// extTypes are the types of files with these extensions, which the system
+// may not know.
+var extTypes = map[string]string{
+	".tar": typeTar,
+	".txt": typeText,
+	".gz":  typeGzip,
+	".tgz": typeGzip,
+}
+
+// fileType guesses the type of the named file from its extension, like
+// browsers do for the web client. It is empty if unknown.
+func fileType(name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	if t, ok := extTypes[ext]; ok {
+		return t
+	}
+	return mime.TypeByExtension(ext)
+}
+
+// mediaType returns the media type in t without any parameters, and with
+// the aliases some browsers use replaced.
+func mediaType(t string) string {
+	mt, _, err := mime.ParseMediaType(t)
+	if err != nil {
+		return ""
+	}
+	if mt == "application/x-gzip" {
+		return typeGzip
+	}
+	return mt
+}
+
+// typedDestination handles files of some well known types specially, and
+// saves all others, and those it wasn't asked to handle, to destination.
+type typedDestination struct {
+	destination
+
+	// extract, if set, is the directory tar archives are extracted into.
+	extract string
+
+	// text, if set, is where text files are printed.
+	text io.Writer
+
+	// gunzip decompresses gzip files before saving them without their
+	// .gz extension.
+	gunzip bool
+}
+
+func (d *typedDestination) create(h header) (io.WriterAt, func() error, func(), error) {
+	switch mediaType(h.Type) {
+	case typeTar:
+		if d.extract != "" {
+			var created []string
+			w, closef := piped(func(r io.Reader) error {
+				return extractTar(r, d.extract, &created)
+			})
+			undo := func() {
+				for _, path := range created {
+					os.Remove(path)
+				}
+			}
+			return w, closef, undo, nil
+		}
+	case typeText:
+		if d.text != nil {
+			return &streamWriter{w: d.text}, func() error { return nil }, func() {}, nil
+		}
+	case typeGzip:
+		if d.gunzip {
+			return d.gunzipped(h)
+		}
+	}
+	return d.destination.create(h)
+}
+
+// gunzipped saves the gzip file described by h decompressed to destination.
+func (d *typedDestination) gunzipped(h header) (io.WriterAt, func() error, func(), error) {
+	name := strings.TrimSuffix(h.Name, filepath.Ext(h.Name))
+	if strings.EqualFold(filepath.Ext(h.Name), ".tgz") {
+		name += ".tar"
+	}
+	out, closeOut, undo, err := d.destination.create(header{Name: name, Type: fileType(name)})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	w, closef := piped(func(r io.Reader) error {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			closeOut()
+			return err
+		}
+		_, err = io.Copy(&atWriter{w: out}, zr)
+		if e := closeOut(); err == nil {
+			err = e
+		}
+		return err
+	})
+	return w, closef, undo, nil
+}
+
+// atWriter writes to w one write after the other from the start.
+type atWriter struct {
+	w   io.WriterAt
+	off int64
+}
+
+func (a *atWriter) Write(p []byte) (int, error) {
+	n, err := a.w.WriteAt(p, a.off)
+	a.off += int64(n)
+	return n, err
+}
+
+// piped returns an io.WriterAt whose writes, which must be in order, are
+// read by consume running in its own goroutine. closef waits for consume
+// to finish and returns its error. Anything consume leaves unread is
+// dropped.
+func piped(consume func(r io.Reader) error) (w io.WriterAt, closef func() error) {
+	pr, pw := io.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		err := consume(pr)
+		if err == nil {
+			_, err = io.Copy(io.Discard, pr)
+		}
+		pr.CloseWithError(err)
+		errc <- err
+	}()
+	return &streamWriter{w: pw}, func() error {
+		pw.Close()
+		return <-errc
+	}
+}
+
+// extractTar extracts the regular files and directories in the tar archive
+// read from r into dir, appending the files it creates to created. Other
+// kinds of entries, like links, are skipped.
+func extractTar(r io.Reader, dir string, created *[]string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, filepath.Clean("/"+hdr.Name))
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0777); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, hdr.FileInfo().Mode().Perm()|0600)
+			if err != nil {
+				return err
+			}
+			*created = append(*created, path)
+			_, err = io.Copy(f, tr)
+			if e := f.Close(); err == nil {
+				err = e
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
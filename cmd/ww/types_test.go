@@ -0,0 +1,159 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// receiveTyped sends the named files to a typedDestination d saving to a
+// new directory, which it returns.
+func receiveTyped(t *testing.T, d *typedDestination, names ...string) string {
+	t.Helper()
+	dst := t.TempDir()
+	d.destination = &dirDestination{dir: dst}
+	if d.extract != "" {
+		d.extract = dst
+	}
+	sender, receiver := msgPipe()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- sendFiles(sender, names, io.Discard, sendOptions{ackTimeout: time.Second})
+		sender.Close()
+	}()
+	results, err := receiveFiles(receiver, d, io.Discard, nil, nil, nil)
+	receiver.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		if r.err != nil {
+			t.Errorf("%s: %v", r.name, r.err)
+		}
+	}
+	return dst
+}
+
+func readFiles(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		buf, err := os.ReadFile(path)
+		rel, _ := filepath.Rel(dir, path)
+		files[filepath.ToSlash(rel)] = string(buf)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func makeTar(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for name, content := range files {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		tw.Write([]byte(content))
+	}
+	tw.WriteHeader(&tar.Header{Name: "link", Linkname: "/etc/passwd", Typeflag: tar.TypeSymlink})
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func gzipped(t *testing.T, p []byte) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	zw.Write(p)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestFileTypes(t *testing.T) {
+	src := t.TempDir()
+	archive := makeTar(t, map[string]string{"a.txt": "aaa", "dir/b.txt": "bbb", "../../escape": "x"})
+	tarFile := writeTestFile(t, src, "files.tar", archive)
+	textFile := writeTestFile(t, src, "notes.txt", []byte("hello\n"))
+	gzFile := writeTestFile(t, src, "log.gz", gzipped(t, []byte("log line\n")))
+
+	t.Run("tar", func(t *testing.T) {
+		dst := receiveTyped(t, &typedDestination{extract: "."}, tarFile)
+		got := readFiles(t, dst)
+		want := map[string]string{"a.txt": "aaa", "dir/b.txt": "bbb", "escape": "x"}
+		if len(got) != len(want) {
+			t.Errorf("got files %v want %v", got, want)
+		}
+		for name, content := range want {
+			if got[name] != content {
+				t.Errorf("%s: got %q want %q", name, got[name], content)
+			}
+		}
+	})
+
+	t.Run("text", func(t *testing.T) {
+		out := &bytes.Buffer{}
+		dst := receiveTyped(t, &typedDestination{text: out}, textFile, tarFile)
+		if out.String() != "hello\n" {
+			t.Errorf("printed %q", out.String())
+		}
+		// Only text is printed, the archive is saved as it is.
+		got := readFiles(t, dst)
+		if len(got) != 1 || got["files.tar"] != string(archive) {
+			t.Errorf("got files %v", got)
+		}
+	})
+
+	t.Run("gzip", func(t *testing.T) {
+		dst := receiveTyped(t, &typedDestination{gunzip: true}, gzFile)
+		got := readFiles(t, dst)
+		if len(got) != 1 || got["log"] != "log line\n" {
+			t.Errorf("got files %v", got)
+		}
+	})
+
+	t.Run("bad gzip", func(t *testing.T) {
+		bad := writeTestFile(t, src, "bad.gz", []byte("not gzip"))
+		sender, receiver := msgPipe()
+		go func() {
+			sendFiles(sender, []string{bad}, io.Discard, sendOptions{ackTimeout: time.Second})
+			sender.Close()
+		}()
+		dst := t.TempDir()
+		d := &typedDestination{destination: &dirDestination{dir: dst}, gunzip: true}
+		results, err := receiveFiles(receiver, d, io.Discard, nil, nil, nil)
+		receiver.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 1 || results[0].err == nil {
+			t.Errorf("got results %v want a failure", results)
+		}
+		if got := readFiles(t, dst); len(got) != 0 {
+			t.Errorf("left files %v", got)
+		}
+	})
+
+	t.Run("off", func(t *testing.T) {
+		dst := receiveTyped(t, &typedDestination{}, tarFile, textFile, gzFile)
+		if got := readFiles(t, dst); len(got) != 3 {
+			t.Errorf("got files %v want the 3 sent", got)
+		}
+	})
+}
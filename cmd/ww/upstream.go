@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"nhooyr.io/websocket"
+	"webwormhole.io/wormhole"
+)
+
+// upstream is the signalling server joins for slots that aren't ours are
+// forwarded to, if any.
+var upstream string
+
+// localSlot reports whether slot is allocated on this server.
+func localSlot(slot string) bool {
+	slots.RLock()
+	defer slots.RUnlock()
+	_, ok := slots.m[slot]
+	return ok
+}
+
+// forward relays the client conn, which wants to join slot, to the upstream
+// signalling server, passing messages and close codes through both ways until
+// either side hangs up. The client sees the upstream's slot and ICE servers
+// as if it had connected there.
+func forward(r *http.Request, conn signalConn, slot, client string) {
+	ctx, cancel := context.WithTimeout(r.Context(), slotTimeout)
+	defer cancel()
+
+	compression := websocket.CompressionDisabled
+	if compress {
+		compression = websocket.CompressionNoContextTakeover
+	}
+	uconn, _, err := websocket.Dial(ctx, strings.TrimSuffix(upstream, "/")+"/"+slot, &websocket.DialOptions{
+		// Pass the client's User-Agent on so upstream metrics see what it is.
+		HTTPHeader:      http.Header{"User-Agent": {r.Header.Get("User-Agent")}},
+		Subprotocols:    []string{wormhole.Protocol},
+		CompressionMode: compression,
+	})
+	if err != nil {
+		log.Printf("could not reach upstream: %v", err)
+		rendezvousCounter.WithLabelValues("upstreamerror", client).Inc()
+		closeWith(conn, wormhole.CloseNoSuchSlot)
+		return
+	}
+	if uconn.Subprotocol() != wormhole.Protocol {
+		rendezvousCounter.WithLabelValues("upstreamerror", client).Inc()
+		closeWith(uconn, wormhole.CloseWrongProto)
+		closeWith(conn, wormhole.CloseNoSuchSlot)
+		return
+	}
+	rendezvousCounter.WithLabelValues("forwarded", client).Inc()
+
+	done := make(chan struct{})
+	go func() {
+		closeLike(conn, pipeWebSocket(ctx, conn, uconn))
+		close(done)
+	}()
+	closeLike(uconn, pipeWebSocket(ctx, uconn, conn))
+	<-done
+}
+
+// pipeWebSocket copies messages from src to dst until either fails, and
+// returns the error.
+func pipeWebSocket(ctx context.Context, dst, src signalConn) error {
+	for {
+		msgType, p, err := src.Read(ctx)
+		if err != nil {
+			return err
+		}
+		err = dst.Write(ctx, msgType, p)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// closeLike closes c the same way the connection that returned err was
+// closed, or as if its peer hung up if it wasn't closed cleanly.
+func closeLike(c signalConn, err error) {
+	var ce websocket.CloseError
+	if errors.As(err, &ce) {
+		c.Close(ce.Code, ce.Reason)
+		return
+	}
+	closeWith(c, wormhole.ClosePeerHungUp)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+)
+
+// urlSource returns a source for the body of rawurl, streamed as it is
+// downloaded. The file is named after the response's Content-Disposition,
+// or else the URL's path. If the response has no Content-Length, the file
+// is sent unsized, which the web client cannot receive.
+func urlSource(client *http.Client, rawurl string) source {
+	return func() (header, io.ReadCloser, error) {
+		resp, err := client.Get(rawurl)
+		if err != nil {
+			return header{}, nil, fmt.Errorf("could not fetch %s: %v", rawurl, err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return header{}, nil, fmt.Errorf("could not fetch %s: %v", rawurl, resp.Status)
+		}
+		h := header{
+			Name: responseFilename(resp),
+			Type: resp.Header.Get("Content-Type"),
+		}
+		if resp.ContentLength >= 0 {
+			h.Size = int(resp.ContentLength)
+		} else {
+			h.Unsized = true
+		}
+		return h, resp.Body, nil
+	}
+}
+
+// responseFilename picks a name for the file in resp.
+func responseFilename(resp *http.Response) string {
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+	if name := path.Base(params["filename"]); err == nil && params["filename"] != "" && name != "/" {
+		return name
+	}
+	if name := path.Base(resp.Request.URL.Path); name != "/" && name != "." {
+		return name
+	}
+	return resp.Request.URL.Hostname()
+}
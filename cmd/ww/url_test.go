@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSendURL(t *testing.T) {
+	body := make([]byte, 100<<10)
+	crand.Read(body)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sized.bin":
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		case "/download":
+			w.Header().Set("Content-Disposition", `attachment; filename="named.bin"`)
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		case "/chunked.bin":
+			// Flushing first makes the response chunked, without a length.
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(body)
+	}))
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		path, name string
+		unsized    bool
+	}{
+		{"/sized.bin", "sized.bin", false},
+		{"/download", "named.bin", false},
+		{"/chunked.bin", "chunked.bin", true},
+	} {
+		h, r, err := urlSource(srv.Client(), srv.URL+tt.path)()
+		if err != nil {
+			t.Fatalf("%v: %v", tt.path, err)
+		}
+		r.Close()
+		if h.Name != tt.name || h.Unsized != tt.unsized || !tt.unsized && h.Size != len(body) {
+			t.Errorf("%v: got header %+v want name %v, unsized %v", tt.path, h, tt.name, tt.unsized)
+		}
+
+		dst := t.TempDir()
+		sender, receiver := msgPipe()
+		errc := make(chan error, 1)
+		go func() {
+			errc <- sendSources(sender, []source{urlSource(srv.Client(), srv.URL+tt.path)}, io.Discard, sendOptions{ackTimeout: time.Second})
+			sender.Close()
+		}()
+		results, err := receiveFiles(receiver, &dirDestination{dir: dst}, io.Discard, nil, nil, nil)
+		if err != nil || len(results) != 1 || results[0].err != nil {
+			t.Fatalf("%v: got %v, %v", tt.path, results, err)
+		}
+		if err := <-errc; err != nil {
+			t.Fatalf("%v: %v", tt.path, err)
+		}
+		got, err := os.ReadFile(filepath.Join(dst, tt.name))
+		if err != nil || !bytes.Equal(got, body) {
+			t.Errorf("%v: got %v bytes, %v want the %v served", tt.path, len(got), err, len(body))
+		}
+	}
+
+	if _, _, err := urlSource(srv.Client(), srv.URL+"/missing")(); err == nil {
+		t.Error("fetched a missing file")
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// errSumMismatch is returned by verifyFile when a file's SHA-256 is not the
+// one expected.
+var errSumMismatch = errors.New("SHA-256 does not match")
+
+func verify(args ...string) {
+	set := flag.NewFlagSet(args[0], flag.ExitOnError)
+	set.Usage = func() {
+		fmt.Fprintf(set.Output(), "check a received file against the SHA-256 the sender printed with send -sha256\n\n")
+		fmt.Fprintf(set.Output(), "usage: %s %s file sha256\n\n", os.Args[0], args[0])
+		fmt.Fprintf(set.Output(), "flags:\n")
+		set.PrintDefaults()
+	}
+	set.Parse(args[1:])
+
+	if set.NArg() != 2 {
+		set.Usage()
+		os.Exit(2)
+	}
+	if err := verifyFile(set.Arg(0), set.Arg(1)); err != nil {
+		fatalf("%s: %v", set.Arg(0), err)
+	}
+	fmt.Fprintf(stderr, "%s: OK\n", set.Arg(0))
+}
+
+// verifyFile returns errSumMismatch if the file at path doesn't have the
+// hex SHA-256 want.
+func verifyFile(path, want string) error {
+	b, err := hex.DecodeString(want)
+	if err != nil || len(b) != sha256.Size {
+		return fmt.Errorf("%q is not a hex SHA-256", want)
+	}
+	got, err := fileSHA256(path)
+	if err != nil {
+		return err
+	}
+	if got != strings.ToLower(want) {
+		return fmt.Errorf("%w: got %s", errSumMismatch, got)
+	}
+	return nil
+}
+
+// fileSHA256 returns the hex SHA-256 of the file at path.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	sum := sha256.New()
+	if _, err := io.Copy(sum, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyFile(t *testing.T) {
+	name := writeTestFile(t, t.TempDir(), "a.txt", []byte("hello"))
+	sum := fmt.Sprintf("%x", sha256.Sum256([]byte("hello")))
+	if err := verifyFile(name, sum); err != nil {
+		t.Errorf("matching SHA-256: %v", err)
+	}
+	if err := verifyFile(name, strings.ToUpper(sum)); err != nil {
+		t.Errorf("upper case SHA-256: %v", err)
+	}
+	other := fmt.Sprintf("%x", sha256.Sum256([]byte("jello")))
+	if err := verifyFile(name, other); !errors.Is(err, errSumMismatch) {
+		t.Errorf("got %v want %v", err, errSumMismatch)
+	}
+	if err := verifyFile(name, "2cf24dba"); err == nil || errors.Is(err, errSumMismatch) {
+		t.Errorf("got %v for a short SHA-256", err)
+	}
+}
+
+func TestSendSums(t *testing.T) {
+	src := t.TempDir()
+	big := make([]byte, 1<<20)
+	for i := range big {
+		big[i] = byte(i * 13)
+	}
+	files := map[string][]byte{"a.bin": big, "b.txt": []byte("hello"), "c.txt": {}}
+	var names []string
+	var want []string
+	for _, name := range []string{"a.bin", "b.txt", "c.txt"} {
+		names = append(names, writeTestFile(t, src, name, files[name]))
+		want = append(want, fmt.Sprintf("%x  %s\n", sha256.Sum256(files[name]), name))
+	}
+
+	// Hashed as they are sent, or from the checksum sent before them.
+	for _, checksum := range []bool{false, true} {
+		sender, receiver := msgPipe()
+		sums := &bytes.Buffer{}
+		errc := make(chan error, 1)
+		go func() {
+			errc <- sendFiles(sender, names, io.Discard, sendOptions{ackTimeout: time.Second, checksum: checksum, sums: sums})
+			sender.Close()
+		}()
+		if _, err := receiveFiles(receiver, &dirDestination{dir: t.TempDir()}, io.Discard, nil, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		receiver.Close()
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+		if got := sums.String(); got != strings.Join(want, "") {
+			t.Errorf("checksum %v: got sums %q want %q", checksum, got, strings.Join(want, ""))
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+func whoami(args ...string) {
+	set := flag.NewFlagSet(args[0], flag.ExitOnError)
+	set.Usage = func() {
+		fmt.Fprintf(set.Output(), "print our public address as seen by STUN servers, and the kind of NAT we're behind, without a peer\n\n")
+		fmt.Fprintf(set.Output(), "usage: %s %s\n\n", os.Args[0], args[0])
+		fmt.Fprintf(set.Output(), "telling cone from symmetric NATs needs at least two STUN servers.\n\n")
+		fmt.Fprintf(set.Output(), "flags:\n")
+		set.PrintDefaults()
+	}
+	stun := set.String("stun", "stun:relay.webwormhole.io", "comma separated list of STUN servers to ask")
+	timeout := set.Duration("timeout", 5*time.Second, "how long to wait for answers")
+	set.Parse(args[1:])
+
+	if set.NArg() > 0 {
+		set.Usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	info, err := conf.Whoami(ctx, strings.Split(*stun, ","))
+	if info != nil {
+		fmt.Fprintf(stderr, "local port %d\n", info.Port)
+		for _, m := range info.Mappings {
+			if m.Err != nil {
+				fmt.Fprintf(stderr, "%s: %v\n", m.Server, m.Err)
+				continue
+			}
+			fmt.Fprintf(stderr, "%s: public address %v\n", m.Server, m.Public)
+		}
+	}
+	if err != nil {
+		fatalf("%v", err)
+	}
+	fmt.Fprintf(stderr, "nat: %s\n", info.NAT)
+}
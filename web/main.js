@@ -346,11 +346,18 @@ function receive(e) {
     if (receiving) {
         receiving.receive(e);
         if (receiving.done()) {
+            if (receiving.header.ack && datachannel) {
+                datachannel.send(new TextEncoder().encode(JSON.stringify({ control: "ack" })));
+            }
             receiving = undefined;
         }
         return;
     }
     const header = JSON.parse(new TextDecoder("utf8").decode(e.data));
+    // Control messages are only meant for senders.
+    if ("control" in header) {
+        return;
+    }
     // Special case raw text that's been received.
     if (header.type === "application/webwormhole-text") {
         const li = document.createElement("li");
@@ -63,9 +63,12 @@ interface FileHeader {
 	name: string;
 	type: string;
 	size: number;
+	// ack asks us to send an ack control message once the file is received.
+	ack?: boolean;
 }
 
 interface Receiver {
+	header: FileHeader;
 	receive(e: MessageEvent): void;
 	done(): boolean;
 	cancel(): void;
@@ -458,6 +461,11 @@ function receive(e: MessageEvent) {
 	if (receiving) {
 		receiving.receive(e);
 		if (receiving.done()) {
+			if (receiving.header.ack && datachannel) {
+				datachannel.send(
+					new TextEncoder().encode(JSON.stringify({ control: "ack" }))
+				);
+			}
 			receiving = undefined;
 		}
 		return;
@@ -467,6 +475,11 @@ function receive(e: MessageEvent) {
 		new TextDecoder("utf8").decode(e.data)
 	) as FileHeader;
 
+	// Control messages are only meant for senders.
+	if ("control" in header) {
+		return;
+	}
+
 	// Special case raw text that's been received.
 	if (header.type === "application/webwormhole-text") {
 		const li = document.createElement("li");
@@ -18,6 +18,7 @@ import (
 	"golang.org/x/crypto/hkdf"
 	"golang.org/x/crypto/nacl/secretbox"
 	"rsc.io/qr"
+	"webwormhole.io/chunkbox"
 	"webwormhole.io/wordlist"
 )
 
@@ -131,6 +132,32 @@ func seal(_ js.Value, args []js.Value) interface{} {
 	return base64.URLEncoding.EncodeToString(result)
 }
 
+// chunkedSeal(key []byte, data uint8array) (sealed uint8array)
+func chunkedSeal(_ js.Value, args []js.Value) interface{} {
+	return chunked(chunkbox.Seal, args)
+}
+
+// chunkedOpen(key []byte, sealed uint8array) (data uint8array)
+func chunkedOpen(_ js.Value, args []js.Value) interface{} {
+	return chunked(chunkbox.Open, args)
+}
+
+// chunked does chunkedSeal or chunkedOpen with f.
+func chunked(f func(*[32]byte, []byte) ([]byte, error), args []js.Value) interface{} {
+	var key [32]byte
+	js.CopyBytesToGo(key[:], args[0])
+	src := make([]byte, args[1].Length())
+	js.CopyBytesToGo(src, args[1])
+
+	result, err := f(&key, src)
+	if err != nil {
+		return nil
+	}
+	dst := js.Global().Get("Uint8Array").New(len(result))
+	js.CopyBytesToJS(dst, result)
+	return dst
+}
+
 // qrencode(url string) (png []byte)
 func qrencode(_ js.Value, args []js.Value) interface{} {
 	code, err := qr.Encode(args[0].String(), qr.L)
@@ -189,6 +216,8 @@ func main() {
 		"exchange":    js.FuncOf(exchange),
 		"open":        js.FuncOf(open),
 		"seal":        js.FuncOf(seal),
+		"chunkedSeal": js.FuncOf(chunkedSeal),
+		"chunkedOpen": js.FuncOf(chunkedOpen),
 		"qrencode":    js.FuncOf(qrencode),
 		"encode":      js.FuncOf(encode),
 		"decode":      js.FuncOf(decode),
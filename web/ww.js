@@ -14,6 +14,9 @@ var WormholeErrorCodes;
     WormholeErrorCodes[WormholeErrorCodes["closeWebRTCSuccessDirect"] = 4007] = "closeWebRTCSuccessDirect";
     WormholeErrorCodes[WormholeErrorCodes["closeWebRTCSuccessRelay"] = 4008] = "closeWebRTCSuccessRelay";
     WormholeErrorCodes[WormholeErrorCodes["closeWebRTCFailed"] = 4009] = "closeWebRTCFailed";
+    WormholeErrorCodes[WormholeErrorCodes["closeSlotTaken"] = 4010] = "closeSlotTaken";
+    WormholeErrorCodes[WormholeErrorCodes["closeJoinRejected"] = 4011] = "closeJoinRejected";
+    WormholeErrorCodes[WormholeErrorCodes["closeTunnelMismatch"] = 4012] = "closeTunnelMismatch";
 })(WormholeErrorCodes || (WormholeErrorCodes = {}));
 class Wormhole {
     constructor(signalserver, code) {
@@ -295,12 +298,24 @@ class Wormhole {
                 this.fail("no such slot");
                 return;
             }
+            case WormholeErrorCodes.closeSlotTaken: {
+                this.fail("someone else already joined this slot");
+                return;
+            }
+            case WormholeErrorCodes.closeJoinRejected: {
+                this.fail("the other side turned down the connection");
+                return;
+            }
+            case WormholeErrorCodes.closeTunnelMismatch: {
+                this.fail("the other side wants an encrypted tunnel, which the web client can't do");
+                return;
+            }
             case WormholeErrorCodes.closeSlotTimedOut: {
                 this.fail("timed out");
                 return;
             }
             case WormholeErrorCodes.closeNoMoreSlots: {
-                this.fail("could not get slot");
+                this.fail(e.reason ? `could not get slot: ${e.reason}` : "could not get slot");
                 return;
             }
             case WormholeErrorCodes.closeWrongProto: {
@@ -10,6 +10,8 @@ declare var webwormhole: {
 	finish(msg: string): Uint8Array;
 	open(key: Uint8Array, msg: string): string;
 	seal(key: Uint8Array, msg: string): string;
+	chunkedSeal(key: Uint8Array, data: Uint8Array): Uint8Array;
+	chunkedOpen(key: Uint8Array, sealed: Uint8Array): Uint8Array | null;
 	fingerprint(key: Uint8Array): Uint8Array;
 
 	match(prefix: string): string;
@@ -34,6 +36,9 @@ enum WormholeErrorCodes {
 	closeWebRTCSuccessDirect = 4007,
 	closeWebRTCSuccessRelay = 4008,
 	closeWebRTCFailed = 4009,
+	closeSlotTaken = 4010,
+	closeJoinRejected = 4011,
+	closeTunnelMismatch = 4012,
 }
 
 type State = (msg: string) => Promise<State>;
@@ -382,12 +387,24 @@ class Wormhole {
 				this.fail("no such slot");
 				return;
 			}
+			case WormholeErrorCodes.closeSlotTaken: {
+				this.fail("someone else already joined this slot");
+				return;
+			}
+			case WormholeErrorCodes.closeJoinRejected: {
+				this.fail("the other side turned down the connection");
+				return;
+			}
+			case WormholeErrorCodes.closeTunnelMismatch: {
+				this.fail("the other side wants an encrypted tunnel, which the web client can't do");
+				return;
+			}
 			case WormholeErrorCodes.closeSlotTimedOut: {
 				this.fail("timed out");
 				return;
 			}
 			case WormholeErrorCodes.closeNoMoreSlots: {
-				this.fail("could not get slot");
+				this.fail(e.reason ? `could not get slot: ${e.reason}` : "could not get slot");
 				return;
 			}
 			case WormholeErrorCodes.closeWrongProto: {
@@ -0,0 +1,301 @@
+package wordlist
+
+import "strings"
+
+// EncodeEmoji returns the string encoding of slot and pass using emoji
+// instead of English words.
+func EncodeEmoji(slot int, pass []byte) string {
+	return emojiEncoding(emojiWords).Encode(slot, pass)
+}
+
+// emojiEncoding is varintEncoding with a list of emoji. Every emoji is a
+// single rune, so codes can also be written without separators.
+type emojiEncoding []string
+
+func (list emojiEncoding) Encode(slot int, pass []byte) string {
+	return varintEncoding(list).Encode(slot, pass)
+}
+
+func (list emojiEncoding) Decode(code string) (slot int, pass []byte) {
+	// Put a space after every rune that isn't a separator, so the code
+	// splits into emoji whether or not it had any. Variation selectors
+	// some keyboards add are dropped.
+	var b strings.Builder
+	for _, r := range code {
+		switch r {
+		case '\ufe0f':
+		case '-', '+':
+			b.WriteRune(' ')
+		default:
+			b.WriteRune(r)
+			b.WriteRune(' ')
+		}
+	}
+	return varintEncoding(list).Decode(b.String())
+}
+
+func (list emojiEncoding) Match(prefix string) string {
+	return match([]string(list), prefix)
+}
+
+// emojiWords are 512 emoji that each take a single code point and are
+// shown as emoji by default, leaving out look-alikes such as faces, clocks,
+// moon phases, and skin tone modifiers.
+var emojiWords = []string{
+	"🌀", "🌁",
+	"🌂", "🌃",
+	"🌄", "🌅",
+	"🌆", "🌇",
+	"🌈", "🌉",
+	"🌊", "🌋",
+	"🌌", "🌍",
+	"🌎", "🌏",
+	"🌐", "🌙",
+	"🌚", "🌛",
+	"🌜", "🌝",
+	"🌞", "🌟",
+	"🌠", "🌭",
+	"🌮", "🌯",
+	"🌰", "🌱",
+	"🌲", "🌳",
+	"🌴", "🌵",
+	"🌷", "🌸",
+	"🌹", "🌺",
+	"🌻", "🌼",
+	"🌽", "🌾",
+	"🌿", "🍀",
+	"🍁", "🍂",
+	"🍃", "🍄",
+	"🍅", "🍆",
+	"🍇", "🍈",
+	"🍉", "🍊",
+	"🍋", "🍌",
+	"🍍", "🍎",
+	"🍏", "🍐",
+	"🍑", "🍒",
+	"🍓", "🍔",
+	"🍕", "🍖",
+	"🍗", "🍘",
+	"🍙", "🍚",
+	"🍛", "🍜",
+	"🍝", "🍞",
+	"🍟", "🍠",
+	"🍡", "🍢",
+	"🍣", "🍤",
+	"🍥", "🍦",
+	"🍧", "🍨",
+	"🍩", "🍪",
+	"🍫", "🍬",
+	"🍭", "🍮",
+	"🍯", "🍰",
+	"🍱", "🍲",
+	"🍳", "🍴",
+	"🍵", "🍶",
+	"🍷", "🍸",
+	"🍹", "🍺",
+	"🍻", "🍼",
+	"🍾", "🍿",
+	"🎀", "🎁",
+	"🎂", "🎃",
+	"🎄", "🎅",
+	"🎆", "🎇",
+	"🎈", "🎉",
+	"🎊", "🎋",
+	"🎌", "🎍",
+	"🎎", "🎏",
+	"🎐", "🎑",
+	"🎒", "🎓",
+	"🎠", "🎡",
+	"🎢", "🎣",
+	"🎤", "🎥",
+	"🎦", "🎧",
+	"🎨", "🎩",
+	"🎪", "🎫",
+	"🎬", "🎭",
+	"🎮", "🎯",
+	"🎰", "🎱",
+	"🎲", "🎳",
+	"🎴", "🎵",
+	"🎶", "🎷",
+	"🎸", "🎹",
+	"🎺", "🎻",
+	"🎼", "🎽",
+	"🎾", "🎿",
+	"🏀", "🏁",
+	"🏂", "🏃",
+	"🏄", "🏅",
+	"🏆", "🏇",
+	"🏈", "🏉",
+	"🏊", "🏏",
+	"🏐", "🏑",
+	"🏒", "🏓",
+	"🏠", "🏡",
+	"🏢", "🏣",
+	"🏤", "🏥",
+	"🏦", "🏧",
+	"🏨", "🏩",
+	"🏪", "🏫",
+	"🏬", "🏭",
+	"🏮", "🏯",
+	"🏰", "🏸",
+	"🏹", "🏺",
+	"🐀", "🐁",
+	"🐂", "🐃",
+	"🐄", "🐅",
+	"🐆", "🐇",
+	"🐈", "🐉",
+	"🐊", "🐋",
+	"🐌", "🐍",
+	"🐎", "🐏",
+	"🐐", "🐑",
+	"🐒", "🐓",
+	"🐔", "🐕",
+	"🐖", "🐗",
+	"🐘", "🐙",
+	"🐚", "🐛",
+	"🐜", "🐝",
+	"🐞", "🐟",
+	"🐠", "🐡",
+	"🐢", "🐣",
+	"🐤", "🐥",
+	"🐦", "🐧",
+	"🐨", "🐩",
+	"🐪", "🐫",
+	"🐬", "🐭",
+	"🐮", "🐯",
+	"🐰", "🐱",
+	"🐲", "🐳",
+	"🐴", "🐵",
+	"🐶", "🐷",
+	"🐸", "🐹",
+	"🐺", "🐻",
+	"🐼", "🐽",
+	"🐾", "👀",
+	"👂", "👃",
+	"👄", "👅",
+	"👆", "👇",
+	"👈", "👉",
+	"👊", "👋",
+	"👌", "👍",
+	"👎", "👏",
+	"👐", "👑",
+	"👒", "👓",
+	"👔", "👕",
+	"👖", "👗",
+	"👘", "👙",
+	"👚", "👛",
+	"👜", "👝",
+	"👞", "👟",
+	"👠", "👡",
+	"👢", "👣",
+	"👤", "👥",
+	"👦", "👧",
+	"👨", "👩",
+	"👪", "👫",
+	"👬", "👭",
+	"👮", "👯",
+	"👰", "👱",
+	"👲", "👳",
+	"👴", "👵",
+	"👶", "👷",
+	"👸", "👹",
+	"👺", "👻",
+	"👼", "👽",
+	"👾", "👿",
+	"💀", "💁",
+	"💂", "💃",
+	"💄", "💅",
+	"💆", "💇",
+	"💈", "💉",
+	"💊", "💋",
+	"💌", "💍",
+	"💎", "💏",
+	"💐", "💑",
+	"💒", "💓",
+	"💔", "💕",
+	"💖", "💗",
+	"💘", "💙",
+	"💚", "💛",
+	"💜", "💝",
+	"💞", "💟",
+	"💠", "💡",
+	"💢", "💣",
+	"💤", "💥",
+	"💦", "💧",
+	"💨", "💩",
+	"💪", "💫",
+	"💬", "💭",
+	"💮", "💯",
+	"💰", "💱",
+	"💲", "💳",
+	"💴", "💵",
+	"💶", "💷",
+	"💸", "💹",
+	"💺", "💻",
+	"💼", "💽",
+	"💾", "💿",
+	"📀", "📁",
+	"📂", "📃",
+	"📄", "📅",
+	"📆", "📇",
+	"📈", "📉",
+	"📊", "📋",
+	"📌", "📍",
+	"📎", "📏",
+	"📐", "📑",
+	"📒", "📓",
+	"📔", "📕",
+	"📖", "📗",
+	"📘", "📙",
+	"📚", "📛",
+	"📜", "📝",
+	"📞", "📟",
+	"📠", "📡",
+	"📢", "📣",
+	"📤", "📥",
+	"📦", "📧",
+	"📨", "📩",
+	"📪", "📫",
+	"📬", "📭",
+	"📮", "📯",
+	"📰", "📱",
+	"📲", "📳",
+	"📴", "📵",
+	"📶", "📷",
+	"📸", "📹",
+	"📺", "📻",
+	"📼", "📿",
+	"🗻", "🗼",
+	"🗽", "🗾",
+	"🗿", "🚀",
+	"🚁", "🚂",
+	"🚃", "🚄",
+	"🚅", "🚆",
+	"🚇", "🚈",
+	"🚉", "🚊",
+	"🚋", "🚌",
+	"🚍", "🚎",
+	"🚏", "🚐",
+	"🚑", "🚒",
+	"🚓", "🚔",
+	"🚕", "🚖",
+	"🚗", "🚘",
+	"🚙", "🚚",
+	"🚛", "🚜",
+	"🚝", "🚞",
+	"🚟", "🚠",
+	"🚡", "🚢",
+	"🚣", "🚤",
+	"🚥", "🚦",
+	"🚧", "🚨",
+	"🚩", "🚪",
+	"🚫", "🚬",
+	"🚭", "🚮",
+	"🚯", "🚰",
+	"🚱", "🚲",
+	"🚳", "🚴",
+	"🚵", "🚶",
+	"🚷", "🚸",
+	"🚹", "🚺",
+	"🚻", "🚼",
+}
@@ -0,0 +1,32 @@
+package wordlist
+
+// An Encoding describes one of the ways codes can be written.
+type Encoding struct {
+	// Name identifies the encoding, e.g. "english-varint-slot".
+	Name string
+
+	// Words is the number of words in the encoding's word list, or 0 if
+	// it writes codes as numbers.
+	Words int
+
+	// Match is whether Match completes words of the encoding.
+	Match bool
+}
+
+// Encodings returns the encodings Decode understands, in the order it tries
+// them. The first is the one Encode uses.
+func Encodings() []Encoding {
+	encs := make([]Encoding, len(defaultEncodings))
+	for i, enc := range defaultEncodings {
+		encs[i] = Encoding{Name: enc.name}
+		switch list := enc.encoding.(type) {
+		case varintEncoding:
+			encs[i].Words, encs[i].Match = len(list), true
+		case magicWormholeEncoding:
+			encs[i].Words, encs[i].Match = len(list), true
+		case emojiEncoding:
+			encs[i].Words, encs[i].Match = len(list), true
+		}
+	}
+	return encs
+}
@@ -0,0 +1,60 @@
+package wordlist
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzDecode(f *testing.F) {
+	for _, code := range []string{
+		"",
+		"affix-acre",
+		"ladle-aged-aloe-aloft",
+		"zippy-afar-acts",
+		"5-acorn-acre",
+		"5-aardvark-absurd",
+		"17-000-400",
+		"acorn",
+		"acre-acorn",
+		"-+ -",
+		"🌀-🌃-🌄",
+	} {
+		f.Add(code)
+	}
+	f.Fuzz(func(t *testing.T, code string) {
+		slot, pass := Decode(code)
+		if pass == nil {
+			if slot != 0 {
+				t.Fatalf("Decode(%q) = %v, nil; invalid codes must have a 0 slot", code, slot)
+			}
+			return
+		}
+		if len(pass) == 0 || slot < 0 {
+			t.Fatalf("Decode(%q) = %v, %v; want a non-negative slot and non-empty pass", code, slot, pass)
+		}
+		for _, enc := range defaultEncodings {
+			s, p := enc.Decode(enc.Encode(slot, pass))
+			if s != slot || !bytes.Equal(p, pass) {
+				t.Fatalf("%T: Decode(%q) = %v, %v; re-encoding decodes to %v, %v", enc, code, slot, pass, s, p)
+			}
+		}
+	})
+}
+
+func FuzzEncode(f *testing.F) {
+	f.Add(0, []byte{0})
+	f.Add(127, []byte{1, 2})
+	f.Add(1<<21, []byte{255, 0, 255})
+	f.Fuzz(func(t *testing.T, slot int, pass []byte) {
+		if slot < 0 || len(pass) == 0 {
+			return
+		}
+		for _, enc := range defaultEncodings {
+			code := enc.Encode(slot, pass)
+			s, p := enc.Decode(code)
+			if s != slot || !bytes.Equal(p, pass) {
+				t.Fatalf("%T: Encode(%v, %v) = %q decodes to %v, %v", enc, slot, pass, code, s, p)
+			}
+		}
+	})
+}
@@ -0,0 +1,18 @@
+package wordlist
+
+import (
+	"golang.org/x/crypto/scrypt"
+)
+
+// passphraseSalt keeps passwords derived here apart from other uses of the
+// same passphrase.
+const passphraseSalt = "webwormhole.io passphrase"
+
+// DerivePass returns a password of length bytes derived from passphrase
+// with scrypt, so the same passphrase always gives the same password and,
+// on the same slot, the same code. Such a password is only as hard to guess
+// as the passphrase, and anyone who knows the passphrase can join every
+// wormhole made with it, so random passwords should be preferred.
+func DerivePass(passphrase string, length int) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), []byte(passphraseSalt), 1<<15, 8, 1, length)
+}
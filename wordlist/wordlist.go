@@ -4,15 +4,17 @@ package wordlist
 import (
 	"encoding/binary"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 )
 
-var defaultEncodings = []encoding{
-	varintEncoding(enWords),
-	magicWormholeEncoding(enWords),
-	magicWormholeEncoding(pgpWords),
-	octalEncoding{},
+var defaultEncodings = []namedEncoding{
+	{"english-varint-slot", varintEncoding(enWords)},
+	{"english-magic-wormhole", magicWormholeEncoding(enWords)},
+	{"pgp-magic-wormhole", magicWormholeEncoding(pgpWords)},
+	{"emoji-varint-slot", emojiEncoding(emojiWords)},
+	{"octal", octalEncoding{}},
 }
 
 // Encode returns the string encoding of slot and pass using the default encoding,
@@ -21,16 +23,34 @@ func Encode(slot int, pass []byte) string {
 	return defaultEncodings[0].Encode(slot, pass)
 }
 
+// EncodeWith returns the string encoding of slot and pass using the named
+// encoding, one of Encodings. It returns false if there is no such encoding.
+func EncodeWith(encoding string, slot int, pass []byte) (string, bool) {
+	for _, enc := range defaultEncodings {
+		if enc.name == encoding {
+			return enc.Encode(slot, pass), true
+		}
+	}
+	return "", false
+}
+
 // Encode returns the slot and pass encoded by code, trying all supported word lists
 // supported in the default order. Invalid codes return a 0 slot and a nil pass.
 func Decode(code string) (slot int, pass []byte) {
+	slot, pass, _ = DecodeVerbose(code)
+	return slot, pass
+}
+
+// DecodeVerbose is like Decode, but also returns the name of the encoding
+// code was decoded with, or the empty string if it is invalid.
+func DecodeVerbose(code string) (slot int, pass []byte, encoding string) {
 	for _, enc := range defaultEncodings {
 		s, p := enc.Decode(code)
 		if p != nil {
-			return s, p
+			return s, p, enc.name
 		}
 	}
-	return 0, nil
+	return 0, nil, ""
 }
 
 // Match returns the first word in the word list that has prefix prefix, trying all
@@ -45,6 +65,46 @@ func Match(prefix string) string {
 	return ""
 }
 
+// WordSlots is the number of slots that the default encoding writes as a
+// single word, which are those below it. Signalling servers hand these out
+// first, so codes can be all words and easy to dictate.
+const WordSlots = 1 << 7
+
+// MaxSlots is the number of slots signalling servers hand out, which are
+// those below it and fit in three varint bytes. Codes for other slots were
+// mistyped.
+const MaxSlots = 1 << 21
+
+// SlotWord returns the word the default encoding uses for slot, or the empty
+// string if slot takes more than one word.
+func SlotWord(slot int) string {
+	if slot < 0 || slot >= WordSlots {
+		return ""
+	}
+	// A single byte varint, at an even position.
+	return enWords[slot*2]
+}
+
+// WordSlot returns the slot word stands for in the default encoding, or -1
+// if it is not a slot word.
+func WordSlot(word string) int {
+	i := indexOf(enWords, word)
+	if i < 0 || i%2 != 0 || i/2 >= WordSlots {
+		return -1
+	}
+	return i / 2
+}
+
+// EncodeBytes returns b in the default encoding's words, one for each byte
+// and without a slot, e.g. for a short authentication string to read out.
+func EncodeBytes(b []byte) string {
+	words := make([]string, len(b))
+	for i := range b {
+		words[i] = enWords[int(b[i])*2+i%2]
+	}
+	return strings.Join(words, "-")
+}
+
 // encoding is a string encoding for a vector of bytes.
 type encoding interface {
 	// Encode returns the string encoding of slot and pass.
@@ -55,6 +115,12 @@ type encoding interface {
 	Match(prefix string) string
 }
 
+// namedEncoding is an encoding with the name Encodings lists it by.
+type namedEncoding struct {
+	name string
+	encoding
+}
+
 // octalEncoding map is a numeric encoding of the codes.
 type octalEncoding struct{}
 
@@ -80,14 +146,14 @@ func (octalEncoding) Decode(code string) (slot int, pass []byte) {
 		return 0, nil
 	}
 
-	s, err := strconv.ParseInt(parts[0], 8, 64)
+	s, err := strconv.ParseInt(parts[0], 8, 0)
 	if err != nil {
 		return 0, nil
 	}
 
 	pass = make([]byte, len(parts[1:]))
 	for i, p := range parts[1:] {
-		n, err := strconv.ParseInt(p, 8, 16)
+		n, err := strconv.ParseUint(p, 8, 9)
 		if err != nil {
 			return 0, nil
 		}
@@ -143,7 +209,12 @@ func (list varintEncoding) Decode(code string) (slot int, pass []byte) {
 	}
 
 	s, n := binary.Uvarint(buf)
-	if n <= 0 {
+	if n <= 0 || n == len(buf) {
+		return 0, nil
+	}
+	// Reject slots that overflow an int and overlong varints, which
+	// Encode never produces.
+	if s > math.MaxInt || n != binary.PutUvarint(make([]byte, binary.MaxVarintLen64), s) {
 		return 0, nil
 	}
 	return int(s), buf[n:]
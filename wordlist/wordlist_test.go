@@ -1,8 +1,11 @@
 package wordlist
 
 import (
+	"bytes"
 	"reflect"
+	"strings"
 	"testing"
+	"unicode/utf8"
 )
 
 func TestEnEncodeDecode(t *testing.T) {
@@ -33,6 +36,85 @@ func TestEnEncodeDecode(t *testing.T) {
 	}
 }
 
+func TestEmojiEncodeDecode(t *testing.T) {
+	cases := []struct {
+		slot int
+		pass []byte
+	}{
+		{2, []byte{0}},
+		{127, []byte{1, 2}},
+		{128, []byte{255, 0, 255}},
+		{1 << 20, []byte{8, 8, 8, 8}},
+	}
+	for i, c := range cases {
+		code := EncodeEmoji(c.slot, c.pass)
+		// Try the code with different separators, or none.
+		for _, variant := range []string{
+			code,
+			strings.ReplaceAll(code, "-", " "),
+			strings.ReplaceAll(code, "-", "+"),
+			strings.ReplaceAll(code, "-", ""),
+			strings.ReplaceAll(code, "-", "\ufe0f - "),
+		} {
+			if slot, pass := Decode(variant); slot != c.slot || !reflect.DeepEqual(pass, c.pass) {
+				t.Errorf("testcase %v: decode %q got %v,%v want %v,%v", i, variant, slot, pass, c.slot, c.pass)
+			}
+		}
+	}
+	if len(emojiWords) != 512 {
+		t.Errorf("got %v emoji want 512", len(emojiWords))
+	}
+	seen := map[string]bool{}
+	for _, e := range emojiWords {
+		if utf8.RuneCountInString(e) != 1 || seen[e] {
+			t.Errorf("emoji %q is not a single, unique rune", e)
+		}
+		seen[e] = true
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	for _, code := range []string{
+		"acorn",            // slot only, no password
+		"ladle-acre-acorn", // overlong varint for slot 0
+		"17-1000",          // octal word beyond 9 bits
+	} {
+		if slot, pass := Decode(code); slot != 0 || pass != nil {
+			t.Errorf("decode %q got %v,%v want 0,nil", code, slot, pass)
+		}
+	}
+}
+
+func TestSlotWords(t *testing.T) {
+	pass := []byte{8, 8}
+	for slot := 0; slot < WordSlots; slot++ {
+		word := SlotWord(slot)
+		if word == "" {
+			t.Fatalf("slot %v has no word", slot)
+		}
+		if got := WordSlot(word); got != slot {
+			t.Errorf("%v: got slot %v want %v", word, got, slot)
+		}
+		code := Encode(slot, pass)
+		if !strings.HasPrefix(code, word+"-") || strings.Count(code, "-") != len(pass) {
+			t.Errorf("slot %v: code %v does not start with the single word %v", slot, code, word)
+		}
+		if s, p := Decode(word + "-aloft-aloe"); s != slot || !reflect.DeepEqual(p, pass) {
+			t.Errorf("%v: decoded %v,%v want %v,%v", word, s, p, slot, pass)
+		}
+	}
+	for _, slot := range []int{-1, WordSlots, 1000} {
+		if word := SlotWord(slot); word != "" {
+			t.Errorf("slot %v got word %v", slot, word)
+		}
+	}
+	for _, word := range []string{"", "afar", "ladle", "nosuchword"} {
+		if slot := WordSlot(word); slot != -1 {
+			t.Errorf("%q got slot %v", word, slot)
+		}
+	}
+}
+
 func TestMatch(t *testing.T) {
 	cases := []struct {
 		prefix string
@@ -56,3 +138,72 @@ func TestMatch(t *testing.T) {
 	}
 
 }
+
+func TestDerivePass(t *testing.T) {
+	code := func(passphrase string) string {
+		pass, err := DerivePass(passphrase, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pass) != 2 {
+			t.Fatalf("got %d byte password want 2", len(pass))
+		}
+		return Encode(7, pass)
+	}
+	a := code("correct horse battery staple")
+	if b := code("correct horse battery staple"); a != b {
+		t.Errorf("same passphrase gave codes %q and %q", a, b)
+	}
+	if b := code("correct horse battery stapler"); a == b {
+		t.Errorf("different passphrases gave the same code %q", a)
+	}
+}
+
+func TestEncodings(t *testing.T) {
+	want := []Encoding{
+		{"english-varint-slot", 512, true},
+		{"english-magic-wormhole", 512, true},
+		{"pgp-magic-wormhole", 512, true},
+		{"emoji-varint-slot", len(emojiWords), true},
+		{"octal", 0, false},
+	}
+	if got := Encodings(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+	// Callers can't change the encodings through what they're given.
+	Encodings()[0].Name = "changed"
+	if got := Encodings()[0].Name; got != "english-varint-slot" {
+		t.Errorf("got name %q after changing a copy", got)
+	}
+}
+
+func TestEncodeBytes(t *testing.T) {
+	b := []byte{0, 8, 255, 1}
+	want := strings.TrimPrefix(magicWormholeEncoding(enWords).Encode(5, b), "5-")
+	if got := EncodeBytes(b); got != want {
+		t.Errorf("got %q want %q", got, want)
+	}
+	if got := EncodeBytes(nil); got != "" {
+		t.Errorf("got %q for no bytes", got)
+	}
+}
+
+func TestEncodeWith(t *testing.T) {
+	pass := []byte{0, 1, 254, 255}
+	for _, from := range Encodings() {
+		code, ok := EncodeWith(from.Name, 300, pass)
+		if !ok {
+			t.Fatalf("%s: no such encoding", from.Name)
+		}
+		slot, got, name := DecodeVerbose(code)
+		if slot != 300 || !bytes.Equal(got, pass) || name != from.Name {
+			t.Errorf("%s: %q decoded to %d %v with %s", from.Name, code, slot, got, name)
+		}
+	}
+	if _, ok := EncodeWith("klingon", 1, pass); ok {
+		t.Error("encoded with an unknown encoding")
+	}
+	if slot, pass, name := DecodeVerbose("not a code"); slot != 0 || pass != nil || name != "" {
+		t.Errorf("decoded an invalid code to %d %v with %q", slot, pass, name)
+	}
+}
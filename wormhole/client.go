@@ -0,0 +1,128 @@
+package wormhole
+
+import (
+	"context"
+	"crypto/tls"
+	"sync"
+
+	"nhooyr.io/websocket"
+)
+
+// A Client establishes Wormholes via one signalling server. It keeps one
+// WebSocket to the server open and carries the signalling of all its
+// Wormholes over it, using MuxProtocol, which makes setting up many
+// Wormholes cheaper than calling New or Join for each. If the server does
+// not speak MuxProtocol, each Wormhole dials its own WebSocket as usual,
+// sharing TLS sessions. A Client is safe for concurrent use.
+type Client struct {
+	cfg     Config
+	sigserv string
+
+	mu sync.Mutex
+	m  *Mux
+	// nomux is set once the server turns down MuxProtocol.
+	nomux bool
+}
+
+// NewClient returns a Client for signalling server sigserv. cfg may be nil,
+// in which case the zero Config is used. Later changes to cfg do not affect
+// the Client.
+func NewClient(sigserv string, cfg *Config) *Client {
+	cl := &Client{sigserv: sigserv}
+	if cfg != nil {
+		cl.cfg = *cfg
+	}
+	tlsConfig := &tls.Config{}
+	if t := cl.cfg.tlsConfig(); t != nil {
+		tlsConfig = t.Clone()
+	}
+	if tlsConfig.ClientSessionCache == nil {
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+	cl.cfg.TLSConfig = tlsConfig
+	cl.cfg.client = httpClient(cl.cfg.Proxy, tlsConfig)
+	cl.cfg.mux = cl.open
+	return cl
+}
+
+// New is like Config.NewContext, using the Client's signalling server.
+func (cl *Client) New(ctx context.Context, pass string, slotc chan string) (*Wormhole, error) {
+	return cl.cfg.NewContext(ctx, pass, cl.sigserv, slotc)
+}
+
+// NewCode is like Config.NewCode, using the Client's signalling server.
+func (cl *Client) NewCode(ctx context.Context, pass []byte, codec chan string) (*Wormhole, error) {
+	return cl.cfg.NewCode(ctx, pass, cl.sigserv, codec)
+}
+
+// Join is like Config.Join, using the Client's signalling server.
+func (cl *Client) Join(slot, pass string) (*Wormhole, error) {
+	return cl.cfg.Join(slot, pass, cl.sigserv)
+}
+
+// Close closes the Client's connection to the signalling server, failing
+// any handshakes still using it. Wormholes already connected are not
+// affected. The Client reconnects if used again.
+func (cl *Client) Close() error {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.m == nil {
+		return nil
+	}
+	err := cl.m.Close()
+	cl.m = nil
+	return err
+}
+
+// open opens a stream on slot over the Client's connection, connecting
+// first if it isn't already.
+func (cl *Client) open(sigserv, slot string) (sigConn, error) {
+	u, err := slotURL(sigserv, slot)
+	if err != nil {
+		return nil, &DialError{sigserv, err}
+	}
+	m, err := cl.mux(sigserv)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		ws, err := cl.cfg.dialWebSocket(sigserv, slot, Protocol)
+		if err != nil {
+			return nil, err
+		}
+		return ws, nil
+	}
+	s, err := m.Open(context.TODO(), u.Path)
+	if err != nil {
+		return nil, &DialError{sigserv, err}
+	}
+	return s, nil
+}
+
+// mux returns the Client's Mux, dialing it if there is none or the last
+// one failed. It returns nil if the server does not speak MuxProtocol.
+func (cl *Client) mux(sigserv string) (*Mux, error) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.nomux {
+		return nil, nil
+	}
+	if cl.m != nil {
+		select {
+		case <-cl.m.Done():
+		default:
+			return cl.m, nil
+		}
+	}
+	ws, err := cl.cfg.dialWebSocket(sigserv, "", MuxProtocol)
+	if err != nil {
+		return nil, err
+	}
+	if ws.Subprotocol() != MuxProtocol {
+		ws.Close(websocket.StatusNormalClosure, "")
+		cl.nomux = true
+		return nil, nil
+	}
+	cl.m = NewMux(ws, true)
+	return cl.m, nil
+}
@@ -0,0 +1,66 @@
+package wormhole
+
+import (
+	"context"
+	crand "crypto/rand"
+	"fmt"
+	"io"
+	"strconv"
+
+	"webwormhole.io/wordlist"
+)
+
+// GenerateCode returns a new random password of length bytes, the secret
+// part of a wormhole code. A UI can show it right away, while NewCode
+// reserves a slot to complete the code with. The words the password is
+// written as depend on the slot, so only the code NewCode sends is what
+// the peer should type. GenerateCode panics if the system's source of
+// randomness fails.
+func GenerateCode(length int) (pass []byte) {
+	pass = make([]byte, length)
+	if _, err := io.ReadFull(crand.Reader, pass); err != nil {
+		panic(fmt.Sprintf("wormhole: could not generate password: %v", err))
+	}
+	return pass
+}
+
+// NewCode is like NewContext for a password from GenerateCode, but sends
+// the full code, encoded with wordlist.Encode, on codec instead of the slot
+// once the signalling server reserves one. If the code isn't received by
+// the time NewCode returns, it is dropped rather than blocking NewCode.
+func (cfg *Config) NewCode(ctx context.Context, pass []byte, sigserv string, codec chan string) (*Wormhole, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	slotc := make(chan string)
+	done := make(chan error, 1)
+	go func() {
+		s, ok := <-slotc
+		if !ok {
+			done <- nil
+			return
+		}
+		slot, err := strconv.Atoi(s)
+		if err != nil {
+			// Not a slot a code can hold. Give up on it.
+			done <- fmt.Errorf("got invalid slot from signalling server: %q", s)
+			cancel()
+			return
+		}
+		select {
+		case codec <- wordlist.Encode(slot, pass):
+		case <-ctx.Done():
+			// No one took the code before we were done with it.
+		}
+		done <- nil
+	}()
+	c, err := cfg.NewContext(ctx, string(pass), sigserv, slotc)
+	close(slotc)
+	cancel()
+	if e := <-done; e != nil {
+		if c != nil {
+			c.Close()
+		}
+		return nil, e
+	}
+	return c, err
+}
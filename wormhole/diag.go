@@ -0,0 +1,133 @@
+package wormhole
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	webrtc "github.com/pion/webrtc/v3"
+)
+
+// Diagnostics describes how a Wormhole's connection attempt went. It is meant
+// to be attached to bug reports, so it never includes passwords, keys, or
+// ICE server credentials.
+type Diagnostics struct {
+	// Start is when the attempt started.
+	Start time.Time `json:"start"`
+
+	// Events are the steps of the handshake, as logged in verbose mode.
+	Events []Event `json:"events"`
+
+	// ICEServers are the URLs of the STUN and TURN servers the signalling
+	// server offered.
+	ICEServers []string `json:"iceServers"`
+
+	// LocalCandidates and RemoteCandidates are the ICE candidates gathered
+	// locally and received from the peer.
+	LocalCandidates  []string `json:"localCandidates"`
+	RemoteCandidates []string `json:"remoteCandidates"`
+
+	// SentCandidates are the local candidates that were sent to the peer,
+	// and so exposed to it. CandidateTypes summarises them.
+	SentCandidates []string `json:"sentCandidates"`
+
+	// ICEConnectionState and ConnectionState are the last states of the
+	// PeerConnection.
+	ICEConnectionState string `json:"iceConnectionState"`
+	ConnectionState    string `json:"connectionState"`
+
+	// Stats is the PeerConnection's WebRTC statistics.
+	Stats webrtc.StatsReport `json:"stats,omitempty"`
+
+	// Error is why the attempt failed, if it did.
+	Error string `json:"error,omitempty"`
+
+	// exposed is set when Config.StrictRelay aborted the attempt.
+	exposed bool
+}
+
+// An Event is a timestamped step of a handshake.
+type Event struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// diagnostics is the mutable state behind Wormhole.Diagnostics.
+type diagnostics struct {
+	sync.Mutex
+	d Diagnostics
+}
+
+// update calls f on c's diagnostics while holding their lock.
+func (c *Wormhole) update(f func(d *Diagnostics)) {
+	c.diag.Lock()
+	defer c.diag.Unlock()
+	f(&c.diag.d)
+}
+
+// logf logs like the package level logf, and records the message as a
+// diagnostics event.
+func (c *Wormhole) logf(format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	c.update(func(d *Diagnostics) {
+		d.Events = append(d.Events, Event{Time: time.Now(), Message: msg})
+	})
+	logf("%s", msg)
+}
+
+// snapshot records the current state and statistics of the PeerConnection.
+func (c *Wormhole) snapshot() {
+	if c.pc == nil {
+		return
+	}
+	stats := c.pc.GetStats()
+	ice, conn := c.pc.ICEConnectionState(), c.pc.ConnectionState()
+	c.update(func(d *Diagnostics) {
+		d.Stats = stats
+		d.ICEConnectionState = ice.String()
+		d.ConnectionState = conn.String()
+	})
+}
+
+// fail records err, tears down the PeerConnection if there is one, and
+// returns err after passing c's Diagnostics to Config.Failed, if set.
+// Closes of the signalling connection are returned as a CloseError.
+func (c *Wormhole) fail(err error) (*Wormhole, error) {
+	err = closeError(err)
+	c.snapshot()
+	c.update(func(d *Diagnostics) {
+		if d.exposed {
+			// Whatever broke, it was because we gave up on purpose.
+			err = ErrCandidateExposed
+		}
+		d.Error = err.Error()
+	})
+	c.endTrace(err)
+	if c.pc != nil {
+		c.pc.Close()
+	}
+	if c.failed != nil {
+		c.failed(c.Diagnostics())
+	}
+	return nil, err
+}
+
+// Diagnostics returns a description of how the connection attempt went.
+// If New or Join fail, they pass it to Config.Failed instead.
+func (c *Wormhole) Diagnostics() *Diagnostics {
+	c.diag.Lock()
+	failed := c.diag.d.Error != ""
+	c.diag.Unlock()
+	if !failed {
+		c.snapshot()
+	}
+
+	c.diag.Lock()
+	defer c.diag.Unlock()
+	d := c.diag.d
+	d.Events = append([]Event(nil), d.Events...)
+	d.LocalCandidates = append([]string(nil), d.LocalCandidates...)
+	d.RemoteCandidates = append([]string(nil), d.RemoteCandidates...)
+	d.SentCandidates = append([]string(nil), d.SentCandidates...)
+	return &d
+}
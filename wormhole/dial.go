@@ -31,24 +31,35 @@
 package wormhole
 
 import (
+	"bytes"
+	"compress/flate"
 	"context"
 	crand "crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log"
+	"net"
+	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"filippo.io/cpace"
 	webrtc "github.com/pion/webrtc/v3"
+	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/hkdf"
 	"golang.org/x/crypto/nacl/secretbox"
-	"golang.org/x/net/proxy"
 	"nhooyr.io/websocket"
+
+	"webwormhole.io/wordlist"
 )
 
 // Protocol is an identifier for the current signalling scheme. It's
@@ -92,6 +103,18 @@ const (
 
 	// CloseWebRTCFailed we couldn't establish a WebRTC connection.
 	CloseWebRTCFailed
+
+	// CloseSlotTaken is the WebSocket status returned when another peer has
+	// already joined the slot.
+	CloseSlotTaken
+
+	// CloseJoinRejected is the WebSocket status returned when the peer that
+	// created the slot turned down the one joining it.
+	CloseJoinRejected
+
+	// CloseTunnelMismatch is the WebSocket status returned when the peer
+	// has closed its connection because only one side set Config.Tunnel.
+	CloseTunnelMismatch
 )
 
 var (
@@ -103,16 +126,328 @@ var (
 	// password.
 	ErrBadKey = errors.New("bad key")
 
-	// ErrNoSuchSlot indicates no one is on the slot requested.
+	// ErrNoSuchSlot is returned by Join when no one is on the slot
+	// requested, most likely because the code was mistyped or already used.
 	ErrNoSuchSlot = errors.New("no such slot")
 
+	// ErrSlotTaken is returned by Join when another peer joined the slot
+	// first. Either the code was used already, or someone raced us to it.
+	ErrSlotTaken = errors.New("slot already taken")
+
+	// ErrJoinRejected is returned by New and Join when Config.ConfirmJoin
+	// turned down the peer, on either side.
+	ErrJoinRejected = errors.New("join rejected")
+
+	// ErrSlotLost is returned by New when the signalling server dropped the
+	// connection while waiting for the peer, e.g. because it restarted and
+	// forgot the slot. Creating a new Wormhole will get a new slot.
+	ErrSlotLost = errors.New("signalling server dropped the slot")
+
 	// ErrTimedOut indicates signalling has timed out.
 	ErrTimedOut = errors.New("timed out")
+
+	// ErrClosed is returned by Write after the Wormhole has been closed.
+	ErrClosed = errors.New("wormhole closed")
+
+	// ErrNoRelay is returned when Config.RelayOnly is set but the signalling
+	// server offered no TURN servers.
+	ErrNoRelay = errors.New("no TURN server available to relay through")
+
+	// ErrNoRelayCandidate is returned when Config.RelayOnly or StrictRelay
+	// is set but none of the TURN servers gave us a relay candidate.
+	ErrNoRelayCandidate = errors.New("could not get a relay candidate from any TURN server")
+
+	// ErrNeedTURN is returned instead of ErrTimedOut when ICE gathered all
+	// its candidates but found no direct path to the peer, and neither side
+	// had a relay candidate to fall back on. This is what happens when both
+	// peers are behind symmetric NATs and no TURN server is configured.
+	ErrNeedTURN = errors.New("no direct path to the peer and no TURN relay to fall back on")
+
+	// ErrCandidateExposed is returned when Config.StrictRelay is set and a
+	// local candidate other than a relay one was about to be sent.
+	ErrCandidateExposed = errors.New("refusing to send a non-relay ICE candidate")
+
+	// ErrNoFingerprint is returned when asking for a DTLS fingerprint before
+	// the connection has got far enough to have one.
+	ErrNoFingerprint = errors.New("no DTLS fingerprint yet")
+
+	// ErrMetadataTooLarge is returned when Config.Metadata, or the peer's,
+	// is longer than MaxMetadataSize.
+	ErrMetadataTooLarge = errors.New("handshake metadata too large")
+
+	// ErrCertMismatch is returned when the signalling server's certificate
+	// does not match Config.SignalCertFingerprint.
+	ErrCertMismatch = errors.New("signalling server certificate does not match pinned fingerprint")
+
+	// ErrCipherMismatch is returned by Join when the peer has the right
+	// password but seals signalling messages with a different Config.Cipher.
+	// The peer that created the slot gets ErrBadKey.
+	ErrCipherMismatch = errors.New("peer uses a different cipher")
+
+	// ErrTunnelMismatch is returned when only one of the peers set
+	// Config.Tunnel.
+	ErrTunnelMismatch = errors.New("only one peer asked for a tunnel")
+
+	// ErrNoSignalling is returned by RestartICE when the signalling channel
+	// wasn't kept open with Config.KeepSignalling, or has since closed.
+	ErrNoSignalling = errors.New("signalling channel closed")
+)
+
+// Ciphers signalling messages can be sealed with. See Config.Cipher.
+const (
+	CipherSecretbox         = "secretbox"
+	CipherXChaCha20Poly1305 = "xchacha20poly1305"
 )
 
+// A PassTooShortError is returned by New and Join when the password is
+// shorter than the signalling server's operator allows. Servers advertise
+// their minimum when clients connect, since they never see passwords
+// themselves. Nothing is sent to the peer.
+type PassTooShortError struct {
+	Min int // The shortest password allowed, in bytes.
+}
+
+func (e *PassTooShortError) Error() string {
+	return fmt.Sprintf("signalling server requires passwords of at least %d bytes", e.Min)
+}
+
+// A DialError is returned when the signalling server could not be reached.
+// Nothing happened on the server, so it is safe to try another.
+type DialError struct {
+	Server string
+	Err    error
+}
+
+func (e *DialError) Error() string { return e.Err.Error() }
+
+func (e *DialError) Unwrap() error { return e.Err }
+
+// A CloseError is returned by New and Join when the signalling server, or
+// the peer through it, closed the connection with a status they have no
+// error of their own for, e.g. CloseNoMoreSlots. Reason is the one given
+// with it, for showing to users.
+type CloseError struct {
+	Code   int
+	Reason string
+	Err    error
+}
+
+func (e *CloseError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("signalling server closed the connection with status %d", e.Code)
+	}
+	return "signalling server closed the connection: " + e.Reason
+}
+
+func (e *CloseError) Unwrap() error { return e.Err }
+
+// closeError returns err as a CloseError if it is the signalling
+// connection being closed, or as is otherwise.
+func closeError(err error) error {
+	if _, ok := err.(*CloseError); ok {
+		return err
+	}
+	var ce websocket.CloseError
+	if !errors.As(err, &ce) {
+		return err
+	}
+	return &CloseError{Code: int(ce.Code), Reason: ce.Reason, Err: err}
+}
+
+// MaxMetadataSize is the most metadata that can be sent with the handshake.
+// See Config.Metadata.
+const MaxMetadataSize = 512
+
+// maxMessageSize is the largest DataChannel message we can receive.
+const maxMessageSize = 64 << 10
+
+// bufferedAmountLowThreshold is how much data Write lets pile up in the
+// DataChannel's buffer before blocking, unless Config.WriteBuffer says
+// otherwise. Any threshold amount >= 1MiB seems to occasionally lock up
+// pion. Choose 512 KiB as a safe default: smaller ones can win over
+// loopback in BenchmarkWrite, but fall behind on links with any latency.
+const bufferedAmountLowThreshold = 512 << 10
+
+// UserAgent is sent to the signalling server to tell it what kind of client
+// this is.
+var UserAgent = "webwormhole-go/" + Protocol
+
 // Verbose logging.
 var Verbose = false
 
+// A Config holds optional settings used to establish a Wormhole. The zero
+// value is ready to use and is what New and Join use.
+type Config struct {
+	// Proxy is the proxy used to dial both the signalling server and ICE TCP
+	// connections. Its user info, if any, is sent to the proxy as credentials.
+	// If nil, the proxies configured in the environment are used.
+	Proxy *url.URL
+
+	// KeySalt and KeyInfo are the HKDF salt and info used to derive the
+	// signalling key from the PAKE output. Both peers must use the same
+	// values. They default to nil, which is what the web client uses.
+	KeySalt []byte
+	KeyInfo []byte
+
+	// Label, if set, is a name both peers agree on out of band, like
+	// "alice-to-bob", and is bound into the PAKE. Peers with different
+	// labels fail to connect with ErrBadKey, even with the right password,
+	// which shows someone was led to the wrong slot. The web client uses
+	// no label.
+	Label string
+
+	// InterfaceFilter and IPFilter, if set, restrict which local network
+	// interfaces and addresses ICE gathers candidates from. Only those they
+	// return true for are used. Filtering out VPNs or virtual adapters can
+	// speed up connecting and avoid leaking internal addresses to the peer.
+	InterfaceFilter func(name string) bool
+	IPFilter        func(ip net.IP) bool
+
+	// UDPPortMin and UDPPortMax, if set, restrict the local UDP ports ICE
+	// uses to this range, inclusive, for hosts behind firewalls.
+	UDPPortMin uint16
+	UDPPortMax uint16
+
+	// DSCP, if set, marks the UDP packets ICE sends, and so the
+	// DataChannels' traffic, with this Differentiated Services code point,
+	// 1 to 63, for networks with QoS policies. E.g. 46 (EF) for
+	// interactive pipes or 8 (CS1) for bulk transfers. TCP and the
+	// signalling connection aren't marked.
+	DSCP int
+
+	// MaxCandidates caps the number of local candidates sent to the peer.
+	// Zero means no limit.
+	MaxCandidates int
+
+	// NoTrickle turns off trickle ICE. Instead of sending candidates as
+	// they are gathered, it waits for gathering to complete, or for
+	// GatherTimeout, and sends them all in the offer or answer. This suits
+	// signalling relays that only pass those along. MaxCandidates does not
+	// apply. GatherTimeout defaults to 10 seconds.
+	NoTrickle     bool
+	GatherTimeout time.Duration
+
+	// ManualTimeout is how long StartManual and AnswerManual wait for the
+	// connection once they have sent their last message, which the peer
+	// may take a while to paste. It defaults to 10 minutes.
+	ManualTimeout time.Duration
+
+	// ICEServers are STUN and TURN servers to use along with the ones
+	// the signalling server offers.
+	ICEServers []webrtc.ICEServer
+
+	// IgnoreServerICE drops the ICE servers the signalling server offers,
+	// leaving only ICEServers, so a server that isn't trusted can't have
+	// the connection go through a TURN relay of its choosing, which would
+	// see who talks to whom and how much. Without any ICEServers, peers can
+	// only connect if they can reach each other's own addresses.
+	IgnoreServerICE bool
+
+	// RelayOnly only allows connecting through a TURN relay, so the peer
+	// never learns our own addresses. Local host and server reflexive
+	// candidates are neither gathered nor sent.
+	RelayOnly bool
+
+	// StrictRelay is RelayOnly, but if a candidate other than a relay one
+	// is ever about to be sent to the peer, the connection fails with
+	// ErrCandidateExposed instead of the candidate being left out. It
+	// guards against our addresses leaking should gathering misbehave.
+	StrictRelay bool
+
+	// CompressSDP compresses session descriptions and candidates before
+	// sealing them, which makes signalling messages smaller. Both peers
+	// understand compressed messages, but the web client does not, so
+	// only set it when the peer is known to be a Go client.
+	CompressSDP bool
+
+	// Compress asks the signalling server to compress messages with
+	// permessage-deflate. Servers that don't support it ignore the request.
+	Compress bool
+
+	// TLSConfig is used to connect to the signalling server. If nil, the
+	// default configuration is used.
+	TLSConfig *tls.Config
+
+	// SignalCertFingerprint, if set, pins the signalling server's
+	// certificate. It is the SHA-256 hash of either the server's leaf
+	// certificate or its public key, and connections to servers presenting
+	// anything else are refused. The usual CA verification still applies
+	// unless TLSConfig sets InsecureSkipVerify, which makes the pin the only
+	// check and allows self-signed certificates.
+	SignalCertFingerprint []byte
+
+	// Rand is the source of randomness for the nonces sealing signalling
+	// messages. If nil, crypto/rand is used, which is the only sensible
+	// choice outside of tests. The PAKE and DTLS always use crypto/rand.
+	Rand io.Reader
+
+	// Metadata, if set, is sent to the peer sealed along with our session
+	// description, so it arrives with the connection without another round
+	// trip. The peer reads it with Metadata. It can be at most
+	// MaxMetadataSize bytes. The web client ignores it.
+	Metadata []byte
+
+	// Cipher is what signalling messages are sealed with, CipherSecretbox
+	// or CipherXChaCha20Poly1305. Both peers must use the same one. It
+	// defaults to secretbox, which is what the web client uses.
+	Cipher string
+
+	// Tunnel encrypts everything sent over the connection again on top of
+	// DTLS, with keys derived from the PAKE secret that the signalling
+	// server and TURN relays never see, for those who don't trust the
+	// WebRTC stack. Each message grows by chacha20poly1305.Overhead bytes,
+	// which MaxMessageSize takes into account. Each message is chained to
+	// those before it, so none can be swapped for another. Both peers
+	// must set it, or connecting fails with ErrTunnelMismatch. The web
+	// client can't.
+	Tunnel bool
+
+	// NoDetach reads and writes the DataChannel through its callbacks
+	// instead of detaching it. It is slower, and only useful if detaching
+	// is broken or unavailable.
+	NoDetach bool
+
+	// ConfirmJoin, if set, is called by New and Join once the peers share
+	// a key, before the WebRTC handshake starts, with a few words derived
+	// from it like ShortAuthString's. The users can compare them to rule
+	// out someone racing the intended peer to the slot. If it returns
+	// false, the peer is turned away and both sides fail with
+	// ErrJoinRejected.
+	ConfirmJoin func(sas string) bool
+
+	// WriteBuffer is how many bytes Write lets pile up in the DataChannel's
+	// buffer before blocking until it drains. Zero means 512 KiB. Bigger
+	// buffers help on links with a lot of latency, but 1 MiB or more can
+	// lock up the DataChannel.
+	WriteBuffer int
+
+	// KeepSignalling keeps the connection to the signalling server open
+	// after connecting, instead of closing it and freeing the slot, so
+	// RestartICE can use it. Both peers must set it.
+	KeepSignalling bool
+
+	// Tracer, if set, traces New and Join, in a span under any in the
+	// context given to NewContext, with a span for each step. See Tracer.
+	Tracer Tracer
+
+	// Failed, if set, is called with the Diagnostics of a New, Join,
+	// StartManual or AnswerManual that fails, since they return no
+	// Wormhole then.
+	Failed func(d *Diagnostics)
+
+	// client, if set, is used to dial the signalling server instead of
+	// making one from Proxy and TLSConfig. See Client.
+	client *http.Client
+
+	// mux, if set, is used to open connections to the signalling server
+	// instead of dialing a WebSocket for each. See Client.
+	mux func(sigserv, slot string) (sigConn, error)
+
+	// settings, if set, is applied to the PeerConnection's settings, for
+	// tests to simulate networks.
+	settings func(*webrtc.SettingEngine)
+}
+
 func logf(format string, v ...interface{}) {
 	if Verbose {
 		log.Printf(format, v...)
@@ -129,14 +464,101 @@ type Wormhole struct {
 	d   *webrtc.DataChannel
 	pc  *webrtc.PeerConnection
 
+	// messages is used as rwc instead of the detached DataChannel if
+	// Config.NoDetach is set.
+	messages *messageConn
+
+	// parent is the Wormhole that opened this one with Channel, and owns
+	// the PeerConnection.
+	parent *Wormhole
+
 	// opened signals that the underlying DataChannel is open and ready
 	// to handle data.
 	opened chan struct{}
 	// err forwards errors from the OnError callback.
 	err chan error
+	// norelay is closed if Config.RelayOnly or StrictRelay is set and
+	// gathering finished without a single relay candidate, so there is
+	// nothing to connect over.
+	norelay     chan struct{}
+	norelayOnce sync.Once
 	// flushc is a condition variable to coordinate flushed state of the
-	// underlying channel.
-	flushc *sync.Cond
+	// underlying channel. flushing counts the Flush calls waiting on it.
+	flushc   *sync.Cond
+	flushing int
+
+	// writeBuffer is the buffered amount Write waits for the DataChannel
+	// to drain to. See Config.WriteBuffer.
+	writeBuffer uint64
+
+	// unread is what's left of the last message read into readbuf, for
+	// readers with buffers smaller than a message.
+	readmu  sync.Mutex
+	readbuf []byte
+	unread  []byte
+
+	// pending holds remote candidates received before the remote session
+	// description.
+	candmu  sync.Mutex
+	pending []webrtc.ICECandidateInit
+
+	// metadata is what the peer sent with its session description.
+	metadata []byte
+
+	// tunnel, if set, seals the messages sent and opens the messages
+	// received. See Config.Tunnel.
+	tunnel *tunnel
+
+	// exporter and sasKey are derived from the PAKE's shared secret, which
+	// isn't kept, for ExportKeys and ShortAuthString. keyed is set once
+	// they are. created is whether we created the slot rather than joined
+	// it.
+	exporter, sasKey [32]byte
+	keyed            bool
+	created          bool
+
+	// done is closed when Close is first called.
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// ws is the signalling channel if Config.KeepSignalling is set, and cfg
+	// and key what messages on it are sealed with. See RestartICE.
+	ws  sigConn
+	cfg *Config
+	key [32]byte
+
+	// failed is Config.Failed, called by fail.
+	failed func(d *Diagnostics)
+
+	// restartmu serialises ICE restarts. restarts counts them once the
+	// peer's new description is set, and changed is closed and replaced
+	// whenever that or the ICE connection state changes.
+	restartmu sync.Mutex
+	statemu   sync.Mutex
+	restarts  int
+	changed   chan struct{}
+
+	// sigclosed is closed when we stop reading the signalling channel.
+	sigclosed chan struct{}
+
+	// trace traces connecting and the connection. See Config.Tracer.
+	trace tracing
+
+	diag diagnostics
+}
+
+func newWormhole() *Wormhole {
+	c := &Wormhole{
+		opened:    make(chan struct{}),
+		err:       make(chan error),
+		norelay:   make(chan struct{}),
+		flushc:    sync.NewCond(&sync.Mutex{}),
+		done:      make(chan struct{}),
+		changed:   make(chan struct{}),
+		sigclosed: make(chan struct{}),
+	}
+	c.diag.d.Start = time.Now()
+	return c
 }
 
 // Read writes a message to the default DataChannel.
@@ -146,47 +568,162 @@ func (c *Wormhole) Write(p []byte) (n int, err error) {
 	// Work around this by blocking here and waiting for flushes.
 	// https://github.com/pion/sctp/issues/77
 	c.flushc.L.Lock()
-	for c.d.BufferedAmount() > c.d.BufferedAmountLowThreshold() {
+	for c.d.BufferedAmount() > c.d.BufferedAmountLowThreshold() && !c.closing() && !c.disconnected() {
 		c.flushc.Wait()
 	}
 	c.flushc.L.Unlock()
+	if c.closing() {
+		return 0, ErrClosed
+	}
+	if c.tunnel != nil {
+		return c.tunnel.write(p, c.rwc.Write)
+	}
 	return c.rwc.Write(p)
 }
 
-// Read read a message from the default DataChannel.
+// Read reads a message from the default DataChannel. If p is too small for
+// the message, the rest of it is returned by the following calls to Read.
+// A single Read never returns data from more than one message.
 func (c *Wormhole) Read(p []byte) (n int, err error) {
-	return c.rwc.Read(p)
+	c.readmu.Lock()
+	defer c.readmu.Unlock()
+	if len(c.unread) == 0 {
+		if len(p) >= maxMessageSize && c.tunnel == nil {
+			return c.rwc.Read(p)
+		}
+		if c.readbuf == nil {
+			c.readbuf = make([]byte, maxMessageSize)
+		}
+		n, err = c.rwc.Read(c.readbuf)
+		if err != nil && n == 0 {
+			return 0, err
+		}
+		c.unread = c.readbuf[:n]
+		if c.tunnel != nil {
+			c.unread, err = c.tunnel.open(c.unread)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	n = copy(p, c.unread)
+	c.unread = c.unread[n:]
+	return n, nil
+}
+
+// closing reports whether Close has been called.
+func (c *Wormhole) closing() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
 }
 
-// TODO benchmark this buffer madness.
+// flushed wakes up writers waiting for the DataChannel's buffer to drain.
 func (c *Wormhole) flushed() {
 	c.flushc.L.Lock()
-	c.flushc.Signal()
+	c.flushc.Broadcast()
 	c.flushc.L.Unlock()
 }
 
-// Close attempts to flush the DataChannel buffers then close it
-// and its PeerConnection.
-func (c *Wormhole) Close() (err error) {
-	logf("closing")
+// disconnected reports whether the PeerConnection is gone for good, so
+// nothing buffered will ever be sent.
+func (c *Wormhole) disconnected() bool {
+	s := c.pc.ConnectionState()
+	return s == webrtc.PeerConnectionStateFailed || s == webrtc.PeerConnectionStateClosed
+}
+
+// Flush blocks until everything written has been sent and acknowledged by
+// the peer's SCTP stack, ctx is done, or the connection fails.
+func (c *Wormhole) Flush(ctx context.Context) error {
+	c.flushc.L.Lock()
+	// OnBufferedAmountLow fires when the buffer drains to the threshold,
+	// so lower it to get told when it is empty.
+	c.flushing++
+	c.d.SetBufferedAmountLowThreshold(0)
+	defer func() {
+		c.flushing--
+		if c.flushing == 0 {
+			c.d.SetBufferedAmountLowThreshold(c.writeBuffer)
+		}
+		c.flushc.L.Unlock()
+	}()
+
+	// Wake up the loop below if ctx is done first.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.flushed()
+		case <-stop:
+		}
+	}()
+
 	for c.d.BufferedAmount() != 0 {
-		// SetBufferedAmountLowThreshold does not seem to take effect
-		// when after the last Write().
-		time.Sleep(time.Second) // eww.
-	}
-	tryclose := func(c io.Closer) {
-		e := c.Close()
-		if e != nil {
-			err = e
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
+		if c.disconnected() {
+			return ErrClosed
+		}
+		c.flushc.Wait()
 	}
-	defer tryclose(c.pc)
-	defer tryclose(c.d)
-	defer tryclose(c.rwc)
 	return nil
 }
 
+// Close attempts to flush the DataChannel buffers then close it
+// and its PeerConnection. Wormholes returned by Channel leave the
+// PeerConnection open. It is safe to call more than once and from
+// multiple goroutines. Writes waiting to be sent fail with ErrClosed.
+// Only the first call returns an error.
+func (c *Wormhole) Close() (err error) {
+	closed := false
+	c.closeOnce.Do(func() {
+		closed = true
+		c.logf("closing")
+		c.flushc.L.Lock()
+		close(c.done)
+		c.flushc.Broadcast()
+		c.flushc.L.Unlock()
+
+		if c.rwc != nil {
+			c.Flush(context.Background())
+		}
+		tryclose := func(c io.Closer) {
+			e := c.Close()
+			if e != nil {
+				err = e
+			}
+		}
+		if c.pc != nil && c.parent == nil {
+			defer tryclose(c.pc)
+		}
+		if c.d != nil {
+			defer tryclose(c.d)
+		}
+		if c.rwc != nil {
+			defer tryclose(c.rwc)
+		}
+		if c.ws != nil {
+			c.closeSignalling()
+		}
+		c.endTrace(nil)
+	})
+	if !closed {
+		return nil
+	}
+	return err
+}
+
 func (c *Wormhole) open() {
+	if c.messages != nil {
+		c.rwc = c.messages
+		close(c.opened)
+		return
+	}
 	var err error
 	c.rwc, err = c.d.Detach()
 	if err != nil {
@@ -202,51 +739,162 @@ func (c *Wormhole) error(err error) {
 	c.err <- err
 }
 
-func readEncJSON(ws *websocket.Conn, key *[32]byte, v interface{}) error {
+func readEncJSON(ws sigConn, cfg *Config, key *[32]byte, v interface{}) error {
 	_, buf, err := ws.Read(context.TODO())
 	if err != nil {
 		return err
 	}
-	encrypted, err := base64.URLEncoding.DecodeString(string(buf))
+	return openJSON(cfg, key, string(buf), v)
+}
+
+func writeEncJSON(ws sigConn, cfg *Config, key *[32]byte, v interface{}) error {
+	msg, err := sealJSON(cfg, key, v)
 	if err != nil {
 		return err
 	}
-	var nonce [24]byte
-	copy(nonce[:], encrypted[:24])
-	jsonmsg, ok := secretbox.Open(nil, encrypted[24:], &nonce, key)
-	if !ok {
-		return ErrBadKey
+	return ws.Write(context.TODO(), websocket.MessageText, []byte(msg))
+}
+
+// flateMarker starts sealed messages that are compressed with flate. JSON
+// never starts with it, so uncompressed messages are told apart.
+const flateMarker = 0x01
+
+// maxInflated limits how large a compressed message may get.
+const maxInflated = 1 << 20
+
+// seal seals msg with key and nonce using cipher. Either way the sealed
+// message is the nonce followed by the ciphertext, so nothing in it says
+// which cipher was used. Peers that disagree find out when they can't open
+// each other's messages, see openJSON.
+func seal(cipher string, key *[32]byte, nonce *[24]byte, msg []byte) ([]byte, error) {
+	switch cipher {
+	case "", CipherSecretbox:
+		return secretbox.Seal(nonce[:], msg, nonce, key), nil
+	case CipherXChaCha20Poly1305:
+		aead, err := chacha20poly1305.NewX(key[:])
+		if err != nil {
+			return nil, err
+		}
+		return aead.Seal(nonce[:], nonce[:], msg, nil), nil
 	}
-	return json.Unmarshal(jsonmsg, v)
+	return nil, fmt.Errorf("unknown cipher %q", cipher)
+}
+
+// open opens box, sealed by seal with key and cipher. It reports whether
+// box was sealed that way.
+func open(cipher string, key *[32]byte, box []byte) ([]byte, bool) {
+	switch cipher {
+	case "", CipherSecretbox:
+		if len(box) < 24 {
+			return nil, false
+		}
+		var nonce [24]byte
+		copy(nonce[:], box[:24])
+		return secretbox.Open(nil, box[24:], &nonce, key)
+	case CipherXChaCha20Poly1305:
+		if len(box) < chacha20poly1305.NonceSizeX {
+			return nil, false
+		}
+		aead, err := chacha20poly1305.NewX(key[:])
+		if err != nil {
+			return nil, false
+		}
+		nonce := box[:chacha20poly1305.NonceSizeX]
+		msg, err := aead.Open(nil, nonce, box[chacha20poly1305.NonceSizeX:], nil)
+		return msg, err == nil
+	}
+	return nil, false
 }
 
-func writeEncJSON(ws *websocket.Conn, key *[32]byte, v interface{}) error {
+// otherCipher returns the cipher peers not using cipher would be using.
+func otherCipher(cipher string) string {
+	if cipher == CipherXChaCha20Poly1305 {
+		return CipherSecretbox
+	}
+	return CipherXChaCha20Poly1305
+}
+
+// sealJSON encodes v as JSON and seals it with key, using cfg.Cipher and a
+// nonce read from cfg.Rand. If cfg.CompressSDP is set, the JSON is
+// compressed first.
+func sealJSON(cfg *Config, key *[32]byte, v interface{}) (string, error) {
 	jsonmsg, err := json.Marshal(v)
 	if err != nil {
-		return err
+		return "", err
+	}
+	if cfg.CompressSDP {
+		b := bytes.NewBuffer([]byte{flateMarker})
+		w, err := flate.NewWriter(b, flate.BestCompression)
+		if err != nil {
+			return "", err
+		}
+		w.Write(jsonmsg)
+		err = w.Close()
+		if err != nil {
+			return "", err
+		}
+		jsonmsg = b.Bytes()
 	}
 	var nonce [24]byte
-	if _, err := io.ReadFull(crand.Reader, nonce[:]); err != nil {
+	if _, err := io.ReadFull(cfg.rand(), nonce[:]); err != nil {
+		return "", err
+	}
+	sealed, err := seal(cfg.Cipher, key, &nonce, jsonmsg)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(sealed), nil
+}
+
+// openJSON opens msg, sealed by sealJSON with cfg.Cipher, and decodes it
+// into v. If msg was sealed with the right key but the other cipher, it
+// returns ErrCipherMismatch.
+func openJSON(cfg *Config, key *[32]byte, msg string, v interface{}) error {
+	encrypted, err := base64.URLEncoding.DecodeString(msg)
+	if err != nil {
 		return err
 	}
-	return ws.Write(
-		context.TODO(),
-		websocket.MessageText,
-		[]byte(base64.URLEncoding.EncodeToString(
-			secretbox.Seal(nonce[:], jsonmsg, &nonce, key),
-		)),
-	)
+	jsonmsg, ok := open(cfg.Cipher, key, encrypted)
+	if !ok {
+		if _, ok := open(otherCipher(cfg.Cipher), key, encrypted); ok {
+			return ErrCipherMismatch
+		}
+		return ErrBadKey
+	}
+	if len(jsonmsg) > 0 && jsonmsg[0] == flateMarker {
+		r := flate.NewReader(bytes.NewReader(jsonmsg[1:]))
+		defer r.Close()
+		jsonmsg, err = io.ReadAll(io.LimitReader(r, maxInflated+1))
+		if err != nil {
+			return err
+		}
+		if len(jsonmsg) > maxInflated {
+			return errors.New("compressed message too large")
+		}
+	}
+	return json.Unmarshal(jsonmsg, v)
 }
 
-func readBase64(ws *websocket.Conn) ([]byte, error) {
-	_, buf, err := ws.Read(context.TODO())
+func readBase64(ctx context.Context, ws sigConn) ([]byte, error) {
+	_, buf, err := ws.Read(ctx)
 	if err != nil {
 		return nil, err
 	}
 	return base64.URLEncoding.DecodeString(string(buf))
 }
 
-func writeBase64(ws *websocket.Conn, p []byte) error {
+// slotLost reports whether err, from reading the signalling server while
+// waiting for the peer, means the server dropped the connection rather than
+// timing out the slot or relaying a malformed message.
+func slotLost(err error) bool {
+	var corrupt base64.CorruptInputError
+	if errors.As(err, &corrupt) {
+		return false
+	}
+	return websocket.CloseStatus(err) != CloseSlotTimedOut
+}
+
+func writeBase64(ws sigConn, p []byte) error {
 	return ws.Write(
 		context.TODO(),
 		websocket.MessageText,
@@ -254,123 +902,809 @@ func writeBase64(ws *websocket.Conn, p []byte) error {
 	)
 }
 
-// readInitMsg reads the first message the signalling server sends over
-// the WebSocket connection, which has metadata includign assigned slot
-// and ICE servers to use.
-func readInitMsg(ws *websocket.Conn) (slot string, iceServers []webrtc.ICEServer, err error) {
-	msg := struct {
-		Slot       string             `json:"slot",omitempty`
-		ICEServers []webrtc.ICEServer `json:"iceServers",omitempty`
-	}{}
+// initMsg is the first message the signalling server sends over the
+// WebSocket connection.
+type initMsg struct {
+	Slot       string             `json:"slot"`
+	ICEServers []webrtc.ICEServer `json:"iceServers"`
+
+	// MinPassLength is the shortest password, in bytes, the server's
+	// operator wants clients to use.
+	MinPassLength int `json:"minPassLength,omitempty"`
+}
 
+// readInitMsg reads the first message the signalling server sends over
+// the WebSocket connection, which has metadata including assigned slot,
+// ICE servers to use and the server's password policy.
+func readInitMsg(ws sigConn) (initMsg, error) {
+	var msg initMsg
 	_, buf, err := ws.Read(context.TODO())
 	if err != nil {
-		return "", nil, err
+		return msg, err
 	}
 	err = json.Unmarshal(buf, &msg)
-	return msg.Slot, msg.ICEServers, err
+	return msg, err
+}
+
+// checkPass returns a PassTooShortError if pass is shorter than the
+// signalling server wants.
+func checkPass(pass string, msg initMsg) error {
+	if len(pass) < msg.MinPassLength {
+		return &PassTooShortError{Min: msg.MinPassLength}
+	}
+	return nil
 }
 
 // handleRemoteCandidates waits for remote candidate to trickle in. We close
 // the websocket when we get a successful connection so this should fail and
-// exit at some point.
-func (c *Wormhole) handleRemoteCandidates(ws *websocket.Conn, key *[32]byte) {
+// exit at some point. If Config.KeepSignalling is set, it carries on after
+// connecting to handle ICE restarts.
+func (c *Wormhole) handleRemoteCandidates(cfg *Config, ws sigConn, key *[32]byte) {
+	defer close(c.sigclosed)
 	for {
-		var candidate webrtc.ICECandidateInit
-		err := readEncJSON(ws, key, &candidate)
+		var s signal
+		err := readEncJSON(ws, cfg, key, &s)
 		if websocket.CloseStatus(err) == websocket.StatusNormalClosure {
 			return
 		}
 		if err != nil {
-			logf("cannot read remote candidate: %v", err)
+			c.logf("cannot read remote candidate: %v", err)
 			return
 		}
-		logf("received new remote candidate: %v", candidate.Candidate)
-		err = c.pc.AddICECandidate(candidate)
+		if s.Restart || s.SDP != "" {
+			err = c.handleRestart(cfg, ws, key, s)
+			if err != nil {
+				c.logf("cannot restart ice: %v", err)
+			}
+			continue
+		}
+		c.logf("received new remote candidate: %v", s.Candidate)
+		err = c.addRemoteCandidate(s.ICECandidateInit)
 		if err != nil {
-			logf("cannot add candidate: %v", err)
+			c.logf("cannot add candidate: %v", err)
 			return
 		}
 	}
 }
 
-func (c *Wormhole) newPeerConnection(ice []webrtc.ICEServer) error {
-	// Accessing pion/webrtc APIs like DataChannel.Detach() requires
-	// that we do this voodoo.
-	s := webrtc.SettingEngine{}
-	s.DetachDataChannels()
-	s.SetICEProxyDialer(proxy.FromEnvironment())
-	rtcapi := webrtc.NewAPI(webrtc.WithSettingEngine(s))
+// signal is a message from the peer carrying either a session description
+// or an ICE candidate.
+type signal struct {
+	webrtc.SessionDescription
+	webrtc.ICECandidateInit
 
-	var err error
-	c.pc, err = rtcapi.NewPeerConnection(webrtc.Configuration{
-		ICEServers: ice,
-	})
-	if err != nil {
-		return err
+	// Metadata and Tunnel come with session descriptions. See
+	// Config.Metadata and Config.Tunnel.
+	Metadata []byte `json:"metadata,omitempty"`
+	Tunnel   bool   `json:"tunnel,omitempty"`
+
+	// Restart asks the peer that created the slot to restart ICE. See
+	// RestartICE.
+	Restart bool `json:"restart,omitempty"`
+}
+
+// description is a session description as sent to the peer.
+type description struct {
+	webrtc.SessionDescription
+	Metadata []byte `json:"metadata,omitempty"`
+	Tunnel   bool   `json:"tunnel,omitempty"`
+}
+
+// peerDescription checks what came with the peer's session description in
+// s against cfg and keeps it.
+func (c *Wormhole) peerDescription(cfg *Config, s signal) (err error) {
+	if len(s.Metadata) > MaxMetadataSize {
+		return ErrMetadataTooLarge
+	}
+	if s.Tunnel != cfg.Tunnel {
+		return ErrTunnelMismatch
 	}
+	c.metadata = s.Metadata
+	if cfg.Tunnel {
+		c.tunnel, err = c.newTunnel(0)
+	}
+	return err
+}
 
-	sigh := true
-	c.d, err = c.pc.CreateDataChannel("data", &webrtc.DataChannelInit{
-		Negotiated: &sigh,
-		ID:         new(uint16),
+// readDescription reads the peer's session description, and the metadata
+// that came with it, from ws. Candidates that race ahead of it are held
+// until it is set.
+func (c *Wormhole) readDescription(cfg *Config, ws sigConn, key *[32]byte) (webrtc.SessionDescription, error) {
+	for {
+		var s signal
+		err := readEncJSON(ws, cfg, key, &s)
+		if err != nil {
+			return webrtc.SessionDescription{}, err
+		}
+		if s.Candidate == "" {
+			return s.SessionDescription, c.peerDescription(cfg, s)
+		}
+		c.logf("received early remote candidate: %v", s.Candidate)
+		err = c.addRemoteCandidate(s.ICECandidateInit)
+		if err != nil {
+			return webrtc.SessionDescription{}, err
+		}
+	}
+}
+
+// addRemoteCandidate adds a candidate from the peer. If we don't have the
+// peer's session description yet, it's kept until setRemoteDescription.
+func (c *Wormhole) addRemoteCandidate(candidate webrtc.ICECandidateInit) error {
+	c.update(func(d *Diagnostics) {
+		d.RemoteCandidates = append(d.RemoteCandidates, candidate.Candidate)
 	})
+	c.candmu.Lock()
+	defer c.candmu.Unlock()
+	if c.pc.RemoteDescription() == nil {
+		c.pending = append(c.pending, candidate)
+		return nil
+	}
+	return c.pc.AddICECandidate(candidate)
+}
+
+// setRemoteDescription sets the peer's session description, then adds the
+// candidates that arrived before it.
+func (c *Wormhole) setRemoteDescription(sd webrtc.SessionDescription) error {
+	c.candmu.Lock()
+	defer c.candmu.Unlock()
+	err := c.pc.SetRemoteDescription(sd)
 	if err != nil {
 		return err
 	}
-	c.d.OnOpen(c.open)
-	c.d.OnError(c.error)
-	c.d.OnBufferedAmountLow(c.flushed)
-	// Any threshold amount >= 1MiB seems to occasionally lock up pion.
-	// Choose 512 KiB as a safe default.
-	c.d.SetBufferedAmountLowThreshold(512 << 10)
+	for _, candidate := range c.pending {
+		err = c.pc.AddICECandidate(candidate)
+		if err != nil {
+			return err
+		}
+	}
+	c.pending = nil
 	return nil
 }
 
-// IsRelay returns whether this connection is over a TURN relay or not.
-func (c *Wormhole) IsRelay() bool {
-	stats := c.pc.GetStats()
-	for _, s := range stats {
-		pairstats, ok := s.(webrtc.ICECandidatePairStats)
-		if !ok {
-			continue
+// sendLocalCandidates trickles local candidates to the peer as they are
+// gathered, up to cfg.MaxCandidates, unless cfg.NoTrickle is set.
+func (c *Wormhole) sendLocalCandidates(cfg *Config, ws sigConn, key *[32]byte) {
+	var mu sync.Mutex
+	sent := 0
+	c.pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			return
 		}
-		if !pairstats.Nominated {
-			continue
+		c.update(func(d *Diagnostics) {
+			d.LocalCandidates = append(d.LocalCandidates, candidate.String())
+		})
+		mu.Lock()
+		defer mu.Unlock()
+		if cfg.NoTrickle {
+			return
 		}
-		local, ok := stats[pairstats.LocalCandidateID].(webrtc.ICECandidateStats)
-		if !ok {
-			continue
+		if cfg.StrictRelay && candidate.Typ != webrtc.ICECandidateTypeRelay {
+			c.logf("aborting rather than send non-relay local candidate: %v", candidate.String())
+			c.exposed(ws)
+			return
 		}
-		remote, ok := stats[pairstats.RemoteCandidateID].(webrtc.ICECandidateStats)
-		if !ok {
-			continue
+		if cfg.RelayOnly && candidate.Typ != webrtc.ICECandidateTypeRelay {
+			c.logf("not sending non-relay local candidate: %v", candidate.String())
+			return
 		}
-		if remote.CandidateType == webrtc.ICECandidateTypeRelay ||
-			local.CandidateType == webrtc.ICECandidateTypeRelay {
-			return true
+		if cfg.MaxCandidates > 0 && sent >= cfg.MaxCandidates {
+			c.logf("not sending local candidate, already sent %v: %v", sent, candidate.String())
+			return
 		}
-	}
+		err := writeEncJSON(ws, cfg, key, candidate.ToJSON())
+		if websocket.CloseStatus(err) == websocket.StatusNormalClosure {
+			return
+		}
+		if err != nil {
+			c.logf("cannot send local candidate: %v", err)
+			return
+		}
+		sent++
+		c.update(func(d *Diagnostics) {
+			d.SentCandidates = append(d.SentCandidates, candidate.ToJSON().Candidate)
+		})
+		c.logf("sent new local candidate: %v", candidate.String())
+	})
+}
+
+// exposed makes the handshake on ws fail with ErrCandidateExposed.
+func (c *Wormhole) exposed(ws sigConn) {
+	c.update(func(d *Diagnostics) {
+		d.exposed = true
+	})
+	ws.Close(websocket.StatusPolicyViolation, "refusing to send non-relay candidate")
+}
+
+// setLocalDescription sets sd as the local description and sends it to the
+// peer. Unless cfg.NoTrickle is set, it is sent first, so candidates that
+// trickle in afterwards don't get ahead of it. Otherwise it is sent once ICE
+// gathering completes, with every candidate in it.
+func (c *Wormhole) setLocalDescription(cfg *Config, ws sigConn, key *[32]byte, sd webrtc.SessionDescription) error {
+	if !cfg.NoTrickle {
+		err := writeEncJSON(ws, cfg, key, description{sd, cfg.Metadata, cfg.Tunnel})
+		if err != nil {
+			return err
+		}
+		return c.pc.SetLocalDescription(sd)
+	}
+
+	sd, err := c.gatherDescription(cfg, sd)
+	if err != nil {
+		return err
+	}
+	candidates := sdpCandidates(sd.SDP)
+	if typ := exposedType(cfg, candidates); typ != "" {
+		c.logf("aborting rather than send %v with a %v candidate", sd.Type, typ)
+		c.exposed(ws)
+		return ErrCandidateExposed
+	}
+	err = writeEncJSON(ws, cfg, key, description{sd, cfg.Metadata, cfg.Tunnel})
+	if err != nil {
+		return err
+	}
+	c.update(func(d *Diagnostics) {
+		d.SentCandidates = append(d.SentCandidates, candidates...)
+	})
+	return nil
+}
+
+// gatherDescription sets sd as the local description and returns it with
+// every candidate in it once ICE gathering completes, or cfg.GatherTimeout
+// passes.
+func (c *Wormhole) gatherDescription(cfg *Config, sd webrtc.SessionDescription) (webrtc.SessionDescription, error) {
+	timeout := cfg.GatherTimeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	gathered := webrtc.GatheringCompletePromise(c.pc)
+	err := c.pc.SetLocalDescription(sd)
+	if err != nil {
+		return sd, err
+	}
+	select {
+	case <-gathered:
+	case <-time.After(timeout):
+		c.logf("ICE gathering did not complete in %v, sending candidates so far", timeout)
+	}
+	sd = *c.pc.LocalDescription()
+	c.logf("gathered %d candidates into the %v", strings.Count(sd.SDP, "a=candidate:"), sd.Type)
+	return sd, nil
+}
+
+// exposedType returns the type of a candidate in candidates that
+// cfg.StrictRelay forbids sending, if it is set and there is one.
+func exposedType(cfg *Config, candidates []string) string {
+	if !cfg.StrictRelay {
+		return ""
+	}
+	for typ := range CandidateTypes(candidates) {
+		if typ != webrtc.ICECandidateTypeRelay.String() {
+			return typ
+		}
+	}
+	return ""
+}
+
+// sdpCandidates returns the candidates in a session description, in the
+// form they are trickled in.
+func sdpCandidates(sdp string) []string {
+	var candidates []string
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "a=candidate:") {
+			candidates = append(candidates, line[len("a="):])
+		}
+	}
+	return candidates
+}
+
+// CandidateTypes counts candidates, like those in Diagnostics, by their
+// type: "host", "srflx", "prflx" or "relay".
+func CandidateTypes(candidates []string) map[string]int {
+	types := map[string]int{}
+	for _, candidate := range candidates {
+		fields := strings.Fields(candidate)
+		for i := 0; i+1 < len(fields); i++ {
+			if fields[i] == "typ" {
+				types[fields[i+1]]++
+				break
+			}
+		}
+	}
+	return types
+}
+
+// timeoutError returns why the WebRTC connection didn't come up in time:
+// ErrNeedTURN if only a relay could have helped, or ErrTimedOut.
+func (c *Wormhole) timeoutError() error {
+	local := sdpCandidates(c.pc.LocalDescription().SDP)
+	c.diag.Lock()
+	remote := append([]string(nil), c.diag.d.RemoteCandidates...)
+	c.diag.Unlock()
+	if sd := c.pc.RemoteDescription(); sd != nil {
+		remote = append(remote, sdpCandidates(sd.SDP)...)
+	}
+	if needTURN(c.pc.ICEGatheringState(), c.pc.ICEConnectionState(), local, remote) {
+		c.logf("no working candidate pair and no relay candidates")
+		return ErrNeedTURN
+	}
+	return ErrTimedOut
+}
+
+// needTURN reports whether a connection attempt stuck in state ice failed
+// for want of a relay: we gathered all our local candidates, and there were
+// candidates on both sides, but no relay ones to try.
+func needTURN(gathering webrtc.ICEGatheringState, ice webrtc.ICEConnectionState, local, remote []string) bool {
+	if gathering != webrtc.ICEGatheringStateComplete || len(local) == 0 || len(remote) == 0 {
+		return false
+	}
+	switch ice {
+	case webrtc.ICEConnectionStateConnected, webrtc.ICEConnectionStateCompleted:
+		return false
+	}
+	relay := webrtc.ICECandidateTypeRelay.String()
+	return CandidateTypes(local)[relay] == 0 && CandidateTypes(remote)[relay] == 0
+}
+
+// iceServers returns the ICE servers to use, given the ones the signalling
+// server offered.
+func (cfg *Config) iceServers(offered []webrtc.ICEServer) []webrtc.ICEServer {
+	if cfg.IgnoreServerICE {
+		offered = nil
+	}
+	return append(append([]webrtc.ICEServer(nil), cfg.ICEServers...), offered...)
+}
+
+// hasTURN reports whether any of servers is a TURN server.
+func hasTURN(servers []webrtc.ICEServer) bool {
+	for _, s := range servers {
+		for _, u := range s.URLs {
+			if strings.HasPrefix(u, "turn:") || strings.HasPrefix(u, "turns:") {
+				return true
+			}
+		}
+	}
 	return false
 }
 
-// New starts a new signalling handshake after asking the server to allocate
-// a new slot.
-//
-// The slot is used to synchronise with the remote peer on signalling server
-// sigserv, and pass is used as the PAKE password authenticate the WebRTC
-// offer and answer.
-//
-// The server generated slot identifier is written on slotc.
-//
-// If pc is nil it initialises ones using the default STUN server.
+func (c *Wormhole) newPeerConnection(cfg *Config, ice []webrtc.ICEServer) error {
+	// Accessing pion/webrtc APIs like DataChannel.Detach() requires
+	// that we do this voodoo.
+	s := webrtc.SettingEngine{}
+	if !cfg.NoDetach {
+		s.DetachDataChannels()
+	}
+	s.SetICEProxyDialer(iceDialer(cfg.Proxy))
+	if cfg.InterfaceFilter != nil {
+		s.SetInterfaceFilter(cfg.InterfaceFilter)
+	}
+	if cfg.IPFilter != nil {
+		s.SetIPFilter(cfg.IPFilter)
+	}
+	if cfg.UDPPortMin != 0 || cfg.UDPPortMax != 0 {
+		err := s.SetEphemeralUDPPortRange(cfg.UDPPortMin, cfg.UDPPortMax)
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.DSCP != 0 {
+		n, err := newDSCPNet(cfg.DSCP)
+		if err != nil {
+			return err
+		}
+		s.SetNet(n)
+	}
+	if cfg.settings != nil {
+		cfg.settings(&s)
+	}
+	rtcapi := webrtc.NewAPI(webrtc.WithSettingEngine(s))
+
+	// Only keep the URLs, credentials don't belong in diagnostics.
+	c.update(func(d *Diagnostics) {
+		for _, server := range ice {
+			d.ICEServers = append(d.ICEServers, server.URLs...)
+		}
+	})
+
+	policy := webrtc.ICETransportPolicyAll
+	if cfg.RelayOnly || cfg.StrictRelay {
+		if !hasTURN(ice) {
+			return ErrNoRelay
+		}
+		policy = webrtc.ICETransportPolicyRelay
+	}
+
+	var err error
+	c.pc, err = rtcapi.NewPeerConnection(webrtc.Configuration{
+		ICEServers:         ice,
+		ICETransportPolicy: policy,
+	})
+	if err != nil {
+		return err
+	}
+	c.pc.OnICEConnectionStateChange(func(s webrtc.ICEConnectionState) {
+		c.logf("ice connection state: %v", s)
+		c.stateChanged(false)
+	})
+	if policy == webrtc.ICETransportPolicyRelay {
+		// Without a relay candidate there is no pair to check, so ICE
+		// would sit waiting until we time out.
+		c.pc.OnICEGatheringStateChange(func(s webrtc.ICEGathererState) {
+			if s != webrtc.ICEGathererStateComplete || len(sdpCandidates(c.pc.LocalDescription().SDP)) > 0 {
+				return
+			}
+			c.logf("gathered no relay candidates")
+			c.norelayOnce.Do(func() { close(c.norelay) })
+		})
+	}
+	c.pc.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
+		c.logf("connection state: %v", s)
+		// Nothing more will be flushed if the connection is gone.
+		c.flushed()
+	})
+
+	c.writeBuffer = bufferedAmountLowThreshold
+	if cfg.WriteBuffer > 0 {
+		c.writeBuffer = uint64(cfg.WriteBuffer)
+	}
+	return c.newDataChannel(0, cfg.NoDetach)
+}
+
+// newDataChannel creates c's negotiated DataChannel with the given ID.
+func (c *Wormhole) newDataChannel(id uint16, noDetach bool) (err error) {
+	sigh := true
+	c.d, err = c.pc.CreateDataChannel("data", &webrtc.DataChannelInit{
+		Negotiated: &sigh,
+		ID:         &id,
+	})
+	if err != nil {
+		return err
+	}
+	if noDetach {
+		c.messages = newMessageConn(c.d)
+	}
+	c.d.OnOpen(c.open)
+	c.d.OnError(c.error)
+	c.d.OnBufferedAmountLow(c.flushed)
+	c.d.SetBufferedAmountLowThreshold(c.writeBuffer)
+	return nil
+}
+
+// Channel opens another DataChannel with the given ID over the same
+// connection, and returns a Wormhole to use it. The peer must open a
+// channel with the same ID for the two to be connected, and should do so
+// before anything is written to it. ID 0 is the Wormhole's own channel.
+// Closing the returned Wormhole leaves the connection open, but closing
+// this one closes the connection and with it all channels.
+func (c *Wormhole) Channel(id uint16) (*Wormhole, error) {
+	if id == 0 {
+		return nil, errors.New("channel 0 is already open")
+	}
+	select {
+	case <-c.opened:
+	default:
+		return nil, errors.New("wormhole not connected yet")
+	}
+	ch := newWormhole()
+	ch.parent = c
+	ch.pc = c.pc
+	// Share the condition variable so connection state changes wake
+	// up writers on all channels.
+	ch.flushc = c.flushc
+	ch.writeBuffer = c.writeBuffer
+	if c.tunnel != nil {
+		t, err := ch.newTunnel(id)
+		if err != nil {
+			return nil, err
+		}
+		ch.tunnel = t
+	}
+	if err := ch.newDataChannel(id, c.messages != nil); err != nil {
+		return nil, err
+	}
+	select {
+	case <-ch.opened:
+		return ch, nil
+	case err := <-ch.err:
+		ch.d.Close()
+		return nil, err
+	case <-c.done:
+		ch.d.Close()
+		return nil, ErrClosed
+	}
+}
+
+// nominatedPair returns the local and remote candidates of the nominated
+// candidate pair in stats.
+func nominatedPair(stats webrtc.StatsReport) (local, remote webrtc.ICECandidateStats, ok bool) {
+	for _, s := range stats {
+		pairstats, ok := s.(webrtc.ICECandidatePairStats)
+		if !ok {
+			continue
+		}
+		if !pairstats.Nominated {
+			continue
+		}
+		local, ok := stats[pairstats.LocalCandidateID].(webrtc.ICECandidateStats)
+		if !ok {
+			continue
+		}
+		remote, ok := stats[pairstats.RemoteCandidateID].(webrtc.ICECandidateStats)
+		if !ok {
+			continue
+		}
+		return local, remote, true
+	}
+	return local, remote, false
+}
+
+// Metadata returns the metadata the peer sent with the handshake, if any.
+// See Config.Metadata.
+func (c *Wormhole) Metadata() []byte {
+	if c.parent != nil {
+		return c.parent.Metadata()
+	}
+	return c.metadata
+}
+
+// keep derives the keys ExportKeys and ShortAuthString derive theirs from
+// from mk, the secret the peers agreed on with the PAKE, and then zeroes
+// mk, so it isn't held for as long as the connection lasts. It is called
+// once the signalling key has been derived from mk too.
+func (c *Wormhole) keep(mk []byte, created bool) error {
+	defer func() {
+		for i := range mk {
+			mk[i] = 0
+		}
+	}()
+	for _, k := range []struct {
+		key  *[32]byte
+		info string
+	}{
+		{&c.exporter, "webwormhole.io exporter"},
+		{&c.sasKey, "webwormhole.io sas"},
+	} {
+		if _, err := io.ReadFull(hkdf.New(sha256.New, mk, nil, []byte(k.info)), k.key[:]); err != nil {
+			return err
+		}
+	}
+	c.keyed, c.created = true, created
+	return nil
+}
+
+// ExportKeys derives a pair of keys from the secret the peers agreed on
+// with the PAKE, for encrypting data again on top of DTLS, one to send with
+// and one to receive with. The peer gets the same pair the other way round.
+// label keeps keys for different uses apart. They are unrelated to the keys
+// sealing signalling messages.
+func (c *Wormhole) ExportKeys(label string) (send, receive *[32]byte, err error) {
+	if c.parent != nil {
+		return c.parent.ExportKeys(label)
+	}
+	if !c.keyed {
+		return nil, nil, errors.New("no shared secret yet")
+	}
+	derive := func(role string) (*[32]byte, error) {
+		var key [32]byte
+		info := "webwormhole.io export " + label + " " + role
+		_, err := io.ReadFull(hkdf.New(sha256.New, c.exporter[:], nil, []byte(info)), key[:])
+		return &key, err
+	}
+	ours, theirs := "joiner", "creator"
+	if c.created {
+		ours, theirs = theirs, ours
+	}
+	if send, err = derive(ours); err != nil {
+		return nil, nil, err
+	}
+	if receive, err = derive(theirs); err != nil {
+		return nil, nil, err
+	}
+	return send, receive, nil
+}
+
+// MaxMessageSize returns the largest message Write can send. Larger writes
+// fail. pion does not negotiate the size with the peer yet, so it is always
+// 64 KiB, which both pion and browsers take, less the tunnel's overhead if
+// Config.Tunnel is set.
+func (c *Wormhole) MaxMessageSize() int {
+	if c.tunnel != nil {
+		return maxMessageSize - chacha20poly1305.Overhead
+	}
+	return maxMessageSize
+}
+
+// IsRelay returns whether this connection is over a TURN relay or not.
+func (c *Wormhole) IsRelay() bool {
+	local, remote, ok := nominatedPair(c.pc.GetStats())
+	return ok && (remote.CandidateType == webrtc.ICECandidateTypeRelay ||
+		local.CandidateType == webrtc.ICECandidateTypeRelay)
+}
+
+// Route describes the candidate pair the connection uses, e.g.
+// "relay via turn:example.com:3478 (srflx→relay)". It is empty if there is
+// no nominated pair yet.
+func (c *Wormhole) Route() string {
+	local, remote, ok := nominatedPair(c.pc.GetStats())
+	if !ok {
+		return ""
+	}
+	return describePair(local, remote)
+}
+
+func describePair(local, remote webrtc.ICECandidateStats) string {
+	addr := func(s webrtc.ICECandidateStats) string {
+		return net.JoinHostPort(s.IP, strconv.Itoa(int(s.Port)))
+	}
+	types := fmt.Sprintf("(%v→%v)", local.CandidateType, remote.CandidateType)
+	// Prefer our own TURN server, it's the one we know the URL of.
+	for _, s := range []webrtc.ICECandidateStats{local, remote} {
+		if s.CandidateType != webrtc.ICECandidateTypeRelay {
+			continue
+		}
+		server := s.URL
+		if server == "" {
+			server = addr(s)
+		}
+		return fmt.Sprintf("relay via %v %v", server, types)
+	}
+	return fmt.Sprintf("direct %v→%v %v", addr(local), addr(remote), types)
+}
+
+// LocalFingerprint returns the SHA-256 fingerprint of the DTLS certificate
+// this end of the connection uses, as uppercase, colon separated hex like
+// in SDP. Comparing it to the peer's RemoteFingerprint out of band shows
+// no one is in the middle of the WebRTC connection.
+func (c *Wormhole) LocalFingerprint() (string, error) {
+	desc := c.pc.LocalDescription()
+	if desc == nil {
+		return "", ErrNoFingerprint
+	}
+	// Session or media level, we only ever have the one certificate.
+	const prefix = "a=fingerprint:"
+	for _, line := range strings.Split(desc.SDP, "\r\n") {
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+		alg, fp, ok := strings.Cut(line[len(prefix):], " ")
+		if ok && strings.EqualFold(alg, "sha-256") {
+			return strings.ToUpper(fp), nil
+		}
+	}
+	return "", ErrNoFingerprint
+}
+
+// RemoteFingerprint returns the SHA-256 fingerprint of the DTLS certificate
+// the peer presented, in the same format as LocalFingerprint. It is only
+// available once the connection is established.
+func (c *Wormhole) RemoteFingerprint() (string, error) {
+	dtls := c.pc.SCTP().Transport()
+	if dtls == nil {
+		return "", ErrNoFingerprint
+	}
+	cert := dtls.GetRemoteCertificate()
+	if len(cert) == 0 {
+		return "", ErrNoFingerprint
+	}
+	return fingerprint(cert), nil
+}
+
+// fingerprint formats the SHA-256 hash of cert like SDP's a=fingerprint.
+func fingerprint(cert []byte) string {
+	sum := sha256.Sum256(cert)
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hex, ":")
+}
+
+// confirmJoin asks cfg.ConfirmJoin, if set, whether to go ahead with the
+// peer, and turns it away if not. The words it is asked about can't cover
+// the DTLS fingerprints like ShortAuthString's, which aren't known yet.
+// If the peers used different passwords, they differ too.
+func (c *Wormhole) confirmJoin(cfg *Config, ws sigConn) error {
+	if cfg.ConfirmJoin == nil {
+		return nil
+	}
+	sas := make([]byte, sasBytes)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, c.sasKey[:], nil, []byte("webwormhole.io join")), sas); err != nil {
+		return err
+	}
+	if !cfg.ConfirmJoin(wordlist.EncodeBytes(sas)) {
+		c.logf("turning away peer")
+		ws.Close(CloseJoinRejected, "join rejected")
+		return ErrJoinRejected
+	}
+	return nil
+}
+
+// sasBytes is how many words ShortAuthString is. Someone in the middle
+// has to guess all of them to go unnoticed, one in 2^32 tries.
+const sasBytes = 4
+
+// ShortAuthString returns a few words derived from the secret the peers
+// agreed on and the fingerprints of both their DTLS certificates, for the
+// users to read to each other, e.g. over the phone. Both peers get the same
+// words unless someone got between them, having guessed the password or
+// broken DTLS. It is only available once the connection is established.
+func (c *Wormhole) ShortAuthString() (string, error) {
+	if c.parent != nil {
+		return c.parent.ShortAuthString()
+	}
+	if !c.keyed {
+		return "", errors.New("no shared secret yet")
+	}
+	local, err := c.LocalFingerprint()
+	if err != nil {
+		return "", err
+	}
+	remote, err := c.RemoteFingerprint()
+	if err != nil {
+		return "", err
+	}
+	creator, joiner := remote, local
+	if c.created {
+		creator, joiner = joiner, creator
+	}
+	info := "webwormhole.io sas " + creator + " " + joiner
+	sas := make([]byte, sasBytes)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, c.sasKey[:], nil, []byte(info)), sas); err != nil {
+		return "", err
+	}
+	return wordlist.EncodeBytes(sas), nil
+}
+
+// New is equivalent to calling New on a zero Config.
 func New(pass string, sigserv string, slotc chan string) (*Wormhole, error) {
-	c := &Wormhole{
-		opened: make(chan struct{}),
-		err:    make(chan error),
-		flushc: sync.NewCond(&sync.Mutex{}),
+	return (&Config{}).New(pass, sigserv, slotc)
+}
+
+// Join is equivalent to calling Join on a zero Config.
+func Join(slot, pass string, sigserv string) (*Wormhole, error) {
+	return (&Config{}).Join(slot, pass, sigserv)
+}
+
+// rand returns cfg.Rand, or crypto/rand's reader if it is not set.
+func (cfg *Config) rand() io.Reader {
+	if cfg.Rand != nil {
+		return cfg.Rand
 	}
+	return crand.Reader
+}
 
+// contextInfo returns the PAKE context, which binds in the label.
+func (cfg *Config) contextInfo() *cpace.ContextInfo {
+	var ad []byte
+	if cfg.Label != "" {
+		ad = []byte(cfg.Label)
+	}
+	return cpace.NewContextInfo("", "", ad)
+}
+
+// deriveKey derives the key used to seal signalling messages from the PAKE
+// master key mk.
+func (cfg *Config) deriveKey(mk []byte) (key [32]byte, err error) {
+	_, err = io.ReadFull(hkdf.New(sha256.New, mk, cfg.KeySalt, cfg.KeyInfo), key[:])
+	return key, err
+}
+
+// dial opens a connection to the signalling server sigserv, on slot if it
+// is not empty. Failures are DialErrors.
+func (cfg *Config) dial(sigserv, slot string) (sigConn, error) {
+	if cfg.mux != nil {
+		return cfg.mux(sigserv, slot)
+	}
+	ws, err := cfg.dialWebSocket(sigserv, slot, Protocol)
+	if err != nil {
+		return nil, err
+	}
+	return ws, nil
+}
+
+// slotURL returns the WebSocket URL of slot on the signalling server
+// sigserv.
+func slotURL(sigserv, slot string) (*url.URL, error) {
 	u, err := url.Parse(sigserv)
 	if err != nil {
 		return nil, err
@@ -380,99 +1714,210 @@ func New(pass string, sigserv string, slotc chan string) (*Wormhole, error) {
 	} else {
 		u.Scheme = "wss"
 	}
+	// Any path is the namespace slots are kept in on the server.
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	u.Path += slot
+	return u, nil
+}
+
+// dialWebSocket opens a WebSocket speaking protocol to the signalling
+// server sigserv, on slot if it is not empty. Failures are DialErrors.
+func (cfg *Config) dialWebSocket(sigserv, slot, protocol string) (*websocket.Conn, error) {
+	u, err := slotURL(sigserv, slot)
+	if err != nil {
+		return nil, &DialError{sigserv, err}
+	}
 	wsaddr := u.String()
 
+	client := cfg.client
+	if client == nil {
+		client = httpClient(cfg.Proxy, cfg.tlsConfig())
+	}
+	compression := websocket.CompressionDisabled
+	if cfg.Compress {
+		compression = websocket.CompressionNoContextTakeover
+	}
 	ws, _, err := websocket.Dial(context.TODO(), wsaddr, &websocket.DialOptions{
-		Subprotocols: []string{Protocol},
+		HTTPClient:      client,
+		HTTPHeader:      http.Header{"User-Agent": {UserAgent}},
+		Subprotocols:    []string{protocol},
+		CompressionMode: compression,
 	})
 	if err != nil {
-		return nil, err
+		return nil, &DialError{sigserv, err}
+	}
+	return ws, nil
+}
+
+// tlsConfig returns the TLS configuration for the signalling server, which
+// is TLSConfig with SignalCertFingerprint enforced if it is set.
+func (cfg *Config) tlsConfig() *tls.Config {
+	if cfg.SignalCertFingerprint == nil {
+		return cfg.TLSConfig
+	}
+	tlsConfig := &tls.Config{}
+	if cfg.TLSConfig != nil {
+		tlsConfig = cfg.TLSConfig.Clone()
+	}
+	pin := cfg.SignalCertFingerprint
+	// Unlike VerifyPeerCertificate, VerifyConnection is also called when
+	// a session is resumed, which would otherwise skip the pin.
+	verify := tlsConfig.VerifyConnection
+	tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+		if verify != nil {
+			if err := verify(cs); err != nil {
+				return err
+			}
+		}
+		if len(cs.PeerCertificates) == 0 {
+			return ErrCertMismatch
+		}
+		cert := cs.PeerCertificates[0]
+		certSum := sha256.Sum256(cert.Raw)
+		keySum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		if subtle.ConstantTimeCompare(pin, certSum[:]) != 1 &&
+			subtle.ConstantTimeCompare(pin, keySum[:]) != 1 {
+			return ErrCertMismatch
+		}
+		return nil
+	}
+	return tlsConfig
+}
+
+// New starts a new signalling handshake after asking the server to allocate
+// a new slot.
+//
+// The slot is used to synchronise with the remote peer on signalling server
+// sigserv, and pass is used as the PAKE password authenticate the WebRTC
+// offer and answer.
+//
+// The server generated slot identifier is written on slotc.
+//
+// If the handshake fails, New returns a nil Wormhole. Config.Failed can
+// be used to see what went wrong.
+func (cfg *Config) New(pass string, sigserv string, slotc chan string) (*Wormhole, error) {
+	return cfg.NewContext(context.Background(), pass, sigserv, slotc)
+}
+
+// NewContext is like New, but gives up waiting for a peer to join the slot
+// when ctx is done. The slot is released and ctx.Err() is returned.
+func (cfg *Config) NewContext(ctx context.Context, pass string, sigserv string, slotc chan string) (*Wormhole, error) {
+	c := newWormhole()
+	c.failed = cfg.Failed
+	c.startTrace(ctx, cfg, "wormhole.new")
+	if len(cfg.Metadata) > MaxMetadataSize {
+		return c.fail(ErrMetadataTooLarge)
+	}
+
+	c.traceStep(SpanSlot)
+	ws, err := cfg.dial(sigserv, "")
+	if err != nil {
+		return c.fail(err)
 	}
 
-	assignedSlot, iceServers, err := readInitMsg(ws)
+	initmsg, err := readInitMsg(ws)
 	if websocket.CloseStatus(err) == CloseWrongProto {
-		return nil, ErrBadVersion
+		return c.fail(ErrBadVersion)
 	}
 	if err != nil {
-		return nil, err
+		return c.fail(err)
+	}
+	if err := checkPass(pass, initmsg); err != nil {
+		ws.Close(websocket.StatusNormalClosure, "password too short")
+		return c.fail(err)
 	}
-	logf("connected to signalling server, got slot: %v", assignedSlot)
-	slotc <- assignedSlot
-	err = c.newPeerConnection(iceServers)
+	c.logf("connected to signalling server, got slot: %v", initmsg.Slot)
+	slotc <- initmsg.Slot
+	err = c.newPeerConnection(cfg, cfg.iceServers(initmsg.ICEServers))
 	if err != nil {
-		return nil, err
+		return c.fail(err)
 	}
 
-	msgA, err := readBase64(ws)
+	// Wait for the peer to join and start the handshake.
+	c.traceStep(SpanWait)
+	msgA, err := readBase64(ctx, ws)
+	if err != nil && ctx.Err() != nil {
+		return c.fail(ctx.Err())
+	}
+	if err != nil && slotLost(err) {
+		c.logf("lost connection to signalling server while waiting: %v", err)
+		return c.fail(ErrSlotLost)
+	}
 	if err != nil {
-		return nil, err
+		return c.fail(err)
 	}
-	logf("got A pake msg (%v bytes)", len(msgA))
+	c.logf("got A pake msg (%v bytes)", len(msgA))
 
-	msgB, mk, err := cpace.Exchange(pass, cpace.NewContextInfo("", "", nil), msgA)
+	c.traceStep(SpanPAKE)
+	msgB, mk, err := cpace.Exchange(pass, cfg.contextInfo(), msgA)
 	if err != nil {
-		return nil, err
+		return c.fail(err)
 	}
-	key := [32]byte{}
-	_, err = io.ReadFull(hkdf.New(sha256.New, mk, nil, nil), key[:])
+	key, err := cfg.deriveKey(mk)
 	if err != nil {
-		return nil, err
+		return c.fail(err)
+	}
+	if err := c.keep(mk, true); err != nil {
+		return c.fail(err)
 	}
 	err = writeBase64(ws, msgB)
 	if err != nil {
-		return nil, err
+		return c.fail(err)
+	}
+	c.logf("have key, sent B pake msg (%v bytes)", len(msgB))
+	if err := c.confirmJoin(cfg, ws); err != nil {
+		return c.fail(err)
 	}
-	logf("have key, sent B pake msg (%v bytes)", len(msgB))
 
-	c.pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
-		if candidate == nil {
-			return
-		}
-		err := writeEncJSON(ws, &key, candidate.ToJSON())
-		if websocket.CloseStatus(err) == websocket.StatusNormalClosure {
-			return
-		}
-		if err != nil {
-			logf("cannot send local candidate: %v", err)
-			return
-		}
-		logf("sent new local candidate: %v", candidate.String())
-	})
+	c.traceStep(SpanOffer)
+	c.sendLocalCandidates(cfg, ws, &key)
 
 	offer, err := c.pc.CreateOffer(nil)
 	if err != nil {
-		return nil, err
-	}
-	err = writeEncJSON(ws, &key, offer)
-	if err != nil {
-		return nil, err
+		return c.fail(err)
 	}
-	err = c.pc.SetLocalDescription(offer)
+	err = c.setLocalDescription(cfg, ws, &key, offer)
 	if err != nil {
-		return nil, err
+		return c.fail(err)
 	}
-	logf("sent offer")
+	c.logf("sent offer")
 
-	var answer webrtc.SessionDescription
-	err = readEncJSON(ws, &key, &answer)
+	answer, err := c.readDescription(cfg, ws, &key)
 	if websocket.CloseStatus(err) == CloseBadKey {
-		return nil, ErrBadKey
+		return c.fail(ErrBadKey)
+	}
+	if websocket.CloseStatus(err) == CloseJoinRejected {
+		return c.fail(ErrJoinRejected)
+	}
+	if websocket.CloseStatus(err) == CloseTunnelMismatch {
+		return c.fail(ErrTunnelMismatch)
+	}
+	if err == ErrTunnelMismatch {
+		ws.Close(CloseTunnelMismatch, "tunnel mismatch")
 	}
 	if err != nil {
-		return nil, err
+		return c.fail(err)
 	}
-	err = c.pc.SetRemoteDescription(answer)
+	err = c.setRemoteDescription(answer)
 	if err != nil {
-		return nil, err
+		return c.fail(err)
 	}
-	logf("got answer")
+	c.logf("got answer")
 
-	go c.handleRemoteCandidates(ws, &key)
+	c.traceStep(SpanConnect)
+	go c.handleRemoteCandidates(cfg, ws, &key)
 
 	select {
 	case <-c.opened:
+		if cfg.KeepSignalling {
+			c.logf("webrtc connection succeeded (relay: %v) keeping signalling channel", c.IsRelay())
+			c.ws, c.cfg, c.key = ws, cfg, key
+			break
+		}
 		relay := c.IsRelay()
-		logf("webrtc connection succeeded (relay: %v) closing signalling channel", relay)
+		c.logf("webrtc connection succeeded (relay: %v) closing signalling channel", relay)
 		if relay {
 			ws.Close(CloseWebRTCSuccessRelay, "")
 		} else {
@@ -480,11 +1925,18 @@ func New(pass string, sigserv string, slotc chan string) (*Wormhole, error) {
 		}
 	case err = <-c.err:
 		ws.Close(CloseWebRTCFailed, "")
+	case <-c.norelay:
+		err = ErrNoRelayCandidate
+		ws.Close(CloseWebRTCFailed, "no relay candidate")
 	case <-time.After(30 * time.Second):
-		err = ErrTimedOut
+		err = c.timeoutError()
 		ws.Close(CloseWebRTCFailed, "timed out")
 	}
-	return c, err
+	if err != nil {
+		return c.fail(err)
+	}
+	c.traceStep(SpanTransfer)
+	return c, nil
 }
 
 // Join performs the signalling handshake to join an existing slot.
@@ -493,45 +1945,43 @@ func New(pass string, sigserv string, slotc chan string) (*Wormhole, error) {
 // sigserv, and pass is used as the PAKE password authenticate the WebRTC
 // offer and answer.
 //
-// If pc is nil it initialises ones using the default STUN server.
-func Join(slot, pass string, sigserv string) (*Wormhole, error) {
-	c := &Wormhole{
-		opened: make(chan struct{}),
-		err:    make(chan error),
-		flushc: sync.NewCond(&sync.Mutex{}),
+// As with New, a failed Join returns a nil Wormhole.
+func (cfg *Config) Join(slot, pass string, sigserv string) (*Wormhole, error) {
+	c := newWormhole()
+	c.failed = cfg.Failed
+	c.startTrace(context.Background(), cfg, "wormhole.join")
+	if len(cfg.Metadata) > MaxMetadataSize {
+		return c.fail(ErrMetadataTooLarge)
 	}
 
-	u, err := url.Parse(sigserv)
-	if err != nil {
-		return nil, err
-	}
-	if u.Scheme == "http" || u.Scheme == "ws" {
-		u.Scheme = "ws"
-	} else {
-		u.Scheme = "wss"
-	}
-	u.Path += slot
-	wsaddr := u.String()
-
 	// Start the handshake.
-	ws, _, err := websocket.Dial(context.TODO(), wsaddr, &websocket.DialOptions{
-		Subprotocols: []string{Protocol},
-	})
+	c.traceStep(SpanSlot)
+	ws, err := cfg.dial(sigserv, slot)
 	if err != nil {
-		return nil, err
+		return c.fail(err)
 	}
 
-	_, iceServers, err := readInitMsg(ws)
+	initmsg, err := readInitMsg(ws)
 	if websocket.CloseStatus(err) == CloseWrongProto {
-		return nil, ErrBadVersion
+		return c.fail(ErrBadVersion)
+	}
+	if websocket.CloseStatus(err) == CloseNoSuchSlot {
+		return c.fail(ErrNoSuchSlot)
+	}
+	if websocket.CloseStatus(err) == CloseSlotTaken {
+		return c.fail(ErrSlotTaken)
 	}
 	if err != nil {
-		return nil, err
+		return c.fail(err)
 	}
-	logf("connected to signalling server on slot: %v", slot)
-	err = c.newPeerConnection(iceServers)
+	if err := checkPass(pass, initmsg); err != nil {
+		ws.Close(websocket.StatusNormalClosure, "password too short")
+		return c.fail(err)
+	}
+	c.logf("connected to signalling server on slot: %v", slot)
+	err = c.newPeerConnection(cfg, cfg.iceServers(initmsg.ICEServers))
 	if err != nil {
-		return nil, err
+		return c.fail(err)
 	}
 
 	// The identity arguments are to bind endpoint identities in PAKE. Cf. Unknown
@@ -544,85 +1994,87 @@ func Join(slot, pass string, sigserv string) (*Wormhole, error) {
 	//   b) A peer only gets one guess.
 	// An unintended destination is likely going to fail PAKE.
 
-	msgA, pake, err := cpace.Start(pass, cpace.NewContextInfo("", "", nil))
+	c.traceStep(SpanPAKE)
+	msgA, pake, err := cpace.Start(pass, cfg.contextInfo())
 	if err != nil {
-		return nil, err
+		return c.fail(err)
 	}
 	err = writeBase64(ws, msgA)
 	if err != nil {
-		return nil, err
+		return c.fail(err)
 	}
-	logf("sent A pake msg (%v bytes)", len(msgA))
+	c.logf("sent A pake msg (%v bytes)", len(msgA))
 
-	msgB, err := readBase64(ws)
+	msgB, err := readBase64(context.TODO(), ws)
 	if websocket.CloseStatus(err) == CloseWrongProto {
-		return nil, ErrBadVersion
+		return c.fail(ErrBadVersion)
 	}
 	if err != nil {
-		return nil, err
+		return c.fail(err)
 	}
 	mk, err := pake.Finish(msgB)
 	if err != nil {
-		return nil, err
+		return c.fail(err)
 	}
-	key := [32]byte{}
-	_, err = io.ReadFull(hkdf.New(sha256.New, mk, nil, nil), key[:])
+	key, err := cfg.deriveKey(mk)
 	if err != nil {
-		return nil, err
+		return c.fail(err)
+	}
+	if err := c.keep(mk, false); err != nil {
+		return c.fail(err)
+	}
+	c.logf("have key, got B msg (%v bytes)", len(msgB))
+	if err := c.confirmJoin(cfg, ws); err != nil {
+		return c.fail(err)
 	}
-	logf("have key, got B msg (%v bytes)", len(msgB))
 
-	var offer webrtc.SessionDescription
-	err = readEncJSON(ws, &key, &offer)
-	if err == ErrBadKey {
+	c.traceStep(SpanAnswer)
+	offer, err := c.readDescription(cfg, ws, &key)
+	if websocket.CloseStatus(err) == CloseJoinRejected {
+		return c.fail(ErrJoinRejected)
+	}
+	if err == ErrBadKey || err == ErrCipherMismatch {
 		// Close with the right status so the other side knows to quit immediately.
 		ws.Close(CloseBadKey, "bad key")
-		return nil, err
+		return c.fail(err)
+	}
+	if err == ErrTunnelMismatch {
+		ws.Close(CloseTunnelMismatch, "tunnel mismatch")
+		return c.fail(err)
 	}
 	if err != nil {
-		return nil, err
+		return c.fail(err)
 	}
 
-	c.pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
-		if candidate == nil {
-			return
-		}
-		err := writeEncJSON(ws, &key, candidate.ToJSON())
-		if websocket.CloseStatus(err) == websocket.StatusNormalClosure {
-			return
-		}
-		if err != nil {
-			logf("cannot send local candidate: %v", err)
-			return
-		}
-		logf("sent new local candidate: %v", candidate.String())
-	})
+	c.sendLocalCandidates(cfg, ws, &key)
 
-	err = c.pc.SetRemoteDescription(offer)
+	err = c.setRemoteDescription(offer)
 	if err != nil {
-		return nil, err
+		return c.fail(err)
 	}
-	logf("got offer")
+	c.logf("got offer")
 	answer, err := c.pc.CreateAnswer(nil)
 	if err != nil {
-		return nil, err
+		return c.fail(err)
 	}
-	err = writeEncJSON(ws, &key, answer)
+	err = c.setLocalDescription(cfg, ws, &key, answer)
 	if err != nil {
-		return nil, err
+		return c.fail(err)
 	}
-	err = c.pc.SetLocalDescription(answer)
-	if err != nil {
-		return nil, err
-	}
-	logf("sent answer")
+	c.logf("sent answer")
 
-	go c.handleRemoteCandidates(ws, &key)
+	c.traceStep(SpanConnect)
+	go c.handleRemoteCandidates(cfg, ws, &key)
 
 	select {
 	case <-c.opened:
+		if cfg.KeepSignalling {
+			c.logf("webrtc connection succeeded (relay: %v) keeping signalling channel", c.IsRelay())
+			c.ws, c.cfg, c.key = ws, cfg, key
+			break
+		}
 		relay := c.IsRelay()
-		logf("webrtc connection succeeded (relay: %v) closing signalling channel", relay)
+		c.logf("webrtc connection succeeded (relay: %v) closing signalling channel", relay)
 		if relay {
 			ws.Close(CloseWebRTCSuccessRelay, "")
 		} else {
@@ -630,9 +2082,16 @@ func Join(slot, pass string, sigserv string) (*Wormhole, error) {
 		}
 	case err = <-c.err:
 		ws.Close(CloseWebRTCFailed, "")
+	case <-c.norelay:
+		err = ErrNoRelayCandidate
+		ws.Close(CloseWebRTCFailed, "no relay candidate")
 	case <-time.After(30 * time.Second):
-		err = ErrTimedOut
+		err = c.timeoutError()
 		ws.Close(CloseWebRTCFailed, "timed out")
 	}
-	return c, err
+	if err != nil {
+		return c.fail(err)
+	}
+	c.traceStep(SpanTransfer)
+	return c, nil
 }
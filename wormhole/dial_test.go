@@ -0,0 +1,1400 @@
+package wormhole
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	webrtc "github.com/pion/webrtc/v3"
+	"nhooyr.io/websocket"
+	"webwormhole.io/wordlist"
+)
+
+// gather returns the local candidates gathered for a PeerConnection set up
+// with cfg and ice.
+func gather(t *testing.T, cfg *Config, ice ...webrtc.ICEServer) []string {
+	t.Helper()
+	c := newWormhole()
+	if err := c.newPeerConnection(cfg, ice); err != nil {
+		t.Fatal(err)
+	}
+	defer c.pc.Close()
+	offer, err := c.pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(c.pc)
+	if err := c.pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	var candidates []string
+	for _, line := range strings.Split(c.pc.LocalDescription().SDP, "\r\n") {
+		if strings.HasPrefix(line, "a=candidate:") {
+			candidates = append(candidates, line)
+		}
+	}
+	return candidates
+}
+
+func TestIgnoreServerICE(t *testing.T) {
+	offered := []webrtc.ICEServer{{URLs: []string{"turn:relay.example.com"}, Username: "user", Credential: "pass"}}
+	own := []webrtc.ICEServer{{URLs: []string{"stun:stun.example.com"}}}
+	for _, tt := range []struct {
+		cfg  *Config
+		want []string
+	}{
+		{&Config{}, []string{"turn:relay.example.com"}},
+		{&Config{ICEServers: own}, []string{"stun:stun.example.com", "turn:relay.example.com"}},
+		{&Config{ICEServers: own, IgnoreServerICE: true}, []string{"stun:stun.example.com"}},
+		{&Config{IgnoreServerICE: true}, nil},
+	} {
+		c := newWormhole()
+		if err := c.newPeerConnection(tt.cfg, tt.cfg.iceServers(offered)); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, s := range c.pc.GetConfiguration().ICEServers {
+			got = append(got, s.URLs...)
+		}
+		c.pc.Close()
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ignore %v: got ICE servers %v want %v", tt.cfg.IgnoreServerICE, got, tt.want)
+		}
+	}
+
+	// Nor is the server's relay any use to RelayOnly.
+	cfg := &Config{RelayOnly: true, IgnoreServerICE: true}
+	if err := newWormhole().newPeerConnection(cfg, cfg.iceServers(offered)); err != ErrNoRelay {
+		t.Errorf("got %v want %v", err, ErrNoRelay)
+	}
+}
+
+func TestRelayOnly(t *testing.T) {
+	if err := newWormhole().newPeerConnection(&Config{RelayOnly: true}, []webrtc.ICEServer{
+		{URLs: []string{"stun:127.0.0.1:1"}},
+	}); err != ErrNoRelay {
+		t.Errorf("got %v want %v", err, ErrNoRelay)
+	}
+
+	// The TURN server doesn't exist, so we get no candidates at all, but
+	// what matters is that there are no others.
+	candidates := gather(t, &Config{RelayOnly: true}, webrtc.ICEServer{
+		URLs:       []string{"stun:127.0.0.1:1", "turn:127.0.0.1:1?transport=tcp"},
+		Username:   "user",
+		Credential: "pass",
+	})
+	for _, candidate := range candidates {
+		if !strings.Contains(candidate, " typ relay") {
+			t.Errorf("got non-relay candidate %v", candidate)
+		}
+	}
+
+	// With a TURN server that works, the peers connect through it even
+	// though they could reach each other directly.
+	cfg := &Config{RelayOnly: true, ICEServers: []webrtc.ICEServer{turnServer(t)}}
+	a, b, erra, errb := signalPair(t, cfg, cfg)
+	if erra != nil || errb != nil {
+		t.Fatal(erra, errb)
+	}
+	defer a.Close()
+	defer b.Close()
+	for _, c := range []*Wormhole{a, b} {
+		local, remote, ok := nominatedPair(c.pc.GetStats())
+		if !ok {
+			t.Fatal("no nominated candidate pair")
+		}
+		if local.CandidateType != webrtc.ICECandidateTypeRelay || remote.CandidateType != webrtc.ICECandidateTypeRelay {
+			t.Errorf("connected over %v→%v want relay→relay", local.CandidateType, remote.CandidateType)
+		}
+		if !c.IsRelay() {
+			t.Error("IsRelay is false")
+		}
+	}
+}
+
+func TestKeep(t *testing.T) {
+	mk := []byte("shared secret from the pake")
+	a, b := newWormhole(), newWormhole()
+	if _, _, err := a.ExportKeys("test"); err == nil {
+		t.Error("exported keys before the pake")
+	}
+	if err := a.keep(append([]byte(nil), mk...), true); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.keep(mk, false); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(mk, make([]byte, len(mk))) {
+		t.Errorf("secret left as %q", mk)
+	}
+	sa, ra, err := a.ExportKeys("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, rb, err := b.ExportKeys("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *sa != *rb || *sb != *ra || *sa == *sb {
+		t.Error("peers derived mismatched keys")
+	}
+}
+
+func TestStrictRelay(t *testing.T) {
+	// The TURN server doesn't exist, so there is no relay candidate to
+	// connect over. The connection has to fail rather than fall back on
+	// anything else.
+	var mu sync.Mutex
+	var failed []*Diagnostics
+	cfg := &Config{
+		StrictRelay: true,
+		ICEServers: []webrtc.ICEServer{{
+			URLs:       []string{"turn:127.0.0.1:1?transport=tcp"},
+			Username:   "user",
+			Credential: "pass",
+		}},
+		Failed: func(d *Diagnostics) {
+			mu.Lock()
+			failed = append(failed, d)
+			mu.Unlock()
+		},
+	}
+	start := time.Now()
+	a, b, erra, errb := signalPair(t, cfg, cfg)
+	if a != nil || b != nil || erra != ErrNoRelayCandidate && errb != ErrNoRelayCandidate {
+		t.Fatalf("got %v, %v want %v", erra, errb, ErrNoRelayCandidate)
+	}
+	if d := time.Since(start); d > 20*time.Second {
+		t.Errorf("took %v to give up, as if waiting to time out", d)
+	}
+	if len(failed) != 2 {
+		t.Fatalf("got %d failed diagnostics want 2", len(failed))
+	}
+	for _, d := range failed {
+		if len(d.LocalCandidates) > 0 {
+			t.Errorf("gathered candidates %q", d.LocalCandidates)
+		}
+	}
+
+	// Had any candidate but a relay one been about to go out, it would
+	// have been the reason to give up.
+	candidates := []string{
+		"candidate:4 1 udp 16777215 198.51.100.1 3478 typ relay raddr 0.0.0.0 rport 0",
+		"candidate:1 1 udp 2130706431 192.168.1.2 50000 typ host",
+	}
+	if typ := exposedType(cfg, candidates); typ != "host" {
+		t.Errorf("got exposed type %q want host", typ)
+	}
+	if typ := exposedType(cfg, candidates[:1]); typ != "" {
+		t.Errorf("got exposed type %q for a relay candidate", typ)
+	}
+	if typ := exposedType(&Config{RelayOnly: true}, candidates); typ != "" {
+		t.Errorf("got exposed type %q without StrictRelay", typ)
+	}
+}
+
+func TestCandidateTypes(t *testing.T) {
+	sdp := "v=0\r\n" +
+		"a=candidate:1 1 udp 2130706431 192.168.1.2 50000 typ host\r\n" +
+		"a=candidate:2 1 tcp 1671430143 192.168.1.2 9 typ host tcptype active\r\n" +
+		"a=candidate:3 1 udp 1694498815 203.0.113.7 50000 typ srflx raddr 192.168.1.2 rport 50000\r\n" +
+		"a=end-of-candidates\r\n"
+	candidates := append(sdpCandidates(sdp),
+		"candidate:4 1 udp 16777215 198.51.100.1 3478 typ relay raddr 0.0.0.0 rport 0",
+		"",
+	)
+	if len(candidates) != 5 || candidates[0] != "candidate:1 1 udp 2130706431 192.168.1.2 50000 typ host" {
+		t.Fatalf("got candidates %q", candidates)
+	}
+	got := CandidateTypes(candidates)
+	want := map[string]int{"host": 2, "srflx": 1, "relay": 1}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+}
+
+func TestNeedTURN(t *testing.T) {
+	// Both peers behind symmetric NATs: the server reflexive addresses
+	// STUN saw aren't the ones the peer's checks would reach.
+	local := []string{
+		"candidate:1 1 udp 2130706431 192.168.1.2 50000 typ host",
+		"candidate:2 1 udp 1694498815 203.0.113.7 61000 typ srflx raddr 192.168.1.2 rport 50000",
+	}
+	remote := []string{
+		"candidate:1 1 udp 2130706431 10.0.0.2 50000 typ host",
+		"candidate:2 1 udp 1694498815 198.51.100.9 62000 typ srflx raddr 10.0.0.2 rport 50000",
+	}
+	relay := "candidate:3 1 udp 16777215 192.0.2.1 3478 typ relay raddr 0.0.0.0 rport 0"
+	complete, gathering := webrtc.ICEGatheringStateComplete, webrtc.ICEGatheringStateGathering
+	checking, failed, connected := webrtc.ICEConnectionStateChecking, webrtc.ICEConnectionStateFailed, webrtc.ICEConnectionStateConnected
+	for _, tt := range []struct {
+		name          string
+		gathering     webrtc.ICEGatheringState
+		ice           webrtc.ICEConnectionState
+		local, remote []string
+		want          bool
+	}{
+		{"symmetric", complete, failed, local, remote, true},
+		{"still checking", complete, checking, local, remote, true},
+		{"still gathering", gathering, checking, local, remote, false},
+		{"connected", complete, connected, local, remote, false},
+		{"local relay", complete, failed, append(local, relay), remote, false},
+		{"remote relay", complete, failed, local, append(remote, relay), false},
+		{"no remote candidates", complete, checking, local, nil, false},
+	} {
+		if got := needTURN(tt.gathering, tt.ice, tt.local, tt.remote); got != tt.want {
+			t.Errorf("%s: got %v want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUDPPortRange(t *testing.T) {
+	candidates := gather(t, &Config{UDPPortMin: 50000, UDPPortMax: 50010})
+	if len(candidates) == 0 {
+		t.Skip("no local candidates")
+	}
+	for _, candidate := range candidates {
+		// a=candidate:foundation component protocol priority address port typ ...
+		f := strings.Fields(candidate)
+		if len(f) < 6 || !strings.EqualFold(f[2], "udp") {
+			continue
+		}
+		port, err := strconv.Atoi(f[5])
+		if err != nil {
+			t.Fatalf("bad candidate %v", candidate)
+		}
+		if port < 50000 || port > 50010 {
+			t.Errorf("candidate port %v out of range: %v", port, candidate)
+		}
+	}
+
+	err := newWormhole().newPeerConnection(&Config{UDPPortMin: 50010, UDPPortMax: 50000}, nil)
+	if err == nil {
+		t.Error("inverted port range accepted")
+	}
+}
+
+func TestCandidateFilter(t *testing.T) {
+	if len(gather(t, &Config{})) == 0 {
+		t.Skip("no local candidates to filter")
+	}
+
+	candidates := gather(t, &Config{
+		InterfaceFilter: func(string) bool { return false },
+	})
+	if len(candidates) != 0 {
+		t.Errorf("got candidates from filtered interfaces: %v", candidates)
+	}
+
+	candidates = gather(t, &Config{
+		IPFilter: func(net.IP) bool { return false },
+	})
+	if len(candidates) != 0 {
+		t.Errorf("got candidates from filtered addresses: %v", candidates)
+	}
+}
+
+// pair returns two Wormholes connected to each other directly, without a
+// signalling server.
+func pair(t *testing.T) (a, b *Wormhole) {
+	t.Helper()
+	return pairConfig(t, &Config{})
+}
+
+// pairConfig is like pair, but sets up both Wormholes with cfg.
+func pairConfig(t testing.TB, cfg *Config) (a, b *Wormhole) {
+	t.Helper()
+	a, b = newWormhole(), newWormhole()
+	for _, c := range []*Wormhole{a, b} {
+		if err := c.newPeerConnection(cfg, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Skip trickling by waiting for all candidates before exchanging
+	// descriptions.
+	settle := func(c *Wormhole, sd webrtc.SessionDescription, err error) webrtc.SessionDescription {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		gathered := webrtc.GatheringCompletePromise(c.pc)
+		if err := c.pc.SetLocalDescription(sd); err != nil {
+			t.Fatal(err)
+		}
+		<-gathered
+		return *c.pc.LocalDescription()
+	}
+	offer, err := a.pc.CreateOffer(nil)
+	offer = settle(a, offer, err)
+	if err := b.pc.SetRemoteDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := b.pc.CreateAnswer(nil)
+	answer = settle(b, answer, err)
+	if err := a.pc.SetRemoteDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []*Wormhole{a, b} {
+		select {
+		case <-c.opened:
+		case err := <-c.err:
+			t.Fatal(err)
+		case <-time.After(10 * time.Second):
+			t.Skip("could not connect peers locally")
+		}
+	}
+	return a, b
+}
+
+func TestCloseTwice(t *testing.T) {
+	a, b := pair(t)
+	defer b.Close()
+	if err := a.Close(); err != nil {
+		t.Fatalf("first close: %v", err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("second close: %v", err)
+	}
+	if _, err := a.Write([]byte("hello")); err != ErrClosed {
+		t.Errorf("write after close got %v want %v", err, ErrClosed)
+	}
+}
+
+func TestCloseConcurrent(t *testing.T) {
+	a, b := pair(t)
+	defer b.Close()
+
+	// Keep the buffers full so writes block waiting for them to drain.
+	written := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 32<<10)
+		for {
+			if _, err := a.Write(buf); err != nil {
+				written <- err
+				return
+			}
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.Close()
+		}()
+	}
+	select {
+	case <-written:
+	case <-time.After(10 * time.Second):
+		t.Fatal("pending write did not fail after close")
+	}
+	wg.Wait()
+}
+
+// candidates sets c's local description to sd, and returns the candidates
+// gathered for it.
+func candidates(t *testing.T, c *Wormhole, sd webrtc.SessionDescription) []webrtc.ICECandidateInit {
+	t.Helper()
+	var gathered []webrtc.ICECandidateInit
+	done := make(chan struct{})
+	c.pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			close(done)
+			return
+		}
+		gathered = append(gathered, candidate.ToJSON())
+	})
+	if err := c.pc.SetLocalDescription(sd); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	return gathered
+}
+
+func TestEarlyCandidates(t *testing.T) {
+	a, b := newWormhole(), newWormhole()
+	for _, c := range []*Wormhole{a, b} {
+		if err := c.newPeerConnection(&Config{}, nil); err != nil {
+			t.Fatal(err)
+		}
+		defer c.pc.Close()
+	}
+
+	// The descriptions are created before gathering starts, so the only
+	// way each side learns the other's candidates is if early ones are
+	// kept until the description is set.
+	offer, err := a.pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acands := candidates(t, a, offer)
+	if len(acands) == 0 {
+		t.Skip("no local candidates")
+	}
+	for _, candidate := range acands {
+		if err := b.addRemoteCandidate(candidate); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(b.pending) != len(acands) {
+		t.Fatalf("got %v pending candidates want %v", len(b.pending), len(acands))
+	}
+	if err := b.setRemoteDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.pending) != 0 {
+		t.Fatalf("%v candidates still pending after setting description", len(b.pending))
+	}
+
+	answer, err := b.pc.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, candidate := range candidates(t, b, answer) {
+		if err := a.addRemoteCandidate(candidate); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.setRemoteDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []*Wormhole{a, b} {
+		select {
+		case <-c.opened:
+		case err := <-c.err:
+			t.Fatal(err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("peers did not connect using early candidates")
+		}
+	}
+}
+
+func TestFixedRand(t *testing.T) {
+	seal := func() (string, [32]byte) {
+		cfg := &Config{Rand: mrand.New(mrand.NewSource(1))}
+		key, err := cfg.deriveKey([]byte("master key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := sealJSON(cfg, &key, map[string]string{"hello": "world"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg, key
+	}
+
+	msg, key := seal()
+	if got, want := hex.EncodeToString(key[:]), "db0c3400aeba0820334034237b7007f8b4921dbc8e34b23ad66afaeb960e3df8"; got != want {
+		t.Errorf("got key %v want %v", got, want)
+	}
+	if want := "Uv38ByGCZU8WP18PmmIdcpVmx00QA3xNHOGueUyRJpGgL3wq5Rs16O4N7AA1D3KbSvYqVpoAYvAz"; msg != want {
+		t.Errorf("got sealed message %v want %v", msg, want)
+	}
+	if again, _ := seal(); again != msg {
+		t.Errorf("same seed sealed %v then %v", msg, again)
+	}
+
+	var v map[string]string
+	if err := openJSON(&Config{}, &key, msg, &v); err != nil || v["hello"] != "world" {
+		t.Errorf("could not open sealed message: %v, %v", v, err)
+	}
+	if err := openJSON(&Config{}, &key, "c2hvcnQ=", &v); err != ErrBadKey {
+		t.Errorf("opening a short message got %v want %v", err, ErrBadKey)
+	}
+}
+
+func TestSmallReads(t *testing.T) {
+	a, b := pair(t)
+	defer a.Close()
+	defer b.Close()
+
+	big := make([]byte, 40<<10)
+	mrand.New(mrand.NewSource(1)).Read(big)
+	for _, msg := range [][]byte{big, []byte("abc"), []byte("def")} {
+		if _, err := a.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := make([]byte, 0, len(big))
+	buf := make([]byte, 100)
+	for len(got) < len(big) {
+		n, err := b.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if !bytes.Equal(got, big) {
+		t.Fatal("large message read in small pieces differs")
+	}
+
+	// Reads still stop at message boundaries.
+	buf = make([]byte, 2)
+	for _, want := range []string{"ab", "c", "de", "f"} {
+		n, err := b.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != want {
+			t.Errorf("got %q want %q", buf[:n], want)
+		}
+	}
+}
+
+func TestCompressedSeal(t *testing.T) {
+	var key [32]byte
+	offer := webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  strings.Repeat("a=candidate:1 1 udp 2130706431 192.0.2.1 50000 typ host\r\n", 20),
+	}
+	plain, err := sealJSON(&Config{}, &key, offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := sealJSON(&Config{CompressSDP: true}, &key, offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compressed) >= len(plain) {
+		t.Errorf("compressed message is %v bytes, uncompressed %v", len(compressed), len(plain))
+	}
+	for _, msg := range []string{plain, compressed} {
+		var got webrtc.SessionDescription
+		if err := openJSON(&Config{}, &key, msg, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got != offer {
+			t.Errorf("got %+v want %+v", got, offer)
+		}
+	}
+}
+
+func TestCipher(t *testing.T) {
+	key := [32]byte{1, 2, 3}
+	ciphers := []string{"", CipherSecretbox, CipherXChaCha20Poly1305}
+	for _, sealer := range ciphers {
+		msg, err := sealJSON(&Config{Cipher: sealer}, &key, map[string]string{"hello": "world"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, opener := range ciphers {
+			var v map[string]string
+			err := openJSON(&Config{Cipher: opener}, &key, msg, &v)
+			same := sealer == opener || sealer != CipherXChaCha20Poly1305 && opener != CipherXChaCha20Poly1305
+			switch {
+			case same && (err != nil || v["hello"] != "world"):
+				t.Errorf("%q to %q: could not open sealed message: %v, %v", sealer, opener, v, err)
+			case !same && err != ErrCipherMismatch:
+				t.Errorf("%q to %q: got %v want %v", sealer, opener, err, ErrCipherMismatch)
+			}
+		}
+		var v map[string]string
+		if err := openJSON(&Config{Cipher: sealer}, &[32]byte{4, 5, 6}, msg, &v); err != ErrBadKey {
+			t.Errorf("%q: opening with the wrong key got %v want %v", sealer, err, ErrBadKey)
+		}
+	}
+	if _, err := sealJSON(&Config{Cipher: "rot13"}, &key, "hello"); err == nil {
+		t.Errorf("sealed with an unknown cipher")
+	}
+}
+
+func TestFlush(t *testing.T) {
+	seta, setb, broken := virtualNet(t)
+	a, b, erra, errb := signalPair(t, &Config{settings: seta}, &Config{settings: setb})
+	if erra != nil || errb != nil {
+		t.Fatal(erra, errb)
+	}
+	defer a.Close()
+	defer b.Close()
+	go io.Copy(io.Discard, b)
+
+	// Nothing is acknowledged while the network drops every packet, so
+	// the buffer can't drain. Stay under the write buffer so Write doesn't
+	// block, and well under the ICE timeouts.
+	broken.Store(true)
+	if _, err := a.Write(make([]byte, 16<<10)); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := a.Flush(ctx); err != context.Canceled {
+		t.Errorf("flush with a cancelled context got %v want %v", err, context.Canceled)
+	}
+	flushed := make(chan error, 1)
+	go func() {
+		flushed <- a.Flush(context.Background())
+	}()
+	select {
+	case err := <-flushed:
+		t.Fatalf("flush returned %v before the buffer could drain", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	broken.Store(false)
+	select {
+	case err := <-flushed:
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := a.d.BufferedAmount(); n != 0 {
+			t.Errorf("flush returned with %v bytes buffered", n)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("flush did not return after the buffer drained")
+	}
+}
+
+func TestFingerprints(t *testing.T) {
+	c := newWormhole()
+	if err := c.newPeerConnection(&Config{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.LocalFingerprint(); err != ErrNoFingerprint {
+		t.Errorf("local fingerprint before offer got %v want %v", err, ErrNoFingerprint)
+	}
+	if _, err := c.RemoteFingerprint(); err != ErrNoFingerprint {
+		t.Errorf("remote fingerprint before connecting got %v want %v", err, ErrNoFingerprint)
+	}
+	c.pc.Close()
+
+	a, b := pair(t)
+	defer a.Close()
+	defer b.Close()
+	for _, p := range [][2]*Wormhole{{a, b}, {b, a}} {
+		local, err := p[0].LocalFingerprint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		remote, err := p[1].RemoteFingerprint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if local != remote {
+			t.Errorf("local fingerprint %v, peer saw %v", local, remote)
+		}
+		if len(local) != 32*3-1 {
+			t.Errorf("malformed fingerprint %v", local)
+		}
+	}
+}
+
+func TestNoDetach(t *testing.T) {
+	a, b := pairConfig(t, &Config{NoDetach: true})
+	defer b.Close()
+
+	big := make([]byte, 40<<10)
+	mrand.New(mrand.NewSource(1)).Read(big)
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 50; i++ {
+			if _, err := a.Write(big); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- a.Close()
+	}()
+
+	buf := make([]byte, maxMessageSize)
+	for i := 0; i < 50; i++ {
+		n, err := b.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], big) {
+			t.Fatalf("message %v differs", i)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Read(buf); err != io.EOF {
+		t.Errorf("read after peer closed got %v want %v", err, io.EOF)
+	}
+}
+
+func TestChannel(t *testing.T) {
+	a, b := pair(t)
+	// a wrote last, so let it flush before b goes away.
+	defer b.Close()
+	defer a.Close()
+
+	if _, err := a.Channel(0); err == nil {
+		t.Error("opened channel 0 twice")
+	}
+	a1, err := a.Channel(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b1, err := b.Channel(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, maxMessageSize)
+	for _, p := range [][2]*Wormhole{{a1, b1}, {a, b}} {
+		if _, err := p[0].Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		n, err := p[1].Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != "hello" {
+			t.Errorf("got %q want %q", buf[:n], "hello")
+		}
+	}
+
+	// Closing a channel leaves the others working.
+	if err := a1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b1.Read(buf); err != io.EOF {
+		t.Errorf("read from closed channel got %v want %v", err, io.EOF)
+	}
+	if _, err := a.Write([]byte("still here")); err != nil {
+		t.Fatal(err)
+	}
+	n, err := b.Read(buf)
+	if err != nil || string(buf[:n]) != "still here" {
+		t.Errorf("got %q, %v after closing a channel", buf[:n], err)
+	}
+}
+
+func TestDescribePair(t *testing.T) {
+	stats := webrtc.StatsReport{
+		"pair": webrtc.ICECandidatePairStats{
+			LocalCandidateID:  "local",
+			RemoteCandidateID: "remote",
+			Nominated:         true,
+		},
+		"other": webrtc.ICECandidatePairStats{
+			LocalCandidateID:  "host",
+			RemoteCandidateID: "remote",
+		},
+		"host": webrtc.ICECandidateStats{
+			IP:            "192.168.1.2",
+			Port:          5000,
+			CandidateType: webrtc.ICECandidateTypeHost,
+		},
+		"local": webrtc.ICECandidateStats{
+			IP:            "203.0.113.1",
+			Port:          5001,
+			CandidateType: webrtc.ICECandidateTypeSrflx,
+		},
+		"remote": webrtc.ICECandidateStats{
+			IP:            "2001:db8::1",
+			Port:          49152,
+			CandidateType: webrtc.ICECandidateTypeRelay,
+		},
+	}
+	local, remote, ok := nominatedPair(stats)
+	if !ok {
+		t.Fatal("no nominated pair found")
+	}
+	if got, want := describePair(local, remote), "relay via [2001:db8::1]:49152 (srflx→relay)"; got != want {
+		t.Errorf("got %q want %q", got, want)
+	}
+
+	remote.URL = "turn:example.com:3478"
+	if got, want := describePair(local, remote), "relay via turn:example.com:3478 (srflx→relay)"; got != want {
+		t.Errorf("got %q want %q", got, want)
+	}
+
+	remote.CandidateType = webrtc.ICECandidateTypePrflx
+	if got, want := describePair(local, remote), "direct 203.0.113.1:5001→[2001:db8::1]:49152 (srflx→prflx)"; got != want {
+		t.Errorf("got %q want %q", got, want)
+	}
+
+	delete(stats, "pair")
+	if _, _, ok := nominatedPair(stats); ok {
+		t.Error("found a nominated pair when none was")
+	}
+}
+
+// benchmarkWrite measures sending over a local connection, in messages of
+// size bytes, with Write blocking once writeBuffer bytes are buffered.
+func benchmarkWrite(b *testing.B, writeBuffer, size int) {
+	const total = 16 << 20
+	a, c := pairConfig(b, &Config{WriteBuffer: writeBuffer})
+	// Close can take a while flushing; don't wait on it between runs.
+	defer func() {
+		go a.Close()
+		go c.Close()
+	}()
+
+	done := make(chan error)
+	go func() {
+		buf := make([]byte, maxMessageSize)
+		for {
+			for read := 0; read < total; {
+				n, err := c.Read(buf)
+				if err != nil {
+					done <- err
+					return
+				}
+				read += n
+			}
+			done <- nil
+		}
+	}()
+	msg := make([]byte, size)
+	b.SetBytes(total)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for sent := 0; sent < total; sent += size {
+			if _, err := a.Write(msg); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := <-done; err != nil {
+			b.Fatal(err)
+		}
+	}
+	// Leave closing out of it.
+	b.StopTimer()
+}
+
+func BenchmarkWrite(b *testing.B) {
+	for _, writeBuffer := range []int{32 << 10, 64 << 10, 128 << 10, 256 << 10, 512 << 10, 768 << 10} {
+		for _, size := range []int{16 << 10, 32 << 10, 64 << 10} {
+			b.Run(fmt.Sprintf("buffer=%dK/msg=%dK", writeBuffer>>10, size>>10), func(b *testing.B) {
+				benchmarkWrite(b, writeBuffer, size)
+			})
+		}
+	}
+}
+
+// nonceReader records every 24 bytes read from r, as sealJSON reads a
+// nonce.
+type nonceReader struct {
+	r      io.Reader
+	mu     sync.Mutex
+	nonces map[string]bool
+}
+
+func (n *nonceReader) Read(p []byte) (int, error) {
+	k, err := n.r.Read(p)
+	if k == 24 {
+		n.mu.Lock()
+		n.nonces[string(p[:k])] = true
+		n.mu.Unlock()
+	}
+	return k, err
+}
+
+func TestFixedRandHandshake(t *testing.T) {
+	var mu sync.Mutex
+	var msgs [][]byte
+	sigserv := recordingSignalServer(t, func(p []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		msgs = append(msgs, p)
+	})
+	ra := &nonceReader{r: mrand.New(mrand.NewSource(1)), nonces: map[string]bool{}}
+	rb := &nonceReader{r: mrand.New(mrand.NewSource(2)), nonces: map[string]bool{}}
+	bc := make(chan error, 1)
+	go func() {
+		b, err := (&Config{Rand: rb}).Join("1", "pass", sigserv)
+		if err == nil {
+			defer b.Close()
+		}
+		bc <- err
+	}()
+	a, err := (&Config{Rand: ra}).New("pass", sigserv, make(chan string, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	if err := <-bc; err != nil {
+		t.Fatal(err)
+	}
+
+	// Sealed messages, unlike the PAKE ones, start with their nonce.
+	mu.Lock()
+	defer mu.Unlock()
+	sealed := map[*nonceReader]int{}
+	for _, p := range msgs {
+		box, err := base64.URLEncoding.DecodeString(string(p))
+		if err != nil || len(box) < 24 {
+			continue
+		}
+		for _, r := range []*nonceReader{ra, rb} {
+			if r.nonces[string(box[:24])] {
+				sealed[r]++
+			}
+		}
+	}
+	if sealed[ra] == 0 || sealed[rb] == 0 {
+		t.Errorf("got %v and %v messages sealed with nonces from Rand, want some from each peer", sealed[ra], sealed[rb])
+	}
+}
+
+// relayServer returns an unstarted signalling server that, unlike
+// signalServer, hands out a new slot to every peer that doesn't ask for
+// one, speaks MuxProtocol as well, and tells peers why the other failed,
+// like ww server does.
+func relayServer(t *testing.T) *httptest.Server {
+	type creator struct {
+		conn sigConn
+		done chan struct{}
+	}
+	var mu sync.Mutex
+	slots := map[string]creator{}
+	next := 0
+	pipe := func(from, to sigConn) {
+		for {
+			typ, p, err := from.Read(context.Background())
+			var ce websocket.CloseError
+			switch {
+			case errors.As(err, &ce) && (ce.Code == CloseBadKey || ce.Code == CloseJoinRejected || ce.Code == CloseTunnelMismatch):
+				to.Close(ce.Code, ce.Reason)
+				return
+			case errors.As(err, &ce):
+				// Peers that are done close with how it went,
+				// each on its own.
+				return
+			case err != nil:
+				to.Close(ClosePeerHungUp, "peer hung up")
+				return
+			}
+			if to.Write(context.Background(), typ, p) != nil {
+				return
+			}
+		}
+	}
+	handle := func(path string, conn sigConn) {
+		slot := strings.TrimPrefix(path, "/")
+		mu.Lock()
+		c, joined := slots[slot]
+		delete(slots, slot)
+		if slot == "" {
+			next++
+			slot = strconv.Itoa(next)
+			c = creator{conn, make(chan struct{})}
+			slots[slot] = c
+		}
+		mu.Unlock()
+		if slot != "" && c.conn == nil {
+			conn.Close(CloseNoSuchSlot, "no such slot")
+			return
+		}
+		buf, _ := json.Marshal(initMsg{Slot: slot})
+		if conn.Write(context.Background(), websocket.MessageText, buf) != nil {
+			return
+		}
+		if !joined {
+			<-c.done
+			return
+		}
+		go pipe(c.conn, conn)
+		pipe(conn, c.conn)
+		close(c.done)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{Subprotocols: []string{Protocol, MuxProtocol}})
+		if err != nil {
+			return
+		}
+		switch conn.Subprotocol() {
+		case Protocol:
+			handle(r.URL.Path, conn)
+			return
+		case "":
+			conn.Close(CloseWrongProto, "wrong protocol")
+			return
+		}
+		m := NewMux(conn, false)
+		for {
+			s, err := m.Accept(r.Context())
+			if err != nil {
+				return
+			}
+			go handle(s.Path(), s)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// loopback connects a Wormhole set up with cfga that creates a slot on
+// relayServer to one set up with cfgb that joins it.
+func loopback(t *testing.T, cfga, cfgb *Config) (a, b *Wormhole, erra, errb error) {
+	t.Helper()
+	srv := relayServer(t)
+	srv.Start()
+	slotc := make(chan string)
+	errc := make(chan error, 1)
+	go func() {
+		var err error
+		a, err = cfga.New("pass", srv.URL, slotc)
+		errc <- err
+	}()
+	select {
+	case slot := <-slotc:
+		b, errb = cfgb.Join(slot, "pass", srv.URL)
+	case err := <-errc:
+		t.Fatalf("could not get slot: %v", err)
+	}
+	erra = <-errc
+	return a, b, erra, errb
+}
+
+func TestKeyDerivation(t *testing.T) {
+	t.Run("match", func(t *testing.T) {
+		cfg := &Config{KeySalt: []byte("salt"), KeyInfo: []byte("info")}
+		a, b, erra, errb := loopback(t, cfg, cfg)
+		if erra != nil || errb != nil {
+			t.Fatalf("could not connect: %v, %v", erra, errb)
+		}
+		a.Close()
+		b.Close()
+	})
+	t.Run("mismatch", func(t *testing.T) {
+		_, _, erra, errb := loopback(t,
+			&Config{KeyInfo: []byte("info")},
+			&Config{KeyInfo: []byte("other info")},
+		)
+		if erra != ErrBadKey || errb != ErrBadKey {
+			t.Fatalf("got %v, %v want %v", erra, errb, ErrBadKey)
+		}
+	})
+}
+
+func TestLabel(t *testing.T) {
+	t.Run("match", func(t *testing.T) {
+		cfg := &Config{Label: "alice-to-bob"}
+		a, b, erra, errb := loopback(t, cfg, cfg)
+		if erra != nil || errb != nil {
+			t.Fatalf("could not connect: %v, %v", erra, errb)
+		}
+		a.Close()
+		b.Close()
+	})
+	t.Run("mismatch", func(t *testing.T) {
+		_, _, erra, errb := loopback(t,
+			&Config{Label: "alice-to-bob"},
+			&Config{Label: "alice-to-mallory"},
+		)
+		if erra != ErrBadKey || errb != ErrBadKey {
+			t.Fatalf("got %v, %v want %v", erra, errb, ErrBadKey)
+		}
+	})
+	t.Run("missing", func(t *testing.T) {
+		_, _, erra, errb := loopback(t, &Config{Label: "alice-to-bob"}, &Config{})
+		if erra != ErrBadKey || errb != ErrBadKey {
+			t.Fatalf("got %v, %v want %v", erra, errb, ErrBadKey)
+		}
+	})
+}
+
+func TestCipherHandshake(t *testing.T) {
+	t.Run("match", func(t *testing.T) {
+		cfg := &Config{Cipher: CipherXChaCha20Poly1305}
+		a, b, erra, errb := loopback(t, cfg, cfg)
+		if erra != nil || errb != nil {
+			t.Fatalf("could not connect: %v, %v", erra, errb)
+		}
+		a.Close()
+		b.Close()
+	})
+	t.Run("mismatch", func(t *testing.T) {
+		_, _, erra, errb := loopback(t,
+			&Config{Cipher: CipherXChaCha20Poly1305},
+			&Config{},
+		)
+		if erra != ErrBadKey || errb != ErrCipherMismatch {
+			t.Fatalf("got %v, %v want %v, %v", erra, errb, ErrBadKey, ErrCipherMismatch)
+		}
+	})
+}
+
+func TestMetadata(t *testing.T) {
+	for _, noTrickle := range []bool{false, true} {
+		a, b, erra, errb := loopback(t,
+			&Config{Metadata: []byte("token"), NoTrickle: noTrickle},
+			&Config{Metadata: []byte("file.txt"), NoTrickle: noTrickle},
+		)
+		if erra != nil || errb != nil {
+			t.Fatalf("could not connect: %v, %v", erra, errb)
+		}
+		if got := string(a.Metadata()); got != "file.txt" {
+			t.Errorf("creator got metadata %q want %q", got, "file.txt")
+		}
+		if got := string(b.Metadata()); got != "token" {
+			t.Errorf("joiner got metadata %q want %q", got, "token")
+		}
+		a.Close()
+		b.Close()
+	}
+
+	// Without metadata there is none.
+	a, b, erra, errb := loopback(t, &Config{}, &Config{})
+	if erra != nil || errb != nil {
+		t.Fatalf("could not connect: %v, %v", erra, errb)
+	}
+	if a.Metadata() != nil || b.Metadata() != nil {
+		t.Errorf("got metadata %q, %q want none", a.Metadata(), b.Metadata())
+	}
+	a.Close()
+	b.Close()
+
+	big := &Config{Metadata: make([]byte, MaxMetadataSize+1)}
+	if _, err := big.New("pass", "http://127.0.0.1:1", nil); err != ErrMetadataTooLarge {
+		t.Errorf("New: got %v want %v", err, ErrMetadataTooLarge)
+	}
+	if _, err := big.Join("1", "pass", "http://127.0.0.1:1"); err != ErrMetadataTooLarge {
+		t.Errorf("Join: got %v want %v", err, ErrMetadataTooLarge)
+	}
+}
+
+func TestNewCode(t *testing.T) {
+	srv := relayServer(t)
+	srv.Start()
+
+	pass := GenerateCode(2)
+	if len(pass) != 2 {
+		t.Fatalf("got %d byte password want 2", len(pass))
+	}
+	if bytes.Equal(pass, GenerateCode(2)) {
+		t.Errorf("generated the same password %v twice", pass)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	codec := make(chan string)
+	errc := make(chan error, 1)
+	var a *Wormhole
+	go func() {
+		var err error
+		a, err = (&Config{}).NewCode(ctx, pass, srv.URL, codec)
+		errc <- err
+	}()
+	var code string
+	select {
+	case code = <-codec:
+	case err := <-errc:
+		t.Fatalf("could not get code: %v", err)
+	}
+	slot, got := wordlist.Decode(code)
+	if !bytes.Equal(got, pass) {
+		t.Fatalf("code %q has password %v want %v", code, got, pass)
+	}
+	b, err := Join(strconv.Itoa(slot), string(got), srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+
+	// Giving up before anyone joins returns the context's error.
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		_, err := (&Config{}).NewCode(ctx, pass, srv.URL, codec)
+		errc <- err
+	}()
+	<-codec
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("got %v want %v", err, context.Canceled)
+	}
+
+	// Nor does a code no one reads keep NewCode from returning.
+	ctx, cancel = context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if _, err := (&Config{}).NewCode(ctx, pass, srv.URL, make(chan string)); err != context.DeadlineExceeded {
+		t.Errorf("got %v want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestNoTrickle(t *testing.T) {
+	cfg := &Config{NoTrickle: true, GatherTimeout: 5 * time.Second}
+	a, b, erra, errb := loopback(t, cfg, cfg)
+	if erra != nil || errb != nil {
+		t.Fatalf("could not connect: %v, %v", erra, errb)
+	}
+	defer a.Close()
+	defer b.Close()
+
+	for _, c := range []*Wormhole{a, b} {
+		d := c.Diagnostics()
+		gathered := false
+		for _, e := range d.Events {
+			if strings.HasPrefix(e.Message, "sent new local candidate") {
+				t.Errorf("trickled a candidate: %v", e.Message)
+			}
+			var n int
+			var typ string
+			if _, err := fmt.Sscanf(e.Message, "gathered %d candidates into the %s", &n, &typ); err == nil && n > 0 {
+				gathered = true
+			}
+		}
+		if !gathered {
+			t.Error("sent a session description without candidates")
+		}
+		if len(d.RemoteCandidates) > 0 {
+			t.Errorf("got trickled candidates %v", d.RemoteCandidates)
+		}
+	}
+}
+
+// countTLS counts the TLS connections made to srv, and how many of them
+// resumed a session.
+func countTLS(srv *httptest.Server) (count func() (handshakes, resumed int)) {
+	var mu sync.Mutex
+	handshakes, resumed := 0, 0
+	srv.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state != http.StateActive {
+			return
+		}
+		if tc, ok := conn.(*tls.Conn); ok {
+			mu.Lock()
+			defer mu.Unlock()
+			handshakes++
+			if tc.ConnectionState().DidResume {
+				resumed++
+			}
+		}
+	}
+	return func() (int, int) {
+		mu.Lock()
+		defer mu.Unlock()
+		return handshakes, resumed
+	}
+}
+
+// clientTransfers sends a message over n wormholes set up one after
+// another through cl.
+func clientTransfers(t *testing.T, cl *Client, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		slotc := make(chan string)
+		type result struct {
+			c   *Wormhole
+			err error
+		}
+		newc := make(chan result, 1)
+		go func() {
+			c, err := cl.New(context.Background(), "pass", slotc)
+			newc <- result{c, err}
+		}()
+		var slot string
+		select {
+		case slot = <-slotc:
+		case r := <-newc:
+			t.Fatalf("transfer %v: could not get slot: %v", i, r.err)
+		}
+		b, err := cl.Join(slot, "pass")
+		if err != nil {
+			t.Fatalf("transfer %v: could not join: %v", i, err)
+		}
+		r := <-newc
+		if r.err != nil {
+			t.Fatalf("transfer %v: could not create: %v", i, r.err)
+		}
+		if _, err := r.c.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(b, buf); err != nil || string(buf) != "hello" {
+			t.Fatalf("transfer %v: got %q, %v", i, buf, err)
+		}
+		r.c.Close()
+		b.Close()
+	}
+}
+
+func TestClientReuse(t *testing.T) {
+	srv := relayServer(t)
+	count := countTLS(srv)
+	srv.StartTLS()
+
+	cl := NewClient(srv.URL, &Config{
+		TLSConfig: srv.Client().Transport.(*http.Transport).TLSClientConfig,
+	})
+	defer cl.Close()
+	clientTransfers(t, cl, 3)
+	if handshakes, _ := count(); handshakes != 1 {
+		t.Errorf("made %v connections for 3 transfers, want 1", handshakes)
+	}
+
+	// A dropped connection is replaced.
+	cl.Close()
+	clientTransfers(t, cl, 1)
+	if handshakes, resumed := count(); handshakes != 2 || resumed != 1 {
+		t.Errorf("got %v connections, %v resumed, want 2, 1", handshakes, resumed)
+	}
+}
+
+func TestExportKeys(t *testing.T) {
+	a, b, erra, errb := loopback(t, &Config{}, &Config{})
+	if erra != nil || errb != nil {
+		t.Fatalf("could not connect: %v, %v", erra, errb)
+	}
+	defer a.Close()
+	defer b.Close()
+	sa, ra, err := a.ExportKeys("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, rb, err := b.ExportKeys("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *sa != *rb || *sb != *ra || *sa == *sb {
+		t.Errorf("peers derived mismatched keys")
+	}
+	other, _, err := a.ExportKeys("other")
+	if err != nil || *other == *sa {
+		t.Errorf("different labels derived the same key, %v", err)
+	}
+}
+
+func TestClientNoMux(t *testing.T) {
+	// A server from before MuxProtocol.
+	srv := relayServer(t)
+	relay := srv.Config.Handler
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Sec-WebSocket-Protocol") == MuxProtocol {
+			r.Header.Del("Sec-WebSocket-Protocol")
+		}
+		relay.ServeHTTP(w, r)
+	})
+	count := countTLS(srv)
+	srv.StartTLS()
+
+	cl := NewClient(srv.URL, &Config{
+		TLSConfig: srv.Client().Transport.(*http.Transport).TLSClientConfig,
+	})
+	defer cl.Close()
+	clientTransfers(t, cl, 2)
+	if _, resumed := count(); resumed == 0 {
+		t.Error("none of the TLS handshakes resumed a session")
+	}
+}
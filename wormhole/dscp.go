@@ -0,0 +1,78 @@
+package wormhole
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/pion/transport/v2"
+	"github.com/pion/transport/v2/stdnet"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// maxDSCP is the biggest Differentiated Services code point, which is six
+// bits.
+const maxDSCP = 63
+
+// dscpNet is a transport.Net whose UDP sockets mark the packets they send
+// with a Differentiated Services code point. pion has no setting for it, so
+// this marks the sockets ICE opens instead, which carry the DataChannels.
+type dscpNet struct {
+	transport.Net
+	dscp int
+}
+
+func newDSCPNet(dscp int) (*dscpNet, error) {
+	if dscp < 0 || dscp > maxDSCP {
+		return nil, fmt.Errorf("invalid DSCP %d, must be 0 to %d", dscp, maxDSCP)
+	}
+	n, err := stdnet.NewNet()
+	if err != nil {
+		return nil, err
+	}
+	return &dscpNet{Net: n, dscp: dscp}, nil
+}
+
+func (n *dscpNet) ListenPacket(network, address string) (net.PacketConn, error) {
+	c, err := n.Net.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return c, n.mark(c)
+}
+
+func (n *dscpNet) ListenUDP(network string, laddr *net.UDPAddr) (transport.UDPConn, error) {
+	c, err := n.Net.ListenUDP(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	return c, n.mark(c)
+}
+
+func (n *dscpNet) DialUDP(network string, laddr, raddr *net.UDPAddr) (transport.UDPConn, error) {
+	c, err := n.Net.DialUDP(network, laddr, raddr)
+	if err != nil {
+		return nil, err
+	}
+	return c, n.mark(c)
+}
+
+// mark sets the DSCP of c, closing it if that fails. The DSCP is the top
+// six bits of the IPv4 TOS and IPv6 traffic class fields.
+func (n *dscpNet) mark(c net.PacketConn) error {
+	var err error
+	if addr, ok := c.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		err = ipv6.NewPacketConn(c).SetTrafficClass(n.dscp << 2)
+		if addr.IP.IsUnspecified() {
+			// A socket on [::] may send IPv4 too, if the system lets it.
+			_ = ipv4.NewPacketConn(c).SetTOS(n.dscp << 2)
+		}
+	} else {
+		err = ipv4.NewPacketConn(c).SetTOS(n.dscp << 2)
+	}
+	if err != nil {
+		c.Close()
+		return fmt.Errorf("could not set DSCP: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package wormhole
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/ipv4"
+)
+
+func TestDSCPNet(t *testing.T) {
+	n, err := newDSCPNet(46)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := n.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	tos, err := ipv4.NewPacketConn(c).TOS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tos != 46<<2 {
+		t.Errorf("got TOS %#x want %#x", tos, 46<<2)
+	}
+
+	for _, dscp := range []int{-1, 64} {
+		if _, err := newDSCPNet(dscp); err == nil {
+			t.Errorf("%d: got no error", dscp)
+		}
+	}
+}
+
+func TestDSCP(t *testing.T) {
+	a, b := pairConfig(t, &Config{DSCP: 46})
+	defer b.Close()
+	defer a.Close()
+	if _, err := a.Write([]byte("marked")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 10)
+	n, err := b.Read(buf)
+	if err != nil || string(buf[:n]) != "marked" {
+		t.Errorf("got %q, %v", buf[:n], err)
+	}
+
+	if err := newWormhole().newPeerConnection(&Config{DSCP: 64}, nil); err == nil {
+		t.Error("got no error for an invalid DSCP")
+	}
+}
@@ -0,0 +1,34 @@
+package wormhole_test
+
+import (
+	"fmt"
+	"log"
+
+	"webwormhole.io/wormhole"
+)
+
+// This runs a tiny request/response protocol over a wormhole: the peer that
+// creates it asks questions, and the one that joins answers them.
+func ExampleMessageConn() {
+	const sigserv = "https://webwormhole.io"
+	slotc := make(chan string)
+	go func() {
+		// Print the slot for the peer to join with the same password.
+		fmt.Println("slot:", <-slotc)
+	}()
+	c, err := wormhole.New("correct horse battery staple", sigserv, slotc)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer c.Close()
+
+	m := wormhole.NewMessageConn(c)
+	if err := m.WriteMessage([]byte("what time is it?")); err != nil {
+		log.Fatal(err)
+	}
+	answer, err := m.ReadMessage()
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%s\n", answer)
+}
@@ -0,0 +1,111 @@
+package wormhole
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+// DefaultMaxMessageSize is the largest message a MessageConn reads unless
+// told otherwise.
+const DefaultMaxMessageSize = 16 << 20
+
+// ErrMessageTooLarge is returned by MessageConn when a message is larger
+// than its MaxMessageSize.
+var ErrMessageTooLarge = errors.New("message too large")
+
+// A MessageConn sends and receives whole messages of any size, up to
+// MaxMessageSize, over a Wormhole or any other stream, for running your own
+// protocol over it. Each message is sent as its length, a 4 byte big endian
+// number, followed by its contents, split into writes small enough for a
+// DataChannel.
+//
+// It is safe to call WriteMessage and ReadMessage at the same time, and
+// each from several goroutines.
+type MessageConn struct {
+	// MaxMessageSize is the largest message ReadMessage accepts and
+	// WriteMessage sends. Zero means DefaultMaxMessageSize.
+	MaxMessageSize int
+
+	rw  io.ReadWriter
+	wmu sync.Mutex
+	rmu sync.Mutex
+}
+
+// NewMessageConn returns a MessageConn sending and receiving messages over
+// rw, usually a *Wormhole.
+func NewMessageConn(rw io.ReadWriter) *MessageConn {
+	return &MessageConn{rw: rw}
+}
+
+func (m *MessageConn) max() int {
+	if m.MaxMessageSize > 0 {
+		return m.MaxMessageSize
+	}
+	return DefaultMaxMessageSize
+}
+
+// chunk returns the largest write rw takes, which is less than a
+// DataChannel message if it is a tunnelled Wormhole.
+func (m *MessageConn) chunk() int {
+	if c, ok := m.rw.(interface{ MaxMessageSize() int }); ok {
+		return c.MaxMessageSize()
+	}
+	return maxMessageSize
+}
+
+// WriteMessage sends msg as one message.
+func (m *MessageConn) WriteMessage(msg []byte) error {
+	if len(msg) > m.max() {
+		return ErrMessageTooLarge
+	}
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(msg)))
+	// Send the length with the start of the message, to save a round of
+	// sending for small ones.
+	chunk := m.chunk()
+	n := len(msg)
+	if n > chunk-len(length) {
+		n = chunk - len(length)
+	}
+	if _, err := m.rw.Write(append(length[:], msg[:n]...)); err != nil {
+		return err
+	}
+	for msg = msg[n:]; len(msg) > 0; msg = msg[n:] {
+		n = len(msg)
+		if n > chunk {
+			n = chunk
+		}
+		if _, err := m.rw.Write(msg[:n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadMessage waits for the next message and returns it. It returns io.EOF
+// if the stream ends cleanly between messages, and io.ErrUnexpectedEOF if
+// it ends in the middle of one.
+func (m *MessageConn) ReadMessage() ([]byte, error) {
+	m.rmu.Lock()
+	defer m.rmu.Unlock()
+	var length [4]byte
+	if _, err := io.ReadFull(m.rw, length[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if uint64(n) > uint64(m.max()) {
+		return nil, ErrMessageTooLarge
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(m.rw, msg); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return msg, nil
+}
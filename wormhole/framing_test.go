@@ -0,0 +1,83 @@
+package wormhole
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+func TestMessageConn(t *testing.T) {
+	a, b := pair(t)
+	defer a.Close()
+	defer b.Close()
+	ma, mb := NewMessageConn(a), NewMessageConn(b)
+
+	var msgs [][]byte
+	for _, size := range []int{0, 1, maxMessageSize - 4, maxMessageSize, 3*maxMessageSize + 100} {
+		msg := make([]byte, size)
+		rand.Read(msg)
+		msgs = append(msgs, msg)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		for _, msg := range msgs {
+			if err := ma.WriteMessage(msg); err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- nil
+	}()
+	for _, want := range msgs {
+		got, err := mb.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("got %d byte message want %d bytes", len(got), len(want))
+		}
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	// Replies go the other way at the same time.
+	go func() { errc <- mb.WriteMessage([]byte("pong")) }()
+	if msg, err := ma.ReadMessage(); err != nil || string(msg) != "pong" {
+		t.Errorf("got %q, %v want pong", msg, err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMessageConnLimits(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	ma, mb := NewMessageConn(a), NewMessageConn(b)
+	ma.MaxMessageSize, mb.MaxMessageSize = 100, 10
+
+	if err := mb.WriteMessage(make([]byte, 11)); err != ErrMessageTooLarge {
+		t.Errorf("writing too much got %v want %v", err, ErrMessageTooLarge)
+	}
+	go ma.WriteMessage(make([]byte, 11))
+	if _, err := mb.ReadMessage(); err != ErrMessageTooLarge {
+		t.Errorf("reading too much got %v want %v", err, ErrMessageTooLarge)
+	}
+
+	// Cut off in the middle of a message.
+	a, b = net.Pipe()
+	mb = NewMessageConn(b)
+	go func() {
+		a.Write([]byte{0, 0, 0, 5, 'h', 'i'})
+		a.Close()
+	}()
+	if _, err := mb.ReadMessage(); err != io.ErrUnexpectedEOF {
+		t.Errorf("got %v want %v", err, io.ErrUnexpectedEOF)
+	}
+	if _, err := mb.ReadMessage(); err != io.EOF {
+		t.Errorf("got %v want %v", err, io.EOF)
+	}
+}
@@ -0,0 +1,71 @@
+package wormhole
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+// ParseICEServers parses ICE server URLs like "stun:host", "turn:host:port",
+// "turns:[2001:db8::1]" or "turn:host?transport=tcp" into ICE servers, one
+// per URL. TURN URLs may carry their credentials as "turn:user:pass@host",
+// percent-encoded if they contain : or @. Empty URLs are skipped, and
+// TURN servers without credentials are left for the caller to fill in.
+func ParseICEServers(urls []string) ([]webrtc.ICEServer, error) {
+	var servers []webrtc.ICEServer
+	for _, raw := range urls {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		server, err := parseICEServer(raw)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+func parseICEServer(raw string) (webrtc.ICEServer, error) {
+	scheme, rest, ok := strings.Cut(raw, ":")
+	if !ok {
+		return webrtc.ICEServer{}, fmt.Errorf("ICE server %q has no scheme", raw)
+	}
+	// Take the credentials out before pion parses the rest, both because
+	// it doesn't understand them and so they stay out of errors.
+	addr, query, _ := strings.Cut(rest, "?")
+	var userinfo string
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		userinfo, addr = addr[:i], addr[i+1:]
+	}
+	stripped := scheme + ":" + addr
+	if query != "" {
+		stripped += "?" + query
+	}
+	u, err := ice.ParseURL(stripped)
+	if err != nil {
+		return webrtc.ICEServer{}, fmt.Errorf("invalid ICE server %q: %v", stripped, err)
+	}
+	server := webrtc.ICEServer{URLs: []string{stripped}}
+	if userinfo == "" {
+		return server, nil
+	}
+	if u.Scheme != ice.SchemeTypeTURN && u.Scheme != ice.SchemeTypeTURNS {
+		return webrtc.ICEServer{}, fmt.Errorf("ICE server %q can't have credentials, only TURN servers can", stripped)
+	}
+	user, pass, ok := strings.Cut(userinfo, ":")
+	if !ok || user == "" {
+		return webrtc.ICEServer{}, fmt.Errorf("TURN server %q credentials are not of the form user:password", stripped)
+	}
+	if server.Username, err = url.PathUnescape(user); err != nil {
+		return webrtc.ICEServer{}, fmt.Errorf("TURN server %q has an invalid username: %v", stripped, err)
+	}
+	if server.Credential, err = url.PathUnescape(pass); err != nil {
+		return webrtc.ICEServer{}, fmt.Errorf("TURN server %q has an invalid password: %v", stripped, err)
+	}
+	return server, nil
+}
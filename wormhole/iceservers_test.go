@@ -0,0 +1,80 @@
+package wormhole
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestParseICEServers(t *testing.T) {
+	for _, tt := range []struct {
+		url  string
+		want webrtc.ICEServer
+	}{
+		{"stun:relay.webwormhole.io", webrtc.ICEServer{URLs: []string{"stun:relay.webwormhole.io"}}},
+		{" stun:example.com:19302 ", webrtc.ICEServer{URLs: []string{"stun:example.com:19302"}}},
+		{"stuns:example.com", webrtc.ICEServer{URLs: []string{"stuns:example.com"}}},
+		{"stun:[2001:db8::1]:3478", webrtc.ICEServer{URLs: []string{"stun:[2001:db8::1]:3478"}}},
+		{"stun:[2001:db8::1]", webrtc.ICEServer{URLs: []string{"stun:[2001:db8::1]"}}},
+		{"turn:example.com", webrtc.ICEServer{URLs: []string{"turn:example.com"}}},
+		{"turn:example.com:3478?transport=tcp", webrtc.ICEServer{URLs: []string{"turn:example.com:3478?transport=tcp"}}},
+		{"turns:example.com:443?transport=tcp", webrtc.ICEServer{URLs: []string{"turns:example.com:443?transport=tcp"}}},
+		{"turn:alice:secret@example.com", webrtc.ICEServer{URLs: []string{"turn:example.com"}, Username: "alice", Credential: "secret"}},
+		{"turn:1700000000%3Awormhole:c2VjcmV0@[2001:db8::1]:3478?transport=udp", webrtc.ICEServer{
+			URLs:     []string{"turn:[2001:db8::1]:3478?transport=udp"},
+			Username: "1700000000:wormhole", Credential: "c2VjcmV0",
+		}},
+		{"turns:a%40b:p%3Ass%40@example.com", webrtc.ICEServer{URLs: []string{"turns:example.com"}, Username: "a@b", Credential: "p:ss@"}},
+		{"turn:alice:@example.com", webrtc.ICEServer{URLs: []string{"turn:example.com"}, Username: "alice", Credential: ""}},
+	} {
+		got, err := ParseICEServers([]string{tt.url})
+		if err != nil {
+			t.Errorf("%q: %v", tt.url, err)
+			continue
+		}
+		if len(got) != 1 || !reflect.DeepEqual(got[0], tt.want) {
+			t.Errorf("%q: got %+v want %+v", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestParseICEServersList(t *testing.T) {
+	got, err := ParseICEServers([]string{"stun:a", "", "turn:u:p@b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].URLs[0] != "stun:a" || got[1].URLs[0] != "turn:b" {
+		t.Errorf("got %+v", got)
+	}
+	if got, err := ParseICEServers(nil); got != nil || err != nil {
+		t.Errorf("got %v, %v for no servers", got, err)
+	}
+}
+
+func TestParseICEServersInvalid(t *testing.T) {
+	for _, url := range []string{
+		"example.com",
+		"http://example.com",
+		"stun:",
+		"stun:example.com:port",
+		"stun:2001:db8::1",
+		"stun:example.com?transport=tcp",
+		"stun:alice:secret@example.com",
+		"turn:example.com?transport=sctp",
+		"turn:example.com?foo=bar",
+		"turn:alice@example.com",
+		"turn::secret@example.com",
+		"turn:alice:%zz@example.com",
+	} {
+		_, err := ParseICEServers([]string{url})
+		if err == nil {
+			t.Errorf("%q: got no error", url)
+			continue
+		}
+		if strings.Contains(err.Error(), "secret") {
+			t.Errorf("%q: error %q gives away the credentials", url, err)
+		}
+	}
+}
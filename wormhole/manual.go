@@ -0,0 +1,243 @@
+package wormhole
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"filippo.io/cpace"
+	webrtc "github.com/pion/webrtc/v3"
+)
+
+// A Signaller carries handshake messages to and from the peer without a
+// signalling server, e.g. by having the user copy and paste them. Messages
+// are single lines of printable text.
+type Signaller interface {
+	Send(msg string) error
+	Receive() (string, error)
+}
+
+// ErrBadMessage is returned when a manual handshake message is not one the
+// peer could have sent, e.g. because it was pasted wrong.
+var ErrBadMessage = errors.New("malformed handshake message")
+
+// The manual handshake takes three messages:
+//
+//	Start                                   Answer
+//	----pake_msg_a------------------------------>
+//	<---pake_msg_b.sbox(offer+candidates)--------
+//	----sbox(answer+candidates)----------------->
+//
+// Since every message is a chore to pass on, candidates are not trickled
+// but gathered into the offer and answer, as with Config.NoTrickle, and
+// descriptions are compressed, as with Config.CompressSDP.
+
+// StartManual performs the handshake over s instead of a signalling
+// server, sending the first message. The peer must call AnswerManual with
+// the same password. ice stand in for the STUN and TURN servers a
+// signalling server would offer, and are used along with
+// Config.ICEServers unless Config.IgnoreServerICE is set.
+func (cfg *Config) StartManual(pass string, s Signaller, ice []webrtc.ICEServer) (*Wormhole, error) {
+	c := newWormhole()
+	c.failed = cfg.Failed
+	if len(cfg.Metadata) > MaxMetadataSize {
+		return c.fail(ErrMetadataTooLarge)
+	}
+	cfg = cfg.manual()
+
+	msgA, pake, err := cpace.Start(pass, cfg.contextInfo())
+	if err != nil {
+		return c.fail(err)
+	}
+	if err := s.Send(base64.URLEncoding.EncodeToString(msgA)); err != nil {
+		return c.fail(err)
+	}
+	c.logf("sent A pake msg (%v bytes)", len(msgA))
+
+	reply, err := s.Receive()
+	if err != nil {
+		return c.fail(err)
+	}
+	b64B, sealedOffer, ok := strings.Cut(strings.TrimSpace(reply), ".")
+	if !ok {
+		return c.fail(ErrBadMessage)
+	}
+	msgB, err := base64.URLEncoding.DecodeString(b64B)
+	if err != nil {
+		return c.fail(ErrBadMessage)
+	}
+	mk, err := pake.Finish(msgB)
+	if err != nil {
+		return c.fail(err)
+	}
+	key, err := cfg.deriveKey(mk)
+	if err != nil {
+		return c.fail(err)
+	}
+	if err := c.keep(mk, false); err != nil {
+		return c.fail(err)
+	}
+	c.logf("have key, got B msg (%v bytes)", len(msgB))
+
+	err = c.newPeerConnection(cfg, cfg.iceServers(ice))
+	if err != nil {
+		return c.fail(err)
+	}
+	offer, err := c.openDescription(cfg, &key, sealedOffer)
+	if err != nil {
+		return c.fail(err)
+	}
+	if err := c.setRemoteDescription(offer); err != nil {
+		return c.fail(err)
+	}
+	c.logf("got offer")
+
+	answer, err := c.pc.CreateAnswer(nil)
+	if err != nil {
+		return c.fail(err)
+	}
+	sealed, err := c.sealDescription(cfg, &key, answer)
+	if err != nil {
+		return c.fail(err)
+	}
+	if err := s.Send(sealed); err != nil {
+		return c.fail(err)
+	}
+	c.logf("sent answer")
+	return c.waitOpen(cfg)
+}
+
+// AnswerManual performs the handshake over s instead of a signalling
+// server, answering the peer's StartManual. ice are used as by
+// StartManual.
+func (cfg *Config) AnswerManual(pass string, s Signaller, ice []webrtc.ICEServer) (*Wormhole, error) {
+	c := newWormhole()
+	c.failed = cfg.Failed
+	if len(cfg.Metadata) > MaxMetadataSize {
+		return c.fail(ErrMetadataTooLarge)
+	}
+	cfg = cfg.manual()
+
+	first, err := s.Receive()
+	if err != nil {
+		return c.fail(err)
+	}
+	msgA, err := base64.URLEncoding.DecodeString(strings.TrimSpace(first))
+	if err != nil {
+		return c.fail(ErrBadMessage)
+	}
+	c.logf("got A pake msg (%v bytes)", len(msgA))
+	msgB, mk, err := cpace.Exchange(pass, cfg.contextInfo(), msgA)
+	if err != nil {
+		return c.fail(err)
+	}
+	key, err := cfg.deriveKey(mk)
+	if err != nil {
+		return c.fail(err)
+	}
+	if err := c.keep(mk, true); err != nil {
+		return c.fail(err)
+	}
+
+	err = c.newPeerConnection(cfg, cfg.iceServers(ice))
+	if err != nil {
+		return c.fail(err)
+	}
+	offer, err := c.pc.CreateOffer(nil)
+	if err != nil {
+		return c.fail(err)
+	}
+	sealed, err := c.sealDescription(cfg, &key, offer)
+	if err != nil {
+		return c.fail(err)
+	}
+	if err := s.Send(base64.URLEncoding.EncodeToString(msgB) + "." + sealed); err != nil {
+		return c.fail(err)
+	}
+	c.logf("have key, sent B pake msg (%v bytes) and offer", len(msgB))
+
+	reply, err := s.Receive()
+	if err != nil {
+		return c.fail(err)
+	}
+	answer, err := c.openDescription(cfg, &key, strings.TrimSpace(reply))
+	if err != nil {
+		return c.fail(err)
+	}
+	if err := c.setRemoteDescription(answer); err != nil {
+		return c.fail(err)
+	}
+	c.logf("got answer")
+	return c.waitOpen(cfg)
+}
+
+// manual returns a copy of cfg set up for a manual handshake.
+func (cfg *Config) manual() *Config {
+	m := *cfg
+	m.NoTrickle = true
+	m.CompressSDP = true
+	return &m
+}
+
+// sealDescription gathers every candidate into sd, and returns it sealed
+// with key to send to the peer.
+func (c *Wormhole) sealDescription(cfg *Config, key *[32]byte, sd webrtc.SessionDescription) (string, error) {
+	sd, err := c.gatherDescription(cfg, sd)
+	if err != nil {
+		return "", err
+	}
+	candidates := sdpCandidates(sd.SDP)
+	if typ := exposedType(cfg, candidates); typ != "" {
+		c.logf("aborting rather than send %v with a %v candidate", sd.Type, typ)
+		return "", ErrCandidateExposed
+	}
+	sealed, err := sealJSON(cfg, key, description{sd, cfg.Metadata, cfg.Tunnel})
+	if err != nil {
+		return "", err
+	}
+	c.update(func(d *Diagnostics) {
+		d.SentCandidates = append(d.SentCandidates, candidates...)
+	})
+	return sealed, nil
+}
+
+// openDescription opens the peer's session description, sealed with key,
+// keeping what came with it.
+func (c *Wormhole) openDescription(cfg *Config, key *[32]byte, msg string) (webrtc.SessionDescription, error) {
+	var s signal
+	if err := openJSON(cfg, key, msg, &s); err != nil {
+		if _, ok := err.(base64.CorruptInputError); ok {
+			return s.SessionDescription, ErrBadMessage
+		}
+		return s.SessionDescription, err
+	}
+	if s.SDP == "" {
+		return s.SessionDescription, ErrBadMessage
+	}
+	return s.SessionDescription, c.peerDescription(cfg, s)
+}
+
+// defaultManualTimeout is how long waitOpen waits by default. It is long
+// since the peer may only just be pasting our last message.
+const defaultManualTimeout = 10 * time.Minute
+
+// waitOpen waits for the DataChannel to open once both descriptions are
+// set, for up to cfg.ManualTimeout.
+func (c *Wormhole) waitOpen(cfg *Config) (*Wormhole, error) {
+	timeout := cfg.ManualTimeout
+	if timeout == 0 {
+		timeout = defaultManualTimeout
+	}
+	select {
+	case <-c.opened:
+		c.logf("webrtc connection succeeded (relay: %v)", c.IsRelay())
+		return c, nil
+	case err := <-c.err:
+		return c.fail(err)
+	case <-c.norelay:
+		return c.fail(ErrNoRelayCandidate)
+	case <-time.After(timeout):
+		return c.fail(c.timeoutError())
+	}
+}
@@ -0,0 +1,124 @@
+package wormhole
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	webrtc "github.com/pion/webrtc/v3"
+)
+
+// pipeSignaller passes messages as lines over in-memory pipes, the way a
+// user copying and pasting them would.
+type pipeSignaller struct {
+	w    io.Writer
+	r    *bufio.Scanner
+	sent []string
+}
+
+func (s *pipeSignaller) Send(msg string) error {
+	if strings.ContainsAny(msg, "\r\n") {
+		return fmt.Errorf("message is not a single line: %q", msg)
+	}
+	s.sent = append(s.sent, msg)
+	_, err := fmt.Fprintln(s.w, msg)
+	return err
+}
+
+func (s *pipeSignaller) Receive() (string, error) {
+	if !s.r.Scan() {
+		if s.r.Err() != nil {
+			return "", s.r.Err()
+		}
+		return "", io.EOF
+	}
+	return s.r.Text(), nil
+}
+
+func signallers() (a, b *pipeSignaller) {
+	ra, wb := io.Pipe()
+	rb, wa := io.Pipe()
+	newScanner := func(r io.Reader) *bufio.Scanner {
+		s := bufio.NewScanner(r)
+		s.Buffer(nil, 1<<20)
+		return s
+	}
+	return &pipeSignaller{w: wa, r: newScanner(ra)}, &pipeSignaller{w: wb, r: newScanner(rb)}
+}
+
+func manualPair(t *testing.T, ca, cb *Config, passa, passb string) (a, b *Wormhole, erra, errb error, sa, sb *pipeSignaller) {
+	t.Helper()
+	sa, sb = signallers()
+	errc := make(chan error, 1)
+	go func() {
+		var err error
+		b, err = cb.AnswerManual(passb, sb, nil)
+		if err != nil {
+			// Unblock the peer.
+			sb.w.(*io.PipeWriter).CloseWithError(err)
+		}
+		errc <- err
+	}()
+	a, erra = ca.StartManual(passa, sa, nil)
+	if erra != nil {
+		sa.w.(*io.PipeWriter).CloseWithError(erra)
+	}
+	errb = <-errc
+	return a, b, erra, errb, sa, sb
+}
+
+func TestManual(t *testing.T) {
+	a, b, erra, errb, sa, sb := manualPair(t,
+		&Config{Metadata: []byte("from a")}, &Config{Metadata: []byte("from b")},
+		"pass", "pass")
+	if erra != nil || errb != nil {
+		t.Fatalf("could not connect: %v, %v", erra, errb)
+	}
+	// Close the writer first, so it isn't left waiting for an
+	// acknowledgement the closed reader will never send.
+	defer b.Close()
+	defer a.Close()
+	if len(sa.sent) != 2 || len(sb.sent) != 1 {
+		t.Errorf("sent %d and %d messages, want 2 and 1", len(sa.sent), len(sb.sent))
+	}
+	if string(a.Metadata()) != "from b" || string(b.Metadata()) != "from a" {
+		t.Errorf("got metadata %q and %q", a.Metadata(), b.Metadata())
+	}
+
+	go a.Write([]byte("hello"))
+	buf := make([]byte, 10)
+	n, err := b.Read(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Errorf("got %q, %v want hello", buf[:n], err)
+	}
+}
+
+func TestManualBadKey(t *testing.T) {
+	_, _, erra, _, _, _ := manualPair(t, &Config{}, &Config{}, "pass", "wrong")
+	if erra != ErrBadKey {
+		t.Errorf("got %v want %v", erra, ErrBadKey)
+	}
+
+	pr, pw := io.Pipe()
+	go fmt.Fprintln(pw, "not a message")
+	if _, err := (&Config{}).StartManual("pass", &pipeSignaller{w: io.Discard, r: bufio.NewScanner(pr)}, nil); err != ErrBadMessage {
+		t.Errorf("got %v want %v", err, ErrBadMessage)
+	}
+}
+
+func TestManualICEServers(t *testing.T) {
+	// Config.ICEServers are used without a signalling server too: relaying
+	// only works if the TURN server given there is.
+	cfg := &Config{RelayOnly: true, ICEServers: []webrtc.ICEServer{turnServer(t)}}
+	a, b, erra, errb, _, _ := manualPair(t, cfg, cfg, "pass", "pass")
+	if erra != nil || errb != nil {
+		t.Fatalf("could not connect: %v, %v", erra, errb)
+	}
+	defer b.Close()
+	defer a.Close()
+	if !a.IsRelay() || !b.IsRelay() {
+		t.Errorf("got IsRelay %v and %v want true", a.IsRelay(), b.IsRelay())
+	}
+}
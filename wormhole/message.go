@@ -0,0 +1,69 @@
+package wormhole
+
+import (
+	"io"
+	"sync"
+
+	webrtc "github.com/pion/webrtc/v3"
+)
+
+// messageConn is an io.ReadWriteCloser over a DataChannel that is not
+// detached. It is slower than a detached one, since every message goes
+// through a callback and a channel, but works without the SettingEngine's
+// help. Like a detached DataChannel, each Read returns one message.
+type messageConn struct {
+	d *webrtc.DataChannel
+
+	msgs chan []byte
+	// eof is closed when the DataChannel closes, and closed when Close is
+	// called.
+	eof, closed         chan struct{}
+	eofOnce, closedOnce sync.Once
+}
+
+func newMessageConn(d *webrtc.DataChannel) *messageConn {
+	m := &messageConn{
+		d:      d,
+		msgs:   make(chan []byte),
+		eof:    make(chan struct{}),
+		closed: make(chan struct{}),
+	}
+	// Blocking here until the message is read holds up the DataChannel's
+	// read loop, which is what stops the peer from sending too much.
+	d.OnMessage(func(msg webrtc.DataChannelMessage) {
+		select {
+		case m.msgs <- msg.Data:
+		case <-m.closed:
+		}
+	})
+	d.OnClose(func() {
+		m.eofOnce.Do(func() { close(m.eof) })
+	})
+	return m
+}
+
+func (m *messageConn) Read(p []byte) (int, error) {
+	select {
+	case msg := <-m.msgs:
+		if len(msg) > len(p) {
+			return 0, io.ErrShortBuffer
+		}
+		return copy(p, msg), nil
+	case <-m.eof:
+		return 0, io.EOF
+	case <-m.closed:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+func (m *messageConn) Write(p []byte) (int, error) {
+	if err := m.d.Send(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (m *messageConn) Close() error {
+	m.closedOnce.Do(func() { close(m.closed) })
+	return m.d.Close()
+}
@@ -0,0 +1,302 @@
+package wormhole
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"nhooyr.io/websocket"
+)
+
+// MuxProtocol is the WebSocket subprotocol for carrying many signalling
+// connections over one, as Client does. Each message on it is a frame: a
+// 4 byte stream ID, a 1 byte op, and the op's payload.
+//
+//	open:   the path the stream would have been dialed on, e.g. "/42"
+//	text:   a text message on the stream
+//	binary: a binary message on the stream
+//	close:  a 2 byte status code followed by the reason
+//
+// Streams are opened with odd IDs by the side that dialed, and even ones by
+// the side that accepted.
+const MuxProtocol = Protocol + ".mux"
+
+const (
+	muxOpen = iota
+	muxText
+	muxBinary
+	muxClose
+)
+
+// muxQueue is how many messages a stream holds before its reader falls too
+// far behind and the stream is closed.
+const muxQueue = 64
+
+// muxReadLimit is the largest message a stream reads, the same as the
+// websocket package's default for a WebSocket.
+const muxReadLimit = 32768
+
+// errMuxClosed is returned by streams of a Mux that has been closed.
+var errMuxClosed = errors.New("wormhole: multiplexed connection closed")
+
+// sigConn is a connection to the signalling server: a WebSocket, or a
+// stream of one shared with a Mux.
+type sigConn interface {
+	Read(ctx context.Context) (websocket.MessageType, []byte, error)
+	Write(ctx context.Context, typ websocket.MessageType, p []byte) error
+	Close(code websocket.StatusCode, reason string) error
+}
+
+// A Mux carries many streams, each standing in for a signalling WebSocket,
+// over one WebSocket using MuxProtocol.
+type Mux struct {
+	ws     *websocket.Conn
+	accept chan *MuxConn
+
+	// done is closed, with err set, once ws fails.
+	done chan struct{}
+	err  error
+
+	mu      sync.Mutex
+	streams map[uint32]*MuxConn
+	next    uint32
+}
+
+// NewMux starts multiplexing streams over ws, which must have negotiated
+// MuxProtocol. dialed is whether this side dialed ws.
+func NewMux(ws *websocket.Conn, dialed bool) *Mux {
+	m := &Mux{
+		ws:      ws,
+		accept:  make(chan *MuxConn, muxQueue),
+		done:    make(chan struct{}),
+		streams: make(map[uint32]*MuxConn),
+		next:    2,
+	}
+	if dialed {
+		m.next = 1
+	}
+	// Leave room for the frame header in messages as large as a
+	// WebSocket's own.
+	ws.SetReadLimit(muxReadLimit + 5)
+	go m.readLoop()
+	return m
+}
+
+// Open opens a stream to be handled as if dialed on path.
+func (m *Mux) Open(ctx context.Context, path string) (*MuxConn, error) {
+	m.mu.Lock()
+	if m.streams == nil {
+		m.mu.Unlock()
+		return nil, m.err
+	}
+	s := m.newStream(m.next, path)
+	m.next += 2
+	m.mu.Unlock()
+	if err := m.write(ctx, s.id, muxOpen, []byte(path)); err != nil {
+		m.remove(s.id)
+		return nil, err
+	}
+	return s, nil
+}
+
+// Accept waits for the peer to open a stream.
+func (m *Mux) Accept(ctx context.Context) (*MuxConn, error) {
+	select {
+	case s := <-m.accept:
+		return s, nil
+	case <-m.done:
+		return nil, m.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Done is closed once the Mux's WebSocket fails or is closed, along with
+// all its streams.
+func (m *Mux) Done() <-chan struct{} {
+	return m.done
+}
+
+// Close closes the Mux's WebSocket, and with it all its streams.
+func (m *Mux) Close() error {
+	return m.ws.Close(websocket.StatusNormalClosure, "")
+}
+
+// newStream adds a stream with id. m.mu must be held, and m not done.
+func (m *Mux) newStream(id uint32, path string) *MuxConn {
+	s := &MuxConn{
+		m:      m,
+		id:     id,
+		path:   path,
+		msgs:   make(chan muxMessage, muxQueue),
+		closed: make(chan struct{}),
+	}
+	m.streams[id] = s
+	return s
+}
+
+func (m *Mux) remove(id uint32) {
+	m.mu.Lock()
+	delete(m.streams, id)
+	m.mu.Unlock()
+}
+
+func (m *Mux) write(ctx context.Context, id uint32, op byte, p []byte) error {
+	frame := make([]byte, 5+len(p))
+	binary.BigEndian.PutUint32(frame, id)
+	frame[4] = op
+	copy(frame[5:], p)
+	return m.ws.Write(ctx, websocket.MessageBinary, frame)
+}
+
+func (m *Mux) readLoop() {
+	var err error
+	defer func() {
+		m.mu.Lock()
+		m.err = err
+		streams := m.streams
+		m.streams = nil
+		m.mu.Unlock()
+		close(m.done)
+		for _, s := range streams {
+			s.end(err)
+		}
+	}()
+	for {
+		var frame []byte
+		_, frame, err = m.ws.Read(context.Background())
+		if err != nil {
+			return
+		}
+		if len(frame) < 5 {
+			m.ws.Close(websocket.StatusProtocolError, "short frame")
+			err = errMuxClosed
+			return
+		}
+		id, op, p := binary.BigEndian.Uint32(frame), frame[4], frame[5:]
+		m.mu.Lock()
+		s := m.streams[id]
+		if op == muxOpen && s == nil && id%2 != m.next%2 {
+			s = m.newStream(id, string(p))
+			select {
+			case m.accept <- s:
+			default:
+				// No one is accepting them.
+				delete(m.streams, id)
+				s = nil
+			}
+		}
+		m.mu.Unlock()
+		if s == nil {
+			// Left over from a stream that is gone.
+			continue
+		}
+		switch op {
+		case muxText, muxBinary:
+			typ := websocket.MessageText
+			if op == muxBinary {
+				typ = websocket.MessageBinary
+			}
+			select {
+			case s.msgs <- muxMessage{typ, p}:
+			default:
+				s.Close(websocket.StatusPolicyViolation, "too many messages")
+			}
+		case muxClose:
+			ce := websocket.CloseError{Code: websocket.StatusNoStatusRcvd}
+			if len(p) >= 2 {
+				ce.Code = websocket.StatusCode(binary.BigEndian.Uint16(p))
+				ce.Reason = string(p[2:])
+			}
+			m.remove(id)
+			s.end(ce)
+		}
+	}
+}
+
+type muxMessage struct {
+	typ websocket.MessageType
+	p   []byte
+}
+
+// A MuxConn is a stream of a Mux. It is used like the WebSocket it stands
+// in for: messages are read and written whole, and closing it with a
+// status code is seen by the peer as a websocket.CloseError.
+type MuxConn struct {
+	m    *Mux
+	id   uint32
+	path string
+	msgs chan muxMessage
+
+	once   sync.Once
+	closed chan struct{}
+	err    error
+}
+
+// Path returns the path the stream was opened for.
+func (s *MuxConn) Path() string {
+	return s.path
+}
+
+// end stops the stream, with Read returning err once the messages already
+// received are read.
+func (s *MuxConn) end(err error) {
+	s.once.Do(func() {
+		s.err = err
+		close(s.closed)
+	})
+}
+
+// Read reads the next message on the stream.
+func (s *MuxConn) Read(ctx context.Context) (websocket.MessageType, []byte, error) {
+	select {
+	case msg := <-s.msgs:
+		return msg.typ, msg.p, nil
+	default:
+	}
+	select {
+	case msg := <-s.msgs:
+		return msg.typ, msg.p, nil
+	case <-s.closed:
+		return 0, nil, s.err
+	case <-ctx.Done():
+		return 0, nil, ctx.Err()
+	}
+}
+
+// Write writes a message to the stream.
+func (s *MuxConn) Write(ctx context.Context, typ websocket.MessageType, p []byte) error {
+	select {
+	case <-s.closed:
+		return s.err
+	default:
+	}
+	op := byte(muxText)
+	if typ == websocket.MessageBinary {
+		op = muxBinary
+	}
+	return s.m.write(ctx, s.id, op, p)
+}
+
+// Close closes the stream with code and reason. Reads after it return
+// them as a websocket.CloseError, like a closed WebSocket's do.
+func (s *MuxConn) Close(code websocket.StatusCode, reason string) error {
+	select {
+	case <-s.closed:
+		return nil
+	default:
+	}
+	s.end(websocket.CloseError{Code: code, Reason: reason})
+	s.m.remove(s.id)
+	p := make([]byte, 2+len(reason))
+	binary.BigEndian.PutUint16(p, uint16(code))
+	copy(p[2:], reason)
+	return s.m.write(context.Background(), s.id, muxClose, p)
+}
+
+// Ping does nothing, since it is the Mux's WebSocket that needs keeping
+// alive rather than its streams.
+func (s *MuxConn) Ping(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,95 @@
+package wormhole
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"nhooyr.io/websocket"
+)
+
+// muxPair returns the two ends of a Mux over a real WebSocket.
+func muxPair(t *testing.T) (dialed, accepted *Mux) {
+	t.Helper()
+	muxc := make(chan *Mux, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{Subprotocols: []string{MuxProtocol}})
+		if err != nil {
+			return
+		}
+		m := NewMux(conn, false)
+		muxc <- m
+		<-m.Done()
+	}))
+	t.Cleanup(srv.Close)
+	ws, _, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http"), &websocket.DialOptions{
+		Subprotocols: []string{MuxProtocol},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialed = NewMux(ws, true)
+	t.Cleanup(func() { dialed.Close() })
+	return dialed, <-muxc
+}
+
+func TestMux(t *testing.T) {
+	ctx := context.Background()
+	a, b := muxPair(t)
+
+	s1, err := a.Open(ctx, "/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := a.Open(ctx, "/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []*MuxConn{s1, s2} {
+		if err := s.Write(ctx, websocket.MessageText, []byte("hello "+s.Path())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{"/1", "/2"} {
+		s, err := b.Accept(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Path() != want {
+			t.Errorf("accepted %q want %q", s.Path(), want)
+		}
+		typ, p, err := s.Read(ctx)
+		if err != nil || typ != websocket.MessageText || string(p) != "hello "+want {
+			t.Errorf("stream %v: got %v %q, %v", want, typ, p, err)
+		}
+		if err := s.Close(CloseBadKey, "bad key"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Close codes get through, like on a WebSocket of their own.
+	for _, s := range []*MuxConn{s1, s2} {
+		_, _, err := s.Read(ctx)
+		if websocket.CloseStatus(err) != CloseBadKey {
+			t.Errorf("stream %v: got %v want close status %v", s.Path(), err, CloseBadKey)
+		}
+		if err := s.Write(ctx, websocket.MessageText, []byte("late")); err == nil {
+			t.Errorf("stream %v: wrote after close", s.Path())
+		}
+	}
+
+	// Closing the Mux ends its streams.
+	s3, err := a.Open(ctx, "/3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+	if _, _, err := s3.Read(ctx); err == nil {
+		t.Error("read from a stream of a closed Mux")
+	}
+	if _, err := a.Open(ctx, "/4"); err == nil {
+		t.Error("opened a stream on a closed Mux")
+	}
+}
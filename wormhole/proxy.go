@@ -0,0 +1,154 @@
+package wormhole
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+
+	"golang.org/x/net/proxy"
+)
+
+// connectDialer dials via an HTTP proxy using the CONNECT method, sending
+// basic Proxy-Authorization if the proxy URL has user info.
+type connectDialer struct {
+	proxy   *url.URL
+	forward proxy.Dialer
+}
+
+func newConnectDialer(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	return &connectDialer{proxy: u, forward: forward}, nil
+}
+
+func (d *connectDialer) Dial(network, addr string) (net.Conn, error) {
+	host := d.proxy.Host
+	if d.proxy.Port() == "" {
+		host = net.JoinHostPort(d.proxy.Hostname(), "80")
+	}
+	conn, err := d.forward.Dial("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if auth := proxyAuth(d.proxy); auth != "" {
+		req.Header.Set("Proxy-Authorization", auth)
+	}
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy: %v", resp.Status)
+	}
+	return &bufferedConn{conn, br}, nil
+}
+
+// bufferedConn is a net.Conn that first reads whatever was left in the
+// buffer used to read the proxy's response.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// proxyAuth returns the value of a basic Proxy-Authorization header for the
+// user info in u, or the empty string if there is none.
+func proxyAuth(u *url.URL) string {
+	if u.User == nil {
+		return ""
+	}
+	pass, _ := u.User.Password()
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+pass))
+}
+
+// iceDialer returns the dialer used for ICE TCP connections, going via
+// proxyURL if it is set or the environment's ALL_PROXY otherwise, except for
+// hosts in NO_PROXY.
+func iceDialer(proxyURL *url.URL) proxy.Dialer {
+	if proxyURL != nil {
+		d, err := proxyDialer(proxyURL)
+		if err != nil {
+			logf("cannot use proxy %v: %v", proxyURL.Redacted(), err)
+			return proxy.Direct
+		}
+		return d
+	}
+	env := getenv("ALL_PROXY", "all_proxy")
+	if env == "" {
+		return proxy.Direct
+	}
+	u, err := url.Parse(env)
+	if err != nil {
+		return proxy.Direct
+	}
+	d, err := proxyDialer(u)
+	if err != nil {
+		return proxy.Direct
+	}
+	if noProxy := getenv("NO_PROXY", "no_proxy"); noProxy != "" {
+		perHost := proxy.NewPerHost(d, proxy.Direct)
+		perHost.AddFromString(noProxy)
+		return perHost
+	}
+	return d
+}
+
+// proxyDialer returns a dialer going via the proxy at u. golang.org/x/net/proxy
+// only knows about SOCKS5, so HTTP CONNECT proxies are handled here rather
+// than registered with it, which would affect every user of that package.
+func proxyDialer(u *url.URL) (proxy.Dialer, error) {
+	if u.Scheme == "http" {
+		return newConnectDialer(u, proxy.Direct)
+	}
+	return proxy.FromURL(u, proxy.Direct)
+}
+
+// getenv returns the first of the named environment variables that is set.
+func getenv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// httpClient returns the client used to dial the signalling server, going
+// via proxyURL if it is set or the environment's HTTPS_PROXY otherwise.
+// net/http sends credentials in proxyURL in Proxy-Authorization itself.
+func httpClient(proxyURL *url.URL, tlsConfig *tls.Config) *http.Client {
+	if proxyURL == nil && tlsConfig == nil {
+		return http.DefaultClient
+	}
+	proxy := http.ProxyFromEnvironment
+	if proxyURL != nil {
+		proxy = http.ProxyURL(proxyURL)
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           proxy,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+}
@@ -0,0 +1,101 @@
+package wormhole
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"golang.org/x/net/proxy"
+)
+
+// authProxy is a stub proxy that records the Proxy-Authorization header of
+// requests and echoes back anything sent over CONNECT tunnels.
+func authProxy(t *testing.T, auth chan<- string) *url.URL {
+	t.Helper()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth <- r.Header.Get("Proxy-Authorization")
+		if r.Method != http.MethodConnect {
+			http.Error(w, "nope", http.StatusForbidden)
+			return
+		}
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		io.Copy(conn, buf)
+	}))
+	t.Cleanup(s.Close)
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.User = url.UserPassword("alice", "hunter2")
+	return u
+}
+
+const wantAuth = "Basic YWxpY2U6aHVudGVyMg=="
+
+func TestICEProxyAuth(t *testing.T) {
+	auth := make(chan string, 1)
+	u := authProxy(t, auth)
+
+	conn, err := iceDialer(u).Dial("tcp", "turn.example:3478")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := <-auth; got != wantAuth {
+		t.Errorf("got Proxy-Authorization %q want %q", got, wantAuth)
+	}
+
+	_, err = conn.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("tunnel got %q want %q", buf, "ping")
+	}
+}
+
+func TestSignallingProxyAuth(t *testing.T) {
+	auth := make(chan string, 1)
+	cfg := &Config{Proxy: authProxy(t, auth)}
+
+	_, err := cfg.dial("http://signal.example/", "")
+	if err == nil {
+		t.Fatal("dial through rejecting proxy succeeded")
+	}
+	if got := <-auth; got != wantAuth {
+		t.Errorf("got Proxy-Authorization %q want %q", got, wantAuth)
+	}
+}
+
+func TestICEProxyEnv(t *testing.T) {
+	auth := make(chan string, 1)
+	u := authProxy(t, auth)
+	t.Setenv("ALL_PROXY", u.String())
+	t.Setenv("all_proxy", "")
+	t.Setenv("NO_PROXY", "direct.example")
+
+	conn, err := iceDialer(nil).Dial("tcp", "turn.example:3478")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if got := <-auth; got != wantAuth {
+		t.Errorf("got Proxy-Authorization %q want %q", got, wantAuth)
+	}
+	if _, ok := iceDialer(nil).(*proxy.PerHost); !ok {
+		t.Error("NO_PROXY ignored")
+	}
+}
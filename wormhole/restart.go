@@ -0,0 +1,152 @@
+package wormhole
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	webrtc "github.com/pion/webrtc/v3"
+)
+
+// restartRequest asks the peer that created the slot to restart ICE. Only
+// it sends restart offers, so the two peers never send offers at once.
+type restartRequest struct {
+	Restart bool `json:"restart"`
+}
+
+// RestartICE restarts ICE, gathering new candidates and exchanging them
+// with the peer over the signalling channel, and waits until the peers are
+// connected again or ctx is done. Use it when the network changes, e.g. a
+// laptop moves from Wi-Fi to ethernet, and the connection breaks. Reads and
+// writes carry on once it reconnects.
+//
+// Both peers must have set Config.KeepSignalling. Either peer can call it.
+func (c *Wormhole) RestartICE(ctx context.Context) error {
+	if c.parent != nil {
+		return c.parent.RestartICE(ctx)
+	}
+	if c.ws == nil || c.signallingClosed() {
+		return ErrNoSignalling
+	}
+	c.statemu.Lock()
+	restarts := c.restarts
+	c.statemu.Unlock()
+
+	var err error
+	if c.created {
+		err = c.restartICE(c.cfg, c.ws, &c.key)
+	} else {
+		c.logf("asking peer to restart ice")
+		err = writeEncJSON(c.ws, c.cfg, &c.key, restartRequest{true})
+	}
+	if c.signallingClosed() {
+		return ErrNoSignalling
+	}
+	if err != nil {
+		return err
+	}
+
+	for {
+		c.statemu.Lock()
+		restarted, changed := c.restarts > restarts, c.changed
+		c.statemu.Unlock()
+		if restarted {
+			switch c.pc.ICEConnectionState() {
+			case webrtc.ICEConnectionStateConnected, webrtc.ICEConnectionStateCompleted:
+				c.logf("ice restart succeeded")
+				return nil
+			}
+		}
+		select {
+		case <-changed:
+		case <-c.sigclosed:
+			return ErrNoSignalling
+		case <-c.done:
+			return ErrClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// restartICE sends the peer an offer restarting ICE, unless one is
+// already waiting for its answer.
+func (c *Wormhole) restartICE(cfg *Config, ws sigConn, key *[32]byte) error {
+	c.restartmu.Lock()
+	defer c.restartmu.Unlock()
+	if c.pc.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+		c.logf("ice restart already in progress")
+		return nil
+	}
+	c.logf("restarting ice")
+	offer, err := c.pc.CreateOffer(&webrtc.OfferOptions{ICERestart: true})
+	if err != nil {
+		return err
+	}
+	return c.setLocalDescription(cfg, ws, key, offer)
+}
+
+// handleRestart handles a restart request, offer or answer from the peer.
+func (c *Wormhole) handleRestart(cfg *Config, ws sigConn, key *[32]byte, s signal) error {
+	switch {
+	case s.Restart:
+		if !c.created {
+			return errors.New("peer that created the slot asked us to restart")
+		}
+		c.logf("peer asked for an ice restart")
+		return c.restartICE(cfg, ws, key)
+	case s.Type == webrtc.SDPTypeOffer:
+		c.logf("got ice restart offer")
+		err := c.setRemoteDescription(s.SessionDescription)
+		if err != nil {
+			return err
+		}
+		c.stateChanged(true)
+		answer, err := c.pc.CreateAnswer(nil)
+		if err != nil {
+			return err
+		}
+		return c.setLocalDescription(cfg, ws, key, answer)
+	case s.Type == webrtc.SDPTypeAnswer:
+		c.logf("got ice restart answer")
+		err := c.setRemoteDescription(s.SessionDescription)
+		if err != nil {
+			return err
+		}
+		c.stateChanged(true)
+		return nil
+	}
+	return fmt.Errorf("unexpected %v from peer", s.Type)
+}
+
+// stateChanged wakes up RestartICE calls waiting for the ICE connection
+// state to change, counting a restart first if restarted is set.
+func (c *Wormhole) stateChanged(restarted bool) {
+	c.statemu.Lock()
+	defer c.statemu.Unlock()
+	if restarted {
+		c.restarts++
+	}
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// signallingClosed reports whether the signalling channel is gone.
+func (c *Wormhole) signallingClosed() bool {
+	select {
+	case <-c.sigclosed:
+		return true
+	default:
+		return false
+	}
+}
+
+// closeSignalling closes the signalling channel kept open by
+// Config.KeepSignalling, telling the server how the connection went.
+func (c *Wormhole) closeSignalling() {
+	if c.IsRelay() {
+		c.ws.Close(CloseWebRTCSuccessRelay, "")
+	} else {
+		c.ws.Close(CloseWebRTCSuccessDirect, "")
+	}
+}
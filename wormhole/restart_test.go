@@ -0,0 +1,176 @@
+package wormhole
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/logging"
+	"github.com/pion/transport/v2/vnet"
+	webrtc "github.com/pion/webrtc/v3"
+	"nhooyr.io/websocket"
+)
+
+// signalServer starts a bare signalling server for one pair of peers, on
+// slot 1, that relays messages between them until either hangs up.
+func signalServer(t *testing.T) string {
+	t.Helper()
+	return recordingSignalServer(t, nil)
+}
+
+// recordingSignalServer is like signalServer, but also passes each message
+// it relays to record, if not nil.
+func recordingSignalServer(t *testing.T, record func(p []byte)) string {
+	t.Helper()
+	conns := make(chan *websocket.Conn, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{Subprotocols: []string{Protocol}})
+		if err != nil {
+			return
+		}
+		buf, _ := json.Marshal(initMsg{Slot: "1"})
+		conn.Write(context.Background(), websocket.MessageText, buf)
+		conns <- conn
+	}))
+	t.Cleanup(srv.Close)
+	pipe := func(from, to *websocket.Conn) {
+		for {
+			typ, p, err := from.Read(context.Background())
+			if err != nil {
+				to.Close(websocket.StatusNormalClosure, "peer hung up")
+				return
+			}
+			if record != nil {
+				record(p)
+			}
+			if to.Write(context.Background(), typ, p) != nil {
+				return
+			}
+		}
+	}
+	go func() {
+		a, b := <-conns, <-conns
+		go pipe(a, b)
+		pipe(b, a)
+	}()
+	return srv.URL
+}
+
+// virtualNet returns settings putting a peer on a virtual network, and a
+// switch to drop every packet on it.
+func virtualNet(t *testing.T) (a, b func(*webrtc.SettingEngine), broken *atomic.Bool) {
+	t.Helper()
+	router, err := vnet.NewRouter(&vnet.RouterConfig{
+		CIDR:          "10.0.0.0/24",
+		LoggerFactory: logging.NewDefaultLoggerFactory(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken = &atomic.Bool{}
+	router.AddChunkFilter(func(vnet.Chunk) bool { return !broken.Load() })
+	settings := func(ip string) func(*webrtc.SettingEngine) {
+		n, err := vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{ip}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := router.AddNet(n); err != nil {
+			t.Fatal(err)
+		}
+		return func(s *webrtc.SettingEngine) {
+			s.SetNet(n)
+			s.SetICEMulticastDNSMode(ice.MulticastDNSModeDisabled)
+			s.SetICETimeouts(time.Second, 2*time.Second, 200*time.Millisecond)
+		}
+	}
+	a, b = settings("10.0.0.1"), settings("10.0.0.2")
+	if err := router.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { router.Stop() })
+	return a, b, broken
+}
+
+// waitICE waits for c's ICE connection state to become want.
+func waitICE(t *testing.T, c *Wormhole, want webrtc.ICEConnectionState) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); c.pc.ICEConnectionState() != want; time.Sleep(50 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("ice connection state is %v, want %v", c.pc.ICEConnectionState(), want)
+		}
+	}
+}
+
+func roundTrip(t *testing.T, from, to *Wormhole, msg string) {
+	t.Helper()
+	if _, err := from.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, err := to.Read(buf)
+	if err != nil || string(buf[:n]) != msg {
+		t.Fatalf("got %q, %v want %q", buf[:n], err, msg)
+	}
+}
+
+func TestRestartICE(t *testing.T) {
+	sigserv := signalServer(t)
+	seta, setb, broken := virtualNet(t)
+
+	bc := make(chan *Wormhole, 1)
+	go func() {
+		b, err := (&Config{KeepSignalling: true, settings: setb}).Join("1", "pass", sigserv)
+		if err != nil {
+			t.Error(err)
+		}
+		bc <- b
+	}()
+	a, err := (&Config{KeepSignalling: true, settings: seta}).New("pass", sigserv, make(chan string, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b := <-bc
+	if b == nil {
+		t.FailNow()
+	}
+	defer b.Close()
+	roundTrip(t, a, b, "before")
+
+	// Cut the network long enough for the candidate pair to fail, then
+	// bring it back. Without a restart, the peers stay disconnected.
+	broken.Store(true)
+	waitICE(t, a, webrtc.ICEConnectionStateFailed)
+	waitICE(t, b, webrtc.ICEConnectionStateFailed)
+	broken.Store(false)
+
+	// The peer that joined asks the one that created the slot to restart.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := b.RestartICE(ctx); err != nil {
+		t.Fatalf("b restart: %v", err)
+	}
+	waitICE(t, a, webrtc.ICEConnectionStateConnected)
+	roundTrip(t, a, b, "after")
+	roundTrip(t, b, a, "back")
+
+	// And the other way round.
+	if err := a.RestartICE(ctx); err != nil {
+		t.Fatalf("a restart: %v", err)
+	}
+	roundTrip(t, a, b, "again")
+}
+
+func TestRestartICENoSignalling(t *testing.T) {
+	a, b := pair(t)
+	defer a.Close()
+	defer b.Close()
+	if err := a.RestartICE(context.Background()); err != ErrNoSignalling {
+		t.Errorf("got %v want %v", err, ErrNoSignalling)
+	}
+}
@@ -0,0 +1,45 @@
+package wormhole
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestShortAuthString(t *testing.T) {
+	a, b, erra, errb := signalPair(t, &Config{}, &Config{})
+	if erra != nil || errb != nil {
+		t.Fatal(erra, errb)
+	}
+	defer b.Close()
+	defer a.Close()
+
+	sasa, err := a.ShortAuthString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sasb, err := b.ShortAuthString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sasa != sasb {
+		t.Errorf("creator got %q, joiner got %q", sasa, sasb)
+	}
+	if words := strings.Split(sasa, "-"); len(words) != sasBytes {
+		t.Errorf("got %q want %d words", sasa, sasBytes)
+	}
+
+	// Another connection with the same password gets a different one.
+	c, d, errc, errd := signalPair(t, &Config{}, &Config{})
+	if errc != nil || errd != nil {
+		t.Fatal(errc, errd)
+	}
+	defer d.Close()
+	defer c.Close()
+	if sasc, err := c.ShortAuthString(); err != nil || sasc == sasa {
+		t.Errorf("got %q, %v for another connection", sasc, err)
+	}
+
+	if _, err := newWormhole().ShortAuthString(); err == nil {
+		t.Error("got a short authentication string before connecting")
+	}
+}
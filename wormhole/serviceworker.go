@@ -0,0 +1,145 @@
+package wormhole
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ServiceWorkerPrefix is the path under which the web client's Service Worker
+// serves files it downloads over a Wormhole, so the browser can save them
+// like any other download. It has to be PREFIX in web/sw.ts followed by a
+// slash, which is what the Service Worker matches paths against.
+const ServiceWorkerPrefix = "/_/"
+
+// ServiceWorkerPage is the text the signalling server returns for paths under
+// ServiceWorkerPrefix. Browsers only see it if the Service Worker isn't
+// running.
+const ServiceWorkerPage = `You're not supposed to get this file or end up here.
+
+This is a dummy URL is used by WebWormhole to help web browsers
+efficiently download files from a WebRTC connection. It should be
+handled entirely by a ServiceWorker running in your browser.
+
+If you got this text instead of the file you expected to download,
+it is possible your web browser doesn't fully support ServiceWorkers
+but claims it does. Try a different web browser, and if that doesn't
+work, please file a bug report.
+`
+
+// ServiceWorkerPath returns the path the Service Worker serves the download
+// with the given id at.
+func ServiceWorkerPath(id string) string {
+	return ServiceWorkerPrefix + url.PathEscape(id)
+}
+
+// ServiceWorkerHandler returns a handler that answers requests under
+// ServiceWorkerPrefix with ServiceWorkerPage and a 404, and passes all others
+// to next. A well-behaved Service Worker must never let a request reach it.
+func ServiceWorkerHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, ServiceWorkerPrefix) {
+			http.Error(w, ServiceWorkerPage, http.StatusNotFound)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ServiceWorkerDownload serves a file being received over a Wormhole the way
+// the Service Worker does, for Go programs that stand in for it, e.g. ww
+// receive -http. Unlike a stream that can only be read once, it answers Range
+// requests, so the browser can resume the download where it left off.
+type ServiceWorkerDownload struct {
+	Name string
+	Type string
+	Size int64
+
+	// Open returns the file's data from offset on, which may not have
+	// been received yet.
+	Open func(offset int64) (io.ReadCloser, error)
+}
+
+func (d *ServiceWorkerDownload) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", d.Type)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": d.Name}))
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	start, end, status := int64(0), d.Size, http.StatusOK
+	if h := r.Header.Get("Range"); h != "" {
+		var err error
+		start, end, err = ServiceWorkerRange(h, d.Size)
+		if err != nil {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", d.Size))
+			http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, d.Size))
+		status = http.StatusPartialContent
+	}
+
+	rc, err := d.Open(start)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer rc.Close()
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start, 10))
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.CopyN(w, rc, end-start); err != nil {
+		// Too late for an error status. Cut the response short so the
+		// browser sees the download failed instead of saving part of it.
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// ErrRange is returned by ServiceWorkerRange for ranges it can't serve.
+var ErrRange = errors.New("invalid or unsatisfiable range")
+
+// ServiceWorkerRange parses the Range header h of a request for a download of
+// size bytes, and returns the range asked for, from start up to but not
+// including end. Like the Service Worker, it only serves a single range in
+// bytes, e.g. "bytes=100-", "bytes=100-199" or "bytes=-100" for the last 100.
+func ServiceWorkerRange(h string, size int64) (start, end int64, err error) {
+	if !strings.HasPrefix(h, "bytes=") || strings.Contains(h, ",") {
+		return 0, 0, ErrRange
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(h[len("bytes="):]), "-")
+	if !ok {
+		return 0, 0, ErrRange
+	}
+	if first == "" {
+		// A suffix: the last so many bytes.
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 || size == 0 {
+			return 0, 0, ErrRange
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size, nil
+	}
+	start, err = strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, ErrRange
+	}
+	end = size
+	if last != "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < start {
+			return 0, 0, ErrRange
+		}
+		if n+1 < size {
+			end = n + 1
+		}
+	}
+	return start, end, nil
+}
@@ -0,0 +1,132 @@
+package wormhole
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestServiceWorkerHandler(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "index")
+	})
+	ts := httptest.NewServer(ServiceWorkerHandler(next))
+	defer ts.Close()
+
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{ServiceWorkerPath("1234"), http.StatusNotFound, ServiceWorkerPage + "\n"},
+		{ServiceWorkerPath("a file?.txt"), http.StatusNotFound, ServiceWorkerPage + "\n"},
+		{"/", http.StatusOK, "index"},
+		{"/_", http.StatusOK, "index"},
+	}
+	for _, tt := range tests {
+		resp, err := http.Get(ts.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: got status %d want %d", tt.path, resp.StatusCode, tt.status)
+		}
+		if string(body) != tt.body {
+			t.Errorf("%s: got body %q want %q", tt.path, body, tt.body)
+		}
+	}
+}
+
+func TestServiceWorkerRange(t *testing.T) {
+	tests := []struct {
+		h          string
+		start, end int64
+		ok         bool
+	}{
+		{"bytes=0-", 0, 10, true},
+		{"bytes=4-", 4, 10, true},
+		{"bytes=4-5", 4, 6, true},
+		{"bytes=4-100", 4, 10, true},
+		{"bytes=-3", 7, 10, true},
+		{"bytes=-100", 0, 10, true},
+		{"bytes=10-", 0, 0, false},
+		{"bytes=5-4", 0, 0, false},
+		{"bytes=-0", 0, 0, false},
+		{"bytes=0-1,4-5", 0, 0, false},
+		{"bytes=x-", 0, 0, false},
+		{"bytes=4", 0, 0, false},
+		{"items=4-", 0, 0, false},
+	}
+	for _, tt := range tests {
+		start, end, err := ServiceWorkerRange(tt.h, 10)
+		if (err == nil) != tt.ok || start != tt.start || end != tt.end {
+			t.Errorf("%s: got %d-%d, %v want %d-%d", tt.h, start, end, err, tt.start, tt.end)
+		}
+	}
+}
+
+func TestServiceWorkerDownload(t *testing.T) {
+	const content = "0123456789"
+	var opened []int64
+	ts := httptest.NewServer(&ServiceWorkerDownload{
+		Name: "a file.txt",
+		Type: "text/plain",
+		Size: int64(len(content)),
+		Open: func(offset int64) (io.ReadCloser, error) {
+			// The sender is asked to send from offset on.
+			opened = append(opened, offset)
+			return io.NopCloser(strings.NewReader(content[offset:])), nil
+		},
+	})
+	defer ts.Close()
+
+	tests := []struct {
+		rng          string
+		status       int
+		contentRange string
+		body         string
+	}{
+		{"", http.StatusOK, "", content},
+		{"bytes=4-", http.StatusPartialContent, "bytes 4-9/10", "456789"},
+		{"bytes=4-5", http.StatusPartialContent, "bytes 4-5/10", "45"},
+		{"bytes=10-", http.StatusRequestedRangeNotSatisfiable, "bytes */10", ""},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", ts.URL+ServiceWorkerPath("1234"), nil)
+		if tt.rng != "" {
+			req.Header.Set("Range", tt.rng)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tt.status {
+			t.Errorf("%q: got status %d want %d", tt.rng, resp.StatusCode, tt.status)
+		}
+		if got := resp.Header.Get("Content-Range"); got != tt.contentRange {
+			t.Errorf("%q: got Content-Range %q want %q", tt.rng, got, tt.contentRange)
+		}
+		if tt.status != http.StatusRequestedRangeNotSatisfiable && string(body) != tt.body {
+			t.Errorf("%q: got body %q want %q", tt.rng, body, tt.body)
+		}
+		if got := resp.Header.Get("Accept-Ranges"); got != "bytes" {
+			t.Errorf("%q: got Accept-Ranges %q", tt.rng, got)
+		}
+	}
+	if want := []int64{0, 4, 4}; !reflect.DeepEqual(opened, want) {
+		t.Errorf("opened at %v want %v", opened, want)
+	}
+}
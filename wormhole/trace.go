@@ -0,0 +1,100 @@
+package wormhole
+
+import (
+	"context"
+	"sync"
+)
+
+// A Tracer records how connecting went as spans in a tracing system, like
+// OpenTelemetry. See Config.Tracer. This package doesn't depend on any, so
+// a few lines adapt one, e.g. with go.opentelemetry.io/otel/trace:
+//
+//	type otelTracer struct{ trace.Tracer }
+//
+//	func (t otelTracer) Start(ctx context.Context, name string) (context.Context, wormhole.Span) {
+//		ctx, span := t.Tracer.Start(ctx, name)
+//		return ctx, otelSpan{span}
+//	}
+//
+//	type otelSpan struct{ trace.Span }
+//
+//	func (s otelSpan) End(err error) {
+//		if err != nil {
+//			s.RecordError(err)
+//			s.SetStatus(codes.Error, err.Error())
+//		}
+//		s.Span.End()
+//	}
+type Tracer interface {
+	// Start starts a span called name, as a child of the span in ctx if
+	// there is one, and returns a context holding the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// A Span is an operation started by a Tracer.
+type Span interface {
+	// End ends the span. err is what the operation failed with, if it did.
+	End(err error)
+}
+
+// The spans New and Join start under their own, "wormhole.new" or
+// "wormhole.join", one after the other. Only New waits, and New sends the
+// offer while Join sends the answer. The last lasts until Close.
+const (
+	SpanSlot     = "slot"     // Getting or joining the slot.
+	SpanWait     = "wait"     // Waiting for the peer to join.
+	SpanPAKE     = "pake"     // Agreeing on a key.
+	SpanOffer    = "offer"    // Sending the offer and getting the answer.
+	SpanAnswer   = "answer"   // Getting the offer and sending the answer.
+	SpanConnect  = "connect"  // Connecting over ICE and opening the DataChannel.
+	SpanTransfer = "transfer" // Using the connection.
+)
+
+// tracing is the span New or Join traces a Wormhole under, and the span of
+// the step it is on. Without a Tracer it does nothing.
+type tracing struct {
+	sync.Mutex
+	tracer Tracer
+	ctx    context.Context
+	root   Span
+	step   Span
+}
+
+// startTrace starts tracing c, if cfg has a Tracer, in a span called name
+// under any in ctx.
+func (c *Wormhole) startTrace(ctx context.Context, cfg *Config, name string) {
+	if cfg.Tracer == nil {
+		return
+	}
+	c.trace.tracer = cfg.Tracer
+	c.trace.ctx, c.trace.root = cfg.Tracer.Start(ctx, name)
+}
+
+// traceStep ends the span of the step c was on, if any, and starts one for
+// the next step called name.
+func (c *Wormhole) traceStep(name string) {
+	c.trace.Lock()
+	defer c.trace.Unlock()
+	if c.trace.tracer == nil || c.trace.root == nil {
+		return
+	}
+	if c.trace.step != nil {
+		c.trace.step.End(nil)
+	}
+	_, c.trace.step = c.trace.tracer.Start(c.trace.ctx, name)
+}
+
+// endTrace ends the span of the step c was on and the one above it, with
+// err if connecting failed. Later calls do nothing.
+func (c *Wormhole) endTrace(err error) {
+	c.trace.Lock()
+	defer c.trace.Unlock()
+	if c.trace.root == nil {
+		return
+	}
+	if c.trace.step != nil {
+		c.trace.step.End(err)
+	}
+	c.trace.root.End(err)
+	c.trace.step, c.trace.root = nil, nil
+}
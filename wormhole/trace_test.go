@@ -0,0 +1,107 @@
+package wormhole
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// recorder is a Tracer that keeps the spans it started in memory.
+type recorder struct {
+	sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpan struct {
+	r      *recorder
+	name   string
+	parent string
+	ended  bool
+	err    error
+}
+
+type spanKey struct{}
+
+func (r *recorder) Start(ctx context.Context, name string) (context.Context, Span) {
+	r.Lock()
+	defer r.Unlock()
+	s := &recordedSpan{r: r, name: name}
+	if parent, ok := ctx.Value(spanKey{}).(*recordedSpan); ok {
+		s.parent = parent.name
+	}
+	r.spans = append(r.spans, s)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func (s *recordedSpan) End(err error) {
+	s.r.Lock()
+	defer s.r.Unlock()
+	s.ended, s.err = true, err
+}
+
+// names returns the names of the spans under parent, in the order they
+// were started, and fails t if any are still going.
+func (r *recorder) names(t *testing.T, parent string) []string {
+	t.Helper()
+	r.Lock()
+	defer r.Unlock()
+	var names []string
+	for _, s := range r.spans {
+		if !s.ended {
+			t.Errorf("span %s not ended", s.name)
+		}
+		if s.parent == parent {
+			names = append(names, s.name)
+		}
+	}
+	return names
+}
+
+func TestTracer(t *testing.T) {
+	ra, rb := &recorder{}, &recorder{}
+	a, b, erra, errb := signalPair(t, &Config{Tracer: ra}, &Config{Tracer: rb})
+	if erra != nil || errb != nil {
+		t.Fatal(erra, errb)
+	}
+	a.Close()
+	b.Close()
+
+	for _, tc := range []struct {
+		r    *recorder
+		root string
+		want []string
+	}{
+		{ra, "wormhole.new", []string{SpanSlot, SpanWait, SpanPAKE, SpanOffer, SpanConnect, SpanTransfer}},
+		{rb, "wormhole.join", []string{SpanSlot, SpanPAKE, SpanAnswer, SpanConnect, SpanTransfer}},
+	} {
+		if got := tc.r.names(t, ""); !reflect.DeepEqual(got, []string{tc.root}) {
+			t.Errorf("got root spans %v want %s", got, tc.root)
+		}
+		if got := tc.r.names(t, tc.root); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("got spans %v under %s want %v", got, tc.root, tc.want)
+		}
+		for _, s := range tc.r.spans {
+			if s.err != nil {
+				t.Errorf("span %s ended with %v", s.name, s.err)
+			}
+		}
+	}
+}
+
+func TestTracerFail(t *testing.T) {
+	r := &recorder{}
+	_, err := (&Config{Tracer: r}).Join("1", "pass", "http://127.0.0.1:1")
+	if err == nil {
+		t.Fatal("joined a server that isn't there")
+	}
+	if got, want := r.names(t, "wormhole.join"), []string{SpanSlot}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got spans %v want %v", got, want)
+	}
+	for _, s := range r.spans {
+		if !errors.Is(s.err, err) {
+			t.Errorf("span %s ended with %v want %v", s.name, s.err, err)
+		}
+	}
+}
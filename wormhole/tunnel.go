@@ -0,0 +1,90 @@
+package wormhole
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// ErrTunnel is returned by Read if a message in a tunnelled Wormhole was
+// not sealed by the peer, was tampered with, or came out of turn.
+var ErrTunnel = errors.New("could not open tunnelled message")
+
+// A tunnel seals every message sent over a DataChannel again with
+// XChaCha20-Poly1305, using keys derived from the PAKE secret by
+// ExportKeys, so the data stays secret even if DTLS is broken or the
+// signalling server or a TURN relay learns its keys. DataChannels are
+// reliable and ordered, so rather than sending nonces each side counts the
+// messages it sends. Each message is sealed with the tag of the one before
+// it as associated data, chaining it to everything sent before, so what
+// follows a file header can only be opened after that very header.
+// Messages keep their boundaries, empty ones included. See Config.Tunnel.
+type tunnel struct {
+	sendmu   sync.Mutex
+	send     *[32]byte
+	sendAEAD cipher.AEAD
+	sent     uint64
+	sealed   []byte
+	lastSent [chacha20poly1305.Overhead]byte
+
+	// The rest is only used by Read, under readmu.
+	receive      *[32]byte
+	receiveAEAD  cipher.AEAD
+	received     uint64
+	opened       []byte
+	lastReceived [chacha20poly1305.Overhead]byte
+}
+
+// newTunnel sets up the tunnel for the DataChannel with id. Each channel
+// gets its own keys.
+func (c *Wormhole) newTunnel(id uint16) (*tunnel, error) {
+	send, receive, err := c.ExportKeys(fmt.Sprintf("tunnel %d", id))
+	if err != nil {
+		return nil, err
+	}
+	sendAEAD, err := chacha20poly1305.NewX(send[:])
+	if err != nil {
+		return nil, err
+	}
+	receiveAEAD, err := chacha20poly1305.NewX(receive[:])
+	if err != nil {
+		return nil, err
+	}
+	return &tunnel{send: send, sendAEAD: sendAEAD, receive: receive, receiveAEAD: receiveAEAD}, nil
+}
+
+func tunnelNonce(i uint64) []byte {
+	n := make([]byte, chacha20poly1305.NonceSizeX)
+	binary.BigEndian.PutUint64(n, i)
+	return n
+}
+
+// write seals p and sends it with write, holding the lock so messages go
+// out in the order their nonces were taken.
+func (t *tunnel) write(p []byte, write func([]byte) (int, error)) (int, error) {
+	t.sendmu.Lock()
+	defer t.sendmu.Unlock()
+	t.sealed = t.sendAEAD.Seal(t.sealed[:0], tunnelNonce(t.sent), p, t.lastSent[:])
+	t.sent++
+	copy(t.lastSent[:], t.sealed[len(t.sealed)-chacha20poly1305.Overhead:])
+	if _, err := write(t.sealed); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// open opens the next message received.
+func (t *tunnel) open(sealed []byte) ([]byte, error) {
+	var err error
+	t.opened, err = t.receiveAEAD.Open(t.opened[:0], tunnelNonce(t.received), sealed, t.lastReceived[:])
+	if err != nil {
+		return nil, ErrTunnel
+	}
+	t.received++
+	copy(t.lastReceived[:], sealed[len(sealed)-chacha20poly1305.Overhead:])
+	return t.opened, nil
+}
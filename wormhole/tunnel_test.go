@@ -0,0 +1,154 @@
+package wormhole
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// signalPair connects a Wormhole with cfga that creates slot 1 to one with
+// cfgb that joins it, over signalServer.
+func signalPair(t *testing.T, cfga, cfgb *Config) (a, b *Wormhole, erra, errb error) {
+	t.Helper()
+	sigserv := signalServer(t)
+	bc := make(chan error, 1)
+	go func() {
+		var err error
+		b, err = cfgb.Join("1", "pass", sigserv)
+		bc <- err
+	}()
+	a, erra = cfga.New("pass", sigserv, make(chan string, 1))
+	errb = <-bc
+	return a, b, erra, errb
+}
+
+func TestTunnel(t *testing.T) {
+	a, b, erra, errb := signalPair(t, &Config{Tunnel: true}, &Config{Tunnel: true})
+	if erra != nil || errb != nil {
+		t.Fatal(erra, errb)
+	}
+	// b writes last, so close it first.
+	defer a.Close()
+	defer b.Close()
+
+	if got, want := a.MaxMessageSize(), maxMessageSize-chacha20poly1305.Overhead; got != want {
+		t.Errorf("got max message size %d want %d", got, want)
+	}
+	big := make([]byte, a.MaxMessageSize())
+	rand.Read(big)
+	buf := make([]byte, maxMessageSize)
+	for _, msg := range [][]byte{[]byte("hello"), nil, big, []byte("bye")} {
+		if _, err := a.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		n, err := b.Read(buf)
+		if err != nil || !bytes.Equal(buf[:n], msg) {
+			t.Fatalf("got %d bytes, %v want the %d sent", n, err, len(msg))
+		}
+	}
+
+	// Underneath, the message is sealed.
+	if _, err := b.Write([]byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	n, err := a.rwc.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len("secret")+chacha20poly1305.Overhead || bytes.Contains(buf[:n], []byte("secret")) {
+		t.Errorf("got %q on the DataChannel", buf[:n])
+	}
+
+	// Channels are tunnelled too, with their own keys.
+	cc := make(chan *Wormhole, 1)
+	go func() {
+		c, err := b.Channel(1)
+		if err != nil {
+			t.Error(err)
+		}
+		cc <- c
+	}()
+	ca, err := a.Channel(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb := <-cc
+	if cb == nil {
+		t.FailNow()
+	}
+	if ca.tunnel == nil || cb.tunnel == nil || *ca.tunnel.send == *a.tunnel.send {
+		t.Fatal("channel not tunnelled with its own keys")
+	}
+	roundTrip(t, ca, cb, "on a channel")
+}
+
+func TestTunnelMismatch(t *testing.T) {
+	for _, tunnel := range []bool{true, false} {
+		// The joiner sees the creator's description first, and is the one
+		// to notice. The creator hears of it from the signalling server.
+		_, _, erra, errb := loopback(t, &Config{Tunnel: tunnel}, &Config{Tunnel: !tunnel})
+		if erra != ErrTunnelMismatch || errb != ErrTunnelMismatch {
+			t.Errorf("creator tunnel %v: got %v, %v want %v", tunnel, erra, errb, ErrTunnelMismatch)
+		}
+	}
+}
+
+func TestTunnelTampered(t *testing.T) {
+	a, b, erra, errb := signalPair(t, &Config{Tunnel: true}, &Config{Tunnel: true})
+	if erra != nil || errb != nil {
+		t.Fatal(erra, errb)
+	}
+	defer b.Close()
+	defer a.Close()
+
+	// Skip a nonce, as a relay replaying or dropping messages would have
+	// to, if it could get through DTLS.
+	a.tunnel.sent++
+	if _, err := a.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Read(make([]byte, 10)); err != ErrTunnel {
+		t.Errorf("got %v want %v", err, ErrTunnel)
+	}
+}
+
+func TestTunnelChained(t *testing.T) {
+	var key [32]byte
+	aead, err := chacha20poly1305.NewX(key[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	newTunnel := func() *tunnel {
+		return &tunnel{send: &key, sendAEAD: aead, receive: &key, receiveAEAD: aead}
+	}
+	seal := func(tn *tunnel, msgs ...string) (sealed [][]byte) {
+		for _, msg := range msgs {
+			tn.write([]byte(msg), func(p []byte) (int, error) {
+				sealed = append(sealed, append([]byte(nil), p...))
+				return len(p), nil
+			})
+		}
+		return sealed
+	}
+
+	// Two streams from the same keys, e.g. two files sent after the same
+	// handshake. Each message is in its right place by count, but only
+	// opens after what it was sent after.
+	a := seal(newTunnel(), "header a", "data a")
+	b := seal(newTunnel(), "header b", "data b")
+	r := newTunnel()
+	if p, err := r.open(a[0]); err != nil || string(p) != "header a" {
+		t.Fatalf("got %q, %v want header a", p, err)
+	}
+	if _, err := r.open(b[1]); err != ErrTunnel {
+		t.Errorf("opened data b after header a, got %v want %v", err, ErrTunnel)
+	}
+	r = newTunnel()
+	for i, want := range []string{"header b", "data b"} {
+		if p, err := r.open(b[i]); err != nil || string(p) != want {
+			t.Errorf("got %q, %v want %q", p, err, want)
+		}
+	}
+}
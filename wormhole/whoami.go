@@ -0,0 +1,185 @@
+package wormhole
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pion/ice/v2"
+)
+
+// NAT behaviours Whoami tells apart.
+const (
+	// NATUnknown means there weren't enough answers to tell.
+	NATUnknown = "unknown"
+
+	// NATNone means the public address is one of our own.
+	NATNone = "none"
+
+	// NATCone means every STUN server saw the same public address, so
+	// peers can usually reach us on it directly.
+	NATCone = "cone"
+
+	// NATSymmetric means STUN servers saw different public addresses, so
+	// the one a peer sees can't be predicted and a TURN relay is likely
+	// needed.
+	NATSymmetric = "symmetric"
+)
+
+// ErrNoMapping is returned by Whoami when no STUN server answered.
+var ErrNoMapping = errors.New("no STUN server answered")
+
+// A Mapping is the public address a STUN server saw us at, or why it
+// couldn't tell.
+type Mapping struct {
+	Server string
+	Public *net.UDPAddr
+	Err    error
+}
+
+// NetworkInfo describes how this host is seen from the internet.
+type NetworkInfo struct {
+	// Port is the local UDP port the STUN servers were asked from.
+	Port int
+
+	// Mappings are the STUN servers' answers, in the order asked.
+	Mappings []Mapping
+
+	// NAT is the NAT behaviour detected, one of the NAT constants. Telling
+	// cone from symmetric NATs needs answers from at least two servers.
+	NAT string
+}
+
+// Whoami asks the STUN servers, given as URLs like "stun:host:port", for
+// our public address, without needing a peer. It is the same as Config.Whoami
+// with the zero Config.
+func Whoami(ctx context.Context, stunServers []string) (*NetworkInfo, error) {
+	return (&Config{}).Whoami(ctx, stunServers)
+}
+
+// Whoami asks the STUN servers, given as URLs like "stun:host:port", for
+// our public address, without needing a peer. All of them are asked from
+// the same local port the way ICE gathers server reflexive candidates
+// over a shared socket, so comparing their answers shows whether the NAT
+// maps addresses per destination. The local port is taken from UDPPortMin
+// and UDPPortMax if set. Non-STUN URLs are ignored. If ctx has no
+// deadline, servers are given 5 seconds to answer. If none do, the returned
+// info holds each server's error along with ErrNoMapping.
+func (cfg *Config) Whoami(ctx context.Context, stunServers []string) (*NetworkInfo, error) {
+	timeout := 5 * time.Second
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+
+	conn, err := cfg.listenUDP()
+	if err != nil {
+		return nil, err
+	}
+	mux := ice.NewUniversalUDPMuxDefault(ice.UniversalUDPMuxParams{UDPConn: conn})
+	defer mux.Close()
+	info := &NetworkInfo{Port: conn.LocalAddr().(*net.UDPAddr).Port}
+
+	var urls []*ice.URL
+	for _, s := range stunServers {
+		u, err := ice.ParseURL(s)
+		if err == nil && u.Scheme != ice.SchemeTypeSTUN {
+			continue
+		}
+		info.Mappings = append(info.Mappings, Mapping{Server: s, Err: err})
+		urls = append(urls, u)
+	}
+	var wg sync.WaitGroup
+	for i, u := range urls {
+		if u == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(m *Mapping, u *ice.URL) {
+			defer wg.Done()
+			addr, err := net.ResolveUDPAddr("udp4", net.JoinHostPort(u.Host, strconv.Itoa(u.Port)))
+			if err != nil {
+				m.Err = err
+				return
+			}
+			mapped, err := mux.GetXORMappedAddr(addr, timeout)
+			if err != nil {
+				m.Err = err
+				return
+			}
+			m.Public = &net.UDPAddr{IP: mapped.IP, Port: mapped.Port}
+		}(&info.Mappings[i], u)
+	}
+	wg.Wait()
+	info.NAT = natType(info.Port, info.Mappings, localIP)
+	for _, m := range info.Mappings {
+		if m.Public != nil {
+			return info, nil
+		}
+	}
+	return info, ErrNoMapping
+}
+
+// listenUDP opens the local UDP socket Whoami asks from, in the
+// configured port range if any.
+func (cfg *Config) listenUDP() (*net.UDPConn, error) {
+	if cfg.UDPPortMin == 0 && cfg.UDPPortMax == 0 {
+		return net.ListenUDP("udp4", &net.UDPAddr{})
+	}
+	max := int(cfg.UDPPortMax)
+	if max == 0 {
+		max = 0xffff
+	}
+	err := errors.New("invalid UDP port range")
+	for port := int(cfg.UDPPortMin); port <= max; port++ {
+		var conn *net.UDPConn
+		conn, err = net.ListenUDP("udp4", &net.UDPAddr{Port: port})
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// natType works out the NAT behaviour from the public addresses the STUN
+// servers saw for local port. isLocal reports whether an IP address is one
+// of our own.
+func natType(port int, mappings []Mapping, isLocal func(net.IP) bool) string {
+	var seen []*net.UDPAddr
+	for _, m := range mappings {
+		if m.Public != nil {
+			seen = append(seen, m.Public)
+		}
+	}
+	if len(seen) == 0 {
+		return NATUnknown
+	}
+	if seen[0].Port == port && isLocal(seen[0].IP) {
+		return NATNone
+	}
+	if len(seen) < 2 {
+		return NATUnknown
+	}
+	for _, a := range seen[1:] {
+		if a.Port != seen[0].Port || !a.IP.Equal(seen[0].IP) {
+			return NATSymmetric
+		}
+	}
+	return NATCone
+}
+
+// localIP reports whether ip is assigned to one of our network interfaces.
+func localIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
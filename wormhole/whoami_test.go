@@ -0,0 +1,125 @@
+package wormhole
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pion/turn/v2"
+	webrtc "github.com/pion/webrtc/v3"
+)
+
+// stunServer starts a STUN server on localhost and returns its URL.
+func stunServer(t *testing.T) string {
+	t.Helper()
+	udp, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := turn.NewServer(turn.ServerConfig{
+		PacketConnConfigs: []turn.PacketConnConfig{{
+			PacketConn: udp,
+			RelayAddressGenerator: &turn.RelayAddressGeneratorStatic{
+				RelayAddress: net.ParseIP("127.0.0.1"),
+				Address:      "127.0.0.1",
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	return "stun:127.0.0.1:" + strconv.Itoa(udp.LocalAddr().(*net.UDPAddr).Port)
+}
+
+// turnServer starts a TURN server on localhost, relaying from localhost,
+// and returns it as an ICE server.
+func turnServer(t *testing.T) webrtc.ICEServer {
+	t.Helper()
+	udp, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := turn.GenerateAuthKey("user", "webwormhole", "pass")
+	srv, err := turn.NewServer(turn.ServerConfig{
+		Realm: "webwormhole",
+		AuthHandler: func(username, realm string, src net.Addr) ([]byte, bool) {
+			return key, username == "user"
+		},
+		PacketConnConfigs: []turn.PacketConnConfig{{
+			PacketConn: udp,
+			RelayAddressGenerator: &turn.RelayAddressGeneratorStatic{
+				RelayAddress: net.ParseIP("127.0.0.1"),
+				Address:      "127.0.0.1",
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	return webrtc.ICEServer{
+		URLs:       []string{"turn:127.0.0.1:" + strconv.Itoa(udp.LocalAddr().(*net.UDPAddr).Port)},
+		Username:   "user",
+		Credential: "pass",
+	}
+}
+
+func TestWhoami(t *testing.T) {
+	a, b := stunServer(t), stunServer(t)
+	info, err := Whoami(context.Background(), []string{a, "turn:127.0.0.1:1", b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Mappings) != 2 {
+		t.Fatalf("got mappings %v want 2", info.Mappings)
+	}
+	for i, server := range []string{a, b} {
+		m := info.Mappings[i]
+		if m.Server != server || m.Err != nil {
+			t.Errorf("got mapping %v from %v", m, server)
+			continue
+		}
+		if !m.Public.IP.Equal(net.ParseIP("127.0.0.1")) || m.Public.Port != info.Port {
+			t.Errorf("%v: got public address %v want 127.0.0.1:%v", server, m.Public, info.Port)
+		}
+	}
+	if info.NAT != NATNone {
+		t.Errorf("got NAT %v want %v", info.NAT, NATNone)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	info, err = Whoami(ctx, []string{"stun:127.0.0.1:1"})
+	if err != ErrNoMapping {
+		t.Errorf("got %v want %v", err, ErrNoMapping)
+	}
+	if info == nil || len(info.Mappings) != 1 || info.Mappings[0].Err == nil {
+		t.Errorf("got %v want the server's error", info)
+	}
+}
+
+func TestNATType(t *testing.T) {
+	public := func(ip string, port int) Mapping {
+		return Mapping{Public: &net.UDPAddr{IP: net.ParseIP(ip), Port: port}}
+	}
+	isLocal := func(ip net.IP) bool { return ip.Equal(net.ParseIP("10.0.0.2")) }
+	for _, tt := range []struct {
+		name     string
+		mappings []Mapping
+		want     string
+	}{
+		{"none answered", []Mapping{{Err: ErrNoMapping}}, NATUnknown},
+		{"one", []Mapping{public("192.0.2.1", 4000)}, NATUnknown},
+		{"no nat", []Mapping{public("10.0.0.2", 5000)}, NATNone},
+		{"cone", []Mapping{public("192.0.2.1", 4000), {Err: ErrNoMapping}, public("192.0.2.1", 4000)}, NATCone},
+		{"symmetric port", []Mapping{public("192.0.2.1", 4000), public("192.0.2.1", 4001)}, NATSymmetric},
+		{"symmetric address", []Mapping{public("192.0.2.1", 4000), public("192.0.2.2", 4000)}, NATSymmetric},
+	} {
+		if got := natType(5000, tt.mappings, isLocal); got != tt.want {
+			t.Errorf("%s: got %v want %v", tt.name, got, tt.want)
+		}
+	}
+}